@@ -0,0 +1,917 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/activitypub"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/validation"
+)
+
+const (
+	// remoteActorTTL is how long a fetched actor is used before it's
+	// fetched again, keys rotated in the meantime are caught by refetching
+	// when a signature doesn't verify
+	remoteActorTTL = 24 * time.Hour
+	// maxInboxBytes caps activities posted to our inboxes
+	maxInboxBytes = 1 << 20
+)
+
+var (
+	errActorNotFound   = errors.New("actor not found")
+	errInvalidActivity = errors.New("invalid activity")
+)
+
+// activityPubStore is the activitypub package's delivery queue, kept in
+// the database. Deliveries are signed with their user's key, looked up
+// when they're claimed
+type activityPubStore struct {
+	db      *database.DB
+	baseURL string
+}
+
+func (s activityPubStore) ClaimDeliveries(now, leaseUntil time.Time, limit int) ([]activitypub.Delivery, error) {
+	claimed, err := s.db.ClaimFederationDeliveries(now, leaseUntil, limit)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []activitypub.Delivery{}
+	for _, delivery := range claimed {
+		key, err := s.signingKey(delivery.UserID)
+		if err != nil {
+			// nothing we can sign with, so it can never go out
+			log.Printf("activitypub: dropping delivery %d: %s", delivery.ID, err)
+			err = s.db.RecordFederationAttempt(delivery.ID, "", nil)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		deliveries = append(deliveries, activitypub.Delivery{
+			ID:       delivery.ID,
+			Inbox:    delivery.Inbox,
+			KeyID:    actorKeyID(s.baseURL + actorPath(delivery.UserID)),
+			Key:      key,
+			Body:     delivery.Activity,
+			Attempts: delivery.Attempts,
+		})
+	}
+	return deliveries, nil
+}
+
+func (s activityPubStore) signingKey(userID int) (*rsa.PrivateKey, error) {
+	key, err := s.db.GetActorKey(userID)
+	if err != nil {
+		return nil, err
+	}
+	return activitypub.ParsePrivateKey(key.PrivateKeyPEM)
+}
+
+func (s activityPubStore) RecordAttempt(deliveryID int, attempt activitypub.Attempt, retryAt time.Time) error {
+	var next *time.Time
+	if !retryAt.IsZero() {
+		next = &retryAt
+	}
+	return s.db.RecordFederationAttempt(deliveryID, attempt.Error, next)
+}
+
+// federating reports whether ActivityPub is on. Actor ids have to stay the
+// same whichever host name a request came in on, so it needs BASE_URL
+func (cfg *apiConfig) federating() bool {
+	return cfg.baseURL != ""
+}
+
+// federationHost is the domain in our users' fediverse handles
+func (cfg *apiConfig) federationHost() string {
+	u, err := url.Parse(cfg.baseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+func actorPath(userID int) string {
+	return "/users/" + strconv.Itoa(userID)
+}
+
+func notePath(chirpID int) string {
+	return "/chirps/" + strconv.Itoa(chirpID)
+}
+
+func actorKeyID(actorID string) string {
+	return actorID + "#main-key"
+}
+
+// localID reads the id out of one of our own URLs like prefix + "12"
+func (cfg *apiConfig) localID(rawURL, prefix string) (int, bool) {
+	rest, ok := strings.CutPrefix(rawURL, cfg.baseURL+prefix)
+	if !ok {
+		return 0, false
+	}
+	id, err := strconv.Atoi(rest)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// localActor returns the user behind one of our actor URLs
+func (cfg *apiConfig) localActor(actorID string) (database.User, error) {
+	userID, ok := cfg.localID(actorID, "/users/")
+	if !ok {
+		return database.User{}, errActorNotFound
+	}
+	return cfg.federatedUser(userID)
+}
+
+// localChirpID reads the chirp id out of one of our note URLs, or the API
+// URL notes link to
+func (cfg *apiConfig) localChirpID(noteID string) (int, bool) {
+	chirpID, ok := cfg.localID(noteID, "/chirps/")
+	if !ok {
+		chirpID, ok = cfg.localID(noteID, "/api/chirps/")
+	}
+	return chirpID, ok
+}
+
+// localChirp returns the public chirp behind one of our note URLs
+func (cfg *apiConfig) localChirp(noteID string) (database.Chirp, error) {
+	chirpID, ok := cfg.localChirpID(noteID)
+	if !ok {
+		return database.Chirp{}, database.ErrChirpNotFound
+	}
+	chirp, err := cfg.db.GetChirp(chirpID)
+	if err != nil {
+		return database.Chirp{}, err
+	}
+	if !federatedChirp(chirp) {
+		return database.Chirp{}, database.ErrChirpNotFound
+	}
+	return chirp, nil
+}
+
+// federatedUser returns userID if they have an actor. Only users with a
+// handle do, since that's how they're found, and suspended users don't
+func (cfg *apiConfig) federatedUser(userID int) (database.User, error) {
+	user, err := cfg.db.GetUser(userID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		return database.User{}, errActorNotFound
+	}
+	if err != nil {
+		return database.User{}, err
+	}
+	if user.Handle == "" || user.SuspendedAt != nil {
+		return database.User{}, errActorNotFound
+	}
+	return user, nil
+}
+
+// federatedChirp reports whether chirp goes out to other servers, the same
+// public chirps feeds have
+func federatedChirp(chirp database.Chirp) bool {
+	return chirp.Published() && chirp.ModerationState == ""
+}
+
+// actorKey returns userID's key pair, making one the first time it's
+// needed
+func (cfg *apiConfig) actorKey(userID int) (database.ActorKey, error) {
+	key, err := cfg.db.GetActorKey(userID)
+	if !errors.Is(err, database.ErrActorKeyNotFound) {
+		return key, err
+	}
+	private, err := activitypub.GenerateKey()
+	if err != nil {
+		return database.ActorKey{}, err
+	}
+	privatePEM, err := activitypub.EncodePrivateKey(private)
+	if err != nil {
+		return database.ActorKey{}, err
+	}
+	publicPEM, err := activitypub.EncodePublicKey(&private.PublicKey)
+	if err != nil {
+		return database.ActorKey{}, err
+	}
+	return cfg.db.AddActorKey(userID, database.ActorKey{
+		PrivateKeyPEM: privatePEM,
+		PublicKeyPEM:  publicPEM,
+		CreatedAt:     time.Now(),
+	})
+}
+
+func (cfg *apiConfig) newActor(user database.User, key database.ActorKey) activitypub.Actor {
+	id := cfg.baseURL + actorPath(user.ID)
+	return activitypub.Actor{
+		Context:           []string{activitypub.ActivityStreamsContext, activitypub.SecurityContext},
+		ID:                id,
+		Type:              activitypub.TypePerson,
+		PreferredUsername: user.Handle,
+		Name:              "@" + user.Handle,
+		Inbox:             id + "/inbox",
+		Outbox:            id + "/outbox",
+		Followers:         id + "/followers",
+		Endpoints:         &activitypub.Endpoints{SharedInbox: cfg.baseURL + "/inbox"},
+		PublicKey: activitypub.PublicKey{
+			ID:           actorKeyID(id),
+			Owner:        id,
+			PublicKeyPem: key.PublicKeyPEM,
+		},
+	}
+}
+
+// newNote turns chirp into a Note. A quoted chirp is what it replies to,
+// since quoting is how chirpy users reply
+func (cfg *apiConfig) newNote(chirp database.Chirp) (activitypub.Note, error) {
+	author := cfg.baseURL + actorPath(chirp.AuthorID)
+	published := chirp.CreatedAt
+	if chirp.PublishedAt != nil {
+		published = *chirp.PublishedAt
+	}
+	note := activitypub.Note{
+		ID:           cfg.baseURL + notePath(chirp.ID),
+		Type:         activitypub.TypeNote,
+		AttributedTo: author,
+		Content:      activitypub.HTMLContent(chirp.Body),
+		URL:          cfg.baseURL + "/api/chirps/" + strconv.Itoa(chirp.ID),
+		Published:    published,
+		Updated:      chirp.EditedAt,
+		To:           []string{activitypub.Public},
+		Cc:           []string{author + "/followers"},
+	}
+	if chirp.QuotedChirpID != 0 {
+		note.InReplyTo = cfg.baseURL + notePath(chirp.QuotedChirpID)
+	}
+	for _, tag := range validation.Hashtags(chirp.Body) {
+		note.Tag = append(note.Tag, activitypub.Tag{
+			Type: activitypub.TypeHashtag,
+			Href: cfg.baseURL + "/tags/" + tag + "/feed.atom",
+			Name: "#" + tag,
+		})
+	}
+	handles := validation.Mentions(chirp.Body)
+	if len(handles) > 0 {
+		users, err := cfg.db.UsersByHandle(handles)
+		if err != nil {
+			return activitypub.Note{}, err
+		}
+		for _, handle := range handles {
+			user, ok := users[handle]
+			if !ok {
+				continue
+			}
+			href := cfg.baseURL + actorPath(user.ID)
+			note.Cc = append(note.Cc, href)
+			note.Tag = append(note.Tag, activitypub.Tag{
+				Type: activitypub.TypeMention,
+				Href: href,
+				Name: "@" + handle + "@" + cfg.federationHost(),
+			})
+		}
+	}
+	for _, m := range chirp.Media {
+		note.Attachment = append(note.Attachment, activitypub.Attachment{
+			Type:      "Document",
+			MediaType: m.ContentType,
+			URL:       cfg.baseURL + m.URL,
+		})
+	}
+	return note, nil
+}
+
+// createActivity is chirp being posted, as it appears in outboxes and is
+// sent to followers
+func (cfg *apiConfig) createActivity(chirp database.Chirp) (activitypub.Activity, error) {
+	note, err := cfg.newNote(chirp)
+	if err != nil {
+		return activitypub.Activity{}, err
+	}
+	activity, err := activitypub.NewActivity(note.ID+"/activity", activitypub.TypeCreate, note.AttributedTo, note)
+	if err != nil {
+		return activitypub.Activity{}, err
+	}
+	activity.Published = &note.Published
+	activity.To = note.To
+	activity.Cc = note.Cc
+	return activity, nil
+}
+
+// newActivityID makes an id for an activity that isn't stored, a fragment
+// of the actor it's by
+func newActivityID(actorID, kind string) string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return actorID + "#" + kind + "/" + hex.EncodeToString(id)
+}
+
+// federate queues activity, by userID, for delivery to inboxes
+func (cfg *apiConfig) federate(userID int, inboxes []string, activity activitypub.Activity) error {
+	// makes sure the key exists before the deliverer needs it
+	_, err := cfg.actorKey(userID)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	err = cfg.db.EnqueueFederationDeliveries(userID, inboxes, body, time.Now())
+	if err != nil {
+		return err
+	}
+	cfg.deliverer.Wake()
+	return nil
+}
+
+// federateChirp sends a newly published chirp to its author's followers on
+// other servers
+func (cfg *apiConfig) federateChirp(chirp database.Chirp) {
+	if !cfg.federating() || !federatedChirp(chirp) {
+		return
+	}
+	_, err := cfg.federatedUser(chirp.AuthorID)
+	if errors.Is(err, errActorNotFound) {
+		return
+	}
+	if err != nil {
+		log.Printf("error federating chirp %d: %s", chirp.ID, err)
+		return
+	}
+	inboxes, err := cfg.db.RemoteFollowerInboxes(chirp.AuthorID)
+	if err != nil {
+		log.Printf("error federating chirp %d: %s", chirp.ID, err)
+		return
+	}
+	if len(inboxes) == 0 {
+		return
+	}
+	activity, err := cfg.createActivity(chirp)
+	if err == nil {
+		err = cfg.federate(chirp.AuthorID, inboxes, activity)
+	}
+	if err != nil {
+		log.Printf("error federating chirp %d: %s", chirp.ID, err)
+	}
+}
+
+// remoteActor returns actor id, fetching it when we don't have a fresh
+// enough copy or refresh is set
+func (cfg *apiConfig) remoteActor(ctx context.Context, id string, refresh bool) (database.RemoteActor, error) {
+	if !refresh {
+		cached, err := cfg.db.GetRemoteActor(id)
+		if err == nil && time.Since(cached.FetchedAt) < remoteActorTTL {
+			return cached, nil
+		}
+	}
+	actor, err := cfg.federation.FetchActor(ctx, id)
+	if err != nil {
+		return database.RemoteActor{}, err
+	}
+	u, err := url.Parse(actor.ID)
+	if err != nil {
+		return database.RemoteActor{}, err
+	}
+	remote := database.RemoteActor{
+		ID:           actor.ID,
+		Handle:       actor.PreferredUsername + "@" + u.Host,
+		Inbox:        actor.Inbox,
+		KeyID:        actor.PublicKey.ID,
+		PublicKeyPEM: actor.PublicKey.PublicKeyPem,
+		FetchedAt:    time.Now(),
+	}
+	if actor.Endpoints != nil {
+		remote.SharedInbox = actor.Endpoints.SharedInbox
+	}
+	err = cfg.db.SaveRemoteActor(remote)
+	if err != nil {
+		return database.RemoteActor{}, err
+	}
+	return remote, nil
+}
+
+// verifyActivity checks the signature on a request to an inbox and
+// returns the actor who signed it. When the signature doesn't verify the
+// actor is fetched again in case they've changed their key
+func (cfg *apiConfig) verifyActivity(r *http.Request, body []byte) (database.RemoteActor, error) {
+	var signer database.RemoteActor
+	refresh := false
+	publicKey := func(keyID string) (*rsa.PublicKey, error) {
+		actorID, _, _ := strings.Cut(keyID, "#")
+		actor, err := cfg.remoteActor(r.Context(), actorID, refresh)
+		if err == nil && actor.KeyID != keyID && !refresh {
+			refresh = true
+			actor, err = cfg.remoteActor(r.Context(), actorID, true)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if actor.KeyID != keyID {
+			return nil, fmt.Errorf("%w: %s isn't %s's key", activitypub.ErrBadSignature, keyID, actor.ID)
+		}
+		signer = actor
+		return activitypub.ParsePublicKey(actor.PublicKeyPEM)
+	}
+	_, err := activitypub.VerifyRequest(r, body, time.Now(), publicKey)
+	if errors.Is(err, activitypub.ErrBadSignature) && signer.ID != "" && !refresh {
+		refresh = true
+		_, err = activitypub.VerifyRequest(r, body, time.Now(), publicKey)
+	}
+	if err != nil {
+		return database.RemoteActor{}, err
+	}
+	return signer, nil
+}
+
+// handleActivity applies an activity signer sent us. Activities we don't
+// act on are ignored
+func (cfg *apiConfig) handleActivity(signer database.RemoteActor, activity activitypub.Activity) error {
+	switch activity.Type {
+	case activitypub.TypeFollow:
+		return cfg.handleFollow(signer, activity)
+	case activitypub.TypeUndo:
+		return cfg.handleUndo(signer, activity)
+	case activitypub.TypeLike:
+		objectID, err := activity.ObjectID()
+		if err != nil {
+			return fmt.Errorf("%w: %s", errInvalidActivity, err)
+		}
+		chirp, err := cfg.localChirp(objectID)
+		if err != nil {
+			return err
+		}
+		_, err = cfg.db.AddRemoteLike(database.RemoteLike{
+			ChirpID:    chirp.ID,
+			ActorID:    signer.ID,
+			ActivityID: activity.ID,
+			CreatedAt:  time.Now(),
+		})
+		return err
+	case activitypub.TypeCreate:
+		return cfg.handleCreate(signer, activity)
+	}
+	return nil
+}
+
+// handleFollow adds signer to a user's followers and tells their server
+// it's accepted
+func (cfg *apiConfig) handleFollow(signer database.RemoteActor, activity activitypub.Activity) error {
+	objectID, err := activity.ObjectID()
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidActivity, err)
+	}
+	user, err := cfg.localActor(objectID)
+	if err != nil {
+		return err
+	}
+	_, err = cfg.db.AddRemoteFollow(database.RemoteFollow{
+		UserID:     user.ID,
+		ActorID:    signer.ID,
+		ActivityID: activity.ID,
+		CreatedAt:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	// the Accept repeats the Follow, so it's sent even when they were
+	// already following in case the first one got lost
+	activity.Context = nil
+	accept, err := activitypub.NewActivity(newActivityID(objectID, "accepts"), activitypub.TypeAccept, objectID, activity)
+	if err != nil {
+		return err
+	}
+	accept.To = []string{signer.ID}
+	return cfg.federate(user.ID, []string{signer.Inbox}, accept)
+}
+
+// handleUndo takes back a follow or like. They're found by the id of the
+// activity being undone, or by what it was about when the server didn't
+// keep that
+func (cfg *apiConfig) handleUndo(signer database.RemoteActor, activity activitypub.Activity) error {
+	objectID, err := activity.ObjectID()
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidActivity, err)
+	}
+	undone, err := cfg.db.UndoRemoteActivity(signer.ID, objectID)
+	if err != nil || undone {
+		return err
+	}
+	undid := activitypub.Activity{}
+	if activity.DecodeObject(&undid) != nil || undid.Actor != signer.ID {
+		return nil
+	}
+	target, err := undid.ObjectID()
+	if err != nil {
+		return nil
+	}
+	switch undid.Type {
+	case activitypub.TypeFollow:
+		userID, ok := cfg.localID(target, "/users/")
+		if ok {
+			return cfg.db.RemoveRemoteFollow(userID, signer.ID)
+		}
+	case activitypub.TypeLike:
+		chirpID, ok := cfg.localChirpID(target)
+		if ok {
+			return cfg.db.RemoveRemoteLike(chirpID, signer.ID)
+		}
+	}
+	return nil
+}
+
+// handleCreate keeps a post from another server if it replies to a chirp
+// or is addressed to local users, everything else is none of our business
+func (cfg *apiConfig) handleCreate(signer database.RemoteActor, activity activitypub.Activity) error {
+	if activity.ObjectType() != activitypub.TypeNote {
+		return nil
+	}
+	note := activitypub.Note{}
+	err := activity.DecodeObject(&note)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidActivity, err)
+	}
+	if note.ID == "" || note.AttributedTo != signer.ID {
+		return fmt.Errorf("%w: note isn't by the activity's actor", errInvalidActivity)
+	}
+	remote := database.RemoteNote{
+		ID:         note.ID,
+		ActorID:    signer.ID,
+		Content:    activitypub.PlainText(note.Content),
+		URL:        note.URL,
+		Published:  note.Published,
+		ReceivedAt: time.Now(),
+	}
+	if note.InReplyTo != "" {
+		chirp, err := cfg.localChirp(note.InReplyTo)
+		if err == nil {
+			remote.InReplyTo = chirp.ID
+		}
+	}
+	addressed := append(append([]string{}, note.To...), note.Cc...)
+	for _, tag := range note.Tag {
+		if tag.Type == activitypub.TypeMention {
+			addressed = append(addressed, tag.Href)
+		}
+	}
+	for _, actorID := range addressed {
+		user, err := cfg.localActor(actorID)
+		if err == nil && !containsInt(remote.Mentions, user.ID) {
+			remote.Mentions = append(remote.Mentions, user.ID)
+		}
+	}
+	if remote.InReplyTo == 0 && len(remote.Mentions) == 0 {
+		return nil
+	}
+	if remote.Published.IsZero() {
+		remote.Published = remote.ReceivedAt
+	}
+	return cfg.db.SaveRemoteNote(remote)
+}
+
+func containsInt(list []int, n int) bool {
+	for _, item := range list {
+		if item == n {
+			return true
+		}
+	}
+	return false
+}
+
+func respondWithActivityJSON(w http.ResponseWriter, contentType string, payload any) {
+	response, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(200)
+	w.Write(response)
+}
+
+// federatedUserFromURL looks up the user in the {id} URL param, writing a
+// 404 when they don't have an actor
+func (cfg *apiConfig) federatedUserFromURL(w http.ResponseWriter, r *http.Request) (database.User, bool) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 404, errActorNotFound.Error())
+		return database.User{}, false
+	}
+	user, err := cfg.federatedUser(userID)
+	if errors.Is(err, errActorNotFound) {
+		respondWithError(w, 404, err.Error())
+		return database.User{}, false
+	}
+	if err != nil {
+		log.Printf("error loading actor: %s", err)
+		respondWithError(w, 500, "couldn't load actor")
+		return database.User{}, false
+	}
+	return user, true
+}
+
+// webfingerHandler finds a user's actor from their handle,
+// ?resource=acct:handle@host
+func (cfg *apiConfig) webfingerHandler(w http.ResponseWriter, r *http.Request) {
+	resource := r.URL.Query().Get("resource")
+	if resource == "" {
+		respondWithError(w, 400, "resource is required")
+		return
+	}
+	var user database.User
+	var err error
+	if account, ok := strings.CutPrefix(resource, "acct:"); ok {
+		handle, host, _ := strings.Cut(strings.TrimPrefix(account, "@"), "@")
+		if !strings.EqualFold(host, cfg.federationHost()) {
+			respondWithError(w, 404, errActorNotFound.Error())
+			return
+		}
+		handle = strings.ToLower(handle)
+		var users map[string]database.User
+		users, err = cfg.db.UsersByHandle([]string{handle})
+		if err == nil {
+			found, ok := users[handle]
+			if !ok {
+				respondWithError(w, 404, errActorNotFound.Error())
+				return
+			}
+			user, err = cfg.federatedUser(found.ID)
+		}
+	} else {
+		user, err = cfg.localActor(resource)
+	}
+	if errors.Is(err, errActorNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error looking up webfinger resource: %s", err)
+		respondWithError(w, 500, "couldn't look up resource")
+		return
+	}
+	actorID := cfg.baseURL + actorPath(user.ID)
+	respondWithActivityJSON(w, activitypub.WebFingerContentType, activitypub.WebFinger{
+		Subject: "acct:" + user.Handle + "@" + cfg.federationHost(),
+		Aliases: []string{actorID},
+		Links: []activitypub.WebFingerLink{
+			{Rel: "self", Type: activitypub.ContentType, Href: actorID},
+		},
+	})
+}
+
+func (cfg *apiConfig) actorHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := cfg.federatedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	key, err := cfg.actorKey(user.ID)
+	if err != nil {
+		log.Printf("error loading actor key: %s", err)
+		respondWithError(w, 500, "couldn't load actor")
+		return
+	}
+	respondWithActivityJSON(w, activitypub.ContentType, cfg.newActor(user, key))
+}
+
+// outboxHandler lists a user's public chirps as Create activities. The
+// collection itself only has the count, ?page=true&before= are its pages,
+// newest first
+func (cfg *apiConfig) outboxHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := cfg.federatedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	page, err := parseFeedPage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	chirps, err := cfg.db.GetChirps()
+	if err != nil {
+		log.Printf("error loading outbox: %s", err)
+		respondWithError(w, 500, "couldn't load outbox")
+		return
+	}
+	public := []database.Chirp{}
+	for _, chirp := range chirps {
+		if chirp.AuthorID == user.ID && federatedChirp(chirp) {
+			public = append(public, chirp)
+		}
+	}
+	outbox := cfg.baseURL + actorPath(user.ID) + "/outbox"
+	if r.URL.Query().Get("page") == "" {
+		respondWithActivityJSON(w, activitypub.ContentType, activitypub.OrderedCollection{
+			Context:    activitypub.ActivityStreamsContext,
+			ID:         outbox,
+			Type:       activitypub.TypeOrderedCollection,
+			TotalItems: len(public),
+			First:      outbox + "?page=true",
+		})
+		return
+	}
+	sort.Slice(public, func(i, j int) bool {
+		return public[i].ID > public[j].ID
+	})
+	items := []any{}
+	last := 0
+	for _, chirp := range public {
+		if page.before != 0 && chirp.ID >= page.before {
+			continue
+		}
+		if len(items) == page.limit {
+			break
+		}
+		activity, err := cfg.createActivity(chirp)
+		if err != nil {
+			log.Printf("error loading outbox: %s", err)
+			respondWithError(w, 500, "couldn't load outbox")
+			return
+		}
+		activity.Context = nil
+		items = append(items, activity)
+		last = chirp.ID
+	}
+	collectionPage := activitypub.OrderedCollectionPage{
+		Context:      activitypub.ActivityStreamsContext,
+		ID:           cfg.baseURL + r.URL.RequestURI(),
+		Type:         activitypub.TypeOrderedCollectionPage,
+		PartOf:       outbox,
+		OrderedItems: items,
+	}
+	if len(items) == page.limit && public[len(public)-1].ID != last {
+		collectionPage.Next = fmt.Sprintf("%s?page=true&limit=%d&before=%d", outbox, page.limit, last)
+	}
+	respondWithActivityJSON(w, activitypub.ContentType, collectionPage)
+}
+
+// followersHandler only says how many followers a user has, who they are
+// isn't published
+func (cfg *apiConfig) followersHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := cfg.federatedUserFromURL(w, r)
+	if !ok {
+		return
+	}
+	local, err := cfg.db.ListFollowers(user.ID)
+	if err != nil {
+		log.Printf("error loading followers: %s", err)
+		respondWithError(w, 500, "couldn't load followers")
+		return
+	}
+	remote, err := cfg.db.RemoteFollowers(user.ID)
+	if err != nil {
+		log.Printf("error loading followers: %s", err)
+		respondWithError(w, 500, "couldn't load followers")
+		return
+	}
+	respondWithActivityJSON(w, activitypub.ContentType, activitypub.OrderedCollection{
+		Context:    activitypub.ActivityStreamsContext,
+		ID:         cfg.baseURL + actorPath(user.ID) + "/followers",
+		Type:       activitypub.TypeOrderedCollection,
+		TotalItems: len(local) + len(remote),
+	})
+}
+
+// noteHandler serves a public chirp as a Note
+func (cfg *apiConfig) noteHandler(w http.ResponseWriter, r *http.Request) {
+	chirp, err := cfg.localChirp(cfg.baseURL + r.URL.Path)
+	if err == nil {
+		_, err = cfg.federatedUser(chirp.AuthorID)
+	}
+	if errors.Is(err, database.ErrChirpNotFound) || errors.Is(err, errActorNotFound) {
+		respondWithError(w, 404, database.ErrChirpNotFound.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error loading note: %s", err)
+		respondWithError(w, 500, "couldn't load note")
+		return
+	}
+	note, err := cfg.newNote(chirp)
+	if err != nil {
+		log.Printf("error loading note: %s", err)
+		respondWithError(w, 500, "couldn't load note")
+		return
+	}
+	note.Context = activitypub.ActivityStreamsContext
+	respondWithActivityJSON(w, activitypub.ContentType, note)
+}
+
+// inboxHandler takes activities from other servers. Every user's inbox
+// and the shared one work the same, the activity says who it's for
+func (cfg *apiConfig) inboxHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxInboxBytes+1))
+	if err != nil {
+		respondWithError(w, 400, "couldn't read request body")
+		return
+	}
+	if len(body) > maxInboxBytes {
+		respondWithError(w, 413, "activity is too large")
+		return
+	}
+	signer, err := cfg.verifyActivity(r, body)
+	if err != nil {
+		log.Printf("rejected activity: %s", err)
+		respondWithError(w, 401, "couldn't verify signature")
+		return
+	}
+	activity := activitypub.Activity{}
+	err = json.Unmarshal(body, &activity)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode activity")
+		return
+	}
+	if activity.Actor != signer.ID {
+		respondWithError(w, 401, "activity wasn't signed by its actor")
+		return
+	}
+	err = cfg.handleActivity(signer, activity)
+	if errors.Is(err, errActorNotFound) || errors.Is(err, database.ErrChirpNotFound) || errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if errors.Is(err, errInvalidActivity) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error handling %s activity: %s", activity.Type, err)
+		respondWithError(w, 500, "couldn't handle activity")
+		return
+	}
+	w.WriteHeader(202)
+}
+
+// remoteReplyResponse is a reply to a chirp from another server
+type remoteReplyResponse struct {
+	ID string `json:"id"`
+	// Author is the fediverse handle of who wrote it, user@host
+	Author    string    `json:"author"`
+	AuthorURL string    `json:"author_url"`
+	Body      string    `json:"body"`
+	URL       string    `json:"url,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// remoteRepliesHandler lists the replies a chirp got from other servers,
+// oldest first
+func (cfg *apiConfig) remoteRepliesHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+	chirp, err := cfg.db.GetChirp(chirpID)
+	if err != nil || !chirp.Published() || !chirpVisible(r, chirp) {
+		respondWithError(w, 404, database.ErrChirpNotFound.Error())
+		return
+	}
+	notes, err := cfg.db.RemoteReplies(chirp.ID)
+	if err != nil {
+		log.Printf("error loading remote replies: %s", err)
+		respondWithError(w, 500, "couldn't load replies")
+		return
+	}
+	replies := []remoteReplyResponse{}
+	for _, note := range notes {
+		author := note.ActorID
+		actor, err := cfg.db.GetRemoteActor(note.ActorID)
+		if err == nil {
+			author = actor.Handle
+		}
+		replies = append(replies, remoteReplyResponse{
+			ID:        note.ID,
+			Author:    author,
+			AuthorURL: note.ActorID,
+			Body:      note.Content,
+			URL:       note.URL,
+			CreatedAt: note.Published,
+		})
+	}
+	respondWithJSON(w, 200, replies)
+}
+
+// activityPubRoutes adds WebFinger, actors, outboxes and inboxes to the
+// root router. They're public, inboxes check HTTP Signatures instead of
+// tokens
+func (cfg *apiConfig) activityPubRoutes(r chi.Router) {
+	r.Get("/.well-known/webfinger", cfg.webfingerHandler)
+	r.Get("/users/{id}", cfg.actorHandler)
+	r.Get("/users/{id}/outbox", cfg.outboxHandler)
+	r.Get("/users/{id}/followers", cfg.followersHandler)
+	r.Post("/users/{id}/inbox", cfg.inboxHandler)
+	r.Post("/inbox", cfg.inboxHandler)
+	r.Get("/chirps/{id}", cfg.noteHandler)
+}
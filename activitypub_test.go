@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/activitypub"
+	"github.com/staf3333/chirpy/internal/database"
+)
+
+// federationTest is a chirpy server federating from an httptest server,
+// with one user, alice, who has an actor
+type federationTest struct {
+	cfg   *apiConfig
+	srv   *httptest.Server
+	alice database.User
+}
+
+func newFederationTest(t *testing.T) *federationTest {
+	t.Helper()
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"))
+	if err != nil {
+		t.Fatalf("NewDB: %s", err)
+	}
+	user, err := db.CreateUser("alice@example.com", "password")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+	user, err = db.SetHandle(user.ID, "alice")
+	if err != nil {
+		t.Fatalf("SetHandle: %s", err)
+	}
+
+	var handler http.Handler
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	opts := activitypub.DefaultOptions
+	opts.Interval = 10 * time.Millisecond
+	opts.Timeout = 5 * time.Second
+	opts.AllowPrivate = true
+	federation := activitypub.NewClient(opts.Timeout, opts.AllowPrivate)
+	cfg := &apiConfig{
+		db:         db,
+		baseURL:    srv.URL,
+		federation: federation,
+		deliverer:  activitypub.NewDeliverer(activityPubStore{db: db, baseURL: srv.URL}, federation, opts),
+	}
+	r := chi.NewRouter()
+	r.Group(cfg.activityPubRoutes)
+	handler = r
+
+	cfg.deliverer.Start()
+	t.Cleanup(cfg.deliverer.Stop)
+	return &federationTest{cfg: cfg, srv: srv, alice: user}
+}
+
+func (ft *federationTest) actorID() string {
+	return ft.srv.URL + actorPath(ft.alice.ID)
+}
+
+func (ft *federationTest) getJSON(t *testing.T, path string, wantContentType string, v any) {
+	t.Helper()
+	resp, err := http.Get(ft.srv.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %s", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", path, resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Type"); got != wantContentType {
+		t.Errorf("GET %s: Content-Type %q, want %q", path, got, wantContentType)
+	}
+	err = json.NewDecoder(resp.Body).Decode(v)
+	if err != nil {
+		t.Fatalf("GET %s: decoding: %s", path, err)
+	}
+}
+
+// remoteInstance is another server with one actor. Its inbox checks
+// signatures by fetching the sender's actor, like a real server would
+type remoteInstance struct {
+	srv      *httptest.Server
+	key      *rsa.PrivateKey
+	actorID  string
+	received chan activitypub.Activity
+}
+
+var remoteKey *rsa.PrivateKey
+
+func newRemoteInstance(t *testing.T) *remoteInstance {
+	t.Helper()
+	if remoteKey == nil {
+		key, err := activitypub.GenerateKey()
+		if err != nil {
+			t.Fatalf("GenerateKey: %s", err)
+		}
+		remoteKey = key
+	}
+	remote := &remoteInstance{
+		key:      remoteKey,
+		received: make(chan activitypub.Activity, 10),
+	}
+	client := activitypub.NewClient(5*time.Second, true)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/actor", func(w http.ResponseWriter, r *http.Request) {
+		publicPEM, _ := activitypub.EncodePublicKey(&remote.key.PublicKey)
+		respondWithActivityJSON(w, activitypub.ContentType, activitypub.Actor{
+			ID:                remote.actorID,
+			Type:              activitypub.TypePerson,
+			PreferredUsername: "bob",
+			Inbox:             remote.srv.URL + "/inbox",
+			PublicKey: activitypub.PublicKey{
+				ID:           remote.actorID + "#main-key",
+				Owner:        remote.actorID,
+				PublicKeyPem: publicPEM,
+			},
+		})
+	})
+	mux.HandleFunc("/inbox", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, err := activitypub.VerifyRequest(r, body, time.Now(), func(keyID string) (*rsa.PublicKey, error) {
+			actorID, _, _ := strings.Cut(keyID, "#")
+			actor, err := client.FetchActor(r.Context(), actorID)
+			if err != nil {
+				return nil, err
+			}
+			if actor.PublicKey.ID != keyID {
+				return nil, fmt.Errorf("%s isn't %s's key", keyID, actorID)
+			}
+			return activitypub.ParsePublicKey(actor.PublicKey.PublicKeyPem)
+		})
+		if err != nil {
+			t.Errorf("remote inbox rejected a delivery: %s", err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		activity := activitypub.Activity{}
+		err = json.Unmarshal(body, &activity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		remote.received <- activity
+		w.WriteHeader(http.StatusAccepted)
+	})
+	remote.srv = httptest.NewServer(mux)
+	remote.actorID = remote.srv.URL + "/actor"
+	t.Cleanup(remote.srv.Close)
+	return remote
+}
+
+func (remote *remoteInstance) follow(t *testing.T, actorID string) activitypub.Activity {
+	t.Helper()
+	follow, err := activitypub.NewActivity(remote.actorID+"/follows/1", activitypub.TypeFollow, remote.actorID, actorID)
+	if err != nil {
+		t.Fatalf("NewActivity: %s", err)
+	}
+	return follow
+}
+
+// inboxRequest changes how post signs and sends an activity, the zero
+// value sends it correctly signed by the remote's actor
+type inboxRequest struct {
+	keyID    string
+	key      *rsa.PrivateKey
+	signedAt time.Time
+	// sent replaces the body after it's been signed
+	sent []byte
+}
+
+func (remote *remoteInstance) post(t *testing.T, inbox string, activity activitypub.Activity, tweak inboxRequest) int {
+	t.Helper()
+	body, err := json.Marshal(activity)
+	if err != nil {
+		t.Fatalf("encoding activity: %s", err)
+	}
+	if tweak.keyID == "" {
+		tweak.keyID = remote.actorID + "#main-key"
+	}
+	if tweak.key == nil {
+		tweak.key = remote.key
+	}
+	if tweak.signedAt.IsZero() {
+		tweak.signedAt = time.Now()
+	}
+	req, err := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	req.Header.Set("Content-Type", activitypub.ContentType)
+	err = activitypub.SignRequest(req, tweak.keyID, tweak.key, body, tweak.signedAt)
+	if err != nil {
+		t.Fatalf("SignRequest: %s", err)
+	}
+	if tweak.sent != nil {
+		req.Body = io.NopCloser(bytes.NewReader(tweak.sent))
+		req.ContentLength = int64(len(tweak.sent))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("POST %s: %s", inbox, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWebFinger(t *testing.T) {
+	ft := newFederationTest(t)
+	host := ft.cfg.federationHost()
+
+	webfinger := activitypub.WebFinger{}
+	ft.getJSON(t, "/.well-known/webfinger?resource="+url.QueryEscape("acct:alice@"+host), activitypub.WebFingerContentType, &webfinger)
+	if webfinger.Subject != "acct:alice@"+host {
+		t.Errorf("subject = %q", webfinger.Subject)
+	}
+	if len(webfinger.Links) != 1 || webfinger.Links[0].Rel != "self" || webfinger.Links[0].Href != ft.actorID() {
+		t.Errorf("links = %+v, want a self link to %s", webfinger.Links, ft.actorID())
+	}
+
+	for _, resource := range []string{"acct:nobody@" + host, "acct:alice@elsewhere.example"} {
+		resp, err := http.Get(ft.srv.URL + "/.well-known/webfinger?resource=" + url.QueryEscape(resource))
+		if err != nil {
+			t.Fatalf("GET webfinger: %s", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: status %d, want 404", resource, resp.StatusCode)
+		}
+	}
+}
+
+func TestActorDocument(t *testing.T) {
+	ft := newFederationTest(t)
+
+	actor := activitypub.Actor{}
+	ft.getJSON(t, actorPath(ft.alice.ID), activitypub.ContentType, &actor)
+	if actor.ID != ft.actorID() || actor.Type != activitypub.TypePerson || actor.PreferredUsername != "alice" {
+		t.Errorf("actor = %+v", actor)
+	}
+	if actor.Inbox != ft.actorID()+"/inbox" || actor.Outbox != ft.actorID()+"/outbox" {
+		t.Errorf("inbox = %q, outbox = %q", actor.Inbox, actor.Outbox)
+	}
+	if actor.PublicKey.ID != actorKeyID(ft.actorID()) || actor.PublicKey.Owner != ft.actorID() {
+		t.Errorf("public key = %+v", actor.PublicKey)
+	}
+	_, err := activitypub.ParsePublicKey(actor.PublicKey.PublicKeyPem)
+	if err != nil {
+		t.Errorf("ParsePublicKey: %s", err)
+	}
+
+	// users without a handle have no actor
+	user, err := ft.cfg.db.CreateUser("nohandle@example.com", "password")
+	if err != nil {
+		t.Fatalf("CreateUser: %s", err)
+	}
+	resp, err := http.Get(ft.srv.URL + actorPath(user.ID))
+	if err != nil {
+		t.Fatalf("GET actor: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status %d for a user without a handle, want 404", resp.StatusCode)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ft := newFederationTest(t)
+	now := time.Now()
+	for _, chirp := range []database.Chirp{
+		{AuthorID: ft.alice.ID, Body: "first #golang", Status: database.ChirpPublished, CreatedAt: now},
+		{AuthorID: ft.alice.ID, Body: "not yet", Status: database.ChirpDraft, CreatedAt: now},
+		{AuthorID: ft.alice.ID, Body: "second", Status: database.ChirpPublished, CreatedAt: now},
+	} {
+		_, err := ft.cfg.db.CreateChirp(chirp, nil, nil)
+		if err != nil {
+			t.Fatalf("CreateChirp: %s", err)
+		}
+	}
+
+	outbox := activitypub.OrderedCollection{}
+	ft.getJSON(t, actorPath(ft.alice.ID)+"/outbox", activitypub.ContentType, &outbox)
+	if outbox.TotalItems != 2 {
+		t.Errorf("totalItems = %d, want the 2 published chirps", outbox.TotalItems)
+	}
+
+	page := struct {
+		activitypub.OrderedCollectionPage
+		OrderedItems []activitypub.Activity `json:"orderedItems"`
+	}{}
+	ft.getJSON(t, actorPath(ft.alice.ID)+"/outbox?page=true&limit=1", activitypub.ContentType, &page)
+	if len(page.OrderedItems) != 1 {
+		t.Fatalf("got %d items, want 1", len(page.OrderedItems))
+	}
+	create := page.OrderedItems[0]
+	if create.Type != activitypub.TypeCreate || create.Actor != ft.actorID() {
+		t.Errorf("item = %+v, want a Create by alice", create)
+	}
+	note := activitypub.Note{}
+	err := create.DecodeObject(&note)
+	if err != nil {
+		t.Fatalf("DecodeObject: %s", err)
+	}
+	if note.ID != ft.srv.URL+notePath(3) || !strings.Contains(note.Content, "second") {
+		t.Errorf("note = %+v, want the newest chirp first", note)
+	}
+	if page.Next == "" {
+		t.Error("the first page has no next link")
+	}
+}
+
+func TestInboxFollowIsAccepted(t *testing.T) {
+	ft := newFederationTest(t)
+	remote := newRemoteInstance(t)
+
+	follow := remote.follow(t, ft.actorID())
+	status := remote.post(t, ft.actorID()+"/inbox", follow, inboxRequest{})
+	if status != http.StatusAccepted {
+		t.Fatalf("inbox returned %d, want 202", status)
+	}
+	followers, err := ft.cfg.db.RemoteFollowers(ft.alice.ID)
+	if err != nil {
+		t.Fatalf("RemoteFollowers: %s", err)
+	}
+	if len(followers) != 1 || followers[0].ActorID != remote.actorID {
+		t.Errorf("followers = %+v, want %s", followers, remote.actorID)
+	}
+
+	select {
+	case accept := <-remote.received:
+		if accept.Type != activitypub.TypeAccept || accept.Actor != ft.actorID() {
+			t.Errorf("got %+v, want an Accept from alice", accept)
+		}
+		accepted := activitypub.Activity{}
+		err = accept.DecodeObject(&accepted)
+		if err != nil || accepted.ID != follow.ID || accepted.Type != activitypub.TypeFollow {
+			t.Errorf("Accept's object = %+v, want the Follow", accepted)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the remote never got an Accept")
+	}
+}
+
+func TestInboxRejectsBadSignatures(t *testing.T) {
+	ft := newFederationTest(t)
+	remote := newRemoteInstance(t)
+	otherKey, err := activitypub.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %s", err)
+	}
+	follow := remote.follow(t, ft.actorID())
+	tampered, _ := json.Marshal(remote.follow(t, ft.srv.URL+actorPath(ft.alice.ID+1)))
+	impersonating := remote.follow(t, ft.actorID())
+	impersonating.Actor = "https://elsewhere.example/users/carol"
+
+	tests := []struct {
+		name     string
+		activity activitypub.Activity
+		tweak    inboxRequest
+	}{
+		{"signed with another key", follow, inboxRequest{key: otherKey}},
+		{"body doesn't match the digest", follow, inboxRequest{sent: tampered}},
+		{"stale date", follow, inboxRequest{signedAt: time.Now().Add(-2 * activitypub.MaxClockSkew)}},
+		{"key id isn't the actor's key", follow, inboxRequest{keyID: remote.actorID + "#other-key"}},
+		{"key id of an actor that doesn't exist", follow, inboxRequest{keyID: remote.srv.URL + "/nobody#main-key"}},
+		{"activity by another actor", impersonating, inboxRequest{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status := remote.post(t, ft.actorID()+"/inbox", tt.activity, tt.tweak)
+			if status != http.StatusUnauthorized {
+				t.Errorf("inbox returned %d, want 401", status)
+			}
+		})
+	}
+
+	followers, err := ft.cfg.db.RemoteFollowers(ft.alice.ID)
+	if err != nil {
+		t.Fatalf("RemoteFollowers: %s", err)
+	}
+	if len(followers) != 0 {
+		t.Errorf("rejected follows were saved: %+v", followers)
+	}
+	select {
+	case activity := <-remote.received:
+		t.Errorf("the remote got %s for a rejected follow", activity.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+)
+
+// adminUserResponse is a user as shown to admins, everything but the
+// password hash
+type adminUserResponse struct {
+	ID                    int        `json:"id"`
+	Email                 string     `json:"email"`
+	Role                  string     `json:"role"`
+	SuspendedAt           *time.Time `json:"suspended_at,omitempty"`
+	SuspendedReason       string     `json:"suspended_reason,omitempty"`
+	PasswordResetRequired bool       `json:"password_reset_required"`
+	IsChirpyRed           bool       `json:"is_chirpy_red"`
+}
+
+func newAdminUserResponse(user database.User) adminUserResponse {
+	return adminUserResponse{
+		ID:                    user.ID,
+		Email:                 user.Email,
+		Role:                  user.RoleOrDefault(),
+		SuspendedAt:           user.SuspendedAt,
+		SuspendedReason:       user.SuspendedReason,
+		PasswordResetRequired: user.PasswordResetRequired,
+		IsChirpyRed:           user.IsChirpyRed,
+	}
+}
+
+// respondWithUserUpdate writes the result of an admin action on a user
+func respondWithUserUpdate(w http.ResponseWriter, user database.User, err error) {
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error updating user: %s", err)
+		respondWithError(w, 500, "couldn't update user")
+		return
+	}
+	respondWithJSON(w, 200, newAdminUserResponse(user))
+}
+
+// adminUsersGetHandler lists users, filtered by ?q= (part of the email),
+// ?role= and ?suspended=true|false
+func (cfg *apiConfig) adminUsersGetHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.UserFilter{
+		Query: query.Get("q"),
+		Role:  query.Get("role"),
+	}
+	if suspended := query.Get("suspended"); suspended != "" {
+		b, err := strconv.ParseBool(suspended)
+		if err != nil {
+			respondWithError(w, 400, "suspended must be true or false")
+			return
+		}
+		filter.Suspended = &b
+	}
+
+	users, err := cfg.db.ListUsers(filter)
+	if err != nil {
+		log.Printf("error listing users: %s", err)
+		respondWithError(w, 500, "couldn't list users")
+		return
+	}
+	response := []adminUserResponse{}
+	for _, user := range users {
+		response = append(response, newAdminUserResponse(user))
+	}
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) adminUserGetHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user id")
+		return
+	}
+	user, err := cfg.db.GetUser(userID)
+	respondWithUserUpdate(w, user, err)
+}
+
+func (cfg *apiConfig) adminUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Role string `json:"role"`
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user id")
+		return
+	}
+	decoder := json.NewDecoder(r.Body)
+	params := requestBody{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	if !auth.IsKnownRole(params.Role) {
+		respondWithError(w, 400, "unknown role "+params.Role)
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	if userID == principal.UserID && params.Role != auth.RoleAdmin {
+		respondWithError(w, 400, "admins can't demote themselves")
+		return
+	}
+
+	user, err := cfg.db.SetUserRole(userID, params.Role, time.Now())
+	respondWithUserUpdate(w, user, err)
+}
+
+func (cfg *apiConfig) adminUserSuspendHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Reason string `json:"reason"`
+	}
+
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user id")
+		return
+	}
+	params := requestBody{}
+	// the reason is optional, so an empty body is fine
+	json.NewDecoder(r.Body).Decode(&params)
+
+	principal, _ := auth.PrincipalFrom(r.Context())
+	if userID == principal.UserID {
+		respondWithError(w, 400, "admins can't suspend themselves")
+		return
+	}
+
+	user, err := cfg.db.SuspendUser(userID, params.Reason, time.Now())
+	respondWithUserUpdate(w, user, err)
+}
+
+func (cfg *apiConfig) adminUserUnsuspendHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user id")
+		return
+	}
+	user, err := cfg.db.UnsuspendUser(userID)
+	respondWithUserUpdate(w, user, err)
+}
+
+// adminUserPasswordResetHandler logs the user out everywhere and makes them
+// choose a new password through /api/password_reset. The reset token in the
+// response is only shown once, the admin passes it on to the user. Their
+// old password isn't enough to finish the reset, since it may be what leaked
+func (cfg *apiConfig) adminUserPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user id")
+		return
+	}
+	token := auth.RandomToken(32)
+	now := time.Now()
+	expiresAt := now.Add(cfg.passwordResetTTL)
+	user, err := cfg.db.RequirePasswordReset(userID, auth.HashSecret(token), now, expiresAt)
+	if err != nil {
+		respondWithUserUpdate(w, user, err)
+		return
+	}
+	respondWithJSON(w, 200, struct {
+		adminUserResponse
+		ResetToken          string    `json:"reset_token"`
+		ResetTokenExpiresAt time.Time `json:"reset_token_expires_at"`
+	}{
+		adminUserResponse:   newAdminUserResponse(user),
+		ResetToken:          token,
+		ResetTokenExpiresAt: expiresAt,
+	})
+}
+
+func adminUsersRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/", cfg.adminUsersGetHandler)
+	r.Get("/{id}", cfg.adminUserGetHandler)
+	r.Put("/{id}/role", cfg.adminUserRoleHandler)
+	r.Post("/{id}/suspend", cfg.adminUserSuspendHandler)
+	r.Post("/{id}/unsuspend", cfg.adminUserUnsuspendHandler)
+	r.Post("/{id}/password_reset", cfg.adminUserPasswordResetHandler)
+	return r
+}
+
+// createAdminCommand bootstraps the first admin: `chirpy create-admin
+// -email me@example.com -password hunter2`. An existing user with that
+// email is promoted instead
+func createAdminCommand(db *database.DB, args []string) error {
+	flags := flag.NewFlagSet("create-admin", flag.ContinueOnError)
+	email := flags.String("email", "", "email of the admin account")
+	password := flags.String("password", "", "password for a new admin account")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *email == "" {
+		return errors.New("-email is required")
+	}
+
+	users, err := db.ListUsers(database.UserFilter{})
+	if err != nil {
+		return err
+	}
+	userID := 0
+	for _, user := range users {
+		if user.Email == *email {
+			userID = user.ID
+		}
+	}
+	if userID == 0 {
+		if *password == "" {
+			return errors.New("-password is required to create a new user")
+		}
+		user, err := db.CreateUser(*email, *password)
+		if err != nil {
+			return err
+		}
+		userID = user.ID
+	}
+
+	user, err := db.SetUserRole(userID, auth.RoleAdmin, time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s (id %d) is now an admin\n", user.Email, user.ID)
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+)
+
+// maxAPIKeyLifetime is the furthest out an API key can be set to expire
+const maxAPIKeyLifetime = 365 * 24 * time.Hour
+
+// apiKeyStore lets the auth middleware look up API keys in the database
+type apiKeyStore struct {
+	db *database.DB
+}
+
+func (s apiKeyStore) LookupAPIKey(id string) (auth.APIKeyRecord, error) {
+	key, err := s.db.GetAPIKey(id)
+	if err != nil {
+		return auth.APIKeyRecord{}, err
+	}
+	record := auth.APIKeyRecord{
+		UserID:    key.UserID,
+		Scopes:    key.Scopes,
+		Hash:      key.Hash,
+		CreatedAt: key.CreatedAt,
+		Revoked:   key.RevokedAt != nil,
+	}
+	if key.ExpiresAt != nil {
+		record.ExpiresAt = *key.ExpiresAt
+	}
+	if key.LastUsedAt != nil {
+		record.LastUsedAt = *key.LastUsedAt
+	}
+	return record, nil
+}
+
+func (s apiKeyStore) TouchAPIKey(id string, usedAt time.Time, ip string) error {
+	return s.db.TouchAPIKey(id, usedAt, ip)
+}
+
+// apiKeyResponse is an API key as shown to its owner, the secret is only
+// ever included right after it's created
+type apiKeyResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Key        string     `json:"key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func newAPIKeyResponse(key database.APIKey) apiKeyResponse {
+	return apiKeyResponse{
+		ID:         key.ID,
+		Name:       key.Name,
+		Scopes:     key.Scopes,
+		CreatedAt:  key.CreatedAt,
+		ExpiresAt:  key.ExpiresAt,
+		LastUsedAt: key.LastUsedAt,
+		LastUsedIP: key.LastUsedIP,
+		RevokedAt:  key.RevokedAt,
+	}
+}
+
+func (cfg *apiConfig) apiKeyCreateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Name       string   `json:"name"`
+		Scopes     []string `json:"scopes"`
+		Expiration *int     `json:"expires_in_seconds,omitempty"`
+	}
+
+	principal, _ := auth.PrincipalFrom(r.Context())
+	// API keys and third party apps shouldn't be able to mint more API keys
+	if !principal.FirstParty() {
+		respondWithError(w, 403, "api keys can only be created from a login session")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestBody{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding JSON: %s", err)
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	if params.Name == "" {
+		respondWithError(w, 400, "api keys need a name")
+		return
+	}
+	if len(params.Scopes) == 0 {
+		respondWithError(w, 400, "api keys need at least one scope")
+		return
+	}
+	for _, scope := range params.Scopes {
+		if !auth.IsKnownScope(scope) {
+			respondWithError(w, 400, "unknown scope "+scope)
+			return
+		}
+	}
+
+	now := time.Now()
+	id, secret, hash := auth.NewAPIKey()
+	key := database.APIKey{
+		ID:        id,
+		UserID:    principal.UserID,
+		Name:      params.Name,
+		Scopes:    params.Scopes,
+		Hash:      hash,
+		CreatedAt: now,
+	}
+	if params.Expiration != nil {
+		if *params.Expiration <= 0 {
+			respondWithError(w, 400, "expires_in_seconds must be positive")
+			return
+		}
+		// compare in seconds, converting first could overflow the Duration
+		if int64(*params.Expiration) > int64(maxAPIKeyLifetime/time.Second) {
+			respondWithError(w, 400, "expires_in_seconds can be at most a year")
+			return
+		}
+		expiresAt := now.Add(time.Duration(*params.Expiration) * time.Second)
+		key.ExpiresAt = &expiresAt
+	}
+
+	key, err = cfg.db.CreateAPIKey(key)
+	if err != nil {
+		log.Printf("error creating api key: %s", err)
+		respondWithError(w, 500, "couldn't create api key")
+		return
+	}
+
+	response := newAPIKeyResponse(key)
+	response.Key = secret
+	respondWithJSON(w, 201, response)
+}
+
+func (cfg *apiConfig) apiKeysGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFrom(r.Context())
+	keys, err := cfg.db.ListAPIKeys(principal.UserID)
+	if err != nil {
+		log.Printf("error listing api keys: %s", err)
+		respondWithError(w, 500, "couldn't list api keys")
+		return
+	}
+	response := []apiKeyResponse{}
+	for _, key := range keys {
+		response = append(response, newAPIKeyResponse(key))
+	}
+	respondWithJSON(w, 200, response)
+}
+
+func (cfg *apiConfig) apiKeyRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFrom(r.Context())
+	_, err := cfg.db.RevokeAPIKey(principal.UserID, chi.URLParam(r, "id"), time.Now())
+	if errors.Is(err, database.ErrAPIKeyNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error revoking api key: %s", err)
+		respondWithError(w, 500, "couldn't revoke api key")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+func apiKeysRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(auth.RequireScope(auth.ScopeProfileWrite))
+	r.Post("/", cfg.apiKeyCreateHandler)
+	r.Get("/", cfg.apiKeysGetHandler)
+	r.Delete("/{id}", cfg.apiKeyRevokeHandler)
+	return r
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/notify"
+	"github.com/staf3333/chirpy/internal/webhooks"
+)
+
+// userLinkHandler returns a handler that blocks, mutes or follows the user
+// in the {id} URL param (or undoes that) using set
+func (cfg *apiConfig) userLinkHandler(set func(userID, targetID int) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		targetID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondWithError(w, 400, "invalid user id")
+			return
+		}
+		principal, _ := auth.PrincipalFrom(r.Context())
+		err = set(principal.UserID, targetID)
+		if errors.Is(err, database.ErrSelfRelation) {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		if errors.Is(err, database.ErrUserNotFound) {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		if errors.Is(err, database.ErrBlocked) {
+			respondWithError(w, 403, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("error updating user relation: %s", err)
+			respondWithError(w, 500, "couldn't update user")
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// userLinksGetHandler returns a handler listing the requester's blocks,
+// mutes, follows or followers using list
+func (cfg *apiConfig) userLinksGetHandler(list func(userID int) ([]database.UserLink, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := auth.PrincipalFrom(r.Context())
+		links, err := list(principal.UserID)
+		if err != nil {
+			log.Printf("error listing user relations: %s", err)
+			respondWithError(w, 500, "couldn't list users")
+			return
+		}
+		respondWithJSON(w, 200, links)
+	}
+}
+
+// userLinkRoutes adds the block, mute and follow endpoints to the users
+// router
+func (cfg *apiConfig) userLinkRoutes(r chi.Router) {
+	r.Post("/{id}/block", cfg.userLinkHandler(func(userID, targetID int) error {
+		return cfg.db.Block(userID, targetID, time.Now())
+	}))
+	r.Delete("/{id}/block", cfg.userLinkHandler(cfg.db.Unblock))
+	r.Post("/{id}/mute", cfg.userLinkHandler(func(userID, targetID int) error {
+		return cfg.db.Mute(userID, targetID, time.Now())
+	}))
+	r.Delete("/{id}/mute", cfg.userLinkHandler(cfg.db.Unmute))
+	r.Post("/{id}/follow", cfg.userLinkHandler(func(userID, targetID int) error {
+		now := time.Now()
+		err := cfg.db.Follow(userID, targetID, now)
+		if err != nil {
+			return err
+		}
+		cfg.notifier.Notify(notify.Event{Kind: notify.KindFollow, UserID: targetID, ActorID: userID, At: now})
+		cfg.emitWebhook(webhooks.EventUserFollowed, targetID, database.UserLink{UserID: userID, TargetID: targetID, CreatedAt: now})
+		return nil
+	}))
+	r.Delete("/{id}/follow", cfg.userLinkHandler(cfg.db.Unfollow))
+}
+
+// timelineHandler is the requester's home feed, their own chirps and
+// those of everyone they follow
+func (cfg *apiConfig) timelineHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFrom(r.Context())
+	following, err := cfg.db.Following(principal.UserID)
+	if err != nil {
+		log.Printf("error loading follows: %s", err)
+		respondWithError(w, 500, "couldn't load chirps")
+		return
+	}
+	authors := []int{principal.UserID}
+	for id := range following {
+		authors = append(authors, id)
+	}
+	chirps, err := cfg.db.ChirpsByAuthors(authors)
+	if err != nil {
+		log.Printf("error loading timeline: %s", err)
+		respondWithError(w, 500, "couldn't load chirps")
+		return
+	}
+	cfg.respondWithFeed(w, r, chirps)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+)
+
+func (cfg *apiConfig) bookmarkCreateHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+	// people can only bookmark chirps they can see
+	chirp, err := cfg.db.GetChirp(chirpID)
+	if err != nil || !chirp.Published() || !chirpVisible(r, chirp) {
+		respondWithError(w, 404, "chirp does not exist")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	created, err := cfg.db.AddBookmark(principal.UserID, chirpID, time.Now())
+	if err != nil {
+		log.Printf("error adding bookmark: %s", err)
+		respondWithError(w, 500, "couldn't add bookmark")
+		return
+	}
+	if !created {
+		w.WriteHeader(200)
+		return
+	}
+	w.WriteHeader(201)
+}
+
+func (cfg *apiConfig) bookmarkDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	err = cfg.db.RemoveBookmark(principal.UserID, chirpID)
+	if err != nil {
+		log.Printf("error removing bookmark: %s", err)
+		respondWithError(w, 500, "couldn't remove bookmark")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// bookmarksGetHandler is the requester's bookmarks as a feed
+func (cfg *apiConfig) bookmarksGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFrom(r.Context())
+	chirps, err := cfg.db.BookmarkedChirps(principal.UserID)
+	if err != nil {
+		log.Printf("error listing bookmarks: %s", err)
+		respondWithError(w, 500, "couldn't list bookmarks")
+		return
+	}
+	cfg.respondWithFeed(w, r, chirps)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/validation"
+)
+
+// membership tiers, each has its own chirp length limit
+const (
+	tierFree = "free"
+	tierRed  = "red"
+)
+
+// defaultChirpLengthLimits can be overridden with CHIRP_MAX_LENGTH and
+// CHIRP_MAX_LENGTH_RED
+var defaultChirpLengthLimits = map[string]int{
+	tierFree: 140,
+	// Chirpy Red members get more room
+	tierRed: 280,
+}
+
+func chirpTier(user database.User) string {
+	if user.IsChirpyRed {
+		return tierRed
+	}
+	return tierFree
+}
+
+// chirpLengthLimit is the longest chirp user can post
+func (cfg *apiConfig) chirpLengthLimit(user database.User) int {
+	return cfg.chirpLengthLimits[chirpTier(user)]
+}
+
+// validateChirp normalizes a chirp body and checks it's not empty and fits
+// user's limit, along with the media attached to it
+func (cfg *apiConfig) validateChirp(user database.User, body string, mediaIDs []string) (string, validation.Errors) {
+	errs := validation.Errors{}
+	body = validation.Text(&errs, "body", body, cfg.chirpLengthLimit(user))
+	validateChirpMedia(&errs, mediaIDs)
+	return body, errs
+}
+
+// maxChirpRequestBytes caps the JSON body of a chirp create or update, it's
+// far more than the longest chirp and poll need
+const maxChirpRequestBytes = 64 * 1024
+
+// maxScheduleAhead is how far in the future a chirp can be scheduled
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+// validateSchedule checks a chirp's status and when it's due to go out
+func validateSchedule(errs *validation.Errors, status string, publishAt *time.Time, now time.Time) {
+	switch status {
+	case database.ChirpDraft, database.ChirpPublished:
+		if publishAt != nil {
+			errs.Add("publish_at", validation.CodeInvalid, "only scheduled chirps have a publish time")
+		}
+	case database.ChirpScheduled:
+		switch {
+		case publishAt == nil:
+			errs.Add("publish_at", validation.CodeRequired, "scheduled chirps need a publish time")
+		case !publishAt.After(now):
+			errs.Add("publish_at", validation.CodeInvalid, "publish_at must be in the future")
+		case publishAt.After(now.Add(maxScheduleAhead)):
+			errs.Add("publish_at", validation.CodeInvalid, "chirps can't be scheduled more than a year ahead")
+		}
+	default:
+		errs.Add("status", validation.CodeInvalid, "status must be draft, scheduled or published")
+	}
+}
+
+// chirpUpdateHandler edits a chirp. Drafts and scheduled chirps can be
+// changed freely, including their status and publish time, published
+// chirps can only have their body edited and only by Chirpy Red members
+func (cfg *apiConfig) chirpUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Body      *string    `json:"body"`
+		Status    string     `json:"status"`
+		PublishAt *time.Time `json:"publish_at"`
+	}
+
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxChirpRequestBytes)
+	decoder := json.NewDecoder(r.Body)
+	params := requestBody{}
+	err = decoder.Decode(&params)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, 413, "request body is too large")
+		return
+	}
+	if err != nil {
+		log.Printf("Error decoding JSON: %s", err)
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+
+	principal, _ := auth.PrincipalFrom(r.Context())
+	user, err := cfg.db.GetUser(principal.UserID)
+	if err != nil {
+		respondWithError(w, 401, err.Error())
+		return
+	}
+	chirp, err := cfg.db.GetChirp(chirpID)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error getting chirp: %s", err)
+		respondWithError(w, 500, "couldn't update chirp")
+		return
+	}
+	if chirp.AuthorID != user.ID {
+		respondWithError(w, 403, database.ErrNotChirpAuthor.Error())
+		return
+	}
+	if !chirp.Published() {
+		cfg.updateUnpublishedChirp(w, r, user, chirp, params.Body, params.Status, params.PublishAt)
+		return
+	}
+
+	if !user.IsChirpyRed {
+		respondWithError(w, 403, "editing chirps requires Chirpy Red")
+		return
+	}
+	newBody := ""
+	if params.Body != nil {
+		newBody = *params.Body
+	}
+	body, errs := cfg.validateChirp(user, newBody, nil)
+	if params.Status != "" && params.Status != database.ChirpPublished {
+		errs.Add("status", validation.CodeInvalid, "published chirps can't be unpublished")
+	}
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	result := cfg.moderation.Run(body)
+	if result.Rejected() {
+		respondWithError(w, 400, errChirpRejected)
+		return
+	}
+	chirp, err = cfg.db.UpdateChirpBody(chirpID, user.ID, result.Body, result.Held(), time.Now())
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrNotChirpAuthor) {
+		respondWithError(w, 403, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error updating chirp: %s", err)
+		respondWithError(w, 500, "couldn't update chirp")
+		return
+	}
+	cfg.requestPreview(chirp)
+	cfg.respondWithChirp(w, r, 200, chirp)
+}
+
+// updateUnpublishedChirp edits a draft or scheduled chirp. Fields left out
+// keep their current value, except publish_at which only scheduled chirps
+// have
+func (cfg *apiConfig) updateUnpublishedChirp(w http.ResponseWriter, r *http.Request, user database.User, chirp database.Chirp, body *string, status string, publishAt *time.Time) {
+	now := time.Now()
+	errs := validation.Errors{}
+	newBody := chirp.Body
+	if body != nil {
+		newBody, errs = cfg.validateChirp(user, *body, nil)
+	}
+	if status == "" {
+		status = chirp.Status
+	}
+	if publishAt == nil && status == database.ChirpScheduled {
+		publishAt = chirp.PublishAt
+	}
+	validateSchedule(&errs, status, publishAt, now)
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	held := false
+	if body != nil {
+		result := cfg.moderation.Run(newBody)
+		if result.Rejected() {
+			respondWithError(w, 400, errChirpRejected)
+			return
+		}
+		newBody = result.Body
+		held = result.Held()
+	}
+
+	chirp, err := cfg.db.UpdateUnpublishedChirp(chirp.ID, user.ID, func(c *database.Chirp) error {
+		c.Body = newBody
+		if held {
+			c.ModerationState = database.ChirpHeld
+		}
+		c.Status = status
+		c.PublishAt = publishAt
+		if status == database.ChirpPublished {
+			c.PublishedAt = &now
+		}
+		return nil
+	})
+	if errors.Is(err, database.ErrChirpPublished) {
+		respondWithError(w, 409, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error updating chirp: %s", err)
+		respondWithError(w, 500, "couldn't update chirp")
+		return
+	}
+	if chirp.Published() {
+		cfg.chirpPublished(chirp)
+	}
+	cfg.respondWithChirp(w, r, 200, chirp)
+}
+
+// chirpDeleteHandler cancels a draft or scheduled chirp
+func (cfg *apiConfig) chirpDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	err = cfg.db.DeleteUnpublishedChirp(chirpID, principal.UserID)
+	if errors.Is(err, database.ErrChirpNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrNotChirpAuthor) {
+		respondWithError(w, 403, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrChirpPublished) {
+		respondWithError(w, 409, "published chirps can't be cancelled")
+		return
+	}
+	if err != nil {
+		log.Printf("error deleting chirp: %s", err)
+		respondWithError(w, 500, "couldn't delete chirp")
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// chirpDraftsHandler lists the requester's drafts and scheduled chirps,
+// ?status=draft or ?status=scheduled narrows it to one kind
+func (cfg *apiConfig) chirpDraftsHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status != "" && status != database.ChirpDraft && status != database.ChirpScheduled {
+		respondWithError(w, 400, "status must be draft or scheduled")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	chirps, err := cfg.db.ListUnpublishedChirps(principal.UserID, status)
+	if err != nil {
+		log.Printf("error listing drafts: %s", err)
+		respondWithError(w, 500, "couldn't list drafts")
+		return
+	}
+	cfg.respondWithChirps(w, r, 200, chirps)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/validation"
+)
+
+const maxMessageLength = 1000
+
+// loadMessageKey returns the key direct messages are encrypted with, read
+// (base64) from the file at path, which is created with a random key the
+// first time
+func loadMessageKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		_, err = rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+		err = os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding message key: %w", err)
+	}
+	return key, nil
+}
+
+// conversationResponse is a conversation as shown to one of its members
+type conversationResponse struct {
+	database.Conversation
+	Unread int `json:"unread"`
+}
+
+// messageResponse is a message with the members, other than the sender,
+// who have read it
+type messageResponse struct {
+	database.Message
+	ReadBy []int `json:"read_by"`
+}
+
+func newMessageResponse(conversation database.Conversation, message database.Message) messageResponse {
+	response := messageResponse{Message: message, ReadBy: []int{}}
+	for _, id := range conversation.MemberIDs {
+		if id != message.SenderID && conversation.ReadUpTo[id] >= message.ID {
+			response.ReadBy = append(response.ReadBy, id)
+		}
+	}
+	return response
+}
+
+// respondWithConversation writes conversation as userID sees it
+func (cfg *apiConfig) respondWithConversation(w http.ResponseWriter, code int, conversation database.Conversation, userID int) {
+	unread, err := cfg.db.UnreadCounts(userID)
+	if err != nil {
+		respondWithConversationError(w, err, "couldn't load conversation")
+		return
+	}
+	respondWithJSON(w, code, conversationResponse{
+		Conversation: conversation,
+		Unread:       unread[conversation.ID],
+	})
+}
+
+// respondWithConversationError writes the errors the conversation
+// endpoints have in common
+func respondWithConversationError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, database.ErrConversationNotFound):
+		respondWithError(w, 404, err.Error())
+	case errors.Is(err, database.ErrDMNotAllowed):
+		respondWithError(w, 403, err.Error())
+	default:
+		log.Printf("%s: %s", msg, err)
+		respondWithError(w, 500, msg)
+	}
+}
+
+// conversationCreateHandler takes {"member_ids": [2, 3]}, everyone but the
+// requester. Starting a one-to-one conversation that already exists
+// returns it with a 200
+func (cfg *apiConfig) conversationCreateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		MemberIDs []int `json:"member_ids"`
+	}
+
+	params := requestBody{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	members := []int{}
+	seen := map[int]bool{principal.UserID: true}
+	for _, id := range params.MemberIDs {
+		if !seen[id] {
+			seen[id] = true
+			members = append(members, id)
+		}
+	}
+	errs := validation.Errors{}
+	if len(members) == 0 {
+		errs.Add("member_ids", validation.CodeRequired, "a conversation needs someone else in it")
+	}
+	if len(members) > database.MaxConversationMembers-1 {
+		errs.Add("member_ids", validation.CodeTooLong, fmt.Sprintf("conversations can have at most %d members", database.MaxConversationMembers))
+	}
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	conversation, created, err := cfg.db.CreateConversation(principal.UserID, members, time.Now())
+	if errors.Is(err, database.ErrUserNotFound) {
+		errs.Add("member_ids", validation.CodeInvalid, err.Error())
+		respondWithValidationErrors(w, errs)
+		return
+	}
+	if err != nil {
+		respondWithConversationError(w, err, "couldn't create conversation")
+		return
+	}
+	code := 200
+	if created {
+		code = 201
+	}
+	cfg.respondWithConversation(w, code, conversation, principal.UserID)
+}
+
+// conversationsGetHandler lists the requester's conversations, the most
+// recently active first, with how many unread messages each has
+func (cfg *apiConfig) conversationsGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFrom(r.Context())
+	conversations, err := cfg.db.ListConversations(principal.UserID)
+	if err != nil {
+		respondWithConversationError(w, err, "couldn't list conversations")
+		return
+	}
+	unread, err := cfg.db.UnreadCounts(principal.UserID)
+	if err != nil {
+		respondWithConversationError(w, err, "couldn't list conversations")
+		return
+	}
+	response := []conversationResponse{}
+	for _, conversation := range conversations {
+		response = append(response, conversationResponse{
+			Conversation: conversation,
+			Unread:       unread[conversation.ID],
+		})
+	}
+	respondWithJSON(w, 200, response)
+}
+
+// conversationFromURL loads the conversation in the {id} URL param, it
+// writes an error and returns false when the requester isn't in it
+func (cfg *apiConfig) conversationFromURL(w http.ResponseWriter, r *http.Request) (database.Conversation, bool) {
+	conversationID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid conversation id")
+		return database.Conversation{}, false
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	conversation, err := cfg.db.GetConversation(conversationID, principal.UserID)
+	if err != nil {
+		respondWithConversationError(w, err, "couldn't load conversation")
+		return database.Conversation{}, false
+	}
+	return conversation, true
+}
+
+func (cfg *apiConfig) conversationGetHandler(w http.ResponseWriter, r *http.Request) {
+	conversation, ok := cfg.conversationFromURL(w, r)
+	if !ok {
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	cfg.respondWithConversation(w, 200, conversation, principal.UserID)
+}
+
+// messagesGetHandler is a conversation's history, newest first and paged
+// like the feeds
+func (cfg *apiConfig) messagesGetHandler(w http.ResponseWriter, r *http.Request) {
+	conversation, ok := cfg.conversationFromURL(w, r)
+	if !ok {
+		return
+	}
+	page, err := parseFeedPage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	messages, more, err := cfg.db.ListMessages(conversation.ID, principal.UserID, page.before, page.limit)
+	if err != nil {
+		respondWithConversationError(w, err, "couldn't load messages")
+		return
+	}
+	if more {
+		setNextPageLink(w, r, page, messages[len(messages)-1].ID)
+	}
+	response := []messageResponse{}
+	for _, message := range messages {
+		response = append(response, newMessageResponse(conversation, message))
+	}
+	respondWithJSON(w, 200, response)
+}
+
+// messageCreateHandler takes {"body": "..."}
+func (cfg *apiConfig) messageCreateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Body string `json:"body"`
+	}
+
+	conversation, ok := cfg.conversationFromURL(w, r)
+	if !ok {
+		return
+	}
+	params := requestBody{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	errs := validation.Errors{}
+	body := validation.Text(&errs, "body", params.Body, maxMessageLength)
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	principal, _ := auth.PrincipalFrom(r.Context())
+	message, err := cfg.db.SendMessage(conversation.ID, principal.UserID, body, time.Now())
+	if err != nil {
+		respondWithConversationError(w, err, "couldn't send message")
+		return
+	}
+	// the sender has read their own message
+	if conversation.ReadUpTo == nil {
+		conversation.ReadUpTo = map[int]int{}
+	}
+	conversation.ReadUpTo[principal.UserID] = message.ID
+	respondWithJSON(w, 201, newMessageResponse(conversation, message))
+}
+
+// conversationReadHandler marks the conversation read up to
+// {"message_id": n}, or up to the latest message without a body
+func (cfg *apiConfig) conversationReadHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		MessageID int `json:"message_id"`
+	}
+
+	conversation, ok := cfg.conversationFromURL(w, r)
+	if !ok {
+		return
+	}
+	params := requestBody{}
+	// the message id is optional, so an empty body is fine
+	json.NewDecoder(r.Body).Decode(&params)
+
+	principal, _ := auth.PrincipalFrom(r.Context())
+	conversation, err := cfg.db.MarkConversationRead(conversation.ID, principal.UserID, params.MessageID)
+	if err != nil {
+		respondWithConversationError(w, err, "couldn't mark conversation read")
+		return
+	}
+	cfg.respondWithConversation(w, 200, conversation, principal.UserID)
+}
+
+// userDMPolicyHandler takes {"dm_policy": "everyone"} or
+// {"dm_policy": "following"} to only take new conversations from people
+// the requester follows
+func (cfg *apiConfig) userDMPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		DMPolicy string `json:"dm_policy"`
+	}
+
+	params := requestBody{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	if params.DMPolicy != database.DMEveryone && params.DMPolicy != database.DMFollowing {
+		errs := validation.Errors{}
+		errs.Add("dm_policy", validation.CodeInvalid, "dm_policy must be everyone or following")
+		respondWithValidationErrors(w, errs)
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	user, err := cfg.db.SetDMPolicy(principal.UserID, params.DMPolicy)
+	if err != nil {
+		log.Printf("error setting dm policy: %s", err)
+		respondWithError(w, 500, "couldn't update user")
+		return
+	}
+	respondWithJSON(w, 200, struct {
+		ID       int    `json:"id"`
+		DMPolicy string `json:"dm_policy"`
+	}{
+		ID:       user.ID,
+		DMPolicy: params.DMPolicy,
+	})
+}
+
+func conversationsRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(auth.RequireScope(auth.ScopeMessagesRead))
+		r.Get("/", cfg.conversationsGetHandler)
+		r.Get("/{id}", cfg.conversationGetHandler)
+		r.Get("/{id}/messages", cfg.messagesGetHandler)
+		r.Post("/{id}/read", cfg.conversationReadHandler)
+	})
+	r.Group(func(r chi.Router) {
+		r.Use(auth.RequireScope(auth.ScopeMessagesWrite))
+		r.Post("/", cfg.conversationCreateHandler)
+		r.Post("/{id}/messages", cfg.messageCreateHandler)
+	})
+	return r
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+)
+
+const (
+	defaultFeedLimit = 50
+	maxFeedLimit     = 100
+)
+
+// feedPage is a page of a feed, newest first. ?limit= sets the page size
+// and ?before= is the id of the last chirp (or message) on the previous
+// page
+type feedPage struct {
+	limit  int
+	before int
+}
+
+func parseFeedPage(r *http.Request) (feedPage, error) {
+	page := feedPage{limit: defaultFeedLimit}
+	query := r.URL.Query()
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxFeedLimit {
+			return feedPage{}, fmt.Errorf("limit must be between 1 and %d", maxFeedLimit)
+		}
+		page.limit = n
+	}
+	if before := query.Get("before"); before != "" {
+		n, err := strconv.Atoi(before)
+		if err != nil || n < 1 {
+			return feedPage{}, fmt.Errorf("invalid before")
+		}
+		page.before = n
+	}
+	return page, nil
+}
+
+// respondWithFeed filters chirps down to what the requester should see,
+// then writes one page of them. Every feed goes through here so they all
+// page and filter the same way:
+//   - drafts, scheduled chirps and chirps held by moderation are left out
+//   - chirps by users the requester blocked or muted, or who blocked the
+//     requester, are left out
+//
+// When there are more chirps a Link header points at the next page
+func (cfg *apiConfig) respondWithFeed(w http.ResponseWriter, r *http.Request, chirps []database.Chirp) {
+	page, err := parseFeedPage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	hidden, err := cfg.db.HiddenAuthors(principal.UserID)
+	if err != nil {
+		log.Printf("error loading blocks: %s", err)
+		respondWithError(w, 500, "couldn't load chirps")
+		return
+	}
+
+	visible := []database.Chirp{}
+	for _, chirp := range chirps {
+		if !chirp.Published() || !chirpVisible(r, chirp) {
+			continue
+		}
+		if _, ok := hidden[chirp.AuthorID]; ok {
+			continue
+		}
+		if page.before != 0 && chirp.ID >= page.before {
+			continue
+		}
+		visible = append(visible, chirp)
+	}
+	sort.Slice(visible, func(i, j int) bool {
+		return visible[i].ID > visible[j].ID
+	})
+
+	if len(visible) > page.limit {
+		visible = visible[:page.limit]
+		setNextPageLink(w, r, page, visible[len(visible)-1].ID)
+	}
+	cfg.respondWithChirps(w, r, 200, visible)
+}
+
+// setNextPageLink points the Link header at the page after the one ending
+// with lastID
+func setNextPageLink(w http.ResponseWriter, r *http.Request, page feedPage, lastID int) {
+	next := url.Values{}
+	for k, v := range r.URL.Query() {
+		next[k] = v
+	}
+	next.Set("limit", strconv.Itoa(page.limit))
+	next.Set("before", strconv.Itoa(lastID))
+	w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, r.URL.Path, next.Encode()))
+}
@@ -9,5 +9,11 @@ require (
 
 require (
 	github.com/golang-jwt/jwt/v5 v5.2.0
+	github.com/gorilla/websocket v1.5.3
 	github.com/joho/godotenv v1.5.1
+	github.com/rivo/uniseg v0.4.7
+	golang.org/x/image v0.14.0
+	golang.org/x/net v0.20.0
+	golang.org/x/text v0.14.0
+	golang.org/x/time v0.5.0
 )
@@ -0,0 +1,211 @@
+// Package activitypub is the ActivityPub vocabulary chirpy federates with,
+// along with HTTP Signatures and the worker that delivers activities to
+// other servers.
+package activitypub
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	// ContentType is what ActivityPub documents are served as
+	ContentType = "application/activity+json"
+	// LDContentType is the other content type servers ask for
+	LDContentType = `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
+
+	ActivityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	SecurityContext        = "https://w3id.org/security/v1"
+	// Public addresses an object to everyone
+	Public = "https://www.w3.org/ns/activitystreams#Public"
+)
+
+// object and activity types chirpy sends or understands
+const (
+	TypePerson = "Person"
+	TypeNote   = "Note"
+
+	TypeAccept = "Accept"
+	TypeCreate = "Create"
+	TypeFollow = "Follow"
+	TypeLike   = "Like"
+	TypeUndo   = "Undo"
+
+	TypeOrderedCollection     = "OrderedCollection"
+	TypeOrderedCollectionPage = "OrderedCollectionPage"
+
+	TypeMention = "Mention"
+	TypeHashtag = "Hashtag"
+)
+
+// ErrNoObjectID is returned when an activity's object has no id
+var ErrNoObjectID = errors.New("activity object has no id")
+
+// PublicKey is the key an actor signs its requests with
+type PublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+// Endpoints are an actor's server wide endpoints
+type Endpoints struct {
+	// SharedInbox takes activities for every actor on the server, so one
+	// delivery reaches all of them
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+// Actor is a user as other servers see them
+type Actor struct {
+	Context           any        `json:"@context,omitempty"`
+	ID                string     `json:"id"`
+	Type              string     `json:"type"`
+	PreferredUsername string     `json:"preferredUsername"`
+	Name              string     `json:"name,omitempty"`
+	URL               string     `json:"url,omitempty"`
+	Inbox             string     `json:"inbox"`
+	Outbox            string     `json:"outbox,omitempty"`
+	Followers         string     `json:"followers,omitempty"`
+	Endpoints         *Endpoints `json:"endpoints,omitempty"`
+	PublicKey         PublicKey  `json:"publicKey"`
+}
+
+// Tag is a mention or hashtag in a note
+type Tag struct {
+	Type string `json:"type"`
+	Href string `json:"href,omitempty"`
+	Name string `json:"name"`
+}
+
+// Attachment is a file attached to a note
+type Attachment struct {
+	Type      string `json:"type"`
+	MediaType string `json:"mediaType,omitempty"`
+	URL       string `json:"url"`
+}
+
+// Note is a chirp, or a post from another server
+type Note struct {
+	Context      any    `json:"@context,omitempty"`
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	AttributedTo string `json:"attributedTo"`
+	// Content is HTML
+	Content    string       `json:"content"`
+	URL        string       `json:"url,omitempty"`
+	InReplyTo  string       `json:"inReplyTo,omitempty"`
+	Published  time.Time    `json:"published"`
+	Updated    *time.Time   `json:"updated,omitempty"`
+	To         []string     `json:"to,omitempty"`
+	Cc         []string     `json:"cc,omitempty"`
+	Tag        []Tag        `json:"tag,omitempty"`
+	Attachment []Attachment `json:"attachment,omitempty"`
+}
+
+// Activity is something an actor did to an object. Object is either the
+// object's id or the object itself, see ObjectID and DecodeObject
+type Activity struct {
+	Context   any             `json:"@context,omitempty"`
+	ID        string          `json:"id"`
+	Type      string          `json:"type"`
+	Actor     string          `json:"actor"`
+	Object    json.RawMessage `json:"object"`
+	Published *time.Time      `json:"published,omitempty"`
+	To        []string        `json:"to,omitempty"`
+	Cc        []string        `json:"cc,omitempty"`
+}
+
+// NewActivity builds an activity of type typ by actor on object, which can
+// be an id or a whole object
+func NewActivity(id, typ, actor string, object any) (Activity, error) {
+	data, err := json.Marshal(object)
+	if err != nil {
+		return Activity{}, err
+	}
+	return Activity{
+		Context: ActivityStreamsContext,
+		ID:      id,
+		Type:    typ,
+		Actor:   actor,
+		Object:  data,
+	}, nil
+}
+
+// ObjectID is the id of the activity's object, whether it's embedded or
+// only referred to
+func (a Activity) ObjectID() (string, error) {
+	var id string
+	if json.Unmarshal(a.Object, &id) == nil {
+		if id == "" {
+			return "", ErrNoObjectID
+		}
+		return id, nil
+	}
+	var object struct {
+		ID string `json:"id"`
+	}
+	err := json.Unmarshal(a.Object, &object)
+	if err != nil {
+		return "", err
+	}
+	if object.ID == "" {
+		return "", ErrNoObjectID
+	}
+	return object.ID, nil
+}
+
+// ObjectType is the type of the activity's object, empty when the object
+// isn't embedded
+func (a Activity) ObjectType() string {
+	var object struct {
+		Type string `json:"type"`
+	}
+	if json.Unmarshal(a.Object, &object) != nil {
+		return ""
+	}
+	return object.Type
+}
+
+// DecodeObject decodes the activity's embedded object into v
+func (a Activity) DecodeObject(v any) error {
+	return json.Unmarshal(a.Object, v)
+}
+
+// OrderedCollection is a list like an outbox or followers. Small ones have
+// their items inline, others link to their first page
+type OrderedCollection struct {
+	Context      any    `json:"@context,omitempty"`
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	TotalItems   int    `json:"totalItems"`
+	First        string `json:"first,omitempty"`
+	OrderedItems []any  `json:"orderedItems,omitempty"`
+}
+
+// OrderedCollectionPage is one page of an OrderedCollection
+type OrderedCollectionPage struct {
+	Context      any    `json:"@context,omitempty"`
+	ID           string `json:"id"`
+	Type         string `json:"type"`
+	PartOf       string `json:"partOf"`
+	Next         string `json:"next,omitempty"`
+	OrderedItems []any  `json:"orderedItems"`
+}
+
+// WebFingerContentType is what WebFinger documents are served as
+const WebFingerContentType = "application/jrd+json"
+
+// WebFinger is the document /.well-known/webfinger serves for an account
+type WebFinger struct {
+	Subject string          `json:"subject"`
+	Aliases []string        `json:"aliases,omitempty"`
+	Links   []WebFingerLink `json:"links"`
+}
+
+// WebFingerLink points from an account to one of its documents
+type WebFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href"`
+}
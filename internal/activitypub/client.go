@@ -0,0 +1,109 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/staf3333/chirpy/internal/preview"
+)
+
+// maxDocumentBytes caps what's read from another server
+const maxDocumentBytes = 1 << 20
+
+// maxResponseBytes is how much of an inbox's response is kept when a
+// delivery fails
+const maxResponseBytes = 512
+
+const userAgent = "ChirpyBot/1.0 (activitypub)"
+
+// ErrInvalidActor is returned when a fetched actor can't be used
+var ErrInvalidActor = errors.New("invalid actor")
+
+// Client talks to other servers. Their URLs come from whoever sends us
+// activities, so it won't connect to private addresses
+type Client struct {
+	http *http.Client
+}
+
+// NewClient creates a client giving up on requests after timeout.
+// allowPrivate is only meant for development
+func NewClient(timeout time.Duration, allowPrivate bool) *Client {
+	return &Client{
+		http: &http.Client{
+			Transport: preview.NewTransport(timeout, allowPrivate),
+			Timeout:   timeout,
+			// ids have to be where they say they are, and inboxes are
+			// published with their real URL
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// FetchActor fetches the actor document at id
+func (c *Client) FetchActor(ctx context.Context, id string) (Actor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, id, nil)
+	if err != nil {
+		return Actor{}, err
+	}
+	req.Header.Set("Accept", ContentType+", "+LDContentType)
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return Actor{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Actor{}, fmt.Errorf("fetching %s: %s", id, resp.Status)
+	}
+	actor := Actor{}
+	err = json.NewDecoder(io.LimitReader(resp.Body, maxDocumentBytes)).Decode(&actor)
+	if err != nil {
+		return Actor{}, fmt.Errorf("%w: %s", ErrInvalidActor, err)
+	}
+	// an actor served from one URL can't claim to be someone else
+	if actor.ID != id {
+		return Actor{}, fmt.Errorf("%w: %s has id %s", ErrInvalidActor, id, actor.ID)
+	}
+	if actor.Inbox == "" || actor.PublicKey.PublicKeyPem == "" || actor.PublicKey.Owner != actor.ID {
+		return Actor{}, fmt.Errorf("%w: %s has no inbox or key", ErrInvalidActor, id)
+	}
+	return actor, nil
+}
+
+// Post sends body, an activity, to inbox signed with key
+func (c *Client) Post(ctx context.Context, inbox, keyID string, key *rsa.PrivateKey, body []byte) (attempt Attempt) {
+	attempt.At = time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", ContentType)
+	req.Header.Set("User-Agent", userAgent)
+	err = SignRequest(req, keyID, key, body, attempt.At)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if !attempt.Succeeded() {
+		response, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+		attempt.Error = fmt.Sprintf("%s: %s", resp.Status, response)
+	}
+	return attempt
+}
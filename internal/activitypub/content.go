@@ -0,0 +1,60 @@
+package activitypub
+
+import (
+	"html"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// maxPlainTextLength caps the text kept from a remote post
+const maxPlainTextLength = 5000
+
+// HTMLContent turns a chirp's text into a note's content, a paragraph with
+// its line breaks kept
+func HTMLContent(text string) string {
+	escaped := html.EscapeString(text)
+	return "<p>" + strings.ReplaceAll(escaped, "\n", "<br>") + "</p>"
+}
+
+// PlainText turns a remote note's HTML content into text, so it's never
+// served back as markup. Paragraphs and line breaks become newlines,
+// scripts and styles are dropped
+func PlainText(content string) string {
+	var b strings.Builder
+	z := xhtml.NewTokenizer(strings.NewReader(content))
+	skipping := ""
+	for {
+		tt := z.Next()
+		switch tt {
+		case xhtml.ErrorToken:
+			text := strings.TrimSpace(b.String())
+			runes := []rune(text)
+			if len(runes) > maxPlainTextLength {
+				text = string(runes[:maxPlainTextLength])
+			}
+			return text
+		case xhtml.TextToken:
+			if skipping == "" {
+				b.Write(z.Text())
+			}
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken, xhtml.EndTagToken:
+			tagName, _ := z.TagName()
+			name := string(tagName)
+			switch name {
+			case "script", "style":
+				if tt == xhtml.StartTagToken {
+					skipping = name
+				} else if tt == xhtml.EndTagToken && name == skipping {
+					skipping = ""
+				}
+			case "br":
+				b.WriteString("\n")
+			case "p":
+				if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n\n") {
+					b.WriteString("\n\n")
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package activitypub
+
+import (
+	"context"
+	"crypto/rsa"
+	"log"
+	"sync"
+	"time"
+)
+
+// Delivery is one activity to send to one inbox, signed by the local actor
+// KeyID belongs to. Attempts is how many times it's been tried before
+type Delivery struct {
+	ID       int
+	Inbox    string
+	KeyID    string
+	Key      *rsa.PrivateKey
+	Body     []byte
+	Attempts int
+}
+
+// Attempt is how one try at a delivery went
+type Attempt struct {
+	At time.Time
+	// StatusCode is 0 when the inbox couldn't be reached
+	StatusCode int
+	Error      string
+}
+
+// Succeeded reports whether the inbox took the activity
+func (a Attempt) Succeeded() bool {
+	return a.StatusCode >= 200 && a.StatusCode <= 299
+}
+
+// Retryable reports whether a failed attempt is worth trying again. Most
+// 4xx responses won't change, but 401s can be the other server failing
+// to fetch our key
+func (a Attempt) Retryable() bool {
+	switch {
+	case a.StatusCode == 0 || a.StatusCode >= 500:
+		return true
+	case a.StatusCode == 401 || a.StatusCode == 408 || a.StatusCode == 429:
+		return true
+	}
+	return false
+}
+
+// Store is the delivery queue
+type Store interface {
+	// ClaimDeliveries returns up to limit deliveries due at now and holds
+	// them until leaseUntil, so they're only sent once unless the sender
+	// dies
+	ClaimDeliveries(now, leaseUntil time.Time, limit int) ([]Delivery, error)
+	// RecordAttempt saves attempt, retryAt is when to try again or zero
+	// when the delivery is done
+	RecordAttempt(deliveryID int, attempt Attempt, retryAt time.Time) error
+}
+
+// Options configures a Deliverer
+type Options struct {
+	// Interval is how often the queue is checked for due deliveries
+	Interval time.Duration
+	// Timeout covers one request to another server, deliveries and actor
+	// fetches alike
+	Timeout   time.Duration
+	Workers   int
+	BatchSize int
+	// a failed delivery is retried after BaseBackoff, doubling each time
+	// up to MaxBackoff, until it's been tried MaxAttempts times
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// AllowPrivate lets us federate with servers on private addresses,
+	// it's only meant for development
+	AllowPrivate bool
+}
+
+// DefaultOptions retry for about two days, servers go down for a while
+var DefaultOptions = Options{
+	Interval:    5 * time.Second,
+	Timeout:     10 * time.Second,
+	Workers:     4,
+	BatchSize:   50,
+	MaxAttempts: 10,
+	BaseBackoff: time.Minute,
+	MaxBackoff:  12 * time.Hour,
+}
+
+// Backoff is how long to wait after a delivery has failed attempts times
+func (o Options) Backoff(attempts int) time.Duration {
+	backoff := o.BaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= o.MaxBackoff {
+			return o.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+// Deliverer sends queued activities to other servers in the background
+// once Start has been called
+type Deliverer struct {
+	store  Store
+	client *Client
+	opts   Options
+
+	wake     chan struct{}
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewDeliverer creates a deliverer sending the deliveries queued in store
+// with client
+func NewDeliverer(store Store, client *Client, opts Options) *Deliverer {
+	return &Deliverer{
+		store:  store,
+		client: client,
+		opts:   opts,
+		wake:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// Start runs the deliverer in a background goroutine until Stop is called
+func (d *Deliverer) Start() {
+	go d.run()
+}
+
+// Stop signals the deliverer to exit and waits for in-flight deliveries.
+// Anything still queued is sent after the next Start
+func (d *Deliverer) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	<-d.done
+}
+
+// Wake tells the deliverer there's something new in the queue, so it goes
+// out without waiting for the next check
+func (d *Deliverer) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Deliverer) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		d.drain()
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// drain sends due deliveries in batches until there are none left
+func (d *Deliverer) drain() {
+	for {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		now := time.Now()
+		// held until the whole batch has surely been tried, so if we die
+		// part way through the rest go out after a restart
+		leaseUntil := now.Add(d.opts.Timeout * time.Duration(d.opts.BatchSize/d.opts.Workers+1))
+		deliveries, err := d.store.ClaimDeliveries(now, leaseUntil, d.opts.BatchSize)
+		if err != nil {
+			log.Printf("activitypub: error claiming deliveries: %s", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+		d.sendAll(deliveries)
+		if len(deliveries) < d.opts.BatchSize {
+			return
+		}
+	}
+}
+
+func (d *Deliverer) sendAll(deliveries []Delivery) {
+	sem := make(chan struct{}, d.opts.Workers)
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(delivery Delivery) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+			defer cancel()
+			attempt := d.client.Post(ctx, delivery.Inbox, delivery.KeyID, delivery.Key, delivery.Body)
+			var retryAt time.Time
+			attempts := delivery.Attempts + 1
+			if !attempt.Succeeded() {
+				if attempt.Retryable() && attempts < d.opts.MaxAttempts {
+					retryAt = attempt.At.Add(d.opts.Backoff(attempts))
+				} else {
+					log.Printf("activitypub: giving up on delivery %d to %s: %s", delivery.ID, delivery.Inbox, attempt.Error)
+				}
+			}
+			err := d.store.RecordAttempt(delivery.ID, attempt, retryAt)
+			if err != nil {
+				log.Printf("activitypub: error recording delivery %d: %s", delivery.ID, err)
+			}
+		}(delivery)
+	}
+	wg.Wait()
+}
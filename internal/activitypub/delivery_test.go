@@ -0,0 +1,226 @@
+package activitypub
+
+import (
+	"crypto/rsa"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memoryStore is a delivery queue kept in memory
+type memoryStore struct {
+	mu         sync.Mutex
+	deliveries map[int]*queuedDelivery
+	attempts   chan recordedAttempt
+}
+
+type queuedDelivery struct {
+	Delivery
+	nextAt     time.Time
+	leaseUntil time.Time
+	done       bool
+}
+
+type recordedAttempt struct {
+	deliveryID int
+	attempt    Attempt
+	retryAt    time.Time
+}
+
+func newMemoryStore(deliveries ...Delivery) *memoryStore {
+	s := &memoryStore{
+		deliveries: map[int]*queuedDelivery{},
+		attempts:   make(chan recordedAttempt, 100),
+	}
+	for _, d := range deliveries {
+		s.deliveries[d.ID] = &queuedDelivery{Delivery: d}
+	}
+	return s
+}
+
+func (s *memoryStore) ClaimDeliveries(now, leaseUntil time.Time, limit int) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	claimed := []Delivery{}
+	for _, d := range s.deliveries {
+		if d.done || now.Before(d.nextAt) || now.Before(d.leaseUntil) || len(claimed) == limit {
+			continue
+		}
+		d.leaseUntil = leaseUntil
+		claimed = append(claimed, d.Delivery)
+	}
+	return claimed, nil
+}
+
+func (s *memoryStore) RecordAttempt(deliveryID int, attempt Attempt, retryAt time.Time) error {
+	s.mu.Lock()
+	d := s.deliveries[deliveryID]
+	d.Attempts++
+	d.leaseUntil = time.Time{}
+	d.nextAt = retryAt
+	d.done = retryAt.IsZero()
+	s.mu.Unlock()
+	s.attempts <- recordedAttempt{deliveryID: deliveryID, attempt: attempt, retryAt: retryAt}
+	return nil
+}
+
+// nextAttempt waits for the deliverer to record an attempt
+func (s *memoryStore) nextAttempt(t *testing.T) recordedAttempt {
+	t.Helper()
+	select {
+	case a := <-s.attempts:
+		return a
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a delivery attempt")
+		return recordedAttempt{}
+	}
+}
+
+func testDeliveryOptions() Options {
+	opts := DefaultOptions
+	opts.Interval = 10 * time.Millisecond
+	opts.Timeout = time.Second
+	opts.BaseBackoff = 10 * time.Millisecond
+	opts.MaxBackoff = 50 * time.Millisecond
+	opts.AllowPrivate = true
+	return opts
+}
+
+func startDeliverer(t *testing.T, store Store, opts Options) {
+	t.Helper()
+	d := NewDeliverer(store, NewClient(opts.Timeout, opts.AllowPrivate), opts)
+	d.Start()
+	t.Cleanup(d.Stop)
+}
+
+func testDelivery(key *rsa.PrivateKey, inbox string) Delivery {
+	return Delivery{
+		ID:    1,
+		Inbox: inbox,
+		KeyID: testKeyID,
+		Key:   key,
+		Body:  []byte(`{"type":"Create"}`),
+	}
+}
+
+func TestDelivererRetriesFailingInbox(t *testing.T) {
+	key := testKey(t, 0)
+	var requests atomic.Int32
+	inbox := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// down for the first two tries
+		if requests.Add(1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, err := VerifyRequest(r, body, time.Now(), lookupKey(key))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer inbox.Close()
+
+	store := newMemoryStore(testDelivery(key, inbox.URL))
+	startDeliverer(t, store, testDeliveryOptions())
+
+	for i := 0; i < 2; i++ {
+		a := store.nextAttempt(t)
+		if a.attempt.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("attempt %d: status %d, want 503", i+1, a.attempt.StatusCode)
+		}
+		if a.retryAt.IsZero() {
+			t.Fatalf("attempt %d wasn't scheduled for a retry", i+1)
+		}
+	}
+	a := store.nextAttempt(t)
+	if !a.attempt.Succeeded() {
+		t.Fatalf("third attempt failed: %d %s", a.attempt.StatusCode, a.attempt.Error)
+	}
+	if !a.retryAt.IsZero() {
+		t.Error("a delivered activity was scheduled for a retry")
+	}
+}
+
+func TestDelivererGivesUp(t *testing.T) {
+	key := testKey(t, 0)
+	var requests atomic.Int32
+	inbox := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer inbox.Close()
+
+	opts := testDeliveryOptions()
+	opts.MaxAttempts = 3
+	store := newMemoryStore(testDelivery(key, inbox.URL))
+	startDeliverer(t, store, opts)
+
+	for i := 1; i <= opts.MaxAttempts; i++ {
+		a := store.nextAttempt(t)
+		if i < opts.MaxAttempts && a.retryAt.IsZero() {
+			t.Fatalf("attempt %d wasn't scheduled for a retry", i)
+		}
+		if i == opts.MaxAttempts && !a.retryAt.IsZero() {
+			t.Fatalf("attempt %d was retried past MaxAttempts", i)
+		}
+	}
+	// give a stray retry the chance to show up
+	time.Sleep(5 * opts.MaxBackoff)
+	if got := requests.Load(); got != int32(opts.MaxAttempts) {
+		t.Errorf("inbox got %d requests, want %d", got, opts.MaxAttempts)
+	}
+}
+
+func TestDelivererDoesNotRetryRejections(t *testing.T) {
+	key := testKey(t, 0)
+	inbox := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no thanks", http.StatusForbidden)
+	}))
+	defer inbox.Close()
+
+	store := newMemoryStore(testDelivery(key, inbox.URL))
+	startDeliverer(t, store, testDeliveryOptions())
+
+	a := store.nextAttempt(t)
+	if a.attempt.StatusCode != http.StatusForbidden {
+		t.Fatalf("status %d, want 403", a.attempt.StatusCode)
+	}
+	if !a.retryAt.IsZero() {
+		t.Error("a 403 was scheduled for a retry")
+	}
+}
+
+func TestDelivererRetriesUnreachableInbox(t *testing.T) {
+	key := testKey(t, 0)
+	inbox := httptest.NewServer(http.NotFoundHandler())
+	url := inbox.URL
+	// nothing is listening anymore
+	inbox.Close()
+
+	store := newMemoryStore(testDelivery(key, url))
+	startDeliverer(t, store, testDeliveryOptions())
+
+	a := store.nextAttempt(t)
+	if a.attempt.StatusCode != 0 || a.attempt.Error == "" {
+		t.Fatalf("got status %d and error %q, want a connection error", a.attempt.StatusCode, a.attempt.Error)
+	}
+	if a.retryAt.IsZero() {
+		t.Error("an unreachable inbox wasn't scheduled for a retry")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	opts := Options{BaseBackoff: time.Minute, MaxBackoff: 10 * time.Minute}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute}
+	for i, w := range want {
+		if got := opts.Backoff(i + 1); got != w {
+			t.Errorf("Backoff(%d) = %s, want %s", i+1, got, w)
+		}
+	}
+}
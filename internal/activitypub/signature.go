@@ -0,0 +1,247 @@
+package activitypub
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MaxClockSkew is how far a signed request's Date can be from our clock,
+// older requests could be replays
+const MaxClockSkew = time.Hour
+
+var (
+	ErrNoSignature  = errors.New("request isn't signed")
+	ErrBadSignature = errors.New("invalid signature")
+)
+
+// GenerateKey makes the key pair an actor signs with, every server
+// understands RSA
+func GenerateKey() (*rsa.PrivateKey, error) {
+	return rsa.GenerateKey(rand.Reader, 2048)
+}
+
+// EncodePrivateKey writes key as a PKCS8 PEM block
+func EncodePrivateKey(key *rsa.PrivateKey) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// ParsePrivateKey reads a key written by EncodePrivateKey
+func ParsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// EncodePublicKey writes pub the way actors publish it, as a PKIX PEM
+// block
+func EncodePublicKey(pub *rsa.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
+
+// ParsePublicKey reads an actor's publicKeyPem, some servers publish
+// PKCS1 keys rather than PKIX ones
+func ParsePublicKey(data string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if block.Type == "RSA PUBLIC KEY" {
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Digest is the Digest header for body
+func Digest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// SignRequest signs req with key (draft-cavage HTTP Signatures with
+// rsa-sha256, which is what the fediverse speaks). keyID is the URL of the
+// actor's public key. The signature covers the request line, host and date
+// and, when there's a body, its digest
+func SignRequest(req *http.Request, keyID string, key *rsa.PrivateKey, body []byte, now time.Time) error {
+	req.Header.Set("Date", now.UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		req.Header.Set("Digest", Digest(body))
+		headers = append(headers, "digest")
+	}
+	signed, err := signingString(req, headers)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+// VerifyRequest checks req's signature and returns the id of the key that
+// made it. body is req's body, which the caller has already read.
+// publicKey looks the key up, usually by fetching the actor it belongs to.
+// Signatures have to cover the request line, host and date, plus the
+// digest when there's a body, or they could be replayed against another
+// URL or with another body
+func VerifyRequest(req *http.Request, body []byte, now time.Time, publicKey func(keyID string) (*rsa.PublicKey, error)) (string, error) {
+	header := req.Header.Get("Signature")
+	if header == "" {
+		return "", ErrNoSignature
+	}
+	params := parseSignatureHeader(header)
+	keyID := params["keyId"]
+	signature, err := base64.StdEncoding.DecodeString(params["signature"])
+	if keyID == "" || err != nil || len(signature) == 0 {
+		return "", fmt.Errorf("%w: malformed Signature header", ErrBadSignature)
+	}
+	switch params["algorithm"] {
+	// hs2019 means "look at the key", ours are all RSA
+	case "", "rsa-sha256", "hs2019":
+	default:
+		return "", fmt.Errorf("%w: unsupported algorithm %q", ErrBadSignature, params["algorithm"])
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	required := []string{"(request-target)", "host", "date"}
+	if len(body) > 0 {
+		required = append(required, "digest")
+	}
+	for _, name := range required {
+		if !contains(headers, name) {
+			return "", fmt.Errorf("%w: %s isn't signed", ErrBadSignature, name)
+		}
+	}
+	date, err := http.ParseTime(req.Header.Get("Date"))
+	if err != nil {
+		return "", fmt.Errorf("%w: bad Date header", ErrBadSignature)
+	}
+	if date.Before(now.Add(-MaxClockSkew)) || date.After(now.Add(MaxClockSkew)) {
+		return "", fmt.Errorf("%w: Date is too far from now", ErrBadSignature)
+	}
+	if len(body) > 0 && !digestMatches(req.Header.Get("Digest"), body) {
+		return "", fmt.Errorf("%w: Digest doesn't match the body", ErrBadSignature)
+	}
+	signed, err := signingString(req, headers)
+	if err != nil {
+		return "", err
+	}
+	pub, err := publicKey(keyID)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(signed))
+	err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, hash[:], signature)
+	if err != nil {
+		return "", ErrBadSignature
+	}
+	return keyID, nil
+}
+
+// signingString is what gets signed, one "name: value" line per header
+func signingString(req *http.Request, headers []string) (string, error) {
+	lines := []string{}
+	for _, name := range headers {
+		switch name {
+		case "(request-target)":
+			lines = append(lines, name+": "+strings.ToLower(req.Method)+" "+req.URL.RequestURI())
+		case "host":
+			// outgoing requests only have the URL's host
+			host := req.Host
+			if host == "" {
+				host = req.URL.Host
+			}
+			lines = append(lines, name+": "+host)
+		default:
+			values := req.Header.Values(name)
+			if len(values) == 0 {
+				return "", fmt.Errorf("%w: %s header is missing", ErrBadSignature, name)
+			}
+			lines = append(lines, name+": "+strings.Join(values, ", "))
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// parseSignatureHeader splits `keyId="...",signature="..."` into its
+// parameters
+func parseSignatureHeader(header string) map[string]string {
+	params := map[string]string{}
+	for header != "" {
+		var name, value string
+		name, header, _ = strings.Cut(header, "=")
+		name = strings.TrimSpace(name)
+		if strings.HasPrefix(header, `"`) {
+			value, header, _ = strings.Cut(header[1:], `"`)
+			_, header, _ = strings.Cut(header, ",")
+		} else {
+			value, header, _ = strings.Cut(header, ",")
+		}
+		params[name] = value
+	}
+	return params
+}
+
+// digestMatches reports whether header, which can list several digests,
+// has body's SHA-256
+func digestMatches(header string, body []byte) bool {
+	want := Digest(body)
+	for _, digest := range strings.Split(header, ",") {
+		algorithm, value, _ := strings.Cut(strings.TrimSpace(digest), "=")
+		if strings.EqualFold(algorithm, "SHA-256") && "SHA-256="+value == want {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
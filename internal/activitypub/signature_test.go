@@ -0,0 +1,181 @@
+package activitypub
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKeys    [2]*rsa.PrivateKey
+)
+
+// testKey returns one of two keys shared by the tests, RSA keys are slow
+// to generate
+func testKey(t *testing.T, i int) *rsa.PrivateKey {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		for n := range testKeys {
+			key, err := GenerateKey()
+			if err != nil {
+				t.Fatalf("GenerateKey: %s", err)
+			}
+			testKeys[n] = key
+		}
+	})
+	return testKeys[i]
+}
+
+const testKeyID = "https://remote.example/users/bob#main-key"
+
+// signedRequest is an inbox request as it arrives, signed at signedAt
+func signedRequest(t *testing.T, key *rsa.PrivateKey, body []byte, signedAt time.Time) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "https://chirpy.example/users/1/inbox", bytes.NewReader(body))
+	err := SignRequest(req, testKeyID, key, body, signedAt)
+	if err != nil {
+		t.Fatalf("SignRequest: %s", err)
+	}
+	return req
+}
+
+func lookupKey(key *rsa.PrivateKey) func(string) (*rsa.PublicKey, error) {
+	return func(keyID string) (*rsa.PublicKey, error) {
+		if keyID != testKeyID {
+			return nil, errors.New("unknown key")
+		}
+		return &key.PublicKey, nil
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	key := testKey(t, 0)
+	body := []byte(`{"type":"Follow"}`)
+	now := time.Now()
+
+	keyID, err := VerifyRequest(signedRequest(t, key, body, now), body, now, lookupKey(key))
+	if err != nil {
+		t.Fatalf("VerifyRequest: %s", err)
+	}
+	if keyID != testKeyID {
+		t.Errorf("keyID = %q, want %q", keyID, testKeyID)
+	}
+}
+
+func TestVerifyRequestRejects(t *testing.T) {
+	key := testKey(t, 0)
+	body := []byte(`{"type":"Follow"}`)
+	now := time.Now()
+
+	tests := []struct {
+		name string
+		req  func() *http.Request
+		// body is what the inbox read, it defaults to what was signed
+		body   []byte
+		lookup func(string) (*rsa.PublicKey, error)
+	}{
+		{
+			name: "unsigned",
+			req: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "https://chirpy.example/users/1/inbox", bytes.NewReader(body))
+			},
+		},
+		{
+			name:   "signed by another key",
+			req:    func() *http.Request { return signedRequest(t, testKey(t, 1), body, now) },
+			lookup: lookupKey(key),
+		},
+		{
+			name: "body doesn't match the digest",
+			req:  func() *http.Request { return signedRequest(t, key, body, now) },
+			body: []byte(`{"type":"Undo"}`),
+		},
+		{
+			name: "digest changed after signing",
+			req: func() *http.Request {
+				req := signedRequest(t, key, body, now)
+				req.Header.Set("Digest", Digest([]byte(`{"type":"Undo"}`)))
+				return req
+			},
+		},
+		{
+			name: "stale date",
+			req:  func() *http.Request { return signedRequest(t, key, body, now.Add(-2*MaxClockSkew)) },
+		},
+		{
+			name: "date from the future",
+			req:  func() *http.Request { return signedRequest(t, key, body, now.Add(2*MaxClockSkew)) },
+		},
+		{
+			name: "sent to another inbox",
+			req: func() *http.Request {
+				req := signedRequest(t, key, body, now)
+				req.URL.Path = "/users/2/inbox"
+				return req
+			},
+		},
+		{
+			name: "digest not signed",
+			req: func() *http.Request {
+				req := signedRequest(t, key, body, now)
+				// re-sign without a body so the digest is left out
+				err := SignRequest(req, testKeyID, key, nil, now)
+				if err != nil {
+					t.Fatalf("SignRequest: %s", err)
+				}
+				return req
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifyBody := body
+			if tt.body != nil {
+				verifyBody = tt.body
+			}
+			lookup := tt.lookup
+			if lookup == nil {
+				lookup = lookupKey(key)
+			}
+			_, err := VerifyRequest(tt.req(), verifyBody, now, lookup)
+			if err == nil {
+				t.Fatal("expected the request to be rejected")
+			}
+			if !errors.Is(err, ErrBadSignature) && !errors.Is(err, ErrNoSignature) {
+				t.Errorf("got %v, want ErrBadSignature or ErrNoSignature", err)
+			}
+		})
+	}
+}
+
+func TestKeyRoundTrip(t *testing.T) {
+	key := testKey(t, 0)
+	privatePEM, err := EncodePrivateKey(key)
+	if err != nil {
+		t.Fatalf("EncodePrivateKey: %s", err)
+	}
+	parsed, err := ParsePrivateKey(privatePEM)
+	if err != nil {
+		t.Fatalf("ParsePrivateKey: %s", err)
+	}
+	if !parsed.Equal(key) {
+		t.Error("private key changed in the round trip")
+	}
+	publicPEM, err := EncodePublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("EncodePublicKey: %s", err)
+	}
+	pub, err := ParsePublicKey(publicPEM)
+	if err != nil {
+		t.Fatalf("ParsePublicKey: %s", err)
+	}
+	if !pub.Equal(&key.PublicKey) {
+		t.Error("public key changed in the round trip")
+	}
+}
@@ -0,0 +1,135 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiKeyPrefix starts every API key so they're easy to spot in logs and
+// secret scanners
+const apiKeyPrefix = "chirpy_"
+
+// apiKeyTouchInterval is how stale last used metadata can get before we
+// write it again, so busy keys don't write to the db on every request
+const apiKeyTouchInterval = time.Minute
+
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+// APIKeyRecord is what the middleware needs to know about a stored key
+type APIKeyRecord struct {
+	UserID     int
+	Scopes     []string
+	Hash       []byte
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+	Revoked    bool
+}
+
+// APIKeyStore looks up API keys by id and records when they're used
+type APIKeyStore interface {
+	LookupAPIKey(id string) (APIKeyRecord, error)
+	TouchAPIKey(id string, usedAt time.Time, ip string) error
+}
+
+// NewAPIKey generates a key id and the full key handed to the user, along
+// with the hash of its secret that should be stored
+func NewAPIKey() (id string, key string, hash []byte) {
+	idBytes := make([]byte, 8)
+	rand.Read(idBytes)
+	secret := make([]byte, 32)
+	rand.Read(secret)
+
+	id = hex.EncodeToString(idBytes)
+	secretStr := base64.RawURLEncoding.EncodeToString(secret)
+	return id, apiKeyPrefix + id + "_" + secretStr, HashAPIKeySecret(secretStr)
+}
+
+// HashAPIKeySecret hashes an API key secret for storage
+func HashAPIKeySecret(secret string) []byte {
+	return HashSecret(secret)
+}
+
+// HashSecret hashes a server generated secret for storage. The secrets are
+// long and random so a fast hash is enough, unlike passwords
+func HashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// RandomToken returns n random bytes encoded for use in URLs
+func RandomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseAPIKey splits a key into its id and secret
+func ParseAPIKey(key string) (id string, secret string, err error) {
+	rest, ok := strings.CutPrefix(key, apiKeyPrefix)
+	if !ok {
+		return "", "", ErrInvalidAPIKey
+	}
+	id, secret, ok = strings.Cut(rest, "_")
+	if !ok || id == "" || secret == "" {
+		return "", "", ErrInvalidAPIKey
+	}
+	return id, secret, nil
+}
+
+// authenticateAPIKey checks a key against the store and returns the
+// principal it acts as and when the key was created
+func (a *Authenticator) authenticateAPIKey(r *http.Request, key string) (Principal, time.Time, error) {
+	if a.APIKeys == nil {
+		return Principal{}, time.Time{}, ErrInvalidAPIKey
+	}
+	id, secret, err := ParseAPIKey(key)
+	if err != nil {
+		return Principal{}, time.Time{}, err
+	}
+	record, err := a.APIKeys.LookupAPIKey(id)
+	if err != nil {
+		return Principal{}, time.Time{}, ErrInvalidAPIKey
+	}
+	if subtle.ConstantTimeCompare(record.Hash, HashAPIKeySecret(secret)) != 1 {
+		return Principal{}, time.Time{}, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if record.Revoked {
+		return Principal{}, time.Time{}, errors.New("api key has been revoked")
+	}
+	if !record.ExpiresAt.IsZero() && now.After(record.ExpiresAt) {
+		return Principal{}, time.Time{}, errors.New("api key has expired")
+	}
+
+	if now.Sub(record.LastUsedAt) > apiKeyTouchInterval {
+		err = a.APIKeys.TouchAPIKey(id, now, clientIP(r))
+		if err != nil {
+			// not worth failing the request over
+			log.Printf("error recording api key use: %s", err)
+		}
+	}
+
+	return Principal{
+		UserID:   record.UserID,
+		Scopes:   record.Scopes,
+		APIKeyID: id,
+	}, record.CreatedAt, nil
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,472 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// LegacyKeyID is the kid given to the old JWT_SECRET when it's imported, so
+// tokens signed before we had kids keep verifying
+const LegacyKeyID = "legacy"
+
+type KeyState string
+
+const (
+	// KeyActive signs new tokens (and verifies them)
+	KeyActive KeyState = "active"
+	// KeyVerifying only verifies tokens signed before the last rotation
+	KeyVerifying KeyState = "verifying"
+	// KeyRetired no longer signs or verifies anything
+	KeyRetired KeyState = "retired"
+)
+
+// Purpose is the type of token a key signs, each purpose has its own active
+// key and can use its own algorithm
+type Purpose string
+
+const (
+	PurposeAccess  Purpose = "access"
+	PurposeRefresh Purpose = "refresh"
+)
+
+// Key is a single signing key in the keyring. HMAC keys keep their secret
+// in Secret, asymmetric keys keep a PKCS8 PEM encoded private key
+type Key struct {
+	ID         string    `json:"kid"`
+	Algorithm  string    `json:"alg"`
+	Purpose    Purpose   `json:"purpose,omitempty"`
+	Secret     []byte    `json:"secret,omitempty"`
+	PrivateKey string    `json:"private_key,omitempty"`
+	State      KeyState  `json:"state"`
+	CreatedAt  time.Time `json:"created_at"`
+	RotatedAt  time.Time `json:"rotated_at,omitempty"`
+	// External keys come from a PEM file the operator manages, so we never
+	// rotate them ourselves
+	External bool `json:"external,omitempty"`
+
+	signer crypto.Signer
+}
+
+// KeyConfig is how tokens of one purpose should be signed
+type KeyConfig struct {
+	// Algorithm is one of HS256 (the default), RS256, ES256 or EdDSA
+	Algorithm string
+	// PEMFile optionally points at a private key to sign with instead of
+	// generating one
+	PEMFile string
+}
+
+// KeyringConfig configures LoadKeyring
+type KeyringConfig struct {
+	Path         string
+	LegacySecret string
+	Keys         map[Purpose]KeyConfig
+	// MaxTokenAge is the longest lifetime of any token the keyring signs,
+	// keys demoted longer ago than that stop verifying
+	MaxTokenAge time.Duration
+}
+
+// Keyring holds every signing key we know about, signs with the active key
+// for a token's purpose and verifies with any key that hasn't been retired.
+// It's persisted to a JSON file so restarts don't log everyone out
+type Keyring struct {
+	path        string
+	configs     map[Purpose]KeyConfig
+	maxTokenAge time.Duration
+
+	mu   sync.RWMutex
+	keys []*Key
+}
+
+// LoadKeyring loads the keyring stored at cfg.Path, creating it if it
+// doesn't exist, and makes sure every purpose has an active key with the
+// configured algorithm. cfg.LegacySecret is only imported, under
+// LegacyKeyID, when the keyring is first created: once it's retired it stays
+// retired even though JWT_SECRET is still set
+func LoadKeyring(cfg KeyringConfig) (*Keyring, error) {
+	kr := &Keyring{
+		path:        cfg.Path,
+		configs:     map[Purpose]KeyConfig{},
+		maxTokenAge: cfg.MaxTokenAge,
+	}
+	for _, purpose := range []Purpose{PurposeAccess, PurposeRefresh} {
+		keyCfg := cfg.Keys[purpose]
+		if keyCfg.Algorithm == "" {
+			keyCfg.Algorithm = jwt.SigningMethodHS256.Alg()
+		}
+		if !supportedAlgorithm(keyCfg.Algorithm) {
+			return nil, fmt.Errorf("unsupported %s token algorithm %q", purpose, keyCfg.Algorithm)
+		}
+		kr.configs[purpose] = keyCfg
+	}
+
+	data, err := os.ReadFile(cfg.Path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	created := errors.Is(err, os.ErrNotExist)
+	if err == nil {
+		err = json.Unmarshal(data, &kr.keys)
+		if err != nil {
+			return nil, fmt.Errorf("decoding keyring: %w", err)
+		}
+	}
+	for _, key := range kr.keys {
+		if key.PrivateKey == "" {
+			continue
+		}
+		key.signer, err = parsePrivateKey([]byte(key.PrivateKey))
+		if err != nil {
+			return nil, fmt.Errorf("decoding key %s: %w", key.ID, err)
+		}
+	}
+
+	if cfg.LegacySecret != "" && created {
+		kr.keys = append(kr.keys, &Key{
+			ID:        LegacyKeyID,
+			Algorithm: jwt.SigningMethodHS256.Alg(),
+			Secret:    []byte(cfg.LegacySecret),
+			State:     KeyVerifying,
+			CreatedAt: time.Now(),
+			RotatedAt: time.Now(),
+		})
+	}
+
+	// keys from before we split them by purpose can still verify, but each
+	// purpose signs with its own key from now on
+	now := time.Now()
+	for _, key := range kr.keys {
+		if key.State == KeyActive && key.Purpose == "" {
+			key.State = KeyVerifying
+			key.RotatedAt = now
+		}
+		// older keyrings imported the legacy key without a RotatedAt, start
+		// its clock now so it's retired once its tokens can't be live
+		if key.State == KeyVerifying && key.RotatedAt.IsZero() {
+			key.RotatedAt = now
+		}
+	}
+	kr.retireExpired(now)
+
+	for purpose, keyCfg := range kr.configs {
+		if keyCfg.PEMFile != "" {
+			err = kr.importPEM(purpose, keyCfg)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		active := kr.active(purpose)
+		if active != nil && active.Algorithm == keyCfg.Algorithm && !active.External {
+			continue
+		}
+		// nothing to sign with yet, or the algorithm changed
+		err = kr.rotate(purpose, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = kr.save()
+	if err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+// Sign signs claims with the active key for purpose and stamps its kid in
+// the header
+func (kr *Keyring) Sign(purpose Purpose, claims jwt.Claims) (string, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	key := kr.active(purpose)
+	if key == nil {
+		return "", fmt.Errorf("keyring has no active %s key", purpose)
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.ID
+	if key.signer != nil {
+		return token.SignedString(key.signer)
+	}
+	return token.SignedString(key.Secret)
+}
+
+// Keyfunc looks up the verification key for a token by its kid, it can be
+// passed straight to jwt.Parse. Tokens without a kid are checked against
+// the legacy key
+func (kr *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = LegacyKeyID
+	}
+	key := kr.find(kid)
+	if key == nil || key.State == KeyRetired || kr.expired(key, time.Now()) {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	// don't let a token pick a different algorithm than the key was made for
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	if key.signer != nil {
+		return key.signer.Public(), nil
+	}
+	return key.Secret, nil
+}
+
+// RotateDue rotates every purpose whose active key is older than interval.
+// Keys demoted more than maxTokenAge ago can't have any live tokens left, so
+// they're retired whether or not a rotation is due. Keys loaded from a PEM
+// file are left alone
+func (kr *Keyring) RotateDue(interval time.Duration, maxTokenAge time.Duration) (bool, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	retired := false
+	if maxTokenAge > 0 {
+		kr.maxTokenAge = maxTokenAge
+		retired = kr.retireExpired(time.Now())
+	}
+	rotated := false
+	for purpose := range kr.configs {
+		active := kr.active(purpose)
+		if active != nil && (active.External || time.Since(active.CreatedAt) < interval) {
+			continue
+		}
+		err := kr.rotate(purpose, maxTokenAge)
+		if err != nil {
+			return rotated, err
+		}
+		rotated = true
+	}
+	if !rotated && !retired {
+		return false, nil
+	}
+	return rotated, kr.save()
+}
+
+// JWKS returns the public half of every non-retired asymmetric key. HMAC
+// keys are secret so they're never published
+func (kr *Keyring) JWKS() JWKSet {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range kr.keys {
+		if key.State == KeyRetired || key.signer == nil {
+			continue
+		}
+		jwk, err := publicJWK(key.ID, key.Algorithm, key.signer.Public())
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// rotate makes a fresh active key for purpose, callers must hold kr.mu or
+// own the keyring exclusively
+func (kr *Keyring) rotate(purpose Purpose, maxTokenAge time.Duration) error {
+	now := time.Now()
+	newActive, err := newKey(kr.configs[purpose].Algorithm)
+	if err != nil {
+		return err
+	}
+	newActive.Purpose = purpose
+	for _, key := range kr.keys {
+		switch {
+		case key.State == KeyActive && key.Purpose == purpose:
+			key.State = KeyVerifying
+			key.RotatedAt = now
+		}
+	}
+	if maxTokenAge > 0 {
+		kr.maxTokenAge = maxTokenAge
+		kr.retireExpired(now)
+	}
+	kr.keys = append(kr.keys, newActive)
+	return nil
+}
+
+// expired reports whether key was demoted long enough ago that no token it
+// signed can still be live
+func (kr *Keyring) expired(key *Key, now time.Time) bool {
+	return key.State == KeyVerifying && kr.maxTokenAge > 0 && now.Sub(key.RotatedAt) > kr.maxTokenAge
+}
+
+// retireExpired retires every expired key and reports whether any were,
+// callers must hold kr.mu or own the keyring exclusively
+func (kr *Keyring) retireExpired(now time.Time) bool {
+	retired := false
+	for _, key := range kr.keys {
+		if !kr.expired(key, now) {
+			continue
+		}
+		key.State = KeyRetired
+		// nothing can verify with it anymore, no point keeping the secret
+		key.Secret = nil
+		key.PrivateKey = ""
+		key.signer = nil
+		retired = true
+	}
+	return retired
+}
+
+// importPEM makes the private key in keyCfg.PEMFile the active key for
+// purpose. The kid is derived from the public key so reloading the same
+// file doesn't add a new key every boot
+func (kr *Keyring) importPEM(purpose Purpose, keyCfg KeyConfig) error {
+	data, err := os.ReadFile(keyCfg.PEMFile)
+	if err != nil {
+		return fmt.Errorf("reading %s key: %w", purpose, err)
+	}
+	signer, err := parsePrivateKey(data)
+	if err != nil {
+		return fmt.Errorf("decoding %s key: %w", purpose, err)
+	}
+	if !keyMatchesAlgorithm(signer, keyCfg.Algorithm) {
+		return fmt.Errorf("%s key in %s can't sign %s tokens", purpose, keyCfg.PEMFile, keyCfg.Algorithm)
+	}
+	kid, err := keyThumbprint(signer.Public())
+	if err != nil {
+		return err
+	}
+	kid = string(purpose) + "-" + kid
+
+	existing := kr.find(kid)
+	if existing != nil && existing.State == KeyActive {
+		return nil
+	}
+	for _, key := range kr.keys {
+		if key.State == KeyActive && key.Purpose == purpose {
+			key.State = KeyVerifying
+			key.RotatedAt = time.Now()
+		}
+	}
+	if existing != nil {
+		existing.State = KeyActive
+		return nil
+	}
+	encoded, err := encodePrivateKey(signer)
+	if err != nil {
+		return err
+	}
+	kr.keys = append(kr.keys, &Key{
+		ID:         kid,
+		Algorithm:  keyCfg.Algorithm,
+		Purpose:    purpose,
+		PrivateKey: encoded,
+		State:      KeyActive,
+		CreatedAt:  time.Now(),
+		External:   true,
+		signer:     signer,
+	})
+	return nil
+}
+
+func (kr *Keyring) active(purpose Purpose) *Key {
+	for i := len(kr.keys) - 1; i >= 0; i-- {
+		if kr.keys[i].State == KeyActive && kr.keys[i].Purpose == purpose {
+			return kr.keys[i]
+		}
+	}
+	return nil
+}
+
+func (kr *Keyring) find(kid string) *Key {
+	for _, key := range kr.keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+// save writes the keyring to a temp file and renames it over the old one so
+// a crash can't leave a half written keyring behind
+func (kr *Keyring) save() error {
+	data, err := json.MarshalIndent(kr.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(kr.path), ".keyring-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), kr.path)
+}
+
+func newKey(alg string) (*Key, error) {
+	kid, err := newKeyID()
+	if err != nil {
+		return nil, err
+	}
+	key := &Key{
+		ID:        kid,
+		Algorithm: alg,
+		State:     KeyActive,
+		CreatedAt: time.Now(),
+	}
+	if alg == jwt.SigningMethodHS256.Alg() {
+		key.Secret = make([]byte, 32)
+		_, err = rand.Read(key.Secret)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+
+	signer, err := generatePrivateKey(alg)
+	if err != nil {
+		return nil, err
+	}
+	key.PrivateKey, err = encodePrivateKey(signer)
+	if err != nil {
+		return nil, err
+	}
+	key.signer = signer
+	return key, nil
+}
+
+func newKeyID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// keyThumbprint is a short stable id for a public key
+func keyThumbprint(pub crypto.PublicKey) (string, error) {
+	der, err := marshalPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
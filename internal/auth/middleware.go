@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrNoToken is returned by BearerToken when the request isn't authenticated
+var ErrNoToken = errors.New("missing authorization header")
+
+// BearerToken pulls the token out of an `Authorization: Bearer <token>`
+// header
+func BearerToken(r *http.Request) (string, error) {
+	scheme, credentials, err := authorizationHeader(r)
+	if err != nil {
+		return "", err
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", errors.New("expected a bearer token")
+	}
+	return credentials, nil
+}
+
+func authorizationHeader(r *http.Request) (scheme string, credentials string, err error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", "", ErrNoToken
+	}
+	scheme, credentials, ok := strings.Cut(header, " ")
+	credentials = strings.TrimSpace(credentials)
+	if !ok || credentials == "" {
+		return "", "", errors.New("malformed authorization header")
+	}
+	return scheme, credentials, nil
+}
+
+// Middleware authenticates requests that carry an access token or API key
+// and puts the principal in the request context. Requests without either
+// pass through anonymously, and so do requests whose credentials don't check
+// out: public routes like login and healthz have to keep working for a
+// client holding a stale token. Use RequireAuth on routes that need a user,
+// it reports why the credentials were refused
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, err := a.authenticate(r)
+		if errors.Is(err, ErrNoToken) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), authErrorKey{}, err.Error())))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), principal)))
+	})
+}
+
+func (a *Authenticator) authenticate(r *http.Request) (Principal, error) {
+	scheme, credentials, err := authorizationHeader(r)
+	if err != nil {
+		return Principal{}, err
+	}
+
+	var principal Principal
+	var issuedAt time.Time
+	switch {
+	case strings.EqualFold(scheme, "Bearer"):
+		claims, err := a.ParseAccessToken(credentials)
+		if err != nil {
+			log.Printf("rejected access token: %s", err)
+			return Principal{}, errors.New("invalid access token")
+		}
+		principal, err = claims.Principal()
+		if err != nil {
+			return Principal{}, err
+		}
+		if claims.IssuedAt != nil {
+			issuedAt = claims.IssuedAt.Time
+		}
+	case strings.EqualFold(scheme, "ApiKey"):
+		// a key counts as issued when it was created, so a password reset
+		// or role change revokes it like any other session
+		principal, issuedAt, err = a.authenticateAPIKey(r, credentials)
+		if err != nil {
+			return Principal{}, err
+		}
+	default:
+		return Principal{}, errors.New("unsupported authorization scheme")
+	}
+
+	if a.Users != nil {
+		err = a.Users.CheckUser(principal.UserID, issuedAt)
+		if err != nil {
+			return Principal{}, err
+		}
+	}
+	return principal, nil
+}
+
+type authErrorKey struct{}
+
+// unauthenticated writes a 401, with the reason the middleware refused the
+// request's credentials if it had any
+func unauthenticated(w http.ResponseWriter, r *http.Request) {
+	msg, ok := r.Context().Value(authErrorKey{}).(string)
+	if !ok {
+		msg = "authentication required"
+	}
+	writeError(w, http.StatusUnauthorized, msg)
+}
+
+// RequireAuth rejects requests that weren't authenticated
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := PrincipalFrom(r.Context()); !ok {
+			unauthenticated(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope rejects requests whose principal wasn't granted every one of
+// scopes. It implies RequireAuth
+func RequireScope(scopes ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := PrincipalFrom(r.Context())
+			if !ok {
+				unauthenticated(w, r)
+				return
+			}
+			for _, scope := range scopes {
+				if !principal.HasScope(scope) {
+					writeError(w, http.StatusForbidden, "missing scope "+scope)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireRole rejects requests whose principal's role is below role. It
+// implies RequireAuth
+func RequireRole(role string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			principal, ok := PrincipalFrom(r.Context())
+			if !ok {
+				unauthenticated(w, r)
+				return
+			}
+			if !principal.HasRole(role) {
+				writeError(w, http.StatusForbidden, "requires the "+role+" role")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
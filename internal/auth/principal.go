@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// scopes a token can be granted
+const (
+	ScopeChirpsRead   = "chirps:read"
+	ScopeChirpsWrite  = "chirps:write"
+	ScopeProfileWrite = "profile:write"
+	// direct messages get their own scopes so an app that can read chirps
+	// can't read private conversations too
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+)
+
+// DefaultScopes is what a user gets when they log in with their password
+var DefaultScopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileWrite, ScopeMessagesRead, ScopeMessagesWrite}
+
+// KnownScopes is every scope a token or API key can be granted
+var KnownScopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileWrite, ScopeMessagesRead, ScopeMessagesWrite}
+
+// IsKnownScope reports whether scope is one we hand out
+func IsKnownScope(scope string) bool {
+	for _, s := range KnownScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// roles a user can have, each one can do everything the ones before it can
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRanks = map[string]int{
+	RoleUser:      0,
+	RoleModerator: 1,
+	RoleAdmin:     2,
+}
+
+// IsKnownRole reports whether role is one of the roles above
+func IsKnownRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// Principal is whoever made the current request
+type Principal struct {
+	UserID    int
+	Scopes    []string
+	SessionID string
+	// Role is only ever elevated for first party sessions, API keys and
+	// third party apps always act as a plain user
+	Role string
+	// APIKeyID is set when the request was authenticated with an API key
+	// instead of an access token
+	APIKeyID string
+	// ClientID is set when a third party OAuth client is acting for the user
+	ClientID string
+	// IssuedAt and ExpiresAt come from the access token, they're zero for
+	// API keys
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// HasRole reports whether the principal's role is at least role
+func (p Principal) HasRole(role string) bool {
+	rank, ok := roleRanks[role]
+	if !ok {
+		return false
+	}
+	return roleRanks[p.Role] >= rank
+}
+
+// FirstParty reports whether the user is acting directly through a login
+// session, rather than through an API key or a third party app
+func (p Principal) FirstParty() bool {
+	return p.APIKeyID == "" && p.ClientID == ""
+}
+
+// HasScope reports whether the principal was granted scope
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying p
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal the auth middleware put in ctx
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// JoinScopes encodes scopes the way they're stored in the `scope` claim
+func JoinScopes(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// SplitScopes decodes a space separated `scope` claim
+func SplitScopes(scope string) []string {
+	return strings.Fields(scope)
+}
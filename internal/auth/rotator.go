@@ -0,0 +1,81 @@
+package auth
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Rotator rotates a keyring's active keys on a schedule
+type Rotator struct {
+	keyring     *Keyring
+	interval    time.Duration
+	maxTokenAge time.Duration
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewRotator creates a rotator that swaps in a new signing key every
+// interval. maxTokenAge is the longest lifetime of any token signed by the
+// keyring, old keys are kept for verification until then
+func NewRotator(keyring *Keyring, interval time.Duration, maxTokenAge time.Duration) *Rotator {
+	return &Rotator{
+		keyring:     keyring,
+		interval:    interval,
+		maxTokenAge: maxTokenAge,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// Start runs the rotator in a background goroutine until Stop is called
+func (r *Rotator) Start() {
+	go r.run()
+}
+
+// Stop signals the rotator to exit and waits for it
+func (r *Rotator) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+	})
+	<-r.done
+}
+
+func (r *Rotator) run() {
+	defer close(r.done)
+
+	// check more often than we rotate so a restart doesn't push the next
+	// rotation back by a whole interval
+	check := r.interval / 10
+	if check > time.Hour {
+		check = time.Hour
+	}
+	if check <= 0 {
+		check = r.interval
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	r.rotateIfDue()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+			r.rotateIfDue()
+		}
+	}
+}
+
+func (r *Rotator) rotateIfDue() {
+	rotated, err := r.keyring.RotateDue(r.interval, r.maxTokenAge)
+	if err != nil {
+		log.Printf("rotator: error rotating signing keys: %s", err)
+		return
+	}
+	if rotated {
+		log.Printf("rotator: rotated signing keys")
+	}
+}
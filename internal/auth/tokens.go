@@ -0,0 +1,144 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	IssuerAccess  = "chirpy-access"
+	IssuerRefresh = "chirpy-refresh"
+	// Audience is who access tokens are meant for
+	Audience = "chirpy-api"
+)
+
+// Claims are the claims in every token we issue
+type Claims struct {
+	jwt.RegisteredClaims
+	Scope     string `json:"scope,omitempty"`
+	SessionID string `json:"sid,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Role      string `json:"role,omitempty"`
+}
+
+// Principal turns verified claims into the principal they were issued to
+func (c *Claims) Principal() (Principal, error) {
+	userID, err := strconv.Atoi(c.Subject)
+	if err != nil {
+		return Principal{}, errors.New("token has an invalid subject")
+	}
+	principal := Principal{
+		UserID:    userID,
+		Scopes:    SplitScopes(c.Scope),
+		SessionID: c.SessionID,
+		ClientID:  c.ClientID,
+		Role:      c.Role,
+	}
+	if c.IssuedAt != nil {
+		principal.IssuedAt = c.IssuedAt.Time
+	}
+	if c.ExpiresAt != nil {
+		principal.ExpiresAt = c.ExpiresAt.Time
+	}
+	return principal, nil
+}
+
+// Authenticator issues and verifies the tokens signed by a keyring
+type Authenticator struct {
+	Keyring *Keyring
+	// APIKeys lets the middleware accept `Authorization: ApiKey ...`
+	// headers, when it's nil only access tokens are accepted
+	APIKeys APIKeyStore
+	// Users lets the middleware reject requests from suspended accounts and
+	// tokens issued before a forced logout, when it's nil it trusts tokens
+	Users UserStore
+}
+
+// UserStore checks that a user is still allowed to use a credential issued
+// at issuedAt. API keys pass a zero issuedAt
+type UserStore interface {
+	CheckUser(userID int, issuedAt time.Time) error
+}
+
+// NewAuthenticator creates an authenticator backed by keyring
+func NewAuthenticator(keyring *Keyring) *Authenticator {
+	return &Authenticator{Keyring: keyring}
+}
+
+// NewSessionID generates an id shared by a refresh token and every access
+// token minted from it
+func NewSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// IssueAccessToken signs an access token for p that expires after ttl and
+// returns it along with its expiry
+func (a *Authenticator) IssueAccessToken(p Principal, ttl time.Duration) (string, time.Time, error) {
+	return a.issue(PurposeAccess, IssuerAccess, p, ttl)
+}
+
+// IssueRefreshToken signs a refresh token for p that expires after ttl and
+// returns it along with its expiry
+func (a *Authenticator) IssueRefreshToken(p Principal, ttl time.Duration) (string, time.Time, error) {
+	return a.issue(PurposeRefresh, IssuerRefresh, p, ttl)
+}
+
+func (a *Authenticator) issue(purpose Purpose, issuer string, p Principal, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	// JWT dates only have second precision, report exactly what's in the token
+	expiresAt := jwt.NewNumericDate(now.Add(ttl))
+	tokenString, err := a.Keyring.Sign(purpose, Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    issuer,
+			Audience:  jwt.ClaimStrings{Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: expiresAt,
+			Subject:   strconv.Itoa(p.UserID),
+		},
+		Scope:     JoinScopes(p.Scopes),
+		SessionID: p.SessionID,
+		ClientID:  p.ClientID,
+		Role:      p.Role,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return tokenString, expiresAt.Time, nil
+}
+
+// ParseAccessToken verifies an access token's signature, expiry, issuer
+// and audience
+func (a *Authenticator) ParseAccessToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, a.Keyring.Keyfunc,
+		jwt.WithIssuer(IssuerAccess),
+		jwt.WithAudience(Audience),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ParseRefreshToken verifies a refresh token's signature, expiry and
+// issuer. Refresh tokens issued before we set an audience don't have one,
+// so it isn't enforced here
+func (a *Authenticator) ParseRefreshToken(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, a.Keyring.Keyfunc,
+		jwt.WithIssuer(IssuerRefresh),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
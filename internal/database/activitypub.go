@@ -0,0 +1,363 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	ErrActorKeyNotFound    = errors.New("actor key not found")
+	ErrRemoteActorNotFound = errors.New("remote actor not found")
+)
+
+// ActorKey is the key pair a user's ActivityPub actor signs requests with
+type ActorKey struct {
+	PrivateKeyPEM string    `json:"private_key_pem"`
+	PublicKeyPEM  string    `json:"public_key_pem"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// RemoteActor is our copy of an actor on another server
+type RemoteActor struct {
+	ID string `json:"id"`
+	// Handle is user@host
+	Handle       string    `json:"handle"`
+	Inbox        string    `json:"inbox"`
+	SharedInbox  string    `json:"shared_inbox,omitempty"`
+	KeyID        string    `json:"key_id"`
+	PublicKeyPEM string    `json:"public_key_pem"`
+	FetchedAt    time.Time `json:"fetched_at"`
+}
+
+// DeliveryInbox is where activities for the actor go, their server's
+// shared inbox when it has one
+func (a RemoteActor) DeliveryInbox() string {
+	if a.SharedInbox != "" {
+		return a.SharedInbox
+	}
+	return a.Inbox
+}
+
+// RemoteFollow is an actor on another server following a local user
+type RemoteFollow struct {
+	UserID  int    `json:"user_id"`
+	ActorID string `json:"actor_id"`
+	// ActivityID is the Follow's id, an Undo can refer to it by that
+	ActivityID string    `json:"activity_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// RemoteLike is an actor on another server liking a chirp
+type RemoteLike struct {
+	ChirpID    int       `json:"chirp_id"`
+	ActorID    string    `json:"actor_id"`
+	ActivityID string    `json:"activity_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// RemoteNote is a post from another server that replies to a chirp or
+// mentions local users, other posts aren't kept
+type RemoteNote struct {
+	ID      string `json:"id"`
+	ActorID string `json:"actor_id"`
+	// InReplyTo is the chirp it replies to, 0 if it doesn't
+	InReplyTo int `json:"in_reply_to,omitempty"`
+	// Mentions are the local users it's addressed to
+	Mentions []int `json:"mentions,omitempty"`
+	// Content is plain text, remote HTML is never served back as is
+	Content    string    `json:"content"`
+	URL        string    `json:"url,omitempty"`
+	Published  time.Time `json:"published"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// FederationDelivery is an activity on its way to another server's inbox.
+// It's removed once it's delivered or given up on
+type FederationDelivery struct {
+	ID int `json:"id"`
+	// UserID is the local user whose actor signs it
+	UserID        int             `json:"user_id"`
+	Inbox         string          `json:"inbox"`
+	Activity      json.RawMessage `json:"activity"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
+
+func remoteFollowKey(userID int, actorID string) string {
+	return fmt.Sprintf("%d %s", userID, actorID)
+}
+
+func remoteLikeKey(chirpID int, actorID string) string {
+	return fmt.Sprintf("%d %s", chirpID, actorID)
+}
+
+// GetActorKey returns userID's key pair
+func (db *DB) GetActorKey(userID int) (ActorKey, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return ActorKey{}, err
+	}
+	key, ok := dbStruct.ActorKeys[userID]
+	if !ok {
+		return ActorKey{}, ErrActorKeyNotFound
+	}
+	return key, nil
+}
+
+// AddActorKey saves userID's key pair unless they already have one, and
+// returns whichever is kept. Keys are made outside the lock since that's
+// slow, so two requests can race to make one
+func (db *DB) AddActorKey(userID int, key ActorKey) (ActorKey, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		if existing, ok := dbStruct.ActorKeys[userID]; ok {
+			key = existing
+			return nil
+		}
+		dbStruct.ActorKeys[userID] = key
+		return nil
+	})
+	if err != nil {
+		return ActorKey{}, err
+	}
+	return key, nil
+}
+
+// GetRemoteActor returns our copy of actor id
+func (db *DB) GetRemoteActor(id string) (RemoteActor, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	actor, ok := dbStruct.RemoteActors[id]
+	if !ok {
+		return RemoteActor{}, ErrRemoteActorNotFound
+	}
+	return actor, nil
+}
+
+// SaveRemoteActor saves a freshly fetched actor
+func (db *DB) SaveRemoteActor(actor RemoteActor) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		dbStruct.RemoteActors[actor.ID] = actor
+		return nil
+	})
+}
+
+// AddRemoteFollow records a remote actor following a user, created is
+// false if they already were. Following again replaces the activity id
+func (db *DB) AddRemoteFollow(follow RemoteFollow) (created bool, err error) {
+	err = db.update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Users[follow.UserID]; !ok {
+			return ErrUserNotFound
+		}
+		key := remoteFollowKey(follow.UserID, follow.ActorID)
+		existing, ok := dbStruct.RemoteFollows[key]
+		if ok {
+			follow.CreatedAt = existing.CreatedAt
+		}
+		dbStruct.RemoteFollows[key] = follow
+		created = !ok
+		return nil
+	})
+	return created, err
+}
+
+// RemoveRemoteFollow takes a remote actor off a user's followers
+func (db *DB) RemoveRemoteFollow(userID int, actorID string) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		delete(dbStruct.RemoteFollows, remoteFollowKey(userID, actorID))
+		return nil
+	})
+}
+
+// RemoteFollowers returns the remote actors following userID, oldest
+// first
+func (db *DB) RemoteFollowers(userID int) ([]RemoteFollow, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	follows := []RemoteFollow{}
+	for _, follow := range dbStruct.RemoteFollows {
+		if follow.UserID == userID {
+			follows = append(follows, follow)
+		}
+	}
+	sort.Slice(follows, func(i, j int) bool {
+		return follows[i].CreatedAt.Before(follows[j].CreatedAt)
+	})
+	return follows, nil
+}
+
+// RemoteFollowerInboxes returns where to deliver activities for userID's
+// remote followers, one inbox per server when they have shared ones
+func (db *DB) RemoteFollowerInboxes(userID int) ([]string, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]struct{}{}
+	inboxes := []string{}
+	for _, follow := range dbStruct.RemoteFollows {
+		actor, ok := dbStruct.RemoteActors[follow.ActorID]
+		if follow.UserID != userID || !ok {
+			continue
+		}
+		inbox := actor.DeliveryInbox()
+		if _, ok := seen[inbox]; ok {
+			continue
+		}
+		seen[inbox] = struct{}{}
+		inboxes = append(inboxes, inbox)
+	}
+	sort.Strings(inboxes)
+	return inboxes, nil
+}
+
+// AddRemoteLike records a remote actor liking a chirp, created is false if
+// they already did
+func (db *DB) AddRemoteLike(like RemoteLike) (created bool, err error) {
+	err = db.update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Chirps[like.ChirpID]; !ok {
+			return ErrChirpNotFound
+		}
+		key := remoteLikeKey(like.ChirpID, like.ActorID)
+		if _, ok := dbStruct.RemoteLikes[key]; ok {
+			return nil
+		}
+		dbStruct.RemoteLikes[key] = like
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+// RemoveRemoteLike takes a remote like back, removing one that doesn't
+// exist is fine
+func (db *DB) RemoveRemoteLike(chirpID int, actorID string) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		delete(dbStruct.RemoteLikes, remoteLikeKey(chirpID, actorID))
+		return nil
+	})
+}
+
+// UndoRemoteActivity removes the follow or like actorID made with
+// activity activityID. It reports whether there was one
+func (db *DB) UndoRemoteActivity(actorID, activityID string) (bool, error) {
+	undone := false
+	err := db.update(func(dbStruct *DBStructure) error {
+		for key, follow := range dbStruct.RemoteFollows {
+			if follow.ActorID == actorID && follow.ActivityID == activityID {
+				delete(dbStruct.RemoteFollows, key)
+				undone = true
+			}
+		}
+		for key, like := range dbStruct.RemoteLikes {
+			if like.ActorID == actorID && like.ActivityID == activityID {
+				delete(dbStruct.RemoteLikes, key)
+				undone = true
+			}
+		}
+		return nil
+	})
+	return undone, err
+}
+
+// SaveRemoteNote saves a remote post, replacing an earlier copy
+func (db *DB) SaveRemoteNote(note RemoteNote) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		dbStruct.RemoteNotes[note.ID] = note
+		return nil
+	})
+}
+
+// RemoteReplies returns the remote posts replying to chirpID, oldest
+// first
+func (db *DB) RemoteReplies(chirpID int) ([]RemoteNote, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	notes := []RemoteNote{}
+	for _, note := range dbStruct.RemoteNotes {
+		if note.InReplyTo == chirpID {
+			notes = append(notes, note)
+		}
+	}
+	sort.Slice(notes, func(i, j int) bool {
+		return notes[i].Published.Before(notes[j].Published)
+	})
+	return notes, nil
+}
+
+// EnqueueFederationDeliveries queues activity, signed by userID, to go to
+// each of inboxes now
+func (db *DB) EnqueueFederationDeliveries(userID int, inboxes []string, activity []byte, at time.Time) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		for _, inbox := range inboxes {
+			dbStruct.LastFederationDeliveryID++
+			dbStruct.FederationDeliveries[dbStruct.LastFederationDeliveryID] = FederationDelivery{
+				ID:            dbStruct.LastFederationDeliveryID,
+				UserID:        userID,
+				Inbox:         inbox,
+				Activity:      activity,
+				NextAttemptAt: at,
+				CreatedAt:     at,
+			}
+		}
+		return nil
+	})
+}
+
+// ClaimFederationDeliveries returns up to limit deliveries that are due at
+// now, oldest first. Their next attempt is pushed back to leaseUntil so
+// they aren't claimed again while they're being sent
+func (db *DB) ClaimFederationDeliveries(now, leaseUntil time.Time, limit int) ([]FederationDelivery, error) {
+	claimed := []FederationDelivery{}
+	err := db.update(func(dbStruct *DBStructure) error {
+		due := []FederationDelivery{}
+		for _, delivery := range dbStruct.FederationDeliveries {
+			if !delivery.NextAttemptAt.After(now) {
+				due = append(due, delivery)
+			}
+		}
+		sort.Slice(due, func(i, j int) bool {
+			return due[i].ID < due[j].ID
+		})
+		if len(due) > limit {
+			due = due[:limit]
+		}
+		for _, delivery := range due {
+			delivery.NextAttemptAt = leaseUntil
+			dbStruct.FederationDeliveries[delivery.ID] = delivery
+			claimed = append(claimed, delivery)
+		}
+		return nil
+	})
+	return claimed, err
+}
+
+// RecordFederationAttempt saves how a try at delivery id went. A nil
+// retryAt means it's done, delivered or given up on, and it's removed
+func (db *DB) RecordFederationAttempt(id int, errMsg string, retryAt *time.Time) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		delivery, ok := dbStruct.FederationDeliveries[id]
+		if !ok {
+			return nil
+		}
+		if retryAt == nil {
+			delete(dbStruct.FederationDeliveries, id)
+			return nil
+		}
+		delivery.Attempts++
+		delivery.LastError = errMsg
+		delivery.NextAttemptAt = *retryAt
+		dbStruct.FederationDeliveries[id] = delivery
+		return nil
+	})
+}
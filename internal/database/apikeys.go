@@ -0,0 +1,107 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrAPIKeyNotFound is returned when an API key doesn't exist or belongs to
+// someone else
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// APIKey is a personal API key. Only a hash of the secret is stored, the
+// key itself is shown to the user once when it's created
+type APIKey struct {
+	ID         string     `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Hash       []byte     `json:"hash"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// CreateAPIKey saves a new API key
+func (db *DB) CreateAPIKey(key APIKey) (APIKey, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.APIKeys[key.ID]; ok {
+			return errors.New("api key already exists")
+		}
+		dbStruct.APIKeys[key.ID] = key
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+// GetAPIKey returns the API key with the given id
+func (db *DB) GetAPIKey(id string) (APIKey, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return APIKey{}, err
+	}
+	key, ok := dbStruct.APIKeys[id]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+// ListAPIKeys returns a user's API keys, oldest first
+func (db *DB) ListAPIKeys(userID int) ([]APIKey, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	keys := []APIKey{}
+	for _, key := range dbStruct.APIKeys {
+		if key.UserID == userID {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// RevokeAPIKey marks one of a user's API keys as revoked
+func (db *DB) RevokeAPIKey(userID int, id string, revokedAt time.Time) (APIKey, error) {
+	var key APIKey
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		key, ok = dbStruct.APIKeys[id]
+		if !ok || key.UserID != userID {
+			return ErrAPIKeyNotFound
+		}
+		if key.RevokedAt == nil {
+			key.RevokedAt = &revokedAt
+			dbStruct.APIKeys[id] = key
+		}
+		return nil
+	})
+	if err != nil {
+		return APIKey{}, err
+	}
+	return key, nil
+}
+
+// TouchAPIKey records when and from where an API key was last used
+func (db *DB) TouchAPIKey(id string, usedAt time.Time, ip string) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		key, ok := dbStruct.APIKeys[id]
+		if !ok {
+			return ErrAPIKeyNotFound
+		}
+		key.LastUsedAt = &usedAt
+		key.LastUsedIP = ip
+		dbStruct.APIKeys[id] = key
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// AuditEntry records something a moderator or admin did
+type AuditEntry struct {
+	ID         int       `json:"id"`
+	ActorID    int       `json:"actor_id"`
+	Action     string    `json:"action"`
+	TargetType string    `json:"target_type"`
+	TargetID   int       `json:"target_id"`
+	ReportID   int       `json:"report_id,omitempty"`
+	Note       string    `json:"note,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// AuditFilter narrows down ListAuditEntries, zero values match everything
+type AuditFilter struct {
+	ActorID    int
+	TargetType string
+	TargetID   int
+}
+
+// RecordAudit appends an entry to the audit trail
+func (db *DB) RecordAudit(entry AuditEntry) (AuditEntry, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		entry = dbStruct.appendAudit(entry)
+		return nil
+	})
+	if err != nil {
+		return AuditEntry{}, err
+	}
+	return entry, nil
+}
+
+// appendAudit adds entry to the trail inside an update, so the audit
+// record is saved together with the change it describes
+func (dbStruct *DBStructure) appendAudit(entry AuditEntry) AuditEntry {
+	entry.ID = len(dbStruct.AuditLog) + 1
+	dbStruct.AuditLog[entry.ID] = entry
+	return entry
+}
+
+// ListAuditEntries returns the entries matching filter, newest first
+func (db *DB) ListAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	entries := []AuditEntry{}
+	for _, entry := range dbStruct.AuditLog {
+		if filter.ActorID != 0 && entry.ActorID != filter.ActorID {
+			continue
+		}
+		if filter.TargetType != "" && entry.TargetType != filter.TargetType {
+			continue
+		}
+		if filter.TargetID != 0 && entry.TargetID != filter.TargetID {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ID > entries[j].ID
+	})
+	return entries, nil
+}
@@ -0,0 +1,168 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var ErrSelfRelation = errors.New("you can't do that to yourself")
+
+// UserLink is one user blocking, muting or following another
+type UserLink struct {
+	UserID    int       `json:"user_id"`
+	TargetID  int       `json:"target_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func userLinkKey(userID, targetID int) string {
+	return fmt.Sprintf("%d:%d", userID, targetID)
+}
+
+// setUserLink adds or removes a link in one of the link collections. When
+// adding, onAdd (if set) runs first in the same update and can refuse
+func (db *DB) setUserLink(links func(*DBStructure) map[string]UserLink, userID, targetID int, on bool, at time.Time, onAdd func(*DBStructure) error) error {
+	if userID == targetID {
+		return ErrSelfRelation
+	}
+	return db.update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Users[targetID]; !ok {
+			return ErrUserNotFound
+		}
+		key := userLinkKey(userID, targetID)
+		m := links(dbStruct)
+		if !on {
+			delete(m, key)
+			return nil
+		}
+		if onAdd != nil {
+			err := onAdd(dbStruct)
+			if err != nil {
+				return err
+			}
+		}
+		if _, ok := m[key]; !ok {
+			m[key] = UserLink{UserID: userID, TargetID: targetID, CreatedAt: at}
+		}
+		return nil
+	})
+}
+
+func blocks(dbStruct *DBStructure) map[string]UserLink { return dbStruct.Blocks }
+func mutes(dbStruct *DBStructure) map[string]UserLink  { return dbStruct.Mutes }
+
+// Block stops userID and targetID from seeing each other's chirps. Any
+// follows between them are dropped
+func (db *DB) Block(userID, targetID int, at time.Time) error {
+	return db.setUserLink(blocks, userID, targetID, true, at, func(dbStruct *DBStructure) error {
+		delete(dbStruct.Follows, userLinkKey(userID, targetID))
+		delete(dbStruct.Follows, userLinkKey(targetID, userID))
+		return nil
+	})
+}
+
+// Unblock lifts a block
+func (db *DB) Unblock(userID, targetID int) error {
+	return db.setUserLink(blocks, userID, targetID, false, time.Time{}, nil)
+}
+
+// Mute hides targetID's chirps from userID without them knowing
+func (db *DB) Mute(userID, targetID int, at time.Time) error {
+	return db.setUserLink(mutes, userID, targetID, true, at, nil)
+}
+
+// Unmute lifts a mute
+func (db *DB) Unmute(userID, targetID int) error {
+	return db.setUserLink(mutes, userID, targetID, false, time.Time{}, nil)
+}
+
+func listUserLinks(m map[string]UserLink, userID int) []UserLink {
+	links := []UserLink{}
+	for _, link := range m {
+		if link.UserID == userID {
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedAt.After(links[j].CreatedAt)
+	})
+	return links
+}
+
+// ListBlocks returns the users userID has blocked, most recent first
+func (db *DB) ListBlocks(userID int) ([]UserLink, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	return listUserLinks(dbStruct.Blocks, userID), nil
+}
+
+// ListMutes returns the users userID has muted, most recent first
+func (db *DB) ListMutes(userID int) ([]UserLink, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	return listUserLinks(dbStruct.Mutes, userID), nil
+}
+
+// IsBlocked reports whether either user has blocked the other
+func (db *DB) IsBlocked(userID, otherID int) (bool, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return false, err
+	}
+	_, blocked := dbStruct.Blocks[userLinkKey(userID, otherID)]
+	_, blockedBy := dbStruct.Blocks[userLinkKey(otherID, userID)]
+	return blocked || blockedBy, nil
+}
+
+// BlockedUsers returns everyone userID has blocked or been blocked by
+func (db *DB) BlockedUsers(userID int) (map[int]struct{}, error) {
+	blocked := map[int]struct{}{}
+	if userID == 0 {
+		return blocked, nil
+	}
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range dbStruct.Blocks {
+		if link.UserID == userID {
+			blocked[link.TargetID] = struct{}{}
+		}
+		if link.TargetID == userID {
+			blocked[link.UserID] = struct{}{}
+		}
+	}
+	return blocked, nil
+}
+
+// HiddenAuthors returns the users whose chirps userID shouldn't see in
+// feeds: everyone they've blocked or muted and everyone who's blocked them
+func (db *DB) HiddenAuthors(userID int) (map[int]struct{}, error) {
+	hidden := map[int]struct{}{}
+	if userID == 0 {
+		return hidden, nil
+	}
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	for _, link := range dbStruct.Blocks {
+		if link.UserID == userID {
+			hidden[link.TargetID] = struct{}{}
+		}
+		if link.TargetID == userID {
+			hidden[link.UserID] = struct{}{}
+		}
+	}
+	for _, link := range dbStruct.Mutes {
+		if link.UserID == userID {
+			hidden[link.TargetID] = struct{}{}
+		}
+	}
+	return hidden, nil
+}
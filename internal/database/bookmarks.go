@@ -0,0 +1,61 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// Bookmark is a chirp a user saved for later, only they can see it
+type Bookmark struct {
+	UserID    int       `json:"user_id"`
+	ChirpID   int       `json:"chirp_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func bookmarkKey(userID, chirpID int) string {
+	return fmt.Sprintf("%d:%d", userID, chirpID)
+}
+
+// AddBookmark saves chirpID for userID, created is false if it was already
+// bookmarked
+func (db *DB) AddBookmark(userID, chirpID int, at time.Time) (created bool, err error) {
+	err = db.update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Chirps[chirpID]; !ok {
+			return ErrChirpNotFound
+		}
+		key := bookmarkKey(userID, chirpID)
+		if _, ok := dbStruct.Bookmarks[key]; ok {
+			return nil
+		}
+		dbStruct.Bookmarks[key] = Bookmark{UserID: userID, ChirpID: chirpID, CreatedAt: at}
+		created = true
+		return nil
+	})
+	return created, err
+}
+
+// RemoveBookmark forgets a bookmark, removing one that doesn't exist is fine
+func (db *DB) RemoveBookmark(userID, chirpID int) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		delete(dbStruct.Bookmarks, bookmarkKey(userID, chirpID))
+		return nil
+	})
+}
+
+// BookmarkedChirps returns the chirps userID has bookmarked
+func (db *DB) BookmarkedChirps(userID int) ([]Chirp, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	chirps := []Chirp{}
+	for _, bookmark := range dbStruct.Bookmarks {
+		if bookmark.UserID != userID {
+			continue
+		}
+		if chirp, ok := dbStruct.Chirps[bookmark.ChirpID]; ok {
+			chirps = append(chirps, chirp)
+		}
+	}
+	return chirps, nil
+}
@@ -0,0 +1,249 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// chirp statuses
+const (
+	ChirpDraft     = "draft"
+	ChirpScheduled = "scheduled"
+	ChirpPublished = "published"
+)
+
+var (
+	ErrChirpNotFound = errors.New("chirp does not exist")
+	// ErrChirpPublished is returned when changing a draft or scheduled chirp
+	// that has been published in the meantime
+	ErrChirpPublished = errors.New("chirp has already been published")
+	// ErrNotChirpAuthor is returned when someone tries to change a chirp
+	// they didn't write
+	ErrNotChirpAuthor = errors.New("only the author can change this chirp")
+)
+
+// Published reports whether the chirp is out, chirps from before drafts
+// existed always are
+func (c Chirp) Published() bool {
+	return c.Status == ChirpPublished || c.Status == ""
+}
+
+// GetChirp returns the chirp with the given id
+func (db *DB) GetChirp(id int) (Chirp, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return Chirp{}, err
+	}
+	chirp, ok := dbStruct.Chirps[id]
+	if !ok {
+		return Chirp{}, ErrChirpNotFound
+	}
+	return chirp, nil
+}
+
+// UpdateChirpBody replaces the body of one of authorID's chirps. A held
+// edit puts the chirp back in the review queue, otherwise its moderation
+// state is left alone. The link preview is cleared since the link may
+// have changed
+func (db *DB) UpdateChirpBody(id int, authorID int, body string, hold bool, editedAt time.Time) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStruct.Chirps[id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		if chirp.AuthorID != authorID {
+			return ErrNotChirpAuthor
+		}
+		chirp.Body = body
+		chirp.EditedAt = &editedAt
+		chirp.Preview = nil
+		if hold {
+			chirp.ModerationState = ChirpHeld
+		}
+		dbStruct.Chirps[id] = chirp
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+// LinkPreview is the card shown for the first link in a chirp
+type LinkPreview struct {
+	// Link is the URL as it appears in the chirp, URL is the canonical
+	// address the page gave
+	Link        string `json:"link"`
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+	Type        string `json:"type,omitempty"`
+}
+
+// SetChirpPreview attaches a link preview to a chirp. Previews are fetched
+// in the background, so if the chirp was edited and no longer has the link
+// in the meantime the preview is dropped
+func (db *DB) SetChirpPreview(id int, preview LinkPreview) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		chirp, ok := dbStruct.Chirps[id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		if !strings.Contains(chirp.Body, preview.Link) {
+			return nil
+		}
+		chirp.Preview = &preview
+		dbStruct.Chirps[id] = chirp
+		return nil
+	})
+}
+
+// ChirpsFor returns the chirps with the given ids, keyed by id. Ids that
+// don't exist are left out
+func (db *DB) ChirpsFor(ids []int) (map[int]Chirp, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	chirps := map[int]Chirp{}
+	for _, id := range ids {
+		if chirp, ok := dbStruct.Chirps[id]; ok {
+			chirps[id] = chirp
+		}
+	}
+	return chirps, nil
+}
+
+// QuotesOf returns the chirps that quote the chirp with the given id
+func (db *DB) QuotesOf(id int) ([]Chirp, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	chirps := []Chirp{}
+	for _, chirp := range dbStruct.Chirps {
+		if chirp.QuotedChirpID == id {
+			chirps = append(chirps, chirp)
+		}
+	}
+	return chirps, nil
+}
+
+// ListUnpublishedChirps returns authorID's drafts and scheduled chirps,
+// scheduled ones in the order they'll go out and then drafts, newest first.
+// An empty status returns both
+func (db *DB) ListUnpublishedChirps(authorID int, status string) ([]Chirp, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	chirps := []Chirp{}
+	for _, chirp := range dbStruct.Chirps {
+		if chirp.AuthorID != authorID || chirp.Published() {
+			continue
+		}
+		if status != "" && chirp.Status != status {
+			continue
+		}
+		chirps = append(chirps, chirp)
+	}
+	sort.Slice(chirps, func(i, j int) bool {
+		a, b := chirps[i], chirps[j]
+		if a.Status != b.Status {
+			return a.Status == ChirpScheduled
+		}
+		if a.Status == ChirpScheduled && !a.PublishAt.Equal(*b.PublishAt) {
+			return a.PublishAt.Before(*b.PublishAt)
+		}
+		return a.ID > b.ID
+	})
+	return chirps, nil
+}
+
+// UpdateUnpublishedChirp applies fn to one of authorID's drafts or
+// scheduled chirps and saves it. The check and the change happen under the
+// same lock, so the scheduler can't publish it halfway through
+func (db *DB) UpdateUnpublishedChirp(id int, authorID int, fn func(chirp *Chirp) error) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStruct.Chirps[id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		if chirp.AuthorID != authorID {
+			return ErrNotChirpAuthor
+		}
+		if chirp.Published() {
+			return ErrChirpPublished
+		}
+		err := fn(&chirp)
+		if err != nil {
+			return err
+		}
+		dbStruct.Chirps[id] = chirp
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
+
+// DeleteUnpublishedChirp cancels one of authorID's drafts or scheduled
+// chirps. Its media is freed up to be attached to another chirp
+func (db *DB) DeleteUnpublishedChirp(id int, authorID int) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		chirp, ok := dbStruct.Chirps[id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		if chirp.AuthorID != authorID {
+			return ErrNotChirpAuthor
+		}
+		if chirp.Published() {
+			return ErrChirpPublished
+		}
+		for _, m := range chirp.Media {
+			if media, ok := dbStruct.Media[m.ID]; ok {
+				media.ChirpID = 0
+				dbStruct.Media[m.ID] = media
+			}
+		}
+		delete(dbStruct.Chirps, id)
+		delete(dbStruct.Polls, id)
+		return nil
+	})
+}
+
+// PublishDueChirps publishes every scheduled chirp whose time has come and
+// returns them. The status change is saved before anything else sees the
+// chirps, so each one is published once even if we crash or restart
+func (db *DB) PublishDueChirps(now time.Time) ([]Chirp, error) {
+	published := []Chirp{}
+	err := db.update(func(dbStruct *DBStructure) error {
+		for id, chirp := range dbStruct.Chirps {
+			if chirp.Status != ChirpScheduled || chirp.PublishAt == nil || chirp.PublishAt.After(now) {
+				continue
+			}
+			chirp.Status = ChirpPublished
+			chirp.PublishedAt = &now
+			dbStruct.Chirps[id] = chirp
+			published = append(published, chirp)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(published, func(i, j int) bool {
+		return published[i].PublishAt.Before(*published[j].PublishAt)
+	})
+	return published, nil
+}
@@ -0,0 +1,393 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MaxConversationMembers is the most people, the creator included, a
+// conversation can have
+const MaxConversationMembers = 8
+
+// DM policies, who a user accepts new conversations from
+const (
+	DMEveryone  = "everyone"
+	DMFollowing = "following"
+)
+
+var (
+	ErrConversationNotFound = errors.New("conversation does not exist")
+	// ErrDMNotAllowed is returned when a member's DM policy or a block
+	// stands in the way of a conversation
+	ErrDMNotAllowed = errors.New("you can't message this user")
+	ErrNoMessageKey = errors.New("no message encryption key configured")
+)
+
+// Conversation is a private conversation between two or more users
+type Conversation struct {
+	ID        int   `json:"id"`
+	MemberIDs []int `json:"member_ids"`
+	CreatorID int   `json:"creator_id"`
+	// ReadUpTo is the id of the last message each member has read, keyed
+	// by user id
+	ReadUpTo      map[int]int `json:"read_up_to"`
+	LastMessageID int         `json:"last_message_id,omitempty"`
+	CreatedAt     time.Time   `json:"created_at"`
+	UpdatedAt     time.Time   `json:"updated_at"`
+}
+
+// HasMember reports whether userID is in the conversation
+func (c Conversation) HasMember(userID int) bool {
+	for _, id := range c.MemberIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Message is a message in a conversation, decrypted
+type Message struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	SenderID       int       `json:"sender_id"`
+	Body           string    `json:"body"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// storedMessage is a message as it's saved, the body is sealed with
+// AES-GCM under the server's message key
+type storedMessage struct {
+	ID             int       `json:"id"`
+	ConversationID int       `json:"conversation_id"`
+	SenderID       int       `json:"sender_id"`
+	Ciphertext     string    `json:"ciphertext"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// SetMessageKey sets the 32 byte key message bodies are encrypted with.
+// Without one, sending and reading messages fails with ErrNoMessageKey
+func (db *DB) SetMessageKey(key []byte) error {
+	if len(key) != 32 {
+		return errors.New("message key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	db.messageAEAD = aead
+	return nil
+}
+
+// messageAD ties a ciphertext to the message it belongs to, so it can't be
+// copied into another message or conversation
+func messageAD(m storedMessage) []byte {
+	return []byte(fmt.Sprintf("%d:%d:%d", m.ConversationID, m.ID, m.SenderID))
+}
+
+func (db *DB) sealMessage(m *storedMessage, body string) error {
+	if db.messageAEAD == nil {
+		return ErrNoMessageKey
+	}
+	nonce := make([]byte, db.messageAEAD.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	sealed := db.messageAEAD.Seal(nonce, nonce, []byte(body), messageAD(*m))
+	m.Ciphertext = base64.StdEncoding.EncodeToString(sealed)
+	return nil
+}
+
+func (db *DB) openMessage(m storedMessage) (Message, error) {
+	if db.messageAEAD == nil {
+		return Message{}, ErrNoMessageKey
+	}
+	sealed, err := base64.StdEncoding.DecodeString(m.Ciphertext)
+	if err != nil {
+		return Message{}, err
+	}
+	size := db.messageAEAD.NonceSize()
+	if len(sealed) < size {
+		return Message{}, errors.New("message ciphertext is too short")
+	}
+	body, err := db.messageAEAD.Open(nil, sealed[:size], sealed[size:], messageAD(m))
+	if err != nil {
+		return Message{}, fmt.Errorf("decrypting message %d: %w", m.ID, err)
+	}
+	return Message{
+		ID:             m.ID,
+		ConversationID: m.ConversationID,
+		SenderID:       m.SenderID,
+		Body:           string(body),
+		CreatedAt:      m.CreatedAt,
+	}, nil
+}
+
+// canMessage checks senderID is allowed to start a conversation with
+// userID: neither has blocked the other and userID's DM policy lets them
+func (dbStruct *DBStructure) canMessage(senderID, userID int) error {
+	user, ok := dbStruct.Users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	_, blocked := dbStruct.Blocks[userLinkKey(senderID, userID)]
+	_, blockedBy := dbStruct.Blocks[userLinkKey(userID, senderID)]
+	if blocked || blockedBy {
+		return ErrDMNotAllowed
+	}
+	if user.DMPolicy == DMFollowing {
+		if _, ok := dbStruct.Follows[userLinkKey(userID, senderID)]; !ok {
+			return ErrDMNotAllowed
+		}
+	}
+	return nil
+}
+
+// CreateConversation starts a conversation between creatorID and
+// memberIDs. Asking for a one-to-one conversation that already exists
+// returns it with created false
+func (db *DB) CreateConversation(creatorID int, memberIDs []int, at time.Time) (conversation Conversation, created bool, err error) {
+	err = db.update(func(dbStruct *DBStructure) error {
+		for _, id := range memberIDs {
+			err := dbStruct.canMessage(creatorID, id)
+			if err != nil {
+				return err
+			}
+		}
+		members := append([]int{creatorID}, memberIDs...)
+		sort.Ints(members)
+		if len(members) == 2 {
+			for _, existing := range dbStruct.Conversations {
+				if len(existing.MemberIDs) == 2 && existing.MemberIDs[0] == members[0] && existing.MemberIDs[1] == members[1] {
+					conversation = existing
+					return nil
+				}
+			}
+		}
+		dbStruct.LastConversationID++
+		conversation = Conversation{
+			ID:        dbStruct.LastConversationID,
+			MemberIDs: members,
+			CreatorID: creatorID,
+			ReadUpTo:  map[int]int{},
+			CreatedAt: at,
+			UpdatedAt: at,
+		}
+		dbStruct.Conversations[conversation.ID] = conversation
+		created = true
+		return nil
+	})
+	return conversation, created, err
+}
+
+// GetConversation returns the conversation with the given id if userID is
+// in it. Anyone else gets ErrConversationNotFound, so they can't tell it
+// exists
+func (db *DB) GetConversation(id int, userID int) (Conversation, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return Conversation{}, err
+	}
+	conversation, ok := dbStruct.Conversations[id]
+	if !ok || !conversation.HasMember(userID) {
+		return Conversation{}, ErrConversationNotFound
+	}
+	return conversation, nil
+}
+
+// ListConversations returns userID's conversations, the most recently
+// active first
+func (db *DB) ListConversations(userID int) ([]Conversation, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	conversations := []Conversation{}
+	for _, conversation := range dbStruct.Conversations {
+		if conversation.HasMember(userID) {
+			conversations = append(conversations, conversation)
+		}
+	}
+	sort.Slice(conversations, func(i, j int) bool {
+		a, b := conversations[i], conversations[j]
+		if !a.UpdatedAt.Equal(b.UpdatedAt) {
+			return a.UpdatedAt.After(b.UpdatedAt)
+		}
+		return a.ID > b.ID
+	})
+	return conversations, nil
+}
+
+// SendMessage adds a message from senderID to a conversation they're in.
+// In a one-to-one conversation a block or the other member's DM policy
+// stops new messages. Sending also marks the conversation read up to the
+// new message for the sender
+func (db *DB) SendMessage(conversationID int, senderID int, body string, at time.Time) (Message, error) {
+	var message Message
+	err := db.update(func(dbStruct *DBStructure) error {
+		conversation, ok := dbStruct.Conversations[conversationID]
+		if !ok || !conversation.HasMember(senderID) {
+			return ErrConversationNotFound
+		}
+		if len(conversation.MemberIDs) == 2 {
+			for _, id := range conversation.MemberIDs {
+				if id == senderID {
+					continue
+				}
+				err := dbStruct.canMessage(senderID, id)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		stored := storedMessage{
+			ID:             dbStruct.LastMessageID + 1,
+			ConversationID: conversationID,
+			SenderID:       senderID,
+			CreatedAt:      at,
+		}
+		err := db.sealMessage(&stored, body)
+		if err != nil {
+			return err
+		}
+		dbStruct.LastMessageID = stored.ID
+		dbStruct.Messages[stored.ID] = stored
+
+		conversation.LastMessageID = stored.ID
+		conversation.UpdatedAt = at
+		if conversation.ReadUpTo == nil {
+			conversation.ReadUpTo = map[int]int{}
+		}
+		conversation.ReadUpTo[senderID] = stored.ID
+		dbStruct.Conversations[conversationID] = conversation
+		message = Message{
+			ID:             stored.ID,
+			ConversationID: conversationID,
+			SenderID:       senderID,
+			Body:           body,
+			CreatedAt:      at,
+		}
+		return nil
+	})
+	if err != nil {
+		return Message{}, err
+	}
+	return message, nil
+}
+
+// ListMessages returns the messages in a conversation userID is in, newest
+// first, leaving out messages from anyone on either side of a block with
+// userID. Only messages with an id below before are returned unless it's 0,
+// and at most limit of them. more is true when there are older ones
+func (db *DB) ListMessages(conversationID int, userID int, before int, limit int) (messages []Message, more bool, err error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, false, err
+	}
+	conversation, ok := dbStruct.Conversations[conversationID]
+	if !ok || !conversation.HasMember(userID) {
+		return nil, false, ErrConversationNotFound
+	}
+	stored := []storedMessage{}
+	for _, m := range dbStruct.Messages {
+		if m.ConversationID != conversationID || (before != 0 && m.ID >= before) {
+			continue
+		}
+		_, blocked := dbStruct.Blocks[userLinkKey(userID, m.SenderID)]
+		_, blockedBy := dbStruct.Blocks[userLinkKey(m.SenderID, userID)]
+		if blocked || blockedBy {
+			continue
+		}
+		stored = append(stored, m)
+	}
+	sort.Slice(stored, func(i, j int) bool {
+		return stored[i].ID > stored[j].ID
+	})
+	if len(stored) > limit {
+		stored = stored[:limit]
+		more = true
+	}
+	messages = []Message{}
+	for _, m := range stored {
+		message, err := db.openMessage(m)
+		if err != nil {
+			return nil, false, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, more, nil
+}
+
+// MarkConversationRead records that userID has read up to messageID, or
+// the latest message when it's 0. Read receipts only move forward
+func (db *DB) MarkConversationRead(conversationID int, userID int, messageID int) (Conversation, error) {
+	var conversation Conversation
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		conversation, ok = dbStruct.Conversations[conversationID]
+		if !ok || !conversation.HasMember(userID) {
+			return ErrConversationNotFound
+		}
+		if messageID == 0 || messageID > conversation.LastMessageID {
+			messageID = conversation.LastMessageID
+		}
+		if conversation.ReadUpTo == nil {
+			conversation.ReadUpTo = map[int]int{}
+		}
+		if messageID > conversation.ReadUpTo[userID] {
+			conversation.ReadUpTo[userID] = messageID
+		}
+		dbStruct.Conversations[conversationID] = conversation
+		return nil
+	})
+	if err != nil {
+		return Conversation{}, err
+	}
+	return conversation, nil
+}
+
+// UnreadCounts returns how many messages userID hasn't read in each of
+// their conversations, keyed by conversation id. Their own messages and
+// messages they can't see because of a block don't count
+func (db *DB) UnreadCounts(userID int) (map[int]int, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	counts := map[int]int{}
+	for _, m := range dbStruct.Messages {
+		conversation, ok := dbStruct.Conversations[m.ConversationID]
+		if !ok || !conversation.HasMember(userID) || m.SenderID == userID {
+			continue
+		}
+		if m.ID <= conversation.ReadUpTo[userID] {
+			continue
+		}
+		_, blocked := dbStruct.Blocks[userLinkKey(userID, m.SenderID)]
+		_, blockedBy := dbStruct.Blocks[userLinkKey(m.SenderID, userID)]
+		if blocked || blockedBy {
+			continue
+		}
+		counts[m.ConversationID]++
+	}
+	return counts, nil
+}
+
+// SetDMPolicy sets who can start conversations with the user
+func (db *DB) SetDMPolicy(id int, policy string) (User, error) {
+	return db.updateUser(id, func(user *User) error {
+		user.DMPolicy = policy
+		return nil
+	})
+}
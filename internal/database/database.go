@@ -1,6 +1,7 @@
 package database
 
 import (
+	"crypto/cipher"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,23 +15,238 @@ import (
 type Chirp struct {
 	ID int `json:"id"`
 	Body string `json:"body"`
+	AuthorID int `json:"author_id"`
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+	// ModerationState is empty for visible chirps, see ChirpHeld and ChirpHidden
+	ModerationState string `json:"moderation_state,omitempty"`
+	Media []ChirpMedia `json:"media,omitempty"`
+	// Preview is filled in by the link preview fetcher after the chirp is
+	// created
+	Preview *LinkPreview `json:"preview,omitempty"`
+	// Status is ChirpDraft, ChirpScheduled or ChirpPublished, scheduled
+	// chirps are published at PublishAt
+	Status string `json:"status"`
+	PublishAt *time.Time `json:"publish_at,omitempty"`
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	// QuotedChirpID is the chirp this one quotes, 0 if it doesn't
+	QuotedChirpID int `json:"quoted_chirp_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type DB struct {
 	path string
 	mux *sync.RWMutex
+	// messageAEAD encrypts direct messages, see SetMessageKey
+	messageAEAD cipher.AEAD
 }
 
 type DBStructure struct {
 	Chirps map[int]Chirp `json:"chirps"`
+	// LastChirpID is the highest id ever handed out, so ids of deleted
+	// chirps aren't reused
+	LastChirpID int `json:"lastChirpId"`
 	Users map[int]User `json:"users"`
-	RevokeTokens map[string]time.Time `json:"revokeTokens"`
+	RevokeTokens map[string]RevokedToken `json:"revokeTokens"`
+	APIKeys map[string]APIKey `json:"apiKeys"`
+	OAuthClients map[string]OAuthClient `json:"oauthClients"`
+	OAuthCodes map[string]OAuthCode `json:"oauthCodes"`
+	// PaymentEvents remembers which payment webhooks we've already handled
+	PaymentEvents map[string]PaymentEvent `json:"paymentEvents"`
+	ModerationRules map[int]ModerationRule `json:"moderationRules"`
+	Reports map[int]Report `json:"reports"`
+	AuditLog map[int]AuditEntry `json:"auditLog"`
+	Media map[string]Media `json:"media"`
+	// Polls are keyed by the id of the chirp they're on
+	Polls map[int]Poll `json:"polls"`
+	Blocks map[string]UserLink `json:"blocks"`
+	Mutes map[string]UserLink `json:"mutes"`
+	Follows map[string]UserLink `json:"follows"`
+	Likes map[string]Like `json:"likes"`
+	Bookmarks map[string]Bookmark `json:"bookmarks"`
+	Lists map[int]UserList `json:"lists"`
+	LastListID int `json:"lastListId"`
+	Conversations map[int]Conversation `json:"conversations"`
+	LastConversationID int `json:"lastConversationId"`
+	Messages map[int]storedMessage `json:"messages"`
+	LastMessageID int `json:"lastMessageId"`
+	Notifications map[int]Notification `json:"notifications"`
+	LastNotificationID int `json:"lastNotificationId"`
+	// NotificationPrefs are keyed by user id
+	NotificationPrefs map[int]NotificationPrefs `json:"notificationPrefs"`
+	Webhooks map[int]Webhook `json:"webhooks"`
+	LastWebhookID int `json:"lastWebhookId"`
+	// WebhookDeliveries is both the delivery log and, for the pending ones,
+	// the queue of deliveries still to make
+	WebhookDeliveries map[int]WebhookDelivery `json:"webhookDeliveries"`
+	LastWebhookDeliveryID int `json:"lastWebhookDeliveryId"`
+	// ActorKeys are keyed by user id, RemoteActors by the actor's id
+	ActorKeys map[int]ActorKey `json:"actorKeys"`
+	RemoteActors map[string]RemoteActor `json:"remoteActors"`
+	RemoteFollows map[string]RemoteFollow `json:"remoteFollows"`
+	RemoteLikes map[string]RemoteLike `json:"remoteLikes"`
+	RemoteNotes map[string]RemoteNote `json:"remoteNotes"`
+	FederationDeliveries map[int]FederationDelivery `json:"federationDeliveries"`
+	LastFederationDeliveryID int `json:"lastFederationDeliveryId"`
+}
+
+// initMaps makes sure every collection exists, database files written by
+// older versions won't have the newer ones
+func (dbStruct *DBStructure) initMaps() {
+	if dbStruct.Chirps == nil {
+		dbStruct.Chirps = map[int]Chirp{}
+	}
+	if dbStruct.Users == nil {
+		dbStruct.Users = map[int]User{}
+	}
+	if dbStruct.RevokeTokens == nil {
+		dbStruct.RevokeTokens = map[string]RevokedToken{}
+	}
+	if dbStruct.APIKeys == nil {
+		dbStruct.APIKeys = map[string]APIKey{}
+	}
+	if dbStruct.OAuthClients == nil {
+		dbStruct.OAuthClients = map[string]OAuthClient{}
+	}
+	if dbStruct.OAuthCodes == nil {
+		dbStruct.OAuthCodes = map[string]OAuthCode{}
+	}
+	if dbStruct.PaymentEvents == nil {
+		dbStruct.PaymentEvents = map[string]PaymentEvent{}
+	}
+	if dbStruct.ModerationRules == nil {
+		dbStruct.ModerationRules = map[int]ModerationRule{}
+	}
+	if dbStruct.Reports == nil {
+		dbStruct.Reports = map[int]Report{}
+	}
+	if dbStruct.AuditLog == nil {
+		dbStruct.AuditLog = map[int]AuditEntry{}
+	}
+	if dbStruct.Media == nil {
+		dbStruct.Media = map[string]Media{}
+	}
+	if dbStruct.Polls == nil {
+		dbStruct.Polls = map[int]Poll{}
+	}
+	if dbStruct.Blocks == nil {
+		dbStruct.Blocks = map[string]UserLink{}
+	}
+	if dbStruct.Mutes == nil {
+		dbStruct.Mutes = map[string]UserLink{}
+	}
+	if dbStruct.Follows == nil {
+		dbStruct.Follows = map[string]UserLink{}
+	}
+	if dbStruct.Likes == nil {
+		dbStruct.Likes = map[string]Like{}
+	}
+	if dbStruct.Bookmarks == nil {
+		dbStruct.Bookmarks = map[string]Bookmark{}
+	}
+	if dbStruct.Lists == nil {
+		dbStruct.Lists = map[int]UserList{}
+	}
+	if dbStruct.Conversations == nil {
+		dbStruct.Conversations = map[int]Conversation{}
+	}
+	if dbStruct.Messages == nil {
+		dbStruct.Messages = map[int]storedMessage{}
+	}
+	if dbStruct.Notifications == nil {
+		dbStruct.Notifications = map[int]Notification{}
+	}
+	if dbStruct.NotificationPrefs == nil {
+		dbStruct.NotificationPrefs = map[int]NotificationPrefs{}
+	}
+	if dbStruct.Webhooks == nil {
+		dbStruct.Webhooks = map[int]Webhook{}
+	}
+	if dbStruct.WebhookDeliveries == nil {
+		dbStruct.WebhookDeliveries = map[int]WebhookDelivery{}
+	}
+	if dbStruct.ActorKeys == nil {
+		dbStruct.ActorKeys = map[int]ActorKey{}
+	}
+	if dbStruct.RemoteActors == nil {
+		dbStruct.RemoteActors = map[string]RemoteActor{}
+	}
+	if dbStruct.RemoteFollows == nil {
+		dbStruct.RemoteFollows = map[string]RemoteFollow{}
+	}
+	if dbStruct.RemoteLikes == nil {
+		dbStruct.RemoteLikes = map[string]RemoteLike{}
+	}
+	if dbStruct.RemoteNotes == nil {
+		dbStruct.RemoteNotes = map[string]RemoteNote{}
+	}
+	if dbStruct.FederationDeliveries == nil {
+		dbStruct.FederationDeliveries = map[int]FederationDelivery{}
+	}
+}
+
+// fillDefaults fills in fields that records written by older versions
+// don't have
+func (dbStruct *DBStructure) fillDefaults() {
+	for id, chirp := range dbStruct.Chirps {
+		if chirp.Status == "" {
+			chirp.Status = ChirpPublished
+			dbStruct.Chirps[id] = chirp
+		}
+	}
+}
+
+// legacyRevokeTokenTTL is how long a revocation record written before we
+// tracked token expiry is kept around, it matches the refresh token lifetime
+const legacyRevokeTokenTTL = 60 * 24 * time.Hour
+
+// RevokedToken records when a refresh token was revoked and when the token
+// itself expires, after which the record can be purged
+type RevokedToken struct {
+	RevokedAt time.Time `json:"revoked_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UnmarshalJSON also accepts the old format where a revocation was stored
+// as a bare revoke time
+func (rt *RevokedToken) UnmarshalJSON(data []byte) error {
+	var revokedAt time.Time
+	if err := json.Unmarshal(data, &revokedAt); err == nil {
+		rt.RevokedAt = revokedAt
+		rt.ExpiresAt = revokedAt.Add(legacyRevokeTokenTTL)
+		return nil
+	}
+	type revokedToken RevokedToken
+	var decoded revokedToken
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*rt = RevokedToken(decoded)
+	return nil
 }
 
 type User struct {
 	ID int `json:"id"`
 	Email string `json:"email"`
 	Password []byte 
+	// Handle is what others @mention the user by, it's optional
+	Handle string `json:"handle,omitempty"`
+	// DMPolicy is DMEveryone (the default when empty) or DMFollowing
+	DMPolicy string `json:"dm_policy,omitempty"`
+	Role string `json:"role,omitempty"`
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	SuspendedReason string `json:"suspended_reason,omitempty"`
+	PasswordResetRequired bool `json:"password_reset_required,omitempty"`
+	// PasswordResetHash is the hash of the single use token that completes
+	// a forced reset, it's only good until PasswordResetExpiresAt
+	PasswordResetHash []byte `json:"password_reset_hash,omitempty"`
+	PasswordResetExpiresAt *time.Time `json:"password_reset_expires_at,omitempty"`
+	// TokensValidAfter invalidates every token issued before it, it's set
+	// when an admin forces a password reset
+	TokensValidAfter time.Time `json:"tokens_valid_after,omitempty"`
+	IsChirpyRed bool `json:"is_chirpy_red"`
+	// MembershipUpdatedAt is when the payment event that last set
+	// IsChirpyRed happened
+	MembershipUpdatedAt time.Time `json:"membership_updated_at,omitempty"`
 }
 
 // NewDB creates a new database connection
@@ -54,32 +270,29 @@ func getUserByEmail(email string, dbStruct DBStructure) (User, error) {
 	return User{}, errors.New("User does not exist") 
 }
 
+// UpdateUser changes a user's email and password. The password is hashed
+// before taking the write lock, bcrypt is slow
 func (db *DB) UpdateUser(id int, email string, password string) (User, error) {
-	
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		fmt.Println("Error loading DBStructure for creating users")
-		return User{}, err
-	}
-
-	// get user with corresponding id
-	user, ok := dbStruct.Users[id]
-	if !ok {
-		log.Printf("User does not exist")
-		return User{}, errors.New("user does not exist")
-	}
-	
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		fmt.Println("Error hashing user's password")
 		return User{}, err
 	}
 
-	user.Email = email
-	user.Password = hash
-	dbStruct.Users[id] = user
-
-	err = db.writeDB(dbStruct)
+	var user User
+	err = db.update(func(dbStruct *DBStructure) error {
+		// get user with corresponding id
+		var ok bool
+		user, ok = dbStruct.Users[id]
+		if !ok {
+			log.Printf("User does not exist")
+			return errors.New("user does not exist")
+		}
+		user.Email = email
+		user.Password = hash
+		dbStruct.Users[id] = user
+		return nil
+	})
 	if err != nil {
 		fmt.Println("Error saving user to database")
 		return User{}, err
@@ -110,34 +323,32 @@ func (db *DB) LoginUser(email string, password string) (User, error) {
 
 }
 
+// CreateUser saves a new user. Like UpdateUser it hashes the password
+// before taking the write lock
 func (db *DB) CreateUser(email string, password string) (User, error) {
-
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		fmt.Println("Error loading DBStructure for creating users")
-		return User{}, err
-	}
-
-	// check if user already exists with same email before creating
-	_, err = getUserByEmail(email, dbStruct)
-	if err == nil {
-		return User{}, errors.New("user already exists with that email, try again")
-	}
-
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
 		fmt.Println("Error hashing user's password")
 		return User{}, err
 	}
 
-	id := len(dbStruct.Users) + 1
-	newUser := User{
-		ID: id,
-		Email: email,
-		Password: hash, 
-	}
-	dbStruct.Users[id] = newUser
-	err = db.writeDB(dbStruct)
+	var newUser User
+	err = db.update(func(dbStruct *DBStructure) error {
+		// check if user already exists with same email before creating
+		_, err := getUserByEmail(email, *dbStruct)
+		if err == nil {
+			return errors.New("user already exists with that email, try again")
+		}
+
+		id := len(dbStruct.Users) + 1
+		newUser = User{
+			ID: id,
+			Email: email,
+			Password: hash,
+		}
+		dbStruct.Users[id] = newUser
+		return nil
+	})
 	if err != nil {
 		fmt.Println("Error saving user to database")
 		return User{}, err
@@ -146,39 +357,51 @@ func (db *DB) CreateUser(email string, password string) (User, error) {
 
 }
 
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string) (Chirp, error) {
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		fmt.Println("Error loading DBStructure for creating chirps")
-		return Chirp{}, err
-	}
-	id := len(dbStruct.Chirps) + 1
-	newChirp := Chirp{
-		ID: id,
-		Body: body,
-	}
-	dbStruct.Chirps[id] = newChirp
-	err = db.writeDB(dbStruct)
+// CreateChirp saves a new chirp and assigns it an id. mediaIDs are the
+// author's uploads to attach to it, poll is saved along with it if it's
+// not nil
+func (db *DB) CreateChirp(chirp Chirp, mediaIDs []string, poll *Poll) (Chirp, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		// files written before LastChirpID existed start from the highest id
+		for id := range dbStruct.Chirps {
+			if id > dbStruct.LastChirpID {
+				dbStruct.LastChirpID = id
+			}
+		}
+		dbStruct.LastChirpID++
+		chirp.ID = dbStruct.LastChirpID
+		media, err := dbStruct.attachMedia(mediaIDs, chirp.AuthorID, chirp.ID)
+		if err != nil {
+			return err
+		}
+		if len(media) > 0 {
+			chirp.Media = media
+		}
+		if poll != nil {
+			poll.ChirpID = chirp.ID
+			poll.Votes = map[int]int{}
+			dbStruct.Polls[chirp.ID] = *poll
+		}
+		dbStruct.Chirps[chirp.ID] = chirp
+		return nil
+	})
 	if err != nil {
 		return Chirp{}, err
 	}
-	return newChirp, nil
+	return chirp, nil
 }
 
-func (db *DB) AddRevokeToken(tokenString string, revokeTime time.Time) error {
-
-	dbStruct, err := db.loadDB()
-	if err != nil {
-		fmt.Println("Error loading db for adding revoke token")
-		return err
-	}
-
-	// fmt.Println(tokenString, revokeTime)
-
-	dbStruct.RevokeTokens[tokenString] = revokeTime
+// AddRevokeToken records a revoked refresh token along with the token's own
+// expiry. A zero expiresAt means the record is never purged
+func (db *DB) AddRevokeToken(tokenString string, revokedAt time.Time, expiresAt time.Time) error {
 
-	err = db.writeDB(dbStruct)
+	err := db.update(func(dbStruct *DBStructure) error {
+		dbStruct.RevokeTokens[tokenString] = RevokedToken{
+			RevokedAt: revokedAt,
+			ExpiresAt: expiresAt,
+		}
+		return nil
+	})
 	if err != nil {
 		fmt.Println("Error saving revoke token to database")
 		return err
@@ -195,12 +418,28 @@ func (db *DB) GetRevokeToken(tokenString string) (bool, error) {
 		return false, err
 	}
 
-	for token := range dbStruct.RevokeTokens {
-		if token == tokenString {
-			return true, nil 
+	_, ok := dbStruct.RevokeTokens[tokenString]
+	return ok, nil
+}
+
+// PurgeExpiredRevokeTokens removes revocation records for tokens that have
+// expired by now, since those tokens can no longer validate anyway
+func (db *DB) PurgeExpiredRevokeTokens(now time.Time) (int, error) {
+	purged := 0
+	err := db.update(func(dbStruct *DBStructure) error {
+		for token, revoked := range dbStruct.RevokeTokens {
+			if revoked.ExpiresAt.IsZero() || revoked.ExpiresAt.After(now) {
+				continue
+			}
+			delete(dbStruct.RevokeTokens, token)
+			purged++
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-	return false, nil
+	return purged, nil
 }
 
 
@@ -220,12 +459,12 @@ func (db *DB) GetChirps() ([]Chirp, error) {
 }
 
 func (db *DB) createDB() error {
-	dbStructure := DBStructure{
-		Chirps: map[int]Chirp{},
-		Users: map[int]User{},
-		RevokeTokens: map[string]time.Time{},
-	}
-	return db.writeDB(dbStructure)
+	dbStructure := DBStructure{}
+	dbStructure.initMaps()
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	return db.writeFile(dbStructure)
 }
 
 // ensureDB creates a new database file if it doesn't exist
@@ -242,6 +481,28 @@ func (db *DB) loadDB() (DBStructure, error) {
 	db.mux.RLock()
 	defer db.mux.RUnlock()
 
+	return db.readFile()
+}
+
+// update loads the database, applies fn and writes the result back while
+// holding the write lock, so background writers can't clobber each other
+func (db *DB) update(fn func(dbStruct *DBStructure) error) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	dbStruct, err := db.readFile()
+	if err != nil {
+		return err
+	}
+	err = fn(&dbStruct)
+	if err != nil {
+		return err
+	}
+	return db.writeFile(dbStruct)
+}
+
+// readFile reads and decodes the database file, callers must hold db.mux
+func (db *DB) readFile() (DBStructure, error) {
 	chirpDB := DBStructure{}
 	data, err := os.ReadFile(db.path)
 	if errors.Is(err, os.ErrNotExist) {
@@ -253,14 +514,13 @@ func (db *DB) loadDB() (DBStructure, error) {
 		fmt.Println("Error unmarshalling json")
 		return chirpDB, err
 	}
+	chirpDB.initMaps()
+	chirpDB.fillDefaults()
 	return chirpDB, nil
 }
 
-// // writeDB writes the database file to disk
-func (db *DB) writeDB(dbStructure DBStructure) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
+// writeFile encodes and writes the database file, callers must hold db.mux
+func (db *DB) writeFile(dbStructure DBStructure) error {
 	dat, err := json.Marshal(dbStructure)
 	if err != nil {
 		return err
@@ -272,4 +532,3 @@ func (db *DB) writeDB(dbStructure DBStructure) error {
 	}
 	return nil
 }
-
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrBlocked is returned when following someone on either side of a block
+var ErrBlocked = errors.New("you can't follow this user")
+
+func follows(dbStruct *DBStructure) map[string]UserLink { return dbStruct.Follows }
+
+// Follow puts targetID's chirps on userID's timeline
+func (db *DB) Follow(userID, targetID int, at time.Time) error {
+	return db.setUserLink(follows, userID, targetID, true, at, func(dbStruct *DBStructure) error {
+		_, blocked := dbStruct.Blocks[userLinkKey(userID, targetID)]
+		_, blockedBy := dbStruct.Blocks[userLinkKey(targetID, userID)]
+		if blocked || blockedBy {
+			return ErrBlocked
+		}
+		return nil
+	})
+}
+
+// Unfollow takes targetID off userID's timeline
+func (db *DB) Unfollow(userID, targetID int) error {
+	return db.setUserLink(follows, userID, targetID, false, time.Time{}, nil)
+}
+
+// ListFollowing returns the users userID follows, most recent first
+func (db *DB) ListFollowing(userID int) ([]UserLink, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	return listUserLinks(dbStruct.Follows, userID), nil
+}
+
+// ListFollowers returns the users following userID, most recent first
+func (db *DB) ListFollowers(userID int) ([]UserLink, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	links := []UserLink{}
+	for _, link := range dbStruct.Follows {
+		if link.TargetID == userID {
+			links = append(links, link)
+		}
+	}
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].CreatedAt.After(links[j].CreatedAt)
+	})
+	return links, nil
+}
+
+// Following returns the ids of the users userID follows
+func (db *DB) Following(userID int) (map[int]struct{}, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	following := map[int]struct{}{}
+	for _, link := range dbStruct.Follows {
+		if link.UserID == userID {
+			following[link.TargetID] = struct{}{}
+		}
+	}
+	return following, nil
+}
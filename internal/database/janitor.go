@@ -0,0 +1,108 @@
+package database
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Janitor periodically purges revocation records for tokens that have
+// already expired so the revoke list doesn't grow forever. It also clears
+// out OAuth authorization codes that were never exchanged
+type Janitor struct {
+	db       *DB
+	interval time.Duration
+
+	purged  atomic.Int64
+	runs    atomic.Int64
+	lastRun atomic.Int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// JanitorStats is a snapshot of what the janitor has done so far
+type JanitorStats struct {
+	Purged  int64
+	Runs    int64
+	LastRun time.Time
+}
+
+// NewJanitor creates a janitor that sweeps db every interval
+func NewJanitor(db *DB, interval time.Duration) *Janitor {
+	return &Janitor{
+		db:       db,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the janitor in a background goroutine until Stop is called
+func (j *Janitor) Start() {
+	go j.run()
+}
+
+// Stop signals the janitor to exit and waits for the current sweep to finish
+func (j *Janitor) Stop() {
+	j.stopOnce.Do(func() {
+		close(j.stop)
+	})
+	<-j.done
+}
+
+// Stats returns how many records the janitor has purged and when it last ran
+func (j *Janitor) Stats() JanitorStats {
+	stats := JanitorStats{
+		Purged: j.purged.Load(),
+		Runs:   j.runs.Load(),
+	}
+	if lastRun := j.lastRun.Load(); lastRun != 0 {
+		stats.LastRun = time.Unix(0, lastRun)
+	}
+	return stats
+}
+
+func (j *Janitor) run() {
+	defer close(j.done)
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	// sweep once on startup so records left over from downtime go away
+	j.sweep()
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-ticker.C:
+			j.sweep()
+		}
+	}
+}
+
+func (j *Janitor) sweep() {
+	now := time.Now()
+	purged, err := j.db.PurgeExpiredRevokeTokens(now)
+	if err != nil {
+		log.Printf("janitor: error purging revoke tokens: %s", err)
+		return
+	}
+	j.purged.Add(int64(purged))
+	if purged > 0 {
+		log.Printf("janitor: purged %d expired revoke tokens", purged)
+	}
+
+	codes, err := j.db.PurgeExpiredOAuthCodes(now)
+	if err != nil {
+		log.Printf("janitor: error purging oauth codes: %s", err)
+	}
+	if codes > 0 {
+		log.Printf("janitor: purged %d expired oauth codes", codes)
+	}
+
+	j.runs.Add(1)
+	j.lastRun.Store(now.UnixNano())
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// Like is a user liking a chirp, unlike bookmarks everyone can see them
+type Like struct {
+	UserID    int       `json:"user_id"`
+	ChirpID   int       `json:"chirp_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func likeKey(userID, chirpID int) string {
+	return fmt.Sprintf("%d:%d", userID, chirpID)
+}
+
+// AddLike records userID liking chirpID, created is false if they already
+// did
+func (db *DB) AddLike(userID, chirpID int, at time.Time) (like Like, created bool, err error) {
+	err = db.update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Chirps[chirpID]; !ok {
+			return ErrChirpNotFound
+		}
+		key := likeKey(userID, chirpID)
+		if existing, ok := dbStruct.Likes[key]; ok {
+			like = existing
+			return nil
+		}
+		like = Like{UserID: userID, ChirpID: chirpID, CreatedAt: at}
+		dbStruct.Likes[key] = like
+		created = true
+		return nil
+	})
+	return like, created, err
+}
+
+// RemoveLike takes a like back, removing one that doesn't exist is fine
+func (db *DB) RemoveLike(userID, chirpID int) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		delete(dbStruct.Likes, likeKey(userID, chirpID))
+		return nil
+	})
+}
+
+// LikeCounts returns how many likes each of the given chirps has, keyed by
+// chirp id. Likes from other servers count too
+func (db *DB) LikeCounts(chirpIDs []int) (map[int]int, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[int]struct{}{}
+	for _, id := range chirpIDs {
+		wanted[id] = struct{}{}
+	}
+	counts := map[int]int{}
+	for _, like := range dbStruct.Likes {
+		if _, ok := wanted[like.ChirpID]; ok {
+			counts[like.ChirpID]++
+		}
+	}
+	for _, like := range dbStruct.RemoteLikes {
+		if _, ok := wanted[like.ChirpID]; ok {
+			counts[like.ChirpID]++
+		}
+	}
+	return counts, nil
+}
@@ -0,0 +1,192 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// list visibilities
+const (
+	ListPublic  = "public"
+	ListPrivate = "private"
+)
+
+var (
+	ErrListNotFound = errors.New("list does not exist")
+	// ErrNotListOwner is returned when someone tries to change a list
+	// they don't own
+	ErrNotListOwner = errors.New("only the owner can change this list")
+	ErrListFull     = errors.New("list is full")
+)
+
+// MaxListMembers is how many users a list can hold
+const MaxListMembers = 500
+
+// UserList is a named set of users whose chirps make up a timeline
+type UserList struct {
+	ID         int       `json:"id"`
+	OwnerID    int       `json:"owner_id"`
+	Name       string    `json:"name"`
+	Visibility string    `json:"visibility"`
+	Members    []int     `json:"members"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// notOwnerErr is the error for changing someone else's list, private lists
+// don't let on that they exist
+func notOwnerErr(list UserList) error {
+	if list.Visibility == ListPrivate {
+		return ErrListNotFound
+	}
+	return ErrNotListOwner
+}
+
+// CreateList saves a new list and assigns it an id
+func (db *DB) CreateList(list UserList) (UserList, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		for id := range dbStruct.Lists {
+			if id > dbStruct.LastListID {
+				dbStruct.LastListID = id
+			}
+		}
+		dbStruct.LastListID++
+		list.ID = dbStruct.LastListID
+		if list.Members == nil {
+			list.Members = []int{}
+		}
+		dbStruct.Lists[list.ID] = list
+		return nil
+	})
+	if err != nil {
+		return UserList{}, err
+	}
+	return list, nil
+}
+
+// GetList returns the list with the given id
+func (db *DB) GetList(id int) (UserList, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return UserList{}, err
+	}
+	list, ok := dbStruct.Lists[id]
+	if !ok {
+		return UserList{}, ErrListNotFound
+	}
+	return list, nil
+}
+
+// ListsOwnedBy returns ownerID's lists ordered by id, private ones only if
+// includePrivate is set
+func (db *DB) ListsOwnedBy(ownerID int, includePrivate bool) ([]UserList, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	lists := []UserList{}
+	for _, list := range dbStruct.Lists {
+		if list.OwnerID != ownerID || (list.Visibility == ListPrivate && !includePrivate) {
+			continue
+		}
+		lists = append(lists, list)
+	}
+	sort.Slice(lists, func(i, j int) bool {
+		return lists[i].ID < lists[j].ID
+	})
+	return lists, nil
+}
+
+// UpdateList applies fn to one of ownerID's lists and saves it
+func (db *DB) UpdateList(id int, ownerID int, at time.Time, fn func(list *UserList, dbStruct *DBStructure) error) (UserList, error) {
+	var list UserList
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		list, ok = dbStruct.Lists[id]
+		if !ok {
+			return ErrListNotFound
+		}
+		if list.OwnerID != ownerID {
+			return notOwnerErr(list)
+		}
+		err := fn(&list, dbStruct)
+		if err != nil {
+			return err
+		}
+		list.UpdatedAt = at
+		dbStruct.Lists[id] = list
+		return nil
+	})
+	if err != nil {
+		return UserList{}, err
+	}
+	return list, nil
+}
+
+// AddListMember adds userID to a list, adding someone already on it is fine
+func (db *DB) AddListMember(id int, ownerID int, userID int, at time.Time) (UserList, error) {
+	return db.UpdateList(id, ownerID, at, func(list *UserList, dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Users[userID]; !ok {
+			return ErrUserNotFound
+		}
+		for _, member := range list.Members {
+			if member == userID {
+				return nil
+			}
+		}
+		if len(list.Members) >= MaxListMembers {
+			return ErrListFull
+		}
+		list.Members = append(list.Members, userID)
+		return nil
+	})
+}
+
+// RemoveListMember takes userID off a list
+func (db *DB) RemoveListMember(id int, ownerID int, userID int, at time.Time) (UserList, error) {
+	return db.UpdateList(id, ownerID, at, func(list *UserList, dbStruct *DBStructure) error {
+		members := []int{}
+		for _, member := range list.Members {
+			if member != userID {
+				members = append(members, member)
+			}
+		}
+		list.Members = members
+		return nil
+	})
+}
+
+// DeleteList removes one of ownerID's lists
+func (db *DB) DeleteList(id int, ownerID int) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		list, ok := dbStruct.Lists[id]
+		if !ok {
+			return ErrListNotFound
+		}
+		if list.OwnerID != ownerID {
+			return notOwnerErr(list)
+		}
+		delete(dbStruct.Lists, id)
+		return nil
+	})
+}
+
+// ChirpsByAuthors returns the chirps written by any of authorIDs
+func (db *DB) ChirpsByAuthors(authorIDs []int) ([]Chirp, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	authors := map[int]struct{}{}
+	for _, id := range authorIDs {
+		authors[id] = struct{}{}
+	}
+	chirps := []Chirp{}
+	for _, chirp := range dbStruct.Chirps {
+		if _, ok := authors[chirp.AuthorID]; ok {
+			chirps = append(chirps, chirp)
+		}
+	}
+	return chirps, nil
+}
@@ -0,0 +1,96 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrMediaNotFound = errors.New("media does not exist")
+	// ErrMediaInUse is returned when attaching media that's already on
+	// another chirp
+	ErrMediaInUse = errors.New("media is already attached to a chirp")
+)
+
+// Media is an uploaded image. The files themselves live in a blob store,
+// Key and ThumbnailKey point at them
+type Media struct {
+	ID           string    `json:"id"`
+	OwnerID      int       `json:"owner_id"`
+	ContentType  string    `json:"content_type"`
+	Size         int       `json:"size"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	AltText      string    `json:"alt_text,omitempty"`
+	Key          string    `json:"key"`
+	ThumbnailKey string    `json:"thumbnail_key"`
+	URL          string    `json:"url"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	ChirpID      int       `json:"chirp_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ChirpMedia is media as shown on a chirp
+type ChirpMedia struct {
+	ID           string `json:"id"`
+	ContentType  string `json:"content_type"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	AltText      string `json:"alt_text,omitempty"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// CreateMedia saves a record for an uploaded image
+func (db *DB) CreateMedia(media Media) (Media, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		dbStruct.Media[media.ID] = media
+		return nil
+	})
+	if err != nil {
+		return Media{}, err
+	}
+	return media, nil
+}
+
+// GetMedia returns the media with the given id
+func (db *DB) GetMedia(id string) (Media, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return Media{}, err
+	}
+	media, ok := dbStruct.Media[id]
+	if !ok {
+		return Media{}, ErrMediaNotFound
+	}
+	return media, nil
+}
+
+// attachMedia marks ownerID's media as belonging to chirpID and returns
+// them as they'll appear on the chirp. It runs inside an update so media
+// can't end up on two chirps
+func (dbStruct *DBStructure) attachMedia(mediaIDs []string, ownerID int, chirpID int) ([]ChirpMedia, error) {
+	attached := []ChirpMedia{}
+	for _, id := range mediaIDs {
+		media, ok := dbStruct.Media[id]
+		// other people's media look the same as media that doesn't exist
+		if !ok || media.OwnerID != ownerID {
+			return nil, ErrMediaNotFound
+		}
+		if media.ChirpID != 0 {
+			return nil, ErrMediaInUse
+		}
+		media.ChirpID = chirpID
+		dbStruct.Media[id] = media
+		attached = append(attached, ChirpMedia{
+			ID:           media.ID,
+			ContentType:  media.ContentType,
+			Width:        media.Width,
+			Height:       media.Height,
+			AltText:      media.AltText,
+			URL:          media.URL,
+			ThumbnailURL: media.ThumbnailURL,
+		})
+	}
+	return attached, nil
+}
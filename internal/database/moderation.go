@@ -0,0 +1,133 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+const (
+	// ChirpHeld chirps are waiting for a moderator and only their author
+	// and moderators can see them
+	ChirpHeld = "held"
+	// ChirpHidden chirps were taken down by a moderator
+	ChirpHidden = "hidden"
+)
+
+var ErrModerationRuleNotFound = errors.New("moderation rule does not exist")
+
+// ModerationRule is an admin-managed rule the moderation pipeline runs on
+// every chirp
+type ModerationRule struct {
+	ID          int       `json:"id"`
+	Kind        string    `json:"kind"`
+	Pattern     string    `json:"pattern"`
+	Action      string    `json:"action"`
+	Description string    `json:"description,omitempty"`
+	CreatedBy   int       `json:"created_by"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// CreateModerationRule saves a new rule and assigns it an id
+func (db *DB) CreateModerationRule(rule ModerationRule) (ModerationRule, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		for id := range dbStruct.ModerationRules {
+			if id > rule.ID {
+				rule.ID = id
+			}
+		}
+		rule.ID++
+		dbStruct.ModerationRules[rule.ID] = rule
+		return nil
+	})
+	if err != nil {
+		return ModerationRule{}, err
+	}
+	return rule, nil
+}
+
+// ListModerationRules returns every rule ordered by id, which is the order
+// they run in
+func (db *DB) ListModerationRules() ([]ModerationRule, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	rules := []ModerationRule{}
+	for _, rule := range dbStruct.ModerationRules {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].ID < rules[j].ID
+	})
+	return rules, nil
+}
+
+// UpdateModerationRule replaces the rule with rule.ID, keeping who created it
+func (db *DB) UpdateModerationRule(rule ModerationRule) (ModerationRule, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		old, ok := dbStruct.ModerationRules[rule.ID]
+		if !ok {
+			return ErrModerationRuleNotFound
+		}
+		rule.CreatedBy = old.CreatedBy
+		rule.CreatedAt = old.CreatedAt
+		dbStruct.ModerationRules[rule.ID] = rule
+		return nil
+	})
+	if err != nil {
+		return ModerationRule{}, err
+	}
+	return rule, nil
+}
+
+// DeleteModerationRule removes a rule
+func (db *DB) DeleteModerationRule(id int) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.ModerationRules[id]; !ok {
+			return ErrModerationRuleNotFound
+		}
+		delete(dbStruct.ModerationRules, id)
+		return nil
+	})
+}
+
+// ListHeldChirps returns the published chirps waiting for review, oldest
+// first. Held drafts wait until they're published
+func (db *DB) ListHeldChirps() ([]Chirp, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	chirps := []Chirp{}
+	for _, chirp := range dbStruct.Chirps {
+		if chirp.ModerationState == ChirpHeld && chirp.Published() {
+			chirps = append(chirps, chirp)
+		}
+	}
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirps[i].ID < chirps[j].ID
+	})
+	return chirps, nil
+}
+
+// SetChirpModerationState sets a chirp's moderation state, an empty state
+// makes it visible again
+func (db *DB) SetChirpModerationState(id int, state string) (Chirp, error) {
+	var chirp Chirp
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		chirp, ok = dbStruct.Chirps[id]
+		if !ok {
+			return ErrChirpNotFound
+		}
+		chirp.ModerationState = state
+		dbStruct.Chirps[id] = chirp
+		return nil
+	})
+	if err != nil {
+		return Chirp{}, err
+	}
+	return chirp, nil
+}
@@ -0,0 +1,207 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// Notification is something that happened to a user. Events of the same
+// kind on the same chirp are coalesced into one notification while it's
+// unread, ActorIDs are everyone involved, most recent first
+type Notification struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	Kind      string     `json:"kind"`
+	ChirpID   int        `json:"chirp_id,omitempty"`
+	ActorIDs  []int      `json:"actor_ids"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+}
+
+// NotificationPrefs are a user's notification settings, Channels lists the
+// channels each kind of notification goes out on. Users without any have
+// nil prefs, the notify package fills in the defaults
+type NotificationPrefs struct {
+	Channels      map[string][]string `json:"channels"`
+	Digest        bool                `json:"digest"`
+	WebhookURL    string              `json:"webhook_url,omitempty"`
+	WebhookSecret string              `json:"webhook_secret,omitempty"`
+	LastDigestAt  *time.Time          `json:"last_digest_at,omitempty"`
+}
+
+// AddNotification records actorID doing kind to userID, on chirpID if
+// there's one. If userID has an unread notification for the same kind and
+// chirp that was updated within window, actorID is added to it instead
+// and created is false
+func (db *DB) AddNotification(userID int, kind string, chirpID, actorID int, at time.Time, window time.Duration) (n Notification, created bool, err error) {
+	err = db.update(func(dbStruct *DBStructure) error {
+		for id, existing := range dbStruct.Notifications {
+			if existing.UserID != userID || existing.Kind != kind || existing.ChirpID != chirpID {
+				continue
+			}
+			if existing.ReadAt != nil || existing.UpdatedAt.Before(at.Add(-window)) {
+				continue
+			}
+			actors := []int{actorID}
+			for _, other := range existing.ActorIDs {
+				if other != actorID {
+					actors = append(actors, other)
+				}
+			}
+			existing.ActorIDs = actors
+			existing.UpdatedAt = at
+			dbStruct.Notifications[id] = existing
+			n = existing
+			return nil
+		}
+		dbStruct.LastNotificationID++
+		n = Notification{
+			ID:        dbStruct.LastNotificationID,
+			UserID:    userID,
+			Kind:      kind,
+			ChirpID:   chirpID,
+			ActorIDs:  []int{actorID},
+			CreatedAt: at,
+			UpdatedAt: at,
+		}
+		dbStruct.Notifications[n.ID] = n
+		created = true
+		return nil
+	})
+	return n, created, err
+}
+
+// ListNotifications returns a page of userID's notifications, newest first.
+// before is the id to start after, 0 for the first page, more is true
+// when there's another page
+func (db *DB) ListNotifications(userID int, unreadOnly bool, before, limit int) (notifications []Notification, more bool, err error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, false, err
+	}
+	notifications = []Notification{}
+	for _, n := range dbStruct.Notifications {
+		if n.UserID != userID || (before > 0 && n.ID >= before) {
+			continue
+		}
+		if unreadOnly && n.ReadAt != nil {
+			continue
+		}
+		notifications = append(notifications, n)
+	}
+	sort.Slice(notifications, func(i, j int) bool {
+		return notifications[i].ID > notifications[j].ID
+	})
+	if len(notifications) > limit {
+		return notifications[:limit], true, nil
+	}
+	return notifications, false, nil
+}
+
+// UnreadNotifications returns userID's unread notifications updated after
+// since, oldest first
+func (db *DB) UnreadNotifications(userID int, since time.Time) ([]Notification, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	notifications := []Notification{}
+	for _, n := range dbStruct.Notifications {
+		if n.UserID == userID && n.ReadAt == nil && n.UpdatedAt.After(since) {
+			notifications = append(notifications, n)
+		}
+	}
+	sort.Slice(notifications, func(i, j int) bool {
+		return notifications[i].ID < notifications[j].ID
+	})
+	return notifications, nil
+}
+
+// MarkNotificationsRead marks userID's notifications read up to and
+// including upTo, or all of them when upTo is 0. It returns how many were
+// unread
+func (db *DB) MarkNotificationsRead(userID, upTo int, at time.Time) (int, error) {
+	marked := 0
+	err := db.update(func(dbStruct *DBStructure) error {
+		for id, n := range dbStruct.Notifications {
+			if n.UserID != userID || n.ReadAt != nil || (upTo > 0 && n.ID > upTo) {
+				continue
+			}
+			n.ReadAt = &at
+			dbStruct.Notifications[id] = n
+			marked++
+		}
+		return nil
+	})
+	return marked, err
+}
+
+// GetNotificationPrefs returns userID's notification settings, nil if they
+// never changed them
+func (db *DB) GetNotificationPrefs(userID int) (*NotificationPrefs, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := dbStruct.Users[userID]; !ok {
+		return nil, ErrUserNotFound
+	}
+	prefs, ok := dbStruct.NotificationPrefs[userID]
+	if !ok {
+		return nil, nil
+	}
+	return &prefs, nil
+}
+
+// SetNotificationPrefs replaces userID's notification settings. When the
+// digest was off, the first one covers what happens from now on rather
+// than everything still unread
+func (db *DB) SetNotificationPrefs(userID int, prefs NotificationPrefs, at time.Time) (NotificationPrefs, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.Users[userID]; !ok {
+			return ErrUserNotFound
+		}
+		old, ok := dbStruct.NotificationPrefs[userID]
+		prefs.LastDigestAt = old.LastDigestAt
+		if prefs.Digest && (!ok || !old.Digest) {
+			prefs.LastDigestAt = &at
+		}
+		dbStruct.NotificationPrefs[userID] = prefs
+		return nil
+	})
+	return prefs, err
+}
+
+// DigestRecipients returns the ids of users who get a digest and haven't
+// had one since before
+func (db *DB) DigestRecipients(before time.Time) ([]int, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	ids := []int{}
+	for userID, prefs := range dbStruct.NotificationPrefs {
+		if !prefs.Digest {
+			continue
+		}
+		if prefs.LastDigestAt == nil || prefs.LastDigestAt.Before(before) {
+			ids = append(ids, userID)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+// SetDigestSent records that userID was sent a digest at
+func (db *DB) SetDigestSent(userID int, at time.Time) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		prefs, ok := dbStruct.NotificationPrefs[userID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		prefs.LastDigestAt = &at
+		dbStruct.NotificationPrefs[userID] = prefs
+		return nil
+	})
+}
@@ -0,0 +1,120 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrOAuthClientNotFound = errors.New("oauth client not found")
+	// ErrOAuthCodeInvalid covers unknown, expired and already used codes,
+	// the token endpoint reports them all the same way
+	ErrOAuthCodeInvalid = errors.New("authorization code is invalid")
+)
+
+// OAuthClient is a third party app registered to act on behalf of users.
+// Public clients (native and browser apps) have no secret
+type OAuthClient struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	OwnerID      int       `json:"owner_id"`
+	SecretHash   []byte    `json:"secret_hash,omitempty"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Confidential reports whether the client has to authenticate with a secret
+func (c OAuthClient) Confidential() bool {
+	return len(c.SecretHash) > 0
+}
+
+// OAuthCode is an authorization code waiting to be exchanged for tokens.
+// Codes are stored by the hash of the code itself
+type OAuthCode struct {
+	ClientID            string    `json:"client_id"`
+	UserID              int       `json:"user_id"`
+	RedirectURI         string    `json:"redirect_uri"`
+	Scopes              []string  `json:"scopes"`
+	CodeChallenge       string    `json:"code_challenge"`
+	CodeChallengeMethod string    `json:"code_challenge_method"`
+	ExpiresAt           time.Time `json:"expires_at"`
+}
+
+// CreateOAuthClient saves a newly registered client
+func (db *DB) CreateOAuthClient(client OAuthClient) (OAuthClient, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		if _, ok := dbStruct.OAuthClients[client.ID]; ok {
+			return errors.New("oauth client already exists")
+		}
+		dbStruct.OAuthClients[client.ID] = client
+		return nil
+	})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	return client, nil
+}
+
+// GetOAuthClient returns the client with the given id
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	client, ok := dbStruct.OAuthClients[id]
+	if !ok {
+		return OAuthClient{}, ErrOAuthClientNotFound
+	}
+	return client, nil
+}
+
+// CreateOAuthCode stores an authorization code under the hash of the code
+func (db *DB) CreateOAuthCode(codeHash string, code OAuthCode) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		dbStruct.OAuthCodes[codeHash] = code
+		return nil
+	})
+}
+
+// ConsumeOAuthCode deletes an authorization code and returns it, so each
+// code can only ever be exchanged once
+func (db *DB) ConsumeOAuthCode(codeHash string, now time.Time) (OAuthCode, error) {
+	var code OAuthCode
+	expired := false
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		code, ok = dbStruct.OAuthCodes[codeHash]
+		if !ok {
+			return ErrOAuthCodeInvalid
+		}
+		delete(dbStruct.OAuthCodes, codeHash)
+		expired = now.After(code.ExpiresAt)
+		return nil
+	})
+	if err != nil {
+		return OAuthCode{}, err
+	}
+	if expired {
+		return OAuthCode{}, ErrOAuthCodeInvalid
+	}
+	return code, nil
+}
+
+// PurgeExpiredOAuthCodes removes authorization codes nobody exchanged
+func (db *DB) PurgeExpiredOAuthCodes(now time.Time) (int, error) {
+	purged := 0
+	err := db.update(func(dbStruct *DBStructure) error {
+		for codeHash, code := range dbStruct.OAuthCodes {
+			if now.After(code.ExpiresAt) {
+				delete(dbStruct.OAuthCodes, codeHash)
+				purged++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return purged, nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"time"
+)
+
+// PaymentEvent is a payment provider webhook we've already applied
+type PaymentEvent struct {
+	Type   string `json:"type"`
+	UserID int    `json:"user_id"`
+	// OccurredAt is when the provider says the event happened, events are
+	// applied in that order rather than the order they arrive in
+	OccurredAt  time.Time `json:"occurred_at"`
+	ProcessedAt time.Time `json:"processed_at"`
+}
+
+// ApplyPaymentEvent sets a user's Chirpy Red membership in response to a
+// payment webhook. Providers retry deliveries, so an event id that's
+// already been applied is skipped and applied comes back false. So is an
+// event older than the last one applied to the user, or older than
+// retention. Event ids are only remembered for retention, anything past it
+// would be refused as too old anyway
+func (db *DB) ApplyPaymentEvent(eventID string, event PaymentEvent, isChirpyRed bool, retention time.Duration) (applied bool, err error) {
+	err = db.update(func(dbStruct *DBStructure) error {
+		cutoff := event.ProcessedAt.Add(-retention)
+		for id, processed := range dbStruct.PaymentEvents {
+			if processed.ProcessedAt.Before(cutoff) {
+				delete(dbStruct.PaymentEvents, id)
+			}
+		}
+		if _, ok := dbStruct.PaymentEvents[eventID]; ok {
+			return nil
+		}
+		if event.OccurredAt.Before(cutoff) {
+			return nil
+		}
+		user, ok := dbStruct.Users[event.UserID]
+		if !ok {
+			return ErrUserNotFound
+		}
+		dbStruct.PaymentEvents[eventID] = event
+		if !event.OccurredAt.After(user.MembershipUpdatedAt) {
+			// a newer event already decided the membership
+			return nil
+		}
+		user.IsChirpyRed = isChirpyRed
+		user.MembershipUpdatedAt = event.OccurredAt
+		dbStruct.Users[user.ID] = user
+		applied = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return applied, nil
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrPollNotFound = errors.New("chirp has no poll")
+	ErrPollClosed   = errors.New("poll is closed")
+	ErrAlreadyVoted = errors.New("you've already voted in this poll")
+	ErrInvalidVote  = errors.New("poll has no such option")
+)
+
+// Poll is attached to a chirp. Votes holds each voter's choice, tallies
+// are counted from it so they can't drift from the votes themselves
+type Poll struct {
+	ChirpID  int         `json:"chirp_id"`
+	Options  []string    `json:"options"`
+	ClosesAt time.Time   `json:"closes_at"`
+	Votes    map[int]int `json:"votes"`
+}
+
+// Closed reports whether voting has ended by now
+func (p Poll) Closed(now time.Time) bool {
+	return !now.Before(p.ClosesAt)
+}
+
+// Tally counts the votes for each option
+func (p Poll) Tally() []int {
+	counts := make([]int, len(p.Options))
+	for _, option := range p.Votes {
+		if option >= 0 && option < len(counts) {
+			counts[option]++
+		}
+	}
+	return counts
+}
+
+// PollsFor returns the polls on the given chirps, keyed by chirp id.
+// Chirps without a poll are left out
+func (db *DB) PollsFor(chirpIDs []int) (map[int]Poll, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	polls := map[int]Poll{}
+	for _, id := range chirpIDs {
+		if poll, ok := dbStruct.Polls[id]; ok {
+			polls[id] = poll
+		}
+	}
+	return polls, nil
+}
+
+// Vote records userID's vote. Voting and the checks before it happen under
+// the write lock, so concurrent votes can't double count or sneak in after
+// the poll closes
+func (db *DB) Vote(chirpID int, userID int, option int, now time.Time) (Poll, error) {
+	var poll Poll
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		poll, ok = dbStruct.Polls[chirpID]
+		if !ok {
+			return ErrPollNotFound
+		}
+		if poll.Closed(now) {
+			return ErrPollClosed
+		}
+		if _, voted := poll.Votes[userID]; voted {
+			return ErrAlreadyVoted
+		}
+		if option < 0 || option >= len(poll.Options) {
+			return ErrInvalidVote
+		}
+		if poll.Votes == nil {
+			poll.Votes = map[int]int{}
+		}
+		poll.Votes[userID] = option
+		dbStruct.Polls[chirpID] = poll
+		return nil
+	})
+	if err != nil {
+		return Poll{}, err
+	}
+	return poll, nil
+}
@@ -0,0 +1,306 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// what a report can be about
+const (
+	ReportTargetChirp = "chirp"
+	ReportTargetUser  = "user"
+)
+
+// where a report is in the moderation queue
+const (
+	ReportOpen     = "open"
+	ReportClaimed  = "claimed"
+	ReportResolved = "resolved"
+)
+
+// how a moderator can resolve a report
+const (
+	ResolutionDismiss       = "dismiss"
+	ResolutionHideChirp     = "hide_chirp"
+	ResolutionSuspendAuthor = "suspend_author"
+)
+
+var (
+	ErrReportNotFound = errors.New("report does not exist")
+	// ErrReportClaimed is returned when another moderator is already
+	// working on a report
+	ErrReportClaimed  = errors.New("report is claimed by another moderator")
+	ErrReportResolved = errors.New("report is already resolved")
+	// ErrInvalidResolution is returned for resolutions that don't fit the
+	// report, like hiding a chirp on a report about a user
+	ErrInvalidResolution = errors.New("resolution doesn't apply to this report")
+	// ErrSuspendStaff is returned when a report would suspend a moderator
+	// or admin, that has to go through an admin
+	ErrSuspendStaff = errors.New("moderators and admins can't be suspended from the report queue")
+)
+
+// Report is a user flagging a chirp or another user for moderators
+type Report struct {
+	ID         int    `json:"id"`
+	ReporterID int    `json:"reporter_id"`
+	TargetType string `json:"target_type"`
+	TargetID   int    `json:"target_id"`
+	// TargetUserID is the user the report is ultimately about, the author
+	// for chirp reports
+	TargetUserID int        `json:"target_user_id"`
+	Reason       string     `json:"reason"`
+	Comment      string     `json:"comment,omitempty"`
+	Status       string     `json:"status"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ClaimedBy    int        `json:"claimed_by,omitempty"`
+	ClaimedAt    *time.Time `json:"claimed_at,omitempty"`
+	Resolution   string     `json:"resolution,omitempty"`
+	ResolvedBy   int        `json:"resolved_by,omitempty"`
+	ResolvedAt   *time.Time `json:"resolved_at,omitempty"`
+	Note         string     `json:"note,omitempty"`
+}
+
+// ReportFilter narrows down ListReports, zero values match everything
+type ReportFilter struct {
+	Status     string
+	TargetType string
+	ClaimedBy  int
+}
+
+// CreateReport files a report. Each reporter gets one pending report per
+// target, reporting the same thing again returns the existing report and
+// created comes back false
+func (db *DB) CreateReport(report Report) (saved Report, created bool, err error) {
+	err = db.update(func(dbStruct *DBStructure) error {
+		for _, existing := range dbStruct.Reports {
+			if existing.ReporterID == report.ReporterID &&
+				existing.TargetType == report.TargetType &&
+				existing.TargetID == report.TargetID &&
+				existing.Status != ReportResolved {
+				saved = existing
+				return nil
+			}
+		}
+		switch report.TargetType {
+		case ReportTargetChirp:
+			chirp, ok := dbStruct.Chirps[report.TargetID]
+			if !ok {
+				return ErrChirpNotFound
+			}
+			report.TargetUserID = chirp.AuthorID
+		case ReportTargetUser:
+			if _, ok := dbStruct.Users[report.TargetID]; !ok {
+				return ErrUserNotFound
+			}
+			report.TargetUserID = report.TargetID
+		}
+		report.ID = len(dbStruct.Reports) + 1
+		report.Status = ReportOpen
+		dbStruct.Reports[report.ID] = report
+		saved = report
+		created = true
+		return nil
+	})
+	if err != nil {
+		return Report{}, false, err
+	}
+	return saved, created, nil
+}
+
+// GetReport returns the report with the given id
+func (db *DB) GetReport(id int) (Report, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return Report{}, err
+	}
+	report, ok := dbStruct.Reports[id]
+	if !ok {
+		return Report{}, ErrReportNotFound
+	}
+	return report, nil
+}
+
+// ListReports returns the reports matching filter, oldest first so the
+// queue is worked in order
+func (db *DB) ListReports(filter ReportFilter) ([]Report, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	reports := []Report{}
+	for _, report := range dbStruct.Reports {
+		if filter.Status != "" && report.Status != filter.Status {
+			continue
+		}
+		if filter.TargetType != "" && report.TargetType != filter.TargetType {
+			continue
+		}
+		if filter.ClaimedBy != 0 && report.ClaimedBy != filter.ClaimedBy {
+			continue
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].ID < reports[j].ID
+	})
+	return reports, nil
+}
+
+// ClaimReport assigns a report to a moderator so nobody else works on it
+func (db *DB) ClaimReport(id int, moderatorID int, at time.Time) (Report, error) {
+	var report Report
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		report, ok = dbStruct.Reports[id]
+		if !ok {
+			return ErrReportNotFound
+		}
+		if report.Status == ReportResolved {
+			return ErrReportResolved
+		}
+		if report.Status == ReportClaimed {
+			if report.ClaimedBy != moderatorID {
+				return ErrReportClaimed
+			}
+			return nil
+		}
+		report.Status = ReportClaimed
+		report.ClaimedBy = moderatorID
+		report.ClaimedAt = &at
+		dbStruct.Reports[id] = report
+		dbStruct.appendAudit(AuditEntry{
+			ActorID:    moderatorID,
+			Action:     "report.claim",
+			TargetType: report.TargetType,
+			TargetID:   report.TargetID,
+			ReportID:   report.ID,
+			CreatedAt:  at,
+		})
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+	return report, nil
+}
+
+// ReleaseReport puts a claimed report back in the queue. override lets
+// admins release reports claimed by someone else
+func (db *DB) ReleaseReport(id int, moderatorID int, override bool, at time.Time) (Report, error) {
+	var report Report
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		report, ok = dbStruct.Reports[id]
+		if !ok {
+			return ErrReportNotFound
+		}
+		if report.Status == ReportResolved {
+			return ErrReportResolved
+		}
+		if report.Status == ReportOpen {
+			return nil
+		}
+		if report.ClaimedBy != moderatorID && !override {
+			return ErrReportClaimed
+		}
+		report.Status = ReportOpen
+		report.ClaimedBy = 0
+		report.ClaimedAt = nil
+		dbStruct.Reports[id] = report
+		dbStruct.appendAudit(AuditEntry{
+			ActorID:    moderatorID,
+			Action:     "report.release",
+			TargetType: report.TargetType,
+			TargetID:   report.TargetID,
+			ReportID:   report.ID,
+			CreatedAt:  at,
+		})
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+	return report, nil
+}
+
+// ResolveReport closes a report and carries out the resolution. Other
+// pending reports about the same target are closed along with it, since
+// the moderator has dealt with that target. override lets admins resolve
+// reports claimed by someone else. The resolution, the reports it closed
+// and the audit entry are saved together
+func (db *DB) ResolveReport(id int, moderatorID int, resolution string, note string, override bool, at time.Time) (Report, error) {
+	var report Report
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		report, ok = dbStruct.Reports[id]
+		if !ok {
+			return ErrReportNotFound
+		}
+		if report.Status == ReportResolved {
+			return ErrReportResolved
+		}
+		if report.Status == ReportClaimed && report.ClaimedBy != moderatorID && !override {
+			return ErrReportClaimed
+		}
+
+		switch resolution {
+		case ResolutionDismiss:
+		case ResolutionHideChirp:
+			if report.TargetType != ReportTargetChirp {
+				return ErrInvalidResolution
+			}
+			chirp, ok := dbStruct.Chirps[report.TargetID]
+			if !ok {
+				return ErrChirpNotFound
+			}
+			chirp.ModerationState = ChirpHidden
+			dbStruct.Chirps[chirp.ID] = chirp
+		case ResolutionSuspendAuthor:
+			user, ok := dbStruct.Users[report.TargetUserID]
+			if !ok {
+				return ErrUserNotFound
+			}
+			if user.RoleOrDefault() != "user" {
+				return ErrSuspendStaff
+			}
+			if user.SuspendedAt == nil {
+				user.SuspendedAt = &at
+				user.SuspendedReason = "reported for " + report.Reason
+			}
+			dbStruct.Users[user.ID] = user
+		default:
+			return ErrInvalidResolution
+		}
+
+		for _, other := range dbStruct.Reports {
+			if other.Status == ReportResolved ||
+				other.TargetType != report.TargetType ||
+				other.TargetID != report.TargetID {
+				continue
+			}
+			other.Status = ReportResolved
+			other.Resolution = resolution
+			other.ResolvedBy = moderatorID
+			other.ResolvedAt = &at
+			other.Note = note
+			dbStruct.Reports[other.ID] = other
+		}
+		report = dbStruct.Reports[id]
+
+		dbStruct.appendAudit(AuditEntry{
+			ActorID:    moderatorID,
+			Action:     "report." + resolution,
+			TargetType: report.TargetType,
+			TargetID:   report.TargetID,
+			ReportID:   report.ID,
+			Note:       note,
+			CreatedAt:  at,
+		})
+		return nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+	return report, nil
+}
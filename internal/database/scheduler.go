@@ -0,0 +1,76 @@
+package database
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Scheduler publishes scheduled chirps when their time comes
+type Scheduler struct {
+	db       *DB
+	interval time.Duration
+	// onPublish is called for each chirp after it's been published
+	onPublish func(Chirp)
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewScheduler creates a scheduler that checks for due chirps every
+// interval and calls onPublish for each one it publishes
+func NewScheduler(db *DB, interval time.Duration, onPublish func(Chirp)) *Scheduler {
+	return &Scheduler{
+		db:        db,
+		interval:  interval,
+		onPublish: onPublish,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// Start runs the scheduler in a background goroutine until Stop is called
+func (s *Scheduler) Start() {
+	go s.run()
+}
+
+// Stop signals the scheduler to exit and waits for the current run to finish
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+}
+
+func (s *Scheduler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	// catch up on anything that came due while we were down
+	s.publish()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.publish()
+		}
+	}
+}
+
+func (s *Scheduler) publish() {
+	published, err := s.db.PublishDueChirps(time.Now())
+	if err != nil {
+		log.Printf("scheduler: error publishing chirps: %s", err)
+		return
+	}
+	for _, chirp := range published {
+		log.Printf("scheduler: published chirp %d", chirp.ID)
+		if s.onPublish != nil {
+			s.onPublish(chirp)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package database
+
+import (
+	"crypto/subtle"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUserNotFound      = errors.New("user does not exist")
+	ErrHandleTaken       = errors.New("handle is already taken")
+	ErrInvalidResetToken = errors.New("invalid or expired reset token")
+	ErrUserSuspended     = errors.New("account suspended")
+)
+
+// UserFilter narrows down ListUsers, zero values match everyone
+type UserFilter struct {
+	// Query matches part of the email, case insensitively
+	Query     string
+	Role      string
+	Suspended *bool
+}
+
+// GetUser returns the user with the given id
+func (db *DB) GetUser(id int) (User, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return User{}, err
+	}
+	user, ok := dbStruct.Users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// ListUsers returns the users matching filter, ordered by id
+func (db *DB) ListUsers(filter UserFilter) ([]User, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	query := strings.ToLower(filter.Query)
+	users := []User{}
+	for _, user := range dbStruct.Users {
+		if query != "" && !strings.Contains(strings.ToLower(user.Email), query) {
+			continue
+		}
+		if filter.Role != "" && user.RoleOrDefault() != filter.Role {
+			continue
+		}
+		if filter.Suspended != nil && (user.SuspendedAt != nil) != *filter.Suspended {
+			continue
+		}
+		users = append(users, user)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].ID < users[j].ID
+	})
+	return users, nil
+}
+
+// RoleOrDefault returns the user's role, users created before roles
+// existed are plain users
+func (u User) RoleOrDefault() string {
+	if u.Role == "" {
+		return "user"
+	}
+	return u.Role
+}
+
+// updateUser applies fn to the user with the given id and saves it
+func (db *DB) updateUser(id int, fn func(user *User) error) (User, error) {
+	var user User
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		user, ok = dbStruct.Users[id]
+		if !ok {
+			return ErrUserNotFound
+		}
+		err := fn(&user)
+		if err != nil {
+			return err
+		}
+		dbStruct.Users[id] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// SetUserRole changes a user's role. Tokens carry the role they were issued
+// with, so changing it logs the user out everywhere
+func (db *DB) SetUserRole(id int, role string, at time.Time) (User, error) {
+	return db.updateUser(id, func(user *User) error {
+		if user.RoleOrDefault() == role {
+			return nil
+		}
+		user.Role = role
+		user.TokensValidAfter = at
+		return nil
+	})
+}
+
+// SuspendUser stops a user from logging in or using any of their tokens
+func (db *DB) SuspendUser(id int, reason string, at time.Time) (User, error) {
+	return db.updateUser(id, func(user *User) error {
+		user.SuspendedAt = &at
+		user.SuspendedReason = reason
+		return nil
+	})
+}
+
+// UnsuspendUser lifts a suspension
+func (db *DB) UnsuspendUser(id int) (User, error) {
+	return db.updateUser(id, func(user *User) error {
+		user.SuspendedAt = nil
+		user.SuspendedReason = ""
+		return nil
+	})
+}
+
+// RequirePasswordReset logs a user out everywhere and makes them pick a
+// new password before they can log in again. The reset can only be
+// completed with the token hashed in tokenHash, until expiresAt
+func (db *DB) RequirePasswordReset(id int, tokenHash []byte, at time.Time, expiresAt time.Time) (User, error) {
+	return db.updateUser(id, func(user *User) error {
+		user.PasswordResetRequired = true
+		user.PasswordResetHash = tokenHash
+		user.PasswordResetExpiresAt = &expiresAt
+		user.TokensValidAfter = at
+		return nil
+	})
+}
+
+// ResetPassword completes a forced reset: if tokenHash matches the user's
+// unexpired reset token their password is replaced and the token is used up
+func (db *DB) ResetPassword(email string, tokenHash []byte, password string, now time.Time) (User, error) {
+	// hash outside the lock, bcrypt is slow
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return User{}, err
+	}
+	var user User
+	err = db.update(func(dbStruct *DBStructure) error {
+		user, err = getUserByEmail(email, *dbStruct)
+		if err != nil {
+			return ErrInvalidResetToken
+		}
+		if !user.PasswordResetRequired || user.PasswordResetExpiresAt == nil || now.After(*user.PasswordResetExpiresAt) {
+			return ErrInvalidResetToken
+		}
+		if subtle.ConstantTimeCompare(user.PasswordResetHash, tokenHash) != 1 {
+			return ErrInvalidResetToken
+		}
+		if user.SuspendedAt != nil {
+			return ErrUserSuspended
+		}
+		user.Password = hash
+		user.PasswordResetRequired = false
+		user.PasswordResetHash = nil
+		user.PasswordResetExpiresAt = nil
+		dbStruct.Users[user.ID] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// SetHandle gives a user the handle others @mention them by, handles are
+// lowercase and unique. An empty handle removes it
+func (db *DB) SetHandle(id int, handle string) (User, error) {
+	var user User
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		user, ok = dbStruct.Users[id]
+		if !ok {
+			return ErrUserNotFound
+		}
+		for _, other := range dbStruct.Users {
+			if handle != "" && other.Handle == handle && other.ID != id {
+				return ErrHandleTaken
+			}
+		}
+		user.Handle = handle
+		dbStruct.Users[id] = user
+		return nil
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// UsersByHandle returns the users with the given handles, keyed by handle.
+// Handles nobody has are left out
+func (db *DB) UsersByHandle(handles []string) (map[string]User, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	wanted := map[string]struct{}{}
+	for _, handle := range handles {
+		wanted[handle] = struct{}{}
+	}
+	users := map[string]User{}
+	for _, user := range dbStruct.Users {
+		if _, ok := wanted[user.Handle]; ok && user.Handle != "" {
+			users[user.Handle] = user
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,324 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+)
+
+var (
+	ErrWebhookNotFound         = errors.New("webhook not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+// states a webhook delivery can be in
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is an endpoint that's sent events. A user's webhooks get events
+// about them, global ones are set up by admins and get every event
+type Webhook struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Global    bool      `json:"global"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// WebhookAttempt is one try at sending a delivery
+type WebhookAttempt struct {
+	At         time.Time `json:"at"`
+	DurationMS int64     `json:"duration_ms"`
+	// StatusCode is 0 when there was no response
+	StatusCode int    `json:"status_code,omitempty"`
+	Response   string `json:"response,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// WebhookDelivery is one event on its way to one webhook. Pending
+// deliveries are the queue, they're tried at NextAttemptAt
+type WebhookDelivery struct {
+	ID        int              `json:"id"`
+	WebhookID int              `json:"webhook_id"`
+	EventID   string           `json:"event_id"`
+	EventType string           `json:"event_type"`
+	Payload   json.RawMessage  `json:"payload"`
+	Status    string           `json:"status"`
+	Attempts  []WebhookAttempt `json:"attempts"`
+	// RedeliveryOf is the delivery this one was copied from by a manual
+	// redelivery
+	RedeliveryOf  int        `json:"redelivery_of,omitempty"`
+	NextAttemptAt *time.Time `json:"next_attempt_at,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+// webhookOwnedBy reports whether hook is managed by userID, or by admins
+// when global is set
+func webhookOwnedBy(hook Webhook, userID int, global bool) bool {
+	if global {
+		return hook.Global
+	}
+	return !hook.Global && hook.UserID == userID
+}
+
+// CreateWebhook saves a new webhook
+func (db *DB) CreateWebhook(hook Webhook) (Webhook, error) {
+	err := db.update(func(dbStruct *DBStructure) error {
+		dbStruct.LastWebhookID++
+		hook.ID = dbStruct.LastWebhookID
+		dbStruct.Webhooks[hook.ID] = hook
+		return nil
+	})
+	if err != nil {
+		return Webhook{}, err
+	}
+	return hook, nil
+}
+
+// GetWebhook returns webhook id if it's userID's, or a global one when
+// global is set
+func (db *DB) GetWebhook(id, userID int, global bool) (Webhook, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return Webhook{}, err
+	}
+	hook, ok := dbStruct.Webhooks[id]
+	if !ok || !webhookOwnedBy(hook, userID, global) {
+		return Webhook{}, ErrWebhookNotFound
+	}
+	return hook, nil
+}
+
+// ListWebhooks returns userID's webhooks, or the global ones when global is
+// set, oldest first
+func (db *DB) ListWebhooks(userID int, global bool) ([]Webhook, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	hooks := []Webhook{}
+	for _, hook := range dbStruct.Webhooks {
+		if webhookOwnedBy(hook, userID, global) {
+			hooks = append(hooks, hook)
+		}
+	}
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].ID < hooks[j].ID
+	})
+	return hooks, nil
+}
+
+// UpdateWebhook runs fn on webhook id and saves the result, see GetWebhook
+// for who can
+func (db *DB) UpdateWebhook(id, userID int, global bool, fn func(hook *Webhook) error) (Webhook, error) {
+	var hook Webhook
+	err := db.update(func(dbStruct *DBStructure) error {
+		var ok bool
+		hook, ok = dbStruct.Webhooks[id]
+		if !ok || !webhookOwnedBy(hook, userID, global) {
+			return ErrWebhookNotFound
+		}
+		err := fn(&hook)
+		if err != nil {
+			return err
+		}
+		dbStruct.Webhooks[id] = hook
+		return nil
+	})
+	if err != nil {
+		return Webhook{}, err
+	}
+	return hook, nil
+}
+
+// DeleteWebhook removes webhook id along with its delivery log, see
+// GetWebhook for who can
+func (db *DB) DeleteWebhook(id, userID int, global bool) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		hook, ok := dbStruct.Webhooks[id]
+		if !ok || !webhookOwnedBy(hook, userID, global) {
+			return ErrWebhookNotFound
+		}
+		delete(dbStruct.Webhooks, id)
+		for deliveryID, delivery := range dbStruct.WebhookDeliveries {
+			if delivery.WebhookID == id {
+				delete(dbStruct.WebhookDeliveries, deliveryID)
+			}
+		}
+		return nil
+	})
+}
+
+// EnqueueWebhookEvent queues a delivery of payload to every active webhook
+// subscribed to eventType that belongs to ownerID or is global. ownerID
+// is who the event is about, 0 when it's only for global webhooks. It
+// returns how many deliveries were queued
+func (db *DB) EnqueueWebhookEvent(eventID, eventType string, ownerID int, payload []byte, at time.Time) (int, error) {
+	queued := 0
+	err := db.update(func(dbStruct *DBStructure) error {
+		for _, hook := range dbStruct.Webhooks {
+			if !hook.Active || !(hook.Global || (ownerID != 0 && hook.UserID == ownerID)) {
+				continue
+			}
+			subscribed := false
+			for _, event := range hook.Events {
+				if event == eventType {
+					subscribed = true
+				}
+			}
+			if !subscribed {
+				continue
+			}
+			dbStruct.LastWebhookDeliveryID++
+			dbStruct.WebhookDeliveries[dbStruct.LastWebhookDeliveryID] = WebhookDelivery{
+				ID:            dbStruct.LastWebhookDeliveryID,
+				WebhookID:     hook.ID,
+				EventID:       eventID,
+				EventType:     eventType,
+				Payload:       payload,
+				Status:        DeliveryPending,
+				Attempts:      []WebhookAttempt{},
+				NextAttemptAt: &at,
+				CreatedAt:     at,
+			}
+			queued++
+		}
+		return nil
+	})
+	return queued, err
+}
+
+// ClaimWebhookDeliveries returns up to limit pending deliveries that are
+// due at now, oldest first, along with their webhooks. Their next attempt
+// is pushed back to leaseUntil so they aren't claimed again while they're
+// being sent, if the sender dies they're retried then
+func (db *DB) ClaimWebhookDeliveries(now, leaseUntil time.Time, limit int) ([]WebhookDelivery, map[int]Webhook, error) {
+	claimed := []WebhookDelivery{}
+	hooks := map[int]Webhook{}
+	err := db.update(func(dbStruct *DBStructure) error {
+		due := []WebhookDelivery{}
+		for _, delivery := range dbStruct.WebhookDeliveries {
+			if delivery.Status != DeliveryPending || delivery.NextAttemptAt == nil || delivery.NextAttemptAt.After(now) {
+				continue
+			}
+			due = append(due, delivery)
+		}
+		sort.Slice(due, func(i, j int) bool {
+			return due[i].ID < due[j].ID
+		})
+		for _, delivery := range due {
+			if len(claimed) >= limit {
+				break
+			}
+			// deliveries to paused webhooks wait until it's turned back on
+			hook, ok := dbStruct.Webhooks[delivery.WebhookID]
+			if !ok || !hook.Active {
+				continue
+			}
+			delivery.NextAttemptAt = &leaseUntil
+			dbStruct.WebhookDeliveries[delivery.ID] = delivery
+			claimed = append(claimed, delivery)
+			hooks[hook.ID] = hook
+		}
+		return nil
+	})
+	return claimed, hooks, err
+}
+
+// RecordWebhookAttempt adds attempt to delivery id. When retryAt is nil the
+// delivery is done, it succeeded if the endpoint answered with a 2xx and
+// failed for good otherwise
+func (db *DB) RecordWebhookAttempt(id int, attempt WebhookAttempt, retryAt *time.Time) error {
+	return db.update(func(dbStruct *DBStructure) error {
+		delivery, ok := dbStruct.WebhookDeliveries[id]
+		if !ok {
+			// the webhook was deleted while we were sending
+			return nil
+		}
+		delivery.Attempts = append(delivery.Attempts, attempt)
+		delivery.NextAttemptAt = retryAt
+		switch {
+		case retryAt != nil:
+			delivery.Status = DeliveryPending
+		case attempt.StatusCode >= 200 && attempt.StatusCode <= 299:
+			delivery.Status = DeliverySucceeded
+		default:
+			delivery.Status = DeliveryFailed
+		}
+		dbStruct.WebhookDeliveries[id] = delivery
+		return nil
+	})
+}
+
+// ListWebhookDeliveries returns a page of a webhook's delivery log, newest
+// first. before is the id to start after, 0 for the first page, more is
+// true when there's another page
+func (db *DB) ListWebhookDeliveries(webhookID, before, limit int) (deliveries []WebhookDelivery, more bool, err error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return nil, false, err
+	}
+	deliveries = []WebhookDelivery{}
+	for _, delivery := range dbStruct.WebhookDeliveries {
+		if delivery.WebhookID != webhookID || (before > 0 && delivery.ID >= before) {
+			continue
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	sort.Slice(deliveries, func(i, j int) bool {
+		return deliveries[i].ID > deliveries[j].ID
+	})
+	if len(deliveries) > limit {
+		return deliveries[:limit], true, nil
+	}
+	return deliveries, false, nil
+}
+
+// GetWebhookDelivery returns delivery id if it was made to webhookID
+func (db *DB) GetWebhookDelivery(webhookID, id int) (WebhookDelivery, error) {
+	dbStruct, err := db.loadDB()
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	delivery, ok := dbStruct.WebhookDeliveries[id]
+	if !ok || delivery.WebhookID != webhookID {
+		return WebhookDelivery{}, ErrWebhookDeliveryNotFound
+	}
+	return delivery, nil
+}
+
+// RedeliverWebhook queues a fresh copy of delivery id to go out now, the
+// original stays in the log as it was
+func (db *DB) RedeliverWebhook(webhookID, id int, at time.Time) (WebhookDelivery, error) {
+	var redelivery WebhookDelivery
+	err := db.update(func(dbStruct *DBStructure) error {
+		original, ok := dbStruct.WebhookDeliveries[id]
+		if !ok || original.WebhookID != webhookID {
+			return ErrWebhookDeliveryNotFound
+		}
+		dbStruct.LastWebhookDeliveryID++
+		redelivery = WebhookDelivery{
+			ID:            dbStruct.LastWebhookDeliveryID,
+			WebhookID:     original.WebhookID,
+			EventID:       original.EventID,
+			EventType:     original.EventType,
+			Payload:       original.Payload,
+			Status:        DeliveryPending,
+			Attempts:      []WebhookAttempt{},
+			RedeliveryOf:  original.ID,
+			NextAttemptAt: &at,
+			CreatedAt:     at,
+		}
+		dbStruct.WebhookDeliveries[redelivery.ID] = redelivery
+		return nil
+	})
+	return redelivery, err
+}
@@ -0,0 +1,94 @@
+// Package media processes uploaded images and stores them.
+package media
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+var (
+	ErrBlobNotFound = errors.New("blob does not exist")
+	ErrInvalidKey   = errors.New("invalid blob key")
+)
+
+// BlobStore stores opaque blobs by key. Keys are short names made of
+// lowercase letters, digits, dots and dashes
+type BlobStore interface {
+	Put(key string, r io.Reader) error
+	Open(key string) (io.ReadSeekCloser, error)
+	Delete(key string) error
+}
+
+var keyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*$`)
+
+// ValidKey reports whether key can be used with a BlobStore
+func ValidKey(key string) bool {
+	return len(key) <= 128 && keyPattern.MatchString(key)
+}
+
+// LocalStore is a BlobStore keeping each blob in a file in one directory
+type LocalStore struct {
+	dir string
+}
+
+// NewLocalStore creates a store in dir, creating the directory if needed
+func NewLocalStore(dir string) (*LocalStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &LocalStore{dir: dir}, nil
+}
+
+// Put writes r to key. It goes through a temporary file so readers never
+// see a partial blob
+func (s *LocalStore) Put(key string, r io.Reader) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	tmp, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, key))
+}
+
+// Open opens the blob stored under key
+func (s *LocalStore) Open(key string) (io.ReadSeekCloser, error) {
+	if !ValidKey(key) {
+		return nil, ErrInvalidKey
+	}
+	f, err := os.Open(filepath.Join(s.dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Delete removes the blob stored under key, deleting a missing blob is fine
+func (s *LocalStore) Delete(key string) error {
+	if !ValidKey(key) {
+		return ErrInvalidKey
+	}
+	err := os.Remove(filepath.Join(s.dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,279 @@
+package media
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported image type")
+	ErrInvalidImage    = errors.New("couldn't decode image")
+	ErrTooManyPixels   = errors.New("image dimensions are too large")
+	ErrTooManyFrames   = errors.New("animation has too many frames")
+)
+
+// content types we accept, webp is converted to png since there's no
+// encoder for it in the standard library
+var allowedTypes = map[string]struct{}{
+	"image/jpeg": {},
+	"image/png":  {},
+	"image/gif":  {},
+	"image/webp": {},
+}
+
+// Options limits what Process accepts and how big thumbnails get
+type Options struct {
+	// MaxPixels guards against decompression bombs, a tiny file can
+	// declare enormous dimensions. Animations count the pixels of every
+	// frame
+	MaxPixels int
+	// MaxFrames is the most frames an animated gif can have
+	MaxFrames     int
+	ThumbnailSize int
+}
+
+// DefaultOptions allow images up to 40 megapixels and animations up to 500
+// frames, with 320px thumbnails
+var DefaultOptions = Options{
+	MaxPixels:     40_000_000,
+	MaxFrames:     500,
+	ThumbnailSize: 320,
+}
+
+// Image is an encoded image ready to store
+type Image struct {
+	Data        []byte
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// Key is a content address for the image, the same bytes always get the
+// same key so stored images never change
+func (img Image) Key() string {
+	sum := sha256.Sum256(img.Data)
+	ext := map[string]string{
+		"image/jpeg": ".jpg",
+		"image/png":  ".png",
+		"image/gif":  ".gif",
+	}[img.ContentType]
+	return hex.EncodeToString(sum[:]) + ext
+}
+
+// Processed is an upload after re-encoding, along with its thumbnail
+type Processed struct {
+	Original  Image
+	Thumbnail Image
+}
+
+// DetectContentType sniffs the content type from the data itself, we
+// don't trust what the client says it's sending
+func DetectContentType(data []byte) (string, error) {
+	contentType := http.DetectContentType(data)
+	if _, ok := allowedTypes[contentType]; !ok {
+		return contentType, ErrUnsupportedType
+	}
+	return contentType, nil
+}
+
+// Process validates an uploaded image and re-encodes it. Re-encoding only
+// keeps the pixels, which drops EXIF data like GPS coordinates along with
+// any other metadata. A jpeg's EXIF orientation is applied to the pixels
+// first so photos aren't left on their side
+func Process(data []byte, opts Options) (Processed, error) {
+	contentType, err := DetectContentType(data)
+	if err != nil {
+		return Processed{}, err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return Processed{}, ErrInvalidImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > opts.MaxPixels {
+		return Processed{}, ErrTooManyPixels
+	}
+
+	var original Image
+	var frame image.Image
+	if contentType == "image/gif" {
+		// a small file can hold thousands of frames, so they're counted
+		// before any of them are decompressed
+		err = checkGIFFrames(data, opts)
+		if err != nil {
+			return Processed{}, err
+		}
+		// keep every frame so animations still play
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return Processed{}, ErrInvalidImage
+		}
+		frame = g.Image[0]
+		original, err = encodeGIF(&gif.GIF{
+			Image:     g.Image,
+			Delay:     g.Delay,
+			LoopCount: g.LoopCount,
+			Disposal:  g.Disposal,
+			Config:    g.Config,
+		})
+		if err != nil {
+			return Processed{}, err
+		}
+	} else {
+		frame, _, err = image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return Processed{}, ErrInvalidImage
+		}
+		if contentType == "image/jpeg" {
+			frame = orient(frame, jpegOrientation(data))
+		}
+		original, err = encode(frame, contentType)
+		if err != nil {
+			return Processed{}, err
+		}
+	}
+
+	thumbnail, err := encode(resize(frame, opts.ThumbnailSize), contentType)
+	if err != nil {
+		return Processed{}, err
+	}
+	return Processed{
+		Original:  original,
+		Thumbnail: thumbnail,
+	}, nil
+}
+
+// checkGIFFrames walks the blocks of a gif without decoding the image data
+// and rejects it if it has more than opts.MaxFrames frames or more than
+// opts.MaxPixels pixels across all of them
+func checkGIFFrames(data []byte, opts Options) error {
+	// header and logical screen descriptor
+	pos := 13
+	if len(data) < pos {
+		return ErrInvalidImage
+	}
+	if packed := data[10]; packed&0x80 != 0 {
+		pos += 3 << ((packed & 0x07) + 1)
+	}
+	// skipSubBlocks moves pos past a chain of data sub-blocks
+	skipSubBlocks := func() error {
+		for {
+			if pos >= len(data) {
+				return ErrInvalidImage
+			}
+			size := int(data[pos])
+			pos += 1 + size
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+
+	frames, pixels := 0, 0
+	for pos < len(data) {
+		switch data[pos] {
+		case 0x21: // extension
+			pos += 2
+			err := skipSubBlocks()
+			if err != nil {
+				return err
+			}
+		case 0x2C: // image descriptor
+			if pos+10 > len(data) {
+				return ErrInvalidImage
+			}
+			width := int(data[pos+5]) | int(data[pos+6])<<8
+			height := int(data[pos+7]) | int(data[pos+8])<<8
+			packed := data[pos+9]
+			pos += 10
+			if packed&0x80 != 0 {
+				pos += 3 << ((packed & 0x07) + 1)
+			}
+			// LZW minimum code size
+			pos++
+			err := skipSubBlocks()
+			if err != nil {
+				return err
+			}
+			frames++
+			pixels += width * height
+			if frames > opts.MaxFrames {
+				return ErrTooManyFrames
+			}
+			if pixels > opts.MaxPixels {
+				return ErrTooManyPixels
+			}
+		case 0x3B: // trailer
+			return nil
+		default:
+			return ErrInvalidImage
+		}
+	}
+	// the decoder reports a missing trailer itself
+	return nil
+}
+
+// resize scales img down to fit in a size x size box, keeping its aspect
+// ratio. Images that already fit are left alone
+func resize(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	if w >= h {
+		h = max(1, h*size/w)
+		w = size
+	} else {
+		w = max(1, w*size/h)
+		h = size
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+// encode writes a still image as a jpeg if it came in as one, png otherwise
+func encode(img image.Image, contentType string) (Image, error) {
+	var buf bytes.Buffer
+	var err error
+	if contentType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+	} else {
+		contentType = "image/png"
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return Image{}, fmt.Errorf("encoding image: %w", err)
+	}
+	return Image{
+		Data:        buf.Bytes(),
+		ContentType: contentType,
+		Width:       img.Bounds().Dx(),
+		Height:      img.Bounds().Dy(),
+	}, nil
+}
+
+func encodeGIF(g *gif.GIF) (Image, error) {
+	var buf bytes.Buffer
+	err := gif.EncodeAll(&buf, g)
+	if err != nil {
+		return Image{}, fmt.Errorf("encoding image: %w", err)
+	}
+	return Image{
+		Data:        buf.Bytes(),
+		ContentType: "image/gif",
+		Width:       g.Config.Width,
+		Height:      g.Config.Height,
+	}, nil
+}
@@ -0,0 +1,102 @@
+package media
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// landscapeJPEG is a 40x20 jpeg, red on the left half and blue on the
+// right, as a camera held on its side would store a portrait photo
+func landscapeJPEG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 40, 20))
+	for y := 0; y < 20; y++ {
+		for x := 0; x < 40; x++ {
+			c := color.RGBA{R: 255, A: 255}
+			if x >= 20 {
+				c = color.RGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95})
+	if err != nil {
+		t.Fatalf("encoding jpeg: %s", err)
+	}
+	return buf.Bytes()
+}
+
+// withOrientation adds an EXIF segment holding orientation right after the
+// jpeg's start of image marker
+func withOrientation(data []byte, orientation byte) []byte {
+	exif := []byte("Exif\x00\x00")
+	// big endian TIFF header, the first IFD starts right after it
+	exif = append(exif, 'M', 'M', 0, 42, 0, 0, 0, 8)
+	// one entry: orientation, a SHORT with a count of 1, then no next IFD
+	exif = append(exif, 0, 1)
+	exif = append(exif, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, orientation, 0, 0)
+	exif = append(exif, 0, 0, 0, 0)
+
+	size := len(exif) + 2
+	segment := append([]byte{0xFF, 0xE1, byte(size >> 8), byte(size)}, exif...)
+	out := append([]byte{}, data[:2]...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func isRed(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0xC000 && b < 0x4000
+}
+
+func TestProcessAppliesOrientation(t *testing.T) {
+	data := withOrientation(landscapeJPEG(t), 6)
+	if got := jpegOrientation(data); got != 6 {
+		t.Fatalf("jpegOrientation = %d, want 6", got)
+	}
+
+	opts := DefaultOptions
+	opts.ThumbnailSize = 10
+	processed, err := Process(data, opts)
+	if err != nil {
+		t.Fatalf("Process: %s", err)
+	}
+	if processed.Original.Width != 20 || processed.Original.Height != 40 {
+		t.Fatalf("original is %dx%d, want it turned to 20x40", processed.Original.Width, processed.Original.Height)
+	}
+	if processed.Thumbnail.Width != 5 || processed.Thumbnail.Height != 10 {
+		t.Errorf("thumbnail is %dx%d, want 5x10", processed.Thumbnail.Width, processed.Thumbnail.Height)
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(processed.Original.Data))
+	if err != nil {
+		t.Fatalf("decoding the result: %s", err)
+	}
+	// turning a quarter clockwise brings the left half to the top
+	if !isRed(img.At(10, 5)) {
+		t.Errorf("top of the result is %v, want red", img.At(10, 5))
+	}
+	if isRed(img.At(10, 35)) {
+		t.Errorf("bottom of the result is %v, want blue", img.At(10, 35))
+	}
+	if got := jpegOrientation(processed.Original.Data); got != 1 {
+		t.Errorf("result still has orientation %d", got)
+	}
+}
+
+func TestJPEGOrientationWithoutExif(t *testing.T) {
+	if got := jpegOrientation(landscapeJPEG(t)); got != 1 {
+		t.Errorf("jpegOrientation = %d, want 1", got)
+	}
+	processed, err := Process(landscapeJPEG(t), DefaultOptions)
+	if err != nil {
+		t.Fatalf("Process: %s", err)
+	}
+	if processed.Original.Width != 40 || processed.Original.Height != 20 {
+		t.Errorf("original is %dx%d, want 40x20", processed.Original.Width, processed.Original.Height)
+	}
+}
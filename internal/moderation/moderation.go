@@ -0,0 +1,115 @@
+// Package moderation checks chirps against a chain of filters before
+// they're posted.
+package moderation
+
+import (
+	"sync"
+)
+
+// Action is what happens to a chirp when a rule matches
+type Action string
+
+const (
+	// ActionMask replaces the offending text with asterisks
+	ActionMask Action = "mask"
+	// ActionHold posts the chirp but hides it until a moderator reviews it
+	ActionHold Action = "hold"
+	// ActionReject refuses the chirp outright
+	ActionReject Action = "reject"
+)
+
+// severity orders actions so the strictest match wins
+var severity = map[Action]int{
+	ActionMask:   1,
+	ActionHold:   2,
+	ActionReject: 3,
+}
+
+// ValidAction reports whether a is one of the actions above
+func ValidAction(a Action) bool {
+	_, ok := severity[a]
+	return ok
+}
+
+// Match is a single rule that matched a chirp
+type Match struct {
+	Rule   string `json:"rule"`
+	Action Action `json:"action"`
+	Text   string `json:"text"`
+}
+
+// Check is a chirp making its way through the chain. Filters mask by
+// rewriting Body and record what they found in Matches
+type Check struct {
+	Body    string
+	Matches []Match
+}
+
+// Add records a match
+func (c *Check) Add(m Match) {
+	c.Matches = append(c.Matches, m)
+}
+
+// Result is the verdict on a chirp
+type Result struct {
+	// Body is the chirp with masked text replaced
+	Body    string
+	Action  Action
+	Matches []Match
+}
+
+// Rejected reports whether the chirp can't be posted
+func (r Result) Rejected() bool {
+	return r.Action == ActionReject
+}
+
+// Held reports whether the chirp needs a moderator to look at it first
+func (r Result) Held() bool {
+	return r.Action == ActionHold
+}
+
+// Filter inspects a chirp, masking parts of its body or recording a match
+// that holds or rejects it
+type Filter interface {
+	Filter(c *Check)
+}
+
+// Chain runs filters in order
+type Chain struct {
+	mu      sync.RWMutex
+	filters []Filter
+}
+
+// NewChain creates a chain that runs filters in the order given
+func NewChain(filters ...Filter) *Chain {
+	return &Chain{filters: filters}
+}
+
+// Use appends a filter to the end of the chain
+func (ch *Chain) Use(f Filter) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.filters = append(ch.filters, f)
+}
+
+// Run checks body against every filter and returns the strictest verdict
+func (ch *Chain) Run(body string) Result {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	c := &Check{Body: body}
+	for _, f := range ch.filters {
+		f.Filter(c)
+	}
+
+	result := Result{
+		Body:    c.Body,
+		Matches: c.Matches,
+	}
+	for _, m := range c.Matches {
+		if severity[m.Action] > severity[result.Action] {
+			result.Action = m.Action
+		}
+	}
+	return result
+}
@@ -0,0 +1,89 @@
+package moderation
+
+import (
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// leet maps the usual character swaps back to the letters they stand for
+var leet = map[rune]rune{
+	'0': 'o',
+	'1': 'i',
+	'3': 'e',
+	'4': 'a',
+	'5': 's',
+	'7': 't',
+	'@': 'a',
+	'$': 's',
+	'!': 'i',
+	'|': 'l',
+}
+
+// Normalize folds text so lookalikes compare equal: compatibility forms
+// (fullwidth letters, ligatures) are decomposed, accents dropped, case
+// folded and leetspeak undone
+func Normalize(s string) string {
+	t := transform.Chain(norm.NFKD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, s)
+	if err != nil {
+		folded = s
+	}
+	var b strings.Builder
+	for _, r := range strings.ToLower(folded) {
+		if l, ok := leet[r]; ok {
+			r = l
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// token is a run of non-space text in a chirp, with the byte offsets of
+// the word inside it once surrounding punctuation is trimmed
+type token struct {
+	start, end         int
+	coreStart, coreEnd int
+}
+
+func tokenize(s string) []token {
+	var tokens []token
+	start := -1
+	for i, r := range s {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				tokens = append(tokens, newToken(s, start, i))
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, newToken(s, start, len(s)))
+	}
+	return tokens
+}
+
+func newToken(s string, start, end int) token {
+	isWordRune := func(r rune) bool {
+		return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+	}
+	word := s[start:end]
+	core := strings.TrimFunc(word, func(r rune) bool { return !isWordRune(r) })
+	coreStart := start + strings.Index(word, core)
+	if core == "" {
+		coreStart = start
+	}
+	return token{
+		start:     start,
+		end:       end,
+		coreStart: coreStart,
+		coreEnd:   coreStart + len(core),
+	}
+}
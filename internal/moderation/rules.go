@@ -0,0 +1,115 @@
+package moderation
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// RuleKind says how a rule's pattern is matched
+type RuleKind string
+
+const (
+	// RuleWord matches a whole word after normalization, like the word list
+	RuleWord RuleKind = "word"
+	// RuleRegex matches a regular expression against the chirp body
+	RuleRegex RuleKind = "regex"
+)
+
+// Rule is a moderation rule managed by admins at runtime
+type Rule struct {
+	ID      int
+	Kind    RuleKind
+	Pattern string
+	Action  Action
+}
+
+// Validate checks that a rule can be compiled
+func (r Rule) Validate() error {
+	if !ValidAction(r.Action) {
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	switch r.Kind {
+	case RuleWord:
+		if strings.TrimSpace(r.Pattern) == "" || len(strings.Fields(r.Pattern)) != 1 {
+			return fmt.Errorf("word rules need a single word")
+		}
+	case RuleRegex:
+		_, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown rule kind %q", r.Kind)
+	}
+	return nil
+}
+
+type compiledRule struct {
+	name   string
+	re     *regexp.Regexp
+	action Action
+}
+
+// RuleSet is a filter made of admin-managed rules. Word rules behave like
+// a word list, regex rules match anywhere in the body
+type RuleSet struct {
+	mu    sync.RWMutex
+	words *WordList
+	rules []compiledRule
+}
+
+// NewRuleSet creates an empty rule set
+func NewRuleSet() *RuleSet {
+	return &RuleSet{words: NewWordList(nil)}
+}
+
+// SetRules replaces every rule in the set. Rules that don't validate are
+// an error and leave the set unchanged
+func (s *RuleSet) SetRules(rules []Rule) error {
+	words := map[string]Action{}
+	compiled := []compiledRule{}
+	for _, rule := range rules {
+		err := rule.Validate()
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", rule.ID, err)
+		}
+		if rule.Kind == RuleWord {
+			words[rule.Pattern] = rule.Action
+			continue
+		}
+		compiled = append(compiled, compiledRule{
+			name:   fmt.Sprintf("rule %d", rule.ID),
+			re:     regexp.MustCompile(rule.Pattern),
+			action: rule.Action,
+		})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.words = NewWordList(words)
+	s.rules = compiled
+	return nil
+}
+
+// Filter runs the word rules, then each regex rule in order
+func (s *RuleSet) Filter(c *Check) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	s.words.Filter(c)
+	for _, rule := range s.rules {
+		found := rule.re.FindAllString(c.Body, -1)
+		for _, text := range found {
+			c.Add(Match{
+				Rule:   rule.name,
+				Action: rule.action,
+				Text:   text,
+			})
+		}
+		if len(found) > 0 && rule.action == ActionMask {
+			c.Body = rule.re.ReplaceAllString(c.Body, mask)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package moderation
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWords is the built-in word list, a file's words are added to it
+var DefaultWords = map[string]Action{
+	"kerfuffle": ActionMask,
+	"sharbert":  ActionMask,
+	"fornax":    ActionMask,
+}
+
+const mask = "****"
+
+// WordList is a filter that matches whole words after normalization, so
+// "K3rfuffle!" is caught by "kerfuffle". It can be loaded from a file with
+// one word per line, optionally followed by an action:
+//
+//	# comments and blank lines are ignored
+//	kerfuffle
+//	sharbert hold
+//	fornax reject
+//
+// Words without an action are masked
+type WordList struct {
+	path string
+	// base is always on the list, the file's words are added to it and can
+	// change a base word's action
+	base map[string]Action
+
+	mu      sync.RWMutex
+	words   map[string]Action
+	modTime time.Time
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewWordList creates a word list from a fixed set of words
+func NewWordList(words map[string]Action) *WordList {
+	w := &WordList{
+		words: map[string]Action{},
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	for word, action := range words {
+		w.words[Normalize(word)] = action
+	}
+	return w
+}
+
+// LoadWordList reads a word list from path on top of base. Call Watch to
+// pick up edits to the file without restarting
+func LoadWordList(path string, base map[string]Action) (*WordList, error) {
+	w := NewWordList(base)
+	w.path = path
+	w.base = w.words
+	err := w.reload()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Len returns how many words are on the list
+func (w *WordList) Len() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return len(w.words)
+}
+
+// Filter masks, holds or rejects chirps containing listed words
+func (w *WordList) Filter(c *Check) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if len(w.words) == 0 {
+		return
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, t := range tokenize(c.Body) {
+		start, end := t.coreStart, t.coreEnd
+		action, ok := w.words[Normalize(c.Body[t.coreStart:t.coreEnd])]
+		if !ok {
+			// the punctuation may be part of the word, as in "$harbert"
+			start, end = t.start, t.end
+			action, ok = w.words[Normalize(c.Body[t.start:t.end])]
+		}
+		if !ok {
+			continue
+		}
+		c.Add(Match{
+			Rule:   "wordlist",
+			Action: action,
+			Text:   c.Body[start:end],
+		})
+		if action == ActionMask {
+			b.WriteString(c.Body[last:start])
+			b.WriteString(mask)
+			last = end
+		}
+	}
+	if last > 0 {
+		b.WriteString(c.Body[last:])
+		c.Body = b.String()
+	}
+}
+
+// Watch checks the file every interval and reloads it when it changes,
+// until Stop is called. A word list with no file ignores it
+func (w *WordList) Watch(interval time.Duration) {
+	if w.path == "" {
+		close(w.done)
+		return
+	}
+	go w.watch(interval)
+}
+
+// Stop stops watching the file
+func (w *WordList) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+	<-w.done
+}
+
+func (w *WordList) watch(interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(w.path)
+			if err != nil {
+				log.Printf("moderation: error checking word list: %s", err)
+				continue
+			}
+			w.mu.RLock()
+			changed := !info.ModTime().Equal(w.modTime)
+			w.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			// keep the old list if the new one is broken
+			err = w.reload()
+			if err != nil {
+				log.Printf("moderation: error reloading word list: %s", err)
+				continue
+			}
+			log.Printf("moderation: reloaded word list, %d words", w.Len())
+		}
+	}
+}
+
+func (w *WordList) reload() error {
+	f, err := os.Open(w.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	words := map[string]Action{}
+	for word, action := range w.base {
+		words[word] = action
+	}
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		action := ActionMask
+		if len(fields) > 2 {
+			return fmt.Errorf("%s:%d: expected a word and an optional action", w.path, line)
+		}
+		if len(fields) == 2 {
+			action = Action(fields[1])
+			if !ValidAction(action) {
+				return fmt.Errorf("%s:%d: unknown action %q", w.path, line, fields[1])
+			}
+		}
+		words[Normalize(fields[0])] = action
+	}
+	err = scanner.Err()
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.words = words
+	w.modTime = info.ModTime()
+	return nil
+}
@@ -0,0 +1,138 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Digester emails users who turned the digest on a summary of their unread
+// notifications once every period
+type Digester struct {
+	notifier *Notifier
+	// interval is how often it checks for users who are due, period is
+	// how long they go between digests
+	interval time.Duration
+	period   time.Duration
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewDigester creates a digester that checks for due users every interval
+// and sends them what happened since their last digest
+func NewDigester(notifier *Notifier, interval, period time.Duration) *Digester {
+	return &Digester{
+		notifier: notifier,
+		interval: interval,
+		period:   period,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the digester in a background goroutine until Stop is called
+func (d *Digester) Start() {
+	go d.run()
+}
+
+// Stop signals the digester to exit and waits for the current run to finish
+func (d *Digester) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	<-d.done
+}
+
+func (d *Digester) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	// catch up on anyone who came due while we were down
+	d.send(time.Now())
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.send(time.Now())
+		}
+	}
+}
+
+func (d *Digester) send(now time.Time) {
+	store := d.notifier.store
+	userIDs, err := store.DigestRecipients(now.Add(-d.period))
+	if err != nil {
+		log.Printf("digest: error finding recipients: %s", err)
+		return
+	}
+	for _, userID := range userIDs {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		err := d.sendOne(userID, now)
+		if err != nil {
+			log.Printf("digest: error sending to user %d: %s", userID, err)
+		}
+	}
+}
+
+// sendOne emails userID their digest, users with nothing unread don't get
+// an email but still count as done until the next period
+func (d *Digester) sendOne(userID int, now time.Time) error {
+	store := d.notifier.store
+	prefs, err := store.Preferences(userID)
+	if err != nil {
+		return err
+	}
+	since := prefs.LastDigestAt
+	if since.IsZero() {
+		since = now.Add(-d.period)
+	}
+	notifications, err := store.UnreadNotifications(userID, since)
+	if err != nil {
+		return err
+	}
+	if len(notifications) > 0 {
+		msg, err := d.message(userID, notifications)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), d.notifier.opts.Timeout)
+		defer cancel()
+		err = d.notifier.mailer.Send(ctx, msg)
+		if err != nil {
+			return err
+		}
+	}
+	return store.SetDigestSent(userID, now)
+}
+
+func (d *Digester) message(userID int, notifications []Notification) (Message, error) {
+	to, err := d.notifier.store.Email(userID)
+	if err != nil {
+		return Message{}, err
+	}
+	var body strings.Builder
+	for _, notification := range notifications {
+		text, err := d.notifier.Text(notification)
+		if err != nil {
+			return Message{}, err
+		}
+		fmt.Fprintf(&body, "- %s\n", text)
+	}
+	subject := "You have 1 unread notification"
+	if len(notifications) > 1 {
+		subject = fmt.Sprintf("You have %d unread notifications", len(notifications))
+	}
+	return Message{To: to, Subject: subject, Body: body.String()}, nil
+}
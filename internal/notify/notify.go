@@ -0,0 +1,396 @@
+// Package notify turns things that happen to users into notifications,
+// kept in-app and sent by email or webhook as each user's preferences say.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/preview"
+)
+
+// kinds of notification. Chirpy doesn't have threads, so quoting
+// someone's chirp is how you reply to it
+const (
+	KindMention = "mention"
+	KindReply   = "reply"
+	KindLike    = "like"
+	KindFollow  = "follow"
+)
+
+// Kinds is every kind of notification
+var Kinds = []string{KindMention, KindReply, KindLike, KindFollow}
+
+// channels a notification can go out on
+const (
+	ChannelInApp   = "in_app"
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+// Channels is every channel
+var Channels = []string{ChannelInApp, ChannelEmail, ChannelWebhook}
+
+// SignatureHeader carries the auth.SignWebhook signature of a webhook body,
+// signed with the user's webhook secret
+const SignatureHeader = "X-Chirpy-Signature"
+
+// Event is ActorID doing something to UserID. ChirpID is the chirp it
+// happened on: the one liked or quoted, or the one with the mention.
+// Follows don't have one
+type Event struct {
+	Kind    string
+	UserID  int
+	ActorID int
+	ChirpID int
+	At      time.Time
+}
+
+// Notification is one or more events of the same kind on the same chirp,
+// ActorIDs are most recent first
+type Notification struct {
+	ID        int
+	UserID    int
+	Kind      string
+	ChirpID   int
+	ActorIDs  []int
+	UpdatedAt time.Time
+}
+
+// Preferences are what a user wants to hear about and how. Channels maps
+// each kind to the channels it goes out on, kinds with none are off
+type Preferences struct {
+	Channels      map[string][]string
+	Digest        bool
+	WebhookURL    string
+	WebhookSecret string
+	LastDigestAt  time.Time
+}
+
+// DefaultPreferences are for users who haven't set any: everything
+// in-app, nothing else
+func DefaultPreferences() Preferences {
+	channels := map[string][]string{}
+	for _, kind := range Kinds {
+		channels[kind] = []string{ChannelInApp}
+	}
+	return Preferences{Channels: channels}
+}
+
+// Wants reports whether kind goes out on channel
+func (p Preferences) Wants(kind, channel string) bool {
+	for _, c := range p.Channels[kind] {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// Store is where notifications and preferences are kept
+type Store interface {
+	Preferences(userID int) (Preferences, error)
+	// Hidden reports whether userID blocked or muted actorID, or was
+	// blocked by them, they don't hear from each other
+	Hidden(userID, actorID int) (bool, error)
+	// AddNotification stores event, or merges it into the user's unread
+	// notification of the same kind on the same chirp if that was updated
+	// within window, in which case created is false
+	AddNotification(event Event, window time.Duration) (n Notification, created bool, err error)
+	// Email is the address email notifications for userID go to
+	Email(userID int) (string, error)
+	// Names returns how each user is shown in notification text
+	Names(userIDs []int) (map[int]string, error)
+	// DigestRecipients returns the users who want a digest and haven't had
+	// one since before
+	DigestRecipients(before time.Time) ([]int, error)
+	// UnreadNotifications returns userID's unread notifications updated
+	// after since, oldest first
+	UnreadNotifications(userID int, since time.Time) ([]Notification, error)
+	SetDigestSent(userID int, at time.Time) error
+}
+
+// Options configures a Notifier
+type Options struct {
+	// Window is how long an unread notification keeps taking more events,
+	// after that the next one starts a new notification
+	Window time.Duration
+	// Timeout covers sending one email or webhook
+	Timeout   time.Duration
+	Workers   int
+	QueueSize int
+	// AllowPrivate lets webhooks go to private addresses, it's only meant
+	// for development
+	AllowPrivate bool
+}
+
+// DefaultOptions coalesce a day's worth of events
+var DefaultOptions = Options{
+	Window:    24 * time.Hour,
+	Timeout:   10 * time.Second,
+	Workers:   2,
+	QueueSize: 256,
+}
+
+// Notifier delivers events in the background once Start has been called.
+//
+// Events are coalesced into the in-app notification, so a chirp getting
+// liked by five people is one notification. Email and webhooks only go out
+// when a notification is created, not for every event merged into it, so
+// they aren't sent again until the user has read it or the window passed.
+// Users who turned in-app off for a kind get every event by the other
+// channels
+type Notifier struct {
+	store  Store
+	mailer Mailer
+	opts   Options
+	client *http.Client
+
+	events   chan Event
+	stopOnce sync.Once
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewNotifier creates a notifier that keeps notifications in store and
+// sends email with mailer
+func NewNotifier(store Store, mailer Mailer, opts Options) *Notifier {
+	return &Notifier{
+		store:  store,
+		mailer: mailer,
+		opts:   opts,
+		client: &http.Client{
+			Transport: preview.NewTransport(opts.Timeout, opts.AllowPrivate),
+			Timeout:   opts.Timeout,
+			// the webhook URL is where the user said, don't go anywhere else
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		events: make(chan Event, opts.QueueSize),
+		stop:   make(chan struct{}),
+	}
+}
+
+// Notify delivers event in the background. Users aren't told about their
+// own doings. It doesn't block, if the queue is full the event is dropped
+// and it returns false
+func (n *Notifier) Notify(event Event) bool {
+	if event.UserID == event.ActorID {
+		return true
+	}
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	select {
+	case n.events <- event:
+		return true
+	default:
+		log.Printf("notify: queue full, dropping %s for user %d", event.Kind, event.UserID)
+		return false
+	}
+}
+
+// Start runs the background workers until Stop is called
+func (n *Notifier) Start() {
+	for i := 0; i < n.opts.Workers; i++ {
+		n.wg.Add(1)
+		go n.work()
+	}
+}
+
+// Stop signals the workers to exit and waits for in-flight deliveries.
+// Queued events that haven't started are dropped
+func (n *Notifier) Stop() {
+	n.stopOnce.Do(func() {
+		close(n.stop)
+	})
+	n.wg.Wait()
+}
+
+func (n *Notifier) work() {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case event := <-n.events:
+			err := n.deliver(event)
+			if err != nil {
+				log.Printf("notify: error delivering %s to user %d: %s", event.Kind, event.UserID, err)
+			}
+		}
+	}
+}
+
+// deliver stores event and sends it on the channels the user wants
+func (n *Notifier) deliver(event Event) error {
+	hidden, err := n.store.Hidden(event.UserID, event.ActorID)
+	if err != nil || hidden {
+		return err
+	}
+	prefs, err := n.store.Preferences(event.UserID)
+	if err != nil {
+		return err
+	}
+	notification := Notification{
+		UserID:    event.UserID,
+		Kind:      event.Kind,
+		ChirpID:   event.ChirpID,
+		ActorIDs:  []int{event.ActorID},
+		UpdatedAt: event.At,
+	}
+	if prefs.Wants(event.Kind, ChannelInApp) {
+		var created bool
+		notification, created, err = n.store.AddNotification(event, n.opts.Window)
+		if err != nil || !created {
+			return err
+		}
+	}
+	wantsEmail := prefs.Wants(event.Kind, ChannelEmail)
+	wantsWebhook := prefs.Wants(event.Kind, ChannelWebhook) && prefs.WebhookURL != ""
+	if !wantsEmail && !wantsWebhook {
+		return nil
+	}
+	text, err := n.Text(notification)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.opts.Timeout)
+	defer cancel()
+	// one channel failing shouldn't stop the other
+	var emailErr, webhookErr error
+	if wantsEmail {
+		emailErr = n.sendEmail(ctx, event.UserID, text)
+	}
+	if wantsWebhook {
+		webhookErr = n.sendWebhook(ctx, prefs, notification, text)
+	}
+	if emailErr != nil {
+		return fmt.Errorf("sending email: %w", emailErr)
+	}
+	if webhookErr != nil {
+		return fmt.Errorf("sending webhook: %w", webhookErr)
+	}
+	return nil
+}
+
+// Text describes notification, naming the most recent actor or two
+func (n *Notifier) Text(notification Notification) (string, error) {
+	actors := notification.ActorIDs
+	if len(actors) > 2 {
+		actors = actors[:1]
+	}
+	names, err := n.store.Names(actors)
+	if err != nil {
+		return "", err
+	}
+	shown := []string{}
+	for _, id := range actors {
+		shown = append(shown, names[id])
+	}
+	return Summary(notification.Kind, shown, len(notification.ActorIDs)), nil
+}
+
+func (n *Notifier) sendEmail(ctx context.Context, userID int, text string) error {
+	to, err := n.store.Email(userID)
+	if err != nil {
+		return err
+	}
+	return n.mailer.Send(ctx, Message{
+		To:      to,
+		Subject: text,
+		Body:    text + "\n",
+	})
+}
+
+// webhookPayload is the body POSTed to a user's webhook
+type webhookPayload struct {
+	Type         string              `json:"type"`
+	Notification webhookNotification `json:"notification"`
+}
+
+type webhookNotification struct {
+	ID        int       `json:"id,omitempty"`
+	Kind      string    `json:"kind"`
+	ChirpID   int       `json:"chirp_id,omitempty"`
+	ActorIDs  []int     `json:"actor_ids"`
+	Text      string    `json:"text"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (n *Notifier) sendWebhook(ctx context.Context, prefs Preferences, notification Notification, text string) error {
+	body, err := json.Marshal(webhookPayload{
+		Type: "notification",
+		Notification: webhookNotification{
+			ID:        notification.ID,
+			Kind:      notification.Kind,
+			ChirpID:   notification.ChirpID,
+			ActorIDs:  notification.ActorIDs,
+			Text:      text,
+			UpdatedAt: notification.UpdatedAt,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, prefs.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ChirpyBot/1.0 (notifications)")
+	req.Header.Set(SignatureHeader, auth.SignWebhook(prefs.WebhookSecret, body, time.Now()))
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %d", prefs.WebhookURL, resp.StatusCode)
+	}
+	return nil
+}
+
+// Summary is the text of a notification of kind, names are the first one
+// or two of the count actors, most recent first:
+//
+//	@alice liked your chirp
+//	@alice and @bob liked your chirp
+//	@alice and 4 others liked your chirp
+func Summary(kind string, names []string, count int) string {
+	var action string
+	switch kind {
+	case KindMention:
+		action = "mentioned you"
+	case KindReply:
+		action = "quoted your chirp"
+	case KindLike:
+		action = "liked your chirp"
+	case KindFollow:
+		action = "followed you"
+	default:
+		action = kind
+	}
+	who := "someone"
+	switch {
+	case len(names) == 0:
+	case count == 2 && len(names) >= 2:
+		who = names[0] + " and " + names[1]
+	case count == 2:
+		who = names[0] + " and 1 other"
+	case count > 2:
+		who = fmt.Sprintf("%s and %d others", names[0], count-1)
+	default:
+		who = names[0]
+	}
+	return who + " " + action
+}
@@ -0,0 +1,226 @@
+// Package preview fetches link preview cards for URLs in chirps.
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnsupportedURL = errors.New("only http and https links get previews")
+	ErrNotHTML        = errors.New("page is not html")
+	ErrNoMetadata     = errors.New("page has no preview metadata")
+)
+
+// Card is what we show for a link
+type Card struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+	Type        string `json:"type,omitempty"`
+}
+
+// Options configures a Fetcher
+type Options struct {
+	// Timeout covers the whole fetch, redirects included
+	Timeout time.Duration
+	// MaxBytes is how much of a page is read looking for metadata
+	MaxBytes int64
+	// CacheTTL is how long a card is reused, failures are cached for a
+	// tenth of it so a flaky site isn't hammered
+	CacheTTL time.Duration
+	// CacheSize is how many URLs are cached
+	CacheSize int
+	Workers   int
+	QueueSize int
+	// AllowPrivate turns off the private address check, it's only meant
+	// for fetching from servers on localhost in development
+	AllowPrivate bool
+}
+
+// DefaultOptions are sensible limits for fetching arbitrary pages
+var DefaultOptions = Options{
+	Timeout:   5 * time.Second,
+	MaxBytes:  512 * 1024,
+	CacheTTL:  6 * time.Hour,
+	CacheSize: 1000,
+	Workers:   4,
+	QueueSize: 100,
+}
+
+const maxRedirects = 5
+
+type cacheEntry struct {
+	card      Card
+	err       error
+	expiresAt time.Time
+}
+
+type job struct {
+	url  string
+	done func(Card, error)
+}
+
+// Fetcher fetches preview cards, either directly with Fetch or in the
+// background with Enqueue once Start has been called
+type Fetcher struct {
+	opts   Options
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+
+	jobs     chan job
+	stopOnce sync.Once
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewFetcher creates a fetcher with opts
+func NewFetcher(opts Options) *Fetcher {
+	return &Fetcher{
+		opts: opts,
+		client: &http.Client{
+			Transport: NewTransport(opts.Timeout, opts.AllowPrivate),
+			Timeout:   opts.Timeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return errors.New("too many redirects")
+				}
+				if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+					return ErrUnsupportedURL
+				}
+				return nil
+			},
+		},
+		cache: map[string]cacheEntry{},
+		jobs:  make(chan job, opts.QueueSize),
+		stop:  make(chan struct{}),
+	}
+}
+
+// Fetch returns the card for rawURL, from the cache if we've seen it recently
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (Card, error) {
+	now := time.Now()
+	f.mu.Lock()
+	entry, ok := f.cache[rawURL]
+	f.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.card, entry.err
+	}
+
+	card, err := f.fetch(ctx, rawURL)
+	ttl := f.opts.CacheTTL
+	if err != nil {
+		ttl /= 10
+	}
+	f.remember(rawURL, cacheEntry{card: card, err: err, expiresAt: now.Add(ttl)})
+	return card, err
+}
+
+func (f *Fetcher) remember(rawURL string, entry cacheEntry) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.cache) >= f.opts.CacheSize {
+		for key, e := range f.cache {
+			if time.Now().After(e.expiresAt) {
+				delete(f.cache, key)
+			}
+		}
+	}
+	// still full, drop something to make room
+	for key := range f.cache {
+		if len(f.cache) < f.opts.CacheSize {
+			break
+		}
+		delete(f.cache, key)
+	}
+	f.cache[rawURL] = entry
+}
+
+func (f *Fetcher) fetch(ctx context.Context, rawURL string) (Card, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return Card{}, ErrUnsupportedURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return Card{}, err
+	}
+	req.Header.Set("User-Agent", "ChirpyBot/1.0 (link previews)")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return Card{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Card{}, fmt.Errorf("fetching %s: status %d", rawURL, resp.StatusCode)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return Card{}, ErrNotHTML
+	}
+
+	card := parse(io.LimitReader(resp.Body, f.opts.MaxBytes), resp.Request.URL)
+	if card.Title == "" && card.Description == "" && card.ImageURL == "" {
+		return Card{}, ErrNoMetadata
+	}
+	return card, nil
+}
+
+// Start runs the background workers until Stop is called
+func (f *Fetcher) Start() {
+	for i := 0; i < f.opts.Workers; i++ {
+		f.wg.Add(1)
+		go f.work()
+	}
+}
+
+// Stop signals the workers to exit and waits for in-flight fetches.
+// Queued jobs that haven't started are dropped
+func (f *Fetcher) Stop() {
+	f.stopOnce.Do(func() {
+		close(f.stop)
+	})
+	f.wg.Wait()
+}
+
+// Enqueue fetches rawURL in the background and calls done with the result.
+// It doesn't block, if the queue is full the job is dropped and it returns
+// false
+func (f *Fetcher) Enqueue(rawURL string, done func(Card, error)) bool {
+	select {
+	case f.jobs <- job{url: rawURL, done: done}:
+		return true
+	default:
+		log.Printf("preview: queue full, dropping %s", rawURL)
+		return false
+	}
+}
+
+func (f *Fetcher) work() {
+	defer f.wg.Done()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case j := <-f.jobs:
+			ctx, cancel := context.WithTimeout(context.Background(), f.opts.Timeout)
+			card, err := f.Fetch(ctx, j.url)
+			cancel()
+			j.done(card, err)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package preview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testOptions lets the fetcher reach httptest servers, which listen on
+// localhost
+func testOptions() Options {
+	opts := DefaultOptions
+	opts.Timeout = time.Second
+	opts.AllowPrivate = true
+	return opts
+}
+
+func serveHTML(t *testing.T, page string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, page)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestFetchOpenGraph(t *testing.T) {
+	srv := serveHTML(t, `<html><head>
+		<title>Page title</title>
+		<meta property="og:title" content="OG title">
+		<meta property="og:description" content="OG description">
+		<meta property="og:image" content="/cover.png">
+		<meta property="og:site_name" content="Example">
+		<meta name="twitter:title" content="Twitter title">
+	</head><body></body></html>`)
+
+	card, err := NewFetcher(testOptions()).Fetch(context.Background(), srv.URL+"/post")
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	want := Card{
+		URL:         srv.URL + "/post",
+		Title:       "OG title",
+		Description: "OG description",
+		ImageURL:    srv.URL + "/cover.png",
+		SiteName:    "Example",
+	}
+	if card != want {
+		t.Errorf("got %+v, want %+v", card, want)
+	}
+}
+
+func TestFetchTwitterCard(t *testing.T) {
+	srv := serveHTML(t, `<html><head>
+		<title>Page title</title>
+		<meta name="twitter:card" content="summary">
+		<meta name="twitter:title" content="Twitter title">
+		<meta name="twitter:image" content="https://cdn.example.com/img.jpg">
+		<meta name="description" content="Plain description">
+	</head></html>`)
+
+	card, err := NewFetcher(testOptions()).Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if card.Title != "Twitter title" {
+		t.Errorf("title = %q, want the twitter title", card.Title)
+	}
+	if card.Description != "Plain description" {
+		t.Errorf("description = %q, want the meta description", card.Description)
+	}
+	if card.ImageURL != "https://cdn.example.com/img.jpg" {
+		t.Errorf("image = %q", card.ImageURL)
+	}
+	if card.Type != "summary" {
+		t.Errorf("type = %q, want summary", card.Type)
+	}
+}
+
+func TestFetchStopsAtMaxBytes(t *testing.T) {
+	padding := strings.Repeat("<!-- padding -->", 1000)
+	srv := serveHTML(t, `<html><head>`+padding+`<meta property="og:title" content="Too late"></head></html>`)
+
+	opts := testOptions()
+	opts.MaxBytes = int64(len(padding) / 2)
+	_, err := NewFetcher(opts).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("got %v, want ErrNoMetadata", err)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+
+	opts := testOptions()
+	opts.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	_, err := NewFetcher(opts).Fetch(context.Background(), srv.URL)
+	if err == nil {
+		t.Fatal("expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("fetch took %s, the timeout is %s", elapsed, opts.Timeout)
+	}
+}
+
+func TestFetchRejectsNonHTML(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"title": "not a page"}`)
+	}))
+	defer srv.Close()
+
+	_, err := NewFetcher(testOptions()).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrNotHTML) {
+		t.Errorf("got %v, want ErrNotHTML", err)
+	}
+}
+
+func TestFetchRejectsUnsupportedURL(t *testing.T) {
+	for _, rawURL := range []string{"ftp://example.com/file", "javascript:alert(1)", "/relative"} {
+		_, err := NewFetcher(testOptions()).Fetch(context.Background(), rawURL)
+		if !errors.Is(err, ErrUnsupportedURL) {
+			t.Errorf("%s: got %v, want ErrUnsupportedURL", rawURL, err)
+		}
+	}
+}
+
+func TestFetchCache(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<html><head><title>Cached</title></head></html>`)
+	}))
+	defer srv.Close()
+
+	opts := testOptions()
+	opts.CacheTTL = 100 * time.Millisecond
+	f := NewFetcher(opts)
+	for i := 0; i < 3; i++ {
+		_, err := f.Fetch(context.Background(), srv.URL)
+		if err != nil {
+			t.Fatalf("Fetch: %s", err)
+		}
+	}
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("server was hit %d times within the TTL, want 1", got)
+	}
+
+	time.Sleep(opts.CacheTTL + 20*time.Millisecond)
+	_, err := f.Fetch(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("Fetch: %s", err)
+	}
+	if got := hits.Load(); got != 2 {
+		t.Errorf("server was hit %d times after the TTL, want 2", got)
+	}
+}
+
+func TestFetchCachesFailuresBriefly(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	opts := testOptions()
+	opts.CacheTTL = time.Second
+	f := NewFetcher(opts)
+	f.Fetch(context.Background(), srv.URL)
+	f.Fetch(context.Background(), srv.URL)
+	if got := hits.Load(); got != 1 {
+		t.Fatalf("server was hit %d times, want the failure cached", got)
+	}
+
+	// failures are cached for a tenth of the TTL
+	time.Sleep(opts.CacheTTL/10 + 20*time.Millisecond)
+	f.Fetch(context.Background(), srv.URL)
+	if got := hits.Load(); got != 2 {
+		t.Errorf("server was hit %d times, want the failure to have expired", got)
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	srv := serveHTML(t, `<html><head><title>Internal</title></head></html>`)
+
+	opts := testOptions()
+	opts.AllowPrivate = false
+	_, err := NewFetcher(opts).Fetch(context.Background(), srv.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("got %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestFetchBlocksRedirectToPrivateAddress(t *testing.T) {
+	internal := serveHTML(t, `<html><head><title>Internal</title></head></html>`)
+	// the redirect is followed with the same transport, so the final hop
+	// is checked too
+	redirect := httptest.NewServer(http.RedirectHandler(internal.URL, http.StatusFound))
+	defer redirect.Close()
+
+	opts := testOptions()
+	opts.AllowPrivate = false
+	_, err := NewFetcher(opts).Fetch(context.Background(), redirect.URL)
+	if !errors.Is(err, ErrBlockedAddress) {
+		t.Errorf("got %v, want ErrBlockedAddress", err)
+	}
+}
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr   string
+		public bool
+	}{
+		{"127.0.0.1", false},
+		{"127.8.8.8", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"172.31.255.255", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"::", false},
+		{"fc00::1", false},
+		{"fd12:3456::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"8.8.8.8", true},
+		{"172.32.0.1", true},
+		{"1.1.1.1", true},
+		{"2606:4700::1111", true},
+	}
+	for _, tt := range tests {
+		if got := PublicAddr(netip.MustParseAddr(tt.addr)); got != tt.public {
+			t.Errorf("PublicAddr(%s) = %v, want %v", tt.addr, got, tt.public)
+		}
+	}
+}
+
+func TestDialControl(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:80", "10.0.0.5:443", "[::1]:8080", "192.168.0.10:80"} {
+		err := dialControl("tcp", address, nil)
+		if !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("dialControl(%s) = %v, want ErrBlockedAddress", address, err)
+		}
+	}
+	err := dialControl("tcp", "93.184.216.34:443", nil)
+	if err != nil {
+		t.Errorf("dialControl on a public address: %s", err)
+	}
+}
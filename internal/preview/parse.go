@@ -0,0 +1,126 @@
+package preview
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// maxFieldLength caps each field so a page can't stuff a huge title into
+// every chirp that links to it
+const maxFieldLength = 300
+
+// parse reads OpenGraph and Twitter card tags from the head of a page,
+// falling back to the <title> and description meta tags. OpenGraph wins
+// when a page has both
+func parse(r io.Reader, pageURL *url.URL) Card {
+	og := map[string]string{}
+	twitter := map[string]string{}
+	var title, description string
+
+	z := html.NewTokenizer(r)
+	inTitle := false
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return buildCard(pageURL, og, twitter, title, description)
+		case html.TextToken:
+			if inTitle && title == "" {
+				title = strings.TrimSpace(string(z.Text()))
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = false
+			case "head":
+				// everything we want is in the head
+				return buildCard(pageURL, og, twitter, title, description)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch string(name) {
+			case "title":
+				inTitle = tt == html.StartTagToken
+			case "body":
+				return buildCard(pageURL, og, twitter, title, description)
+			case "meta":
+				if !hasAttr {
+					continue
+				}
+				attrs := map[string]string{}
+				for {
+					key, val, more := z.TagAttr()
+					attrs[strings.ToLower(string(key))] = string(val)
+					if !more {
+						break
+					}
+				}
+				property := strings.ToLower(attrs["property"])
+				if property == "" {
+					property = strings.ToLower(attrs["name"])
+				}
+				content := strings.TrimSpace(attrs["content"])
+				switch {
+				case strings.HasPrefix(property, "og:"):
+					setOnce(og, strings.TrimPrefix(property, "og:"), content)
+				case strings.HasPrefix(property, "twitter:"):
+					setOnce(twitter, strings.TrimPrefix(property, "twitter:"), content)
+				case property == "description" && description == "":
+					description = content
+				}
+			}
+		}
+	}
+}
+
+func setOnce(m map[string]string, key, val string) {
+	if _, ok := m[key]; !ok && val != "" {
+		m[key] = val
+	}
+}
+
+func buildCard(pageURL *url.URL, og, twitter map[string]string, title, description string) Card {
+	card := Card{
+		URL:         pageURL.String(),
+		Title:       first(og["title"], twitter["title"], title),
+		Description: first(og["description"], twitter["description"], description),
+		SiteName:    first(og["site_name"], twitter["site"]),
+		Type:        first(og["type"], twitter["card"]),
+	}
+	if canonical := resolve(pageURL, og["url"]); canonical != "" {
+		card.URL = canonical
+	}
+	card.ImageURL = resolve(pageURL, first(og["image"], og["image:url"], twitter["image"], twitter["image:src"]))
+	return card
+}
+
+// first returns the first non-empty value, trimmed to maxFieldLength
+func first(vals ...string) string {
+	for _, val := range vals {
+		if val == "" {
+			continue
+		}
+		if r := []rune(val); len(r) > maxFieldLength {
+			return string(r[:maxFieldLength])
+		}
+		return val
+	}
+	return ""
+}
+
+// resolve turns a possibly relative link on the page into an absolute
+// http(s) URL, anything else is dropped
+func resolve(pageURL *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := pageURL.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
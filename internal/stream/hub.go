@@ -0,0 +1,162 @@
+// Package stream fans events out to live subscribers such as SSE clients.
+package stream
+
+import (
+	"sync"
+)
+
+// Event is one thing that happened. IDs go up by one per event and restart
+// when the process does
+type Event struct {
+	ID   uint64
+	Type string
+	Data any
+}
+
+// Hub broadcasts published events to every subscriber and keeps the last
+// few in a ring buffer so subscribers that reconnect can pick up where they
+// left off.
+//
+// Publishing never blocks: a subscriber whose buffer is full is dropped and
+// its channel closed, it has to reconnect and resume from the ring
+type Hub struct {
+	mu      sync.Mutex
+	ring    []Event
+	next    int // where the next event goes in ring
+	count   int
+	lastID  uint64
+	subs    map[*Subscription]struct{}
+	bufSize int
+	closed  bool
+}
+
+// NewHub creates a hub that remembers the last ringSize events and buffers
+// up to bufSize events per subscriber
+func NewHub(ringSize, bufSize int) *Hub {
+	if ringSize < 1 {
+		ringSize = 1
+	}
+	if bufSize < 1 {
+		bufSize = 1
+	}
+	return &Hub{
+		ring:    make([]Event, ringSize),
+		subs:    map[*Subscription]struct{}{},
+		bufSize: bufSize,
+	}
+}
+
+// Subscription is one subscriber's view of the hub. Events arrive on C,
+// which is closed when the subscriber is dropped, unsubscribes or the hub
+// closes
+type Subscription struct {
+	C <-chan Event
+	// StartID is the id of the last event published before the
+	// subscription started
+	StartID uint64
+
+	c       chan Event
+	hub     *Hub
+	dropped bool
+}
+
+// Dropped reports whether the subscription was closed because it fell
+// behind. Only meaningful once C is closed
+func (s *Subscription) Dropped() bool {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.dropped
+}
+
+// Close unsubscribes, it's safe to call more than once
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// Publish assigns the event an id, remembers it and sends it to every
+// subscriber
+func (h *Hub) Publish(typ string, data any) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastID++
+	event := Event{ID: h.lastID, Type: typ, Data: data}
+	if h.closed {
+		return event
+	}
+	h.ring[h.next] = event
+	h.next = (h.next + 1) % len(h.ring)
+	if h.count < len(h.ring) {
+		h.count++
+	}
+	for sub := range h.subs {
+		select {
+		case sub.c <- event:
+		default:
+			sub.dropped = true
+			h.remove(sub)
+		}
+	}
+	return event
+}
+
+// Subscribe starts a subscription. When lastID isn't 0 the events after it
+// are returned for replay, nothing published in between is missed. ok is
+// false when the events after lastID aren't all in the ring anymore (or
+// lastID is from before a restart), then the subscriber has to catch up
+// some other way
+func (h *Hub) Subscribe(lastID uint64) (sub *Subscription, replay []Event, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := make(chan Event, h.bufSize)
+	sub = &Subscription{C: c, StartID: h.lastID, c: c, hub: h}
+	if h.closed {
+		close(c)
+		return sub, nil, true
+	}
+	h.subs[sub] = struct{}{}
+	if lastID == 0 {
+		return sub, nil, true
+	}
+	if lastID > h.lastID {
+		return sub, nil, false
+	}
+	oldest := h.lastID - uint64(h.count) + 1
+	if lastID+1 < oldest {
+		return sub, nil, false
+	}
+	for i := 0; i < h.count; i++ {
+		event := h.ring[(h.next-h.count+i+len(h.ring))%len(h.ring)]
+		if event.ID > lastID {
+			replay = append(replay, event)
+		}
+	}
+	return sub, replay, true
+}
+
+// Close ends every subscription, later subscriptions start closed
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		h.remove(sub)
+	}
+}
+
+// Subscribers returns how many subscriptions are open
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// remove closes sub, the caller holds h.mu
+func (h *Hub) remove(sub *Subscription) {
+	if _, ok := h.subs[sub]; !ok {
+		return
+	}
+	delete(h.subs, sub)
+	close(sub.c)
+}
@@ -0,0 +1,189 @@
+// Package syndication renders feeds of chirps as Atom and RSS.
+package syndication
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+// Feed is a feed in a format neutral form, entries newest first
+type Feed struct {
+	// ID is a URI that never changes for this feed
+	ID    string
+	Title string
+	// Link is the page the feed is about, if there's one. Self is the
+	// feed's own URL
+	Link    string
+	Self    string
+	Updated time.Time
+	Entries []Entry
+}
+
+// Entry is one item in a feed
+type Entry struct {
+	// ID is a URI that never changes for this entry, even if it's edited
+	ID        string
+	Title     string
+	Link      string
+	Content   string
+	Author    string
+	Published time.Time
+	Updated   time.Time
+	// Enclosures are attached media, only Atom has room for more than one
+	// so RSS leaves them out
+	Enclosures []Enclosure
+}
+
+// Enclosure is a file attached to an entry
+type Enclosure struct {
+	URL  string
+	Type string
+}
+
+// LastUpdated is when the most recently updated entry was, zero for a feed
+// without entries
+func LastUpdated(entries []Entry) time.Time {
+	var last time.Time
+	for _, entry := range entries {
+		if entry.Updated.After(last) {
+			last = entry.Updated
+		}
+	}
+	return last
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    atomAuthor  `xml:"author"`
+	Links     []atomLink  `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+// Atom renders feed as an Atom 1.0 document
+func Atom(feed Feed) ([]byte, error) {
+	doc := atomFeed{
+		ID:      feed.ID,
+		Title:   feed.Title,
+		Updated: feed.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: feed.Self},
+		},
+		Entries: []atomEntry{},
+	}
+	if feed.Link != "" {
+		doc.Links = append(doc.Links, atomLink{Rel: "alternate", Href: feed.Link})
+	}
+	for _, entry := range feed.Entries {
+		links := []atomLink{{Rel: "alternate", Href: entry.Link}}
+		for _, enclosure := range entry.Enclosures {
+			links = append(links, atomLink{Rel: "enclosure", Type: enclosure.Type, Href: enclosure.URL})
+		}
+		doc.Entries = append(doc.Entries, atomEntry{
+			ID:        entry.ID,
+			Title:     entry.Title,
+			Published: entry.Published.UTC().Format(time.RFC3339),
+			Updated:   entry.Updated.UTC().Format(time.RFC3339),
+			Author:    atomAuthor{Name: entry.Author},
+			Links:     links,
+			Content:   atomContent{Type: "text", Body: entry.Content},
+		})
+	}
+	return marshal(doc)
+}
+
+type rssDoc struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Atom    string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Self          atomLink  `xml:"atom:link"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	GUID        rssGUID `xml:"guid"`
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+// RSS renders feed as an RSS 2.0 document. RSS has no updated time for
+// items, readers go by the guid
+func RSS(feed Feed) ([]byte, error) {
+	// a channel must have a link, the feed itself has to do when it isn't
+	// about a page
+	link := feed.Link
+	if link == "" {
+		link = feed.Self
+	}
+	doc := rssDoc{
+		Version: "2.0",
+		Atom:    "http://www.w3.org/2005/Atom",
+		Channel: rssChannel{
+			Title:         feed.Title,
+			Link:          link,
+			Description:   feed.Title,
+			LastBuildDate: feed.Updated.UTC().Format(time.RFC1123Z),
+			Self:          atomLink{Rel: "self", Type: "application/rss+xml", Href: feed.Self},
+			Items:         []rssItem{},
+		},
+	}
+	for _, entry := range feed.Entries {
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			GUID:        rssGUID{Value: entry.ID},
+			Title:       entry.Title,
+			Link:        entry.Link,
+			Description: entry.Content,
+			PubDate:     entry.Published.UTC().Format(time.RFC1123Z),
+		})
+	}
+	return marshal(doc)
+}
+
+func marshal(doc any) ([]byte, error) {
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(body, '\n')...), nil
+}
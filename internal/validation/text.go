@@ -0,0 +1,139 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/unicode/norm"
+)
+
+// URLLength is how many characters a link counts as no matter how long it
+// is, so people aren't punished for long URLs
+const URLLength = 23
+
+// MaxBytesPerCharacter caps how many bytes text can take up per character of
+// its limit. Length counts a URL or a grapheme with any number of combining
+// marks as one short run, so it alone doesn't bound the size of the text
+const MaxBytesPerCharacter = 4
+
+var urlPattern = regexp.MustCompile(`https?://[^\s]+`)
+
+var (
+	handlePattern = regexp.MustCompile(`^[a-z0-9_]{3,15}$`)
+	// a mention can't follow a word character or another @, so emails
+	// don't count
+	mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9_]{3,15})\b`)
+	// hashtags follow the same rule, so #anchors in URLs aren't tags
+	hashtagPattern = regexp.MustCompile(`(?:^|[^\w#/])#([A-Za-z0-9_]{1,50})\b`)
+	tagPattern     = regexp.MustCompile(`^[a-z0-9_]{1,50}$`)
+)
+
+// NormalizeText puts text in NFC form and strips control characters, other
+// than newlines and tabs, along with the bidi overrides that can be used
+// to disguise text
+func NormalizeText(s string) string {
+	s = norm.NFC.String(s)
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\t':
+			return r
+		case unicode.IsControl(r):
+			return -1
+		case r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// URLs returns the links in s in the order they appear. Punctuation at the
+// end of a link is more likely to end the sentence, so it's left off
+func URLs(s string) []string {
+	urls := urlPattern.FindAllString(s, -1)
+	for i, u := range urls {
+		urls[i] = strings.TrimRight(u, ".,;:!?)]}'\"")
+	}
+	return urls
+}
+
+// Mentions returns the handles @mentioned in s, lowercased, each once and in
+// the order they first appear
+func Mentions(s string) []string {
+	handles := []string{}
+	seen := map[string]bool{}
+	for _, match := range mentionPattern.FindAllStringSubmatch(s, -1) {
+		handle := strings.ToLower(match[1])
+		if !seen[handle] {
+			seen[handle] = true
+			handles = append(handles, handle)
+		}
+	}
+	return handles
+}
+
+// Hashtags returns the #tags in s, lowercased, each once and in the order
+// they first appear
+func Hashtags(s string) []string {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, match := range hashtagPattern.FindAllStringSubmatch(s, -1) {
+		tag := strings.ToLower(match[1])
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// IsTag reports whether tag is a lowercased hashtag without the #
+func IsTag(tag string) bool {
+	return tagPattern.MatchString(tag)
+}
+
+// Length counts the user-perceived characters in s, so an emoji made of
+// several code points counts once. Each URL counts as URLLength
+func Length(s string) int {
+	length := 0
+	last := 0
+	for _, loc := range urlPattern.FindAllStringIndex(s, -1) {
+		length += uniseg.GraphemeClusterCount(s[last:loc[0]]) + URLLength
+		last = loc[1]
+	}
+	return length + uniseg.GraphemeClusterCount(s[last:])
+}
+
+// Text normalizes a required text field and checks it fits in maxLength
+// characters, recording any problem in errs. It returns the normalized text
+func Text(errs *Errors, field string, s string, maxLength int) string {
+	s = NormalizeText(s)
+	if strings.TrimSpace(s) == "" {
+		errs.Add(field, CodeRequired, field+" can't be empty")
+		return s
+	}
+	if length := Length(s); length > maxLength {
+		*errs = append(*errs, FieldError{
+			Field:   field,
+			Code:    CodeTooLong,
+			Message: fmt.Sprintf("%s is %d characters, the limit is %d", field, length, maxLength),
+			Limit:   maxLength,
+			Length:  length,
+		})
+	} else if maxBytes := maxLength * MaxBytesPerCharacter; len(s) > maxBytes {
+		errs.Add(field, CodeTooLong, fmt.Sprintf("%s is %d bytes, the limit is %d", field, len(s), maxBytes))
+	}
+	return s
+}
+
+// Handle lowercases a handle and checks it's 3 to 15 letters, digits or
+// underscores, recording any problem in errs. An empty handle is fine
+func Handle(errs *Errors, field string, s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s != "" && !handlePattern.MatchString(s) {
+		errs.Add(field, CodeInvalid, field+" must be 3 to 15 letters, digits or underscores")
+	}
+	return s
+}
@@ -0,0 +1,53 @@
+// Package validation checks user input and reports problems per field.
+package validation
+
+import (
+	"fmt"
+	"strings"
+)
+
+// error codes clients can switch on
+const (
+	CodeRequired = "required"
+	CodeTooLong  = "too_long"
+	CodeInvalid  = "invalid"
+)
+
+// FieldError is one problem with one field of a request
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Limit and Length are set for too_long errors
+	Limit  int `json:"limit,omitempty"`
+	Length int `json:"length,omitempty"`
+}
+
+// Errors collects every problem found in a request, so clients can show
+// them all at once
+type Errors []FieldError
+
+// Add records a problem with field
+func (e *Errors) Add(field string, code string, message string) {
+	*e = append(*e, FieldError{
+		Field:   field,
+		Code:    code,
+		Message: message,
+	})
+}
+
+// Err returns e as an error, or nil if nothing was wrong
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e Errors) Error() string {
+	msgs := []string{}
+	for _, fe := range e {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", fe.Field, fe.Message))
+	}
+	return strings.Join(msgs, "; ")
+}
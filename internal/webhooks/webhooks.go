@@ -0,0 +1,273 @@
+// Package webhooks sends events to the endpoints users and admins register,
+// retrying failed deliveries from a persistent queue.
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/preview"
+)
+
+// event types a webhook can subscribe to
+const (
+	EventChirpCreated = "chirp.created"
+	EventChirpLiked   = "chirp.liked"
+	EventUserCreated  = "user.created"
+	EventUserFollowed = "user.followed"
+)
+
+// EventTypes is every event type
+var EventTypes = []string{EventChirpCreated, EventChirpLiked, EventUserCreated, EventUserFollowed}
+
+// headers sent with every delivery. The signature is auth.SignWebhook of
+// the body with the webhook's secret
+const (
+	SignatureHeader = "X-Chirpy-Signature"
+	EventHeader     = "X-Chirpy-Event"
+	DeliveryHeader  = "X-Chirpy-Delivery"
+)
+
+// maxResponseBytes is how much of an endpoint's response is kept for the
+// delivery log
+const maxResponseBytes = 1024
+
+// Delivery is one event to send to one endpoint, Attempts is how many
+// times it's been tried before
+type Delivery struct {
+	ID        int
+	EventType string
+	URL       string
+	Secret    string
+	Payload   []byte
+	Attempts  int
+}
+
+// Attempt is how one try at a delivery went
+type Attempt struct {
+	At       time.Time
+	Duration time.Duration
+	// StatusCode is 0 when the endpoint couldn't be reached
+	StatusCode int
+	// Response is the start of the response body
+	Response string
+	Error    string
+}
+
+// Succeeded reports whether the endpoint took the delivery
+func (a Attempt) Succeeded() bool {
+	return a.StatusCode >= 200 && a.StatusCode <= 299
+}
+
+// Store is the delivery queue
+type Store interface {
+	// ClaimDeliveries returns up to limit deliveries due at now and holds
+	// them until leaseUntil, so they're only sent once unless the sender
+	// dies
+	ClaimDeliveries(now, leaseUntil time.Time, limit int) ([]Delivery, error)
+	// RecordAttempt saves attempt, retryAt is when to try again or zero
+	// when the delivery is done
+	RecordAttempt(deliveryID int, attempt Attempt, retryAt time.Time) error
+}
+
+// Options configures a Dispatcher
+type Options struct {
+	// Interval is how often the queue is checked for due deliveries
+	Interval time.Duration
+	// Timeout covers one attempt
+	Timeout   time.Duration
+	Workers   int
+	BatchSize int
+	// a failed delivery is retried after BaseBackoff, doubling each time
+	// up to MaxBackoff, until it's been tried MaxAttempts times
+	MaxAttempts int
+	BaseBackoff time.Duration
+	MaxBackoff  time.Duration
+	// AllowPrivate lets webhooks go to private addresses, it's only meant
+	// for development
+	AllowPrivate bool
+}
+
+// DefaultOptions retry for about a day and a half
+var DefaultOptions = Options{
+	Interval:    5 * time.Second,
+	Timeout:     10 * time.Second,
+	Workers:     4,
+	BatchSize:   50,
+	MaxAttempts: 10,
+	BaseBackoff: 30 * time.Second,
+	MaxBackoff:  12 * time.Hour,
+}
+
+// Backoff is how long to wait after a delivery has failed attempts times
+func (o Options) Backoff(attempts int) time.Duration {
+	backoff := o.BaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= o.MaxBackoff {
+			return o.MaxBackoff
+		}
+	}
+	return backoff
+}
+
+// Dispatcher sends queued deliveries in the background once Start has
+// been called
+type Dispatcher struct {
+	store  Store
+	opts   Options
+	client *http.Client
+
+	wake     chan struct{}
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewDispatcher creates a dispatcher sending the deliveries queued in store
+func NewDispatcher(store Store, opts Options) *Dispatcher {
+	return &Dispatcher{
+		store: store,
+		opts:  opts,
+		client: &http.Client{
+			Transport: preview.NewTransport(opts.Timeout, opts.AllowPrivate),
+			Timeout:   opts.Timeout,
+			// a redirect counts as a failure, the endpoint should be
+			// registered with its real URL
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+// Start runs the dispatcher in a background goroutine until Stop is called
+func (d *Dispatcher) Start() {
+	go d.run()
+}
+
+// Stop signals the dispatcher to exit and waits for in-flight deliveries.
+// Anything still queued is sent after the next Start
+func (d *Dispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	<-d.done
+}
+
+// Wake tells the dispatcher there's something new in the queue, so it
+// goes out without waiting for the next check
+func (d *Dispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		d.drain()
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+// drain sends due deliveries in batches until there are none left
+func (d *Dispatcher) drain() {
+	for {
+		select {
+		case <-d.stop:
+			return
+		default:
+		}
+		now := time.Now()
+		// held until the whole batch has surely been tried, so if we die
+		// part way through the rest go out after a restart
+		leaseUntil := now.Add(d.opts.Timeout * time.Duration(d.opts.BatchSize/d.opts.Workers+1))
+		deliveries, err := d.store.ClaimDeliveries(now, leaseUntil, d.opts.BatchSize)
+		if err != nil {
+			log.Printf("webhooks: error claiming deliveries: %s", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+		d.sendAll(deliveries)
+		if len(deliveries) < d.opts.BatchSize {
+			return
+		}
+	}
+}
+
+func (d *Dispatcher) sendAll(deliveries []Delivery) {
+	sem := make(chan struct{}, d.opts.Workers)
+	var wg sync.WaitGroup
+	for _, delivery := range deliveries {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(delivery Delivery) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			attempt := d.Send(delivery)
+			var retryAt time.Time
+			attempts := delivery.Attempts + 1
+			if !attempt.Succeeded() && attempts < d.opts.MaxAttempts {
+				retryAt = attempt.At.Add(d.opts.Backoff(attempts))
+			}
+			err := d.store.RecordAttempt(delivery.ID, attempt, retryAt)
+			if err != nil {
+				log.Printf("webhooks: error recording delivery %d: %s", delivery.ID, err)
+			}
+		}(delivery)
+	}
+	wg.Wait()
+}
+
+// Send makes one attempt at delivery
+func (d *Dispatcher) Send(delivery Delivery) (attempt Attempt) {
+	attempt.At = time.Now()
+	defer func() {
+		attempt.Duration = time.Since(attempt.At)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), d.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "ChirpyBot/1.0 (webhooks)")
+	req.Header.Set(EventHeader, delivery.EventType)
+	req.Header.Set(DeliveryHeader, strconv.Itoa(delivery.ID))
+	req.Header.Set(SignatureHeader, auth.SignWebhook(delivery.Secret, delivery.Payload, attempt.At))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	attempt.Response = string(body)
+	return attempt
+}
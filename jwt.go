@@ -1,2 +1,10 @@
 package main
 
+import "net/http"
+
+// jwksHandler publishes the public keys other services can use to verify
+// our tokens
+func (cfg *apiConfig) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	respondWithJSON(w, 200, cfg.keyring.JWKS())
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/notify"
+	"github.com/staf3333/chirpy/internal/webhooks"
+)
+
+// likeEvent goes out on the hub when someone likes a chirp
+type likeEvent struct {
+	Like  database.Like
+	Chirp database.Chirp
+}
+
+func (cfg *apiConfig) likeCreateHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	chirp, err := cfg.db.GetChirp(chirpID)
+	if err != nil || !chirp.Published() || !chirpVisible(r, chirp) {
+		respondWithError(w, 404, database.ErrChirpNotFound.Error())
+		return
+	}
+	blocked, err := cfg.db.IsBlocked(principal.UserID, chirp.AuthorID)
+	if err != nil {
+		log.Printf("error checking blocks: %s", err)
+		respondWithError(w, 500, "couldn't like chirp")
+		return
+	}
+	if blocked {
+		respondWithError(w, 404, database.ErrChirpNotFound.Error())
+		return
+	}
+	like, created, err := cfg.db.AddLike(principal.UserID, chirpID, time.Now())
+	if err != nil {
+		log.Printf("error adding like: %s", err)
+		respondWithError(w, 500, "couldn't like chirp")
+		return
+	}
+	if !created {
+		w.WriteHeader(200)
+		return
+	}
+	cfg.hub.Publish(eventLike, likeEvent{Like: like, Chirp: chirp})
+	cfg.notifier.Notify(notify.Event{
+		Kind:    notify.KindLike,
+		UserID:  chirp.AuthorID,
+		ActorID: principal.UserID,
+		ChirpID: chirp.ID,
+		At:      like.CreatedAt,
+	})
+	cfg.emitWebhook(webhooks.EventChirpLiked, chirp.AuthorID, like)
+	w.WriteHeader(201)
+}
+
+func (cfg *apiConfig) likeDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	err = cfg.db.RemoveLike(principal.UserID, chirpID)
+	if err != nil {
+		log.Printf("error removing like: %s", err)
+		respondWithError(w, 500, "couldn't unlike chirp")
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/validation"
+)
+
+// maxListNameLength is the longest list name, in characters
+const maxListNameLength = 50
+
+type listRequest struct {
+	Name       string `json:"name"`
+	Visibility string `json:"visibility"`
+}
+
+// decodeList reads a list's name and visibility, visibility defaults to
+// private
+func decodeList(w http.ResponseWriter, r *http.Request) (listRequest, bool) {
+	defer r.Body.Close()
+	params := listRequest{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return listRequest{}, false
+	}
+	errs := validation.Errors{}
+	params.Name = validation.Text(&errs, "name", params.Name, maxListNameLength)
+	if params.Visibility == "" {
+		params.Visibility = database.ListPrivate
+	}
+	if params.Visibility != database.ListPublic && params.Visibility != database.ListPrivate {
+		errs.Add("visibility", validation.CodeInvalid, "visibility must be public or private")
+	}
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return listRequest{}, false
+	}
+	return params, true
+}
+
+// respondWithList writes the result of a change to a list
+func respondWithList(w http.ResponseWriter, code int, list database.UserList, err error) {
+	switch {
+	case errors.Is(err, database.ErrListNotFound), errors.Is(err, database.ErrUserNotFound):
+		respondWithError(w, 404, err.Error())
+	case errors.Is(err, database.ErrNotListOwner):
+		respondWithError(w, 403, err.Error())
+	case errors.Is(err, database.ErrListFull):
+		respondWithError(w, 409, err.Error())
+	case err != nil:
+		log.Printf("error updating list: %s", err)
+		respondWithError(w, 500, "couldn't update list")
+	default:
+		respondWithJSON(w, code, list)
+	}
+}
+
+// visibleList loads the list in the {id} URL param if the requester can
+// see it, private lists look like they don't exist to everyone but
+// their owner
+func (cfg *apiConfig) visibleList(w http.ResponseWriter, r *http.Request) (database.UserList, bool) {
+	listID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid list id")
+		return database.UserList{}, false
+	}
+	list, err := cfg.db.GetList(listID)
+	principal, _ := auth.PrincipalFrom(r.Context())
+	if err == nil && list.Visibility == database.ListPrivate && list.OwnerID != principal.UserID {
+		err = database.ErrListNotFound
+	}
+	if err != nil {
+		respondWithList(w, 200, list, err)
+		return database.UserList{}, false
+	}
+	return list, true
+}
+
+func (cfg *apiConfig) listCreateHandler(w http.ResponseWriter, r *http.Request) {
+	params, ok := decodeList(w, r)
+	if !ok {
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	now := time.Now()
+	list, err := cfg.db.CreateList(database.UserList{
+		OwnerID:    principal.UserID,
+		Name:       params.Name,
+		Visibility: params.Visibility,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	})
+	respondWithList(w, 201, list, err)
+}
+
+// listsGetHandler lists the requester's own lists, or another user's
+// public lists with ?owner_id=
+func (cfg *apiConfig) listsGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFrom(r.Context())
+	ownerID := principal.UserID
+	if owner := r.URL.Query().Get("owner_id"); owner != "" {
+		id, err := strconv.Atoi(owner)
+		if err != nil {
+			respondWithError(w, 400, "invalid owner_id")
+			return
+		}
+		ownerID = id
+	}
+	if ownerID == 0 {
+		respondWithError(w, 401, "authentication required")
+		return
+	}
+	lists, err := cfg.db.ListsOwnedBy(ownerID, ownerID == principal.UserID)
+	if err != nil {
+		log.Printf("error listing lists: %s", err)
+		respondWithError(w, 500, "couldn't list lists")
+		return
+	}
+	respondWithJSON(w, 200, lists)
+}
+
+func (cfg *apiConfig) listGetHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := cfg.visibleList(w, r)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, 200, list)
+}
+
+func (cfg *apiConfig) listUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	listID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid list id")
+		return
+	}
+	params, ok := decodeList(w, r)
+	if !ok {
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	list, err := cfg.db.UpdateList(listID, principal.UserID, time.Now(), func(list *database.UserList, _ *database.DBStructure) error {
+		list.Name = params.Name
+		list.Visibility = params.Visibility
+		return nil
+	})
+	respondWithList(w, 200, list, err)
+}
+
+func (cfg *apiConfig) listDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	listID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid list id")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	err = cfg.db.DeleteList(listID, principal.UserID)
+	if err != nil {
+		respondWithList(w, 204, database.UserList{}, err)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// listMemberAddHandler takes {"user_id": 2}
+func (cfg *apiConfig) listMemberAddHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		UserID int `json:"user_id"`
+	}
+
+	listID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid list id")
+		return
+	}
+	params := requestBody{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	list, err := cfg.db.AddListMember(listID, principal.UserID, params.UserID, time.Now())
+	respondWithList(w, 200, list, err)
+}
+
+func (cfg *apiConfig) listMemberRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	listID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid list id")
+		return
+	}
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid user id")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	list, err := cfg.db.RemoveListMember(listID, principal.UserID, userID, time.Now())
+	respondWithList(w, 200, list, err)
+}
+
+// listChirpsHandler is the list's timeline, chirps by its members
+func (cfg *apiConfig) listChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	list, ok := cfg.visibleList(w, r)
+	if !ok {
+		return
+	}
+	chirps, err := cfg.db.ChirpsByAuthors(list.Members)
+	if err != nil {
+		log.Printf("error loading list timeline: %s", err)
+		respondWithError(w, 500, "couldn't load chirps")
+		return
+	}
+	cfg.respondWithFeed(w, r, chirps)
+}
+
+func listsRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/", cfg.listsGetHandler)
+	r.Get("/{id}", cfg.listGetHandler)
+	r.Get("/{id}/chirps", cfg.listChirpsHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(auth.RequireScope(auth.ScopeProfileWrite))
+		r.Post("/", cfg.listCreateHandler)
+		r.Put("/{id}", cfg.listUpdateHandler)
+		r.Delete("/{id}", cfg.listDeleteHandler)
+		r.Post("/{id}/members", cfg.listMemberAddHandler)
+		r.Delete("/{id}/members/{userID}", cfg.listMemberRemoveHandler)
+	})
+	return r
+}
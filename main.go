@@ -1,18 +1,35 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/joho/godotenv"
+	"github.com/staf3333/chirpy/internal/activitypub"
+	"github.com/staf3333/chirpy/internal/auth"
 	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/media"
+	"github.com/staf3333/chirpy/internal/moderation"
+	"github.com/staf3333/chirpy/internal/notify"
+	"github.com/staf3333/chirpy/internal/preview"
+	"github.com/staf3333/chirpy/internal/stream"
+	"github.com/staf3333/chirpy/internal/validation"
+	"github.com/staf3333/chirpy/internal/webhooks"
+	"golang.org/x/time/rate"
 )
 
 // create function that matches this signature
@@ -26,7 +43,49 @@ func readinessHandler(w http.ResponseWriter, r *http.Request) {
 type apiConfig struct {
 	fileServerHits int
 	db *database.DB
-	jwtSecret string
+	keyring *auth.Keyring
+	auth *auth.Authenticator
+	// access tokens never live longer than accessTokenTTL, even if the
+	// client asks for more
+	accessTokenTTL time.Duration
+	refreshTokenTTL time.Duration
+	// reset tokens from an admin forced password reset expire after this
+	passwordResetTTL time.Duration
+	// the payment provider authenticates its webhooks with one of these
+	paymentsWebhookKey string
+	paymentsWebhookSecret string
+	janitor *database.Janitor
+	// every chirp goes through moderation before it's saved, rules are the
+	// admin-managed part of the chain
+	moderation *moderation.Chain
+	moderationRules *moderation.RuleSet
+	// chirpLengthLimits is the longest chirp each membership tier can post
+	chirpLengthLimits map[string]int
+	// uploaded media is stored in blobs, uploads bigger than mediaMaxBytes
+	// are refused
+	blobs media.BlobStore
+	mediaMaxBytes int64
+	previews *preview.Fetcher
+	// published chirps go out to the live streams through hub
+	hub *stream.Hub
+	streamHeartbeat time.Duration
+	// WebSocket clients are pinged every wsPingInterval and can send
+	// wsRateLimit messages a second, with bursts of wsRateBurst
+	wsPingInterval time.Duration
+	wsRateLimit rate.Limit
+	wsRateBurst int
+	// mentions, quotes, likes and follows are turned into notifications
+	// by notifier
+	notifier *notify.Notifier
+	// webhook deliveries are queued in the database and sent by webhooks
+	webhooks *webhooks.Dispatcher
+	// baseURL is where the server is reached from outside, for links in
+	// feeds. Requests' own host is used when it's empty
+	baseURL string
+	// federation fetches actors from other servers, activities for them
+	// are queued in the database and sent by deliverer
+	federation *activitypub.Client
+	deliverer *activitypub.Deliverer
 }
 
 func outputMetricsHtml(w http.ResponseWriter, filename string, data interface{}) {
@@ -45,8 +104,11 @@ func (cfg *apiConfig) metricsHtmlHandler(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 
+	janitorStats := cfg.janitor.Stats()
 	hits := map[string]interface{}{
 		"Hits": cfg.fileServerHits,
+		"RevokeTokensPurged": janitorStats.Purged,
+		"JanitorRuns": janitorStats.Runs,
 	}
 	outputMetricsHtml(w, "static/metrics.html", hits)
 }
@@ -57,24 +119,17 @@ func (cfg *apiConfig) resetHandler(w http.ResponseWriter, r *http.Request) {
 	cfg.fileServerHits = 0
 }
 
-func cleanBody(body string) string {
-	badWords := map[string]struct{}{}
-	badWords["kerfuffle"] = struct{}{}
-	badWords["sharbert"] = struct{}{}
-	badWords["fornax"] = struct{}{}
-	words := strings.Split(body, " ")
-	// range through words and check if word
-	for i, word := range words {
-		if _, ok := badWords[strings.ToLower(word)]; ok {
-			words[i] = "****"
-		}
-	}
-	return strings.Join(words, " ")
-}
-
 func respondWithError(w http.ResponseWriter, code int, msg string) error {
 	return respondWithJSON(w, code, map[string]string{"error": msg})
 }
+
+// respondWithValidationErrors writes a 400 listing every invalid field
+func respondWithValidationErrors(w http.ResponseWriter, errs validation.Errors) error {
+	return respondWithJSON(w, 400, map[string]interface{}{
+		"error": "invalid request",
+		"errors": errs,
+	})
+}
 	
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) error {
@@ -90,41 +145,113 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) error
 	return nil
 }
 
-func chirpValidationHandler(w http.ResponseWriter, r *http.Request) {
+func (cfg *apiConfig) chirpValidationHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	type requestBody struct {
 		Body string `json:"body"`
+		MediaIDs []string `json:"media_ids"`
+		// Status defaults to published, scheduled chirps need PublishAt
+		Status string `json:"status"`
+		PublishAt *time.Time `json:"publish_at"`
+		Poll *pollRequest `json:"poll"`
+		QuotedChirpID int `json:"quoted_chirp_id"`
 	}
 
+	r.Body = http.MaxBytesReader(w, r.Body, maxChirpRequestBytes)
 	decoder := json.NewDecoder(r.Body)
 	params := requestBody{}
 	err := decoder.Decode(&params)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, 413, "request body is too large")
+		return
+	}
 	if err != nil {
 		log.Printf("Error decoding JSON: %s", err)
-		w.WriteHeader(500)
+		respondWithError(w, 400, "couldn't decode request body")
 		return
 	}
-	if len(params.Body) > 140 {
-		respondWithError(w, 400, "Chirp is too long")	
-	} else {
-		db, err := database.NewDB("database.json")
-		if err != nil {
-			log.Fatal("error loading db")
-		}
-		cleanBodyStr := cleanBody(params.Body)
-		newChirp, err := db.CreateChirp(cleanBodyStr)
-		if err != nil {
-			fmt.Println("ran into error creating chirp")
-			log.Fatal("error creating chirp")
+	principal, _ := auth.PrincipalFrom(r.Context())
+	user, err := cfg.db.GetUser(principal.UserID)
+	if err != nil {
+		respondWithError(w, 401, err.Error())
+		return
+	}
+	now := time.Now()
+	if params.Status == "" {
+		params.Status = database.ChirpPublished
+	}
+	body, errs := cfg.validateChirp(user, params.Body, params.MediaIDs)
+	validateSchedule(&errs, params.Status, params.PublishAt, now)
+	// drafts don't have a publish time yet, so their poll is checked
+	// against now
+	goesOutAt := now
+	if params.PublishAt != nil {
+		goesOutAt = *params.PublishAt
+	}
+	poll := validatePoll(&errs, params.Poll, goesOutAt)
+	err = cfg.validateQuote(&errs, principal.UserID, params.QuotedChirpID)
+	if err != nil {
+		log.Printf("error checking quoted chirp: %s", err)
+		respondWithError(w, 500, "couldn't create chirp")
+		return
+	}
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+	result := cfg.moderation.Run(body)
+	if result.Rejected() {
+		respondWithError(w, 400, errChirpRejected)
+		return
+	}
+	if poll != nil {
+		// poll options go through moderation too
+		for i, option := range poll.Options {
+			optionResult := cfg.moderation.Run(option)
+			if optionResult.Rejected() {
+				respondWithError(w, 400, errChirpRejected)
+				return
+			}
+			if optionResult.Held() {
+				result.Action = optionResult.Action
+			}
+			poll.Options[i] = optionResult.Body
 		}
-		respondWithJSON(w, 201, struct {
-			Body string `json:"body"`
-			ID int `json:"id"`
-		}{
-			Body: newChirp.Body,
-			ID: newChirp.ID,
-		})
 	}
+	chirp := database.Chirp{
+		Body: result.Body,
+		AuthorID: principal.UserID,
+		ModerationState: moderationState(result),
+		Status: params.Status,
+		PublishAt: params.PublishAt,
+		QuotedChirpID: params.QuotedChirpID,
+		CreatedAt: now,
+	}
+	if chirp.Status == database.ChirpPublished {
+		chirp.PublishedAt = &now
+	}
+	newChirp, err := cfg.db.CreateChirp(chirp, params.MediaIDs, poll)
+	if errors.Is(err, database.ErrMediaNotFound) || errors.Is(err, database.ErrMediaInUse) {
+		errs := validation.Errors{}
+		errs.Add("media_ids", validation.CodeInvalid, err.Error())
+		respondWithValidationErrors(w, errs)
+		return
+	}
+	if err != nil {
+		log.Printf("error creating chirp: %s", err)
+		respondWithError(w, 500, "couldn't create chirp")
+		return
+	}
+	if newChirp.Published() {
+		cfg.chirpPublished(newChirp)
+	}
+	// held chirps are saved but not public yet
+	if result.Held() {
+		cfg.respondWithChirp(w, r, 202, newChirp)
+		return
+	}
+	cfg.respondWithChirp(w, r, 201, newChirp)
 }
 
 // create a function that handles get request (gets chirps and responds with some json)
@@ -134,10 +261,7 @@ func (cfg *apiConfig) chirpsGetHandler(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		fmt.Println("Error getting chirps from database")
 	}
-	err = respondWithJSON(w, 200, chirps)
-	if err != nil {
-		fmt.Println("Error responding to the client")
-	}
+	cfg.respondWithFeed(w, r, chirps)
 }
 
 func (cfg *apiConfig) chirpsWithIDHandler(w http.ResponseWriter, r *http.Request) {
@@ -154,11 +278,8 @@ func (cfg *apiConfig) chirpsWithIDHandler(w http.ResponseWriter, r *http.Request
 		fmt.Println("Error getting chirps from database")
 	}
 	for _, chirp := range chirps {
-		if chirp.ID == chirpID {
-			err = respondWithJSON(w, 200, chirp)
-			if err != nil {
-				fmt.Println("found chirp but trouble responding")
-			}
+		if chirp.ID == chirpID && chirpVisible(r, chirp) {
+			cfg.respondWithChirp(w, r, 200, chirp)
 			return
 		}
 	}
@@ -170,62 +291,422 @@ func (cfg *apiConfig) chirpsWithIDHandler(w http.ResponseWriter, r *http.Request
 
 func chirpsRoutes(cfg *apiConfig) *chi.Mux {
 	r := chi.NewRouter()
-	r.Post("/", chirpValidationHandler)
+	r.With(auth.RequireScope(auth.ScopeChirpsWrite)).Post("/", cfg.chirpValidationHandler)
 	r.Get("/", cfg.chirpsGetHandler)
+	r.With(auth.RequireScope(auth.ScopeChirpsRead)).Get("/drafts", cfg.chirpDraftsHandler)
 	r.Get("/{id}", cfg.chirpsWithIDHandler)
+	r.Get("/{id}/quotes", cfg.chirpQuotesHandler)
+	r.Get("/{id}/remote_replies", cfg.remoteRepliesHandler)
+	r.With(auth.RequireScope(auth.ScopeChirpsWrite)).Put("/{id}", cfg.chirpUpdateHandler)
+	r.With(auth.RequireScope(auth.ScopeChirpsWrite)).Delete("/{id}", cfg.chirpDeleteHandler)
+	r.With(auth.RequireScope(auth.ScopeChirpsWrite)).Post("/{id}/poll/votes", cfg.pollVoteHandler)
+	r.With(auth.RequireAuth).Post("/{id}/report", cfg.reportHandler(database.ReportTargetChirp))
+	r.With(auth.RequireScope(auth.ScopeChirpsWrite)).Post("/{id}/like", cfg.likeCreateHandler)
+	r.With(auth.RequireScope(auth.ScopeChirpsWrite)).Delete("/{id}/like", cfg.likeDeleteHandler)
+	r.With(auth.RequireAuth).Post("/{id}/bookmark", cfg.bookmarkCreateHandler)
+	r.With(auth.RequireAuth).Delete("/{id}/bookmark", cfg.bookmarkDeleteHandler)
 	return r
 }
 
 func usersRoutes(cfg *apiConfig) *chi.Mux {
 	r := chi.NewRouter()
 	r.Post("/", cfg.userCreateHandler)
-	r.Put("/", cfg.userUpdateHandler)
+	r.With(auth.RequireScope(auth.ScopeProfileWrite)).Put("/", cfg.userUpdateHandler)
+	r.With(auth.RequireScope(auth.ScopeProfileWrite)).Put("/handle", cfg.userHandleHandler)
+	r.With(auth.RequireScope(auth.ScopeProfileWrite)).Put("/dm_policy", cfg.userDMPolicyHandler)
+	r.With(auth.RequireAuth).Post("/{id}/report", cfg.reportHandler(database.ReportTargetUser))
+	r.With(auth.RequireScope(auth.ScopeProfileWrite)).Group(cfg.userLinkRoutes)
 	return r
 }
 
 func apiRoutes(cfg *apiConfig) *chi.Mux {
 	r := chi.NewRouter()
-	r.Get("/healthz", readinessHandler)
-	r.Get("/reset", cfg.resetHandler)
-	r.Post("/login", cfg.loginHandler)
+	// these take a refresh token in the Authorization header, so they sit
+	// outside the access token middleware
 	r.Post("/refresh", cfg.refreshHandler)
 	r.Post("/revoke", cfg.revokeHandler)
-	r.Mount("/chirps", chirpsRoutes(cfg))
-	r.Mount("/users", usersRoutes(cfg))
+	// the payment provider authenticates with its own key or signature
+	r.Post("/webhooks/payments", cfg.paymentsWebhookHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(cfg.auth.Middleware)
+		r.Get("/healthz", readinessHandler)
+		r.With(auth.RequireRole(auth.RoleAdmin)).Get("/reset", cfg.resetHandler)
+		r.Post("/login", cfg.loginHandler)
+		r.Post("/password_reset", cfg.passwordResetHandler)
+		r.Mount("/chirps", chirpsRoutes(cfg))
+		r.Mount("/users", usersRoutes(cfg))
+		r.Mount("/api_keys", apiKeysRoutes(cfg))
+		r.Mount("/oauth/clients", oauthClientsRoutes(cfg))
+		r.Mount("/moderation", moderationRoutes(cfg))
+		r.Mount("/media", mediaRoutes(cfg))
+		r.Mount("/lists", listsRoutes(cfg))
+		r.Mount("/conversations", conversationsRoutes(cfg))
+		r.Mount("/notifications", notificationsRoutes(cfg))
+		r.With(auth.RequireScope(auth.ScopeProfileWrite)).Mount("/webhooks", webhooksRoutes(cfg, false))
+		r.With(auth.RequireAuth).Get("/bookmarks", cfg.bookmarksGetHandler)
+		r.With(auth.RequireAuth).Get("/blocks", cfg.userLinksGetHandler(cfg.db.ListBlocks))
+		r.With(auth.RequireAuth).Get("/mutes", cfg.userLinksGetHandler(cfg.db.ListMutes))
+		r.With(auth.RequireAuth).Get("/following", cfg.userLinksGetHandler(cfg.db.ListFollowing))
+		r.With(auth.RequireAuth).Get("/followers", cfg.userLinksGetHandler(cfg.db.ListFollowers))
+		r.With(auth.RequireScope(auth.ScopeChirpsRead)).Get("/timeline", cfg.timelineHandler)
+		r.Mount("/stream", streamRoutes(cfg))
+		r.With(auth.RequireScope(auth.ScopeChirpsRead)).Get("/ws", cfg.wsHandler)
+	})
 	return r
 }
 
 func adminRoutes(cfg *apiConfig) *chi.Mux {
 	r := chi.NewRouter()
+	r.Use(cfg.auth.Middleware)
+	r.Use(auth.RequireRole(auth.RoleAdmin))
 	r.Get("/metrics", cfg.metricsHtmlHandler)
+	r.Mount("/users", adminUsersRoutes(cfg))
+	r.Mount("/moderation", adminModerationRoutes(cfg))
+	r.Mount("/webhooks", webhooksRoutes(cfg, true))
 	return r
 }
 
+// envDuration reads a duration like "30m" from the environment, falling
+// back to def when it's unset or invalid
+func envDuration(key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil || d <= 0 {
+		log.Printf("invalid duration for %s: %q, using %s", key, val, def)
+		return def
+	}
+	return d
+}
+
+// envInt reads a positive integer from the environment, falling back to
+// def when it's unset or invalid
+func envInt(key string, def int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n <= 0 {
+		log.Printf("invalid number for %s: %q, using %d", key, val, def)
+		return def
+	}
+	return n
+}
+
+// appRoot is the directory the /app file server serves, nothing secret may
+// live under it
+const appRoot = "."
+
+// databasePath is the database file, the message key must never sit next
+// to it or a copy of the directory would decrypt every DM
+const databasePath = "database.json"
+
+// dataDir is where keys and other private state live. It comes from
+// DATA_DIR, otherwise it's a chirpy directory in the user config dir so it's
+// never inside appRoot by default
+func dataDir() (string, error) {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("finding a data directory, set DATA_DIR: %w", err)
+		}
+		dir = filepath.Join(configDir, "chirpy")
+	}
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// checkNotServed refuses paths the /app file server would hand out to
+// anyone who asks
+func checkNotServed(path string) error {
+	root, err := filepath.Abs(appRoot)
+	if err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return err
+	}
+	if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+		return fmt.Errorf("%s is inside the /app root %s and would be served publicly", abs, root)
+	}
+	return nil
+}
+
+// hideFile 404s requests for name, a file in appRoot the file server must
+// not hand out, and for any dotfile or dot directory in it (.env holds our
+// secrets, .git our history)
+func hideFile(next http.Handler, name string) http.Handler {
+	hidden := path.Clean("/" + filepath.ToSlash(name))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := path.Clean("/" + r.URL.Path)
+		if p == hidden || strings.Contains(p, "/.") {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkMessageKeyPath keeps the DM key out of the served tree and out of
+// the directory holding the ciphertexts it protects
+func checkMessageKeyPath(path string) error {
+	err := checkNotServed(path)
+	if err != nil {
+		return err
+	}
+	keyDir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	dbDir, err := filepath.Abs(filepath.Dir(databasePath))
+	if err != nil {
+		return err
+	}
+	if keyDir == dbDir {
+		return fmt.Errorf("%s is in the same directory as the database", path)
+	}
+	return nil
+}
+
 func main() {
-	db, err := database.NewDB("database.json")
+	db, err := database.NewDB(databasePath)
 	if err != nil {
 		log.Fatal("error loading DB")
 	}
+	// `chirpy create-admin ...` bootstraps the first admin and exits
+	if len(os.Args) > 1 && os.Args[1] == "create-admin" {
+		err = createAdminCommand(db, os.Args[2:])
+		if err != nil {
+			log.Fatalf("create-admin: %s", err)
+		}
+		return
+	}
 	err = godotenv.Load()
 	jwtSecret := os.Getenv("JWT_SECRET")
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
+	privateDir, err := dataDir()
+	if err != nil {
+		log.Fatalf("error opening data directory: %s", err)
+	}
+	keyringPath := os.Getenv("KEYRING_PATH")
+	if keyringPath == "" {
+		keyringPath = filepath.Join(privateDir, "keyring.json")
+	}
+	err = checkNotServed(keyringPath)
+	if err != nil {
+		log.Fatalf("refusing to use KEYRING_PATH: %s", err)
+	}
+	accessTokenTTL := envDuration("ACCESS_TOKEN_TTL", time.Hour)
+	refreshTokenTTL := envDuration("REFRESH_TOKEN_TTL", 60*24*time.Hour)
+	// old keys have to outlive the longest lived token they signed
+	maxTokenAge := refreshTokenTTL
+	if accessTokenTTL > maxTokenAge {
+		maxTokenAge = accessTokenTTL
+	}
+	keyring, err := auth.LoadKeyring(auth.KeyringConfig{
+		Path: keyringPath,
+		LegacySecret: jwtSecret,
+		MaxTokenAge: maxTokenAge,
+		Keys: map[auth.Purpose]auth.KeyConfig{
+			auth.PurposeAccess: {
+				Algorithm: os.Getenv("ACCESS_TOKEN_ALG"),
+				PEMFile: os.Getenv("ACCESS_TOKEN_KEY_FILE"),
+			},
+			auth.PurposeRefresh: {
+				Algorithm: os.Getenv("REFRESH_TOKEN_ALG"),
+				PEMFile: os.Getenv("REFRESH_TOKEN_KEY_FILE"),
+			},
+		},
+	})
+	if err != nil {
+		log.Fatalf("error loading keyring: %s", err)
+	}
+	rotator := auth.NewRotator(keyring, envDuration("KEY_ROTATION_INTERVAL", 30*24*time.Hour), maxTokenAge)
+	janitor := database.NewJanitor(db, envDuration("REVOKE_JANITOR_INTERVAL", time.Hour))
+	// words from MODERATION_WORDLIST are added to the built-in list, the
+	// file is reloaded when it changes
+	wordList := moderation.NewWordList(moderation.DefaultWords)
+	if path := os.Getenv("MODERATION_WORDLIST"); path != "" {
+		wordList, err = moderation.LoadWordList(path, moderation.DefaultWords)
+		if err != nil {
+			log.Fatalf("error loading moderation word list: %s", err)
+		}
+		log.Printf("moderation: loaded %s on top of the built-in word list, %d words", path, wordList.Len())
+	}
+	moderationRules := moderation.NewRuleSet()
+	err = loadModerationRules(db, moderationRules)
+	if err != nil {
+		log.Fatalf("error loading moderation rules: %s", err)
+	}
+	messageKeyPath := os.Getenv("MESSAGE_KEY_FILE")
+	if messageKeyPath == "" {
+		messageKeyPath = filepath.Join(privateDir, "message.key")
+	}
+	// the key used to be read from MESSAGE_KEY, which usually lived in
+	// .env next to everything else. Starting without it would make a new
+	// key and every existing message unreadable, so don't
+	if os.Getenv("MESSAGE_KEY") != "" {
+		log.Fatal("MESSAGE_KEY is no longer read, move the key into the file at MESSAGE_KEY_FILE and unset it")
+	}
+	err = checkMessageKeyPath(messageKeyPath)
+	if err != nil {
+		log.Fatalf("refusing to use MESSAGE_KEY_FILE: %s", err)
+	}
+	messageKey, err := loadMessageKey(messageKeyPath)
+	if err != nil {
+		log.Fatalf("error loading message key: %s", err)
+	}
+	err = db.SetMessageKey(messageKey)
+	if err != nil {
+		log.Fatalf("error loading message key: %s", err)
+	}
+	// blobs are only handed out by key through mediaServeHandler, the file
+	// server would let anyone browse the directory
+	mediaDir := os.Getenv("MEDIA_DIR")
+	if mediaDir == "" {
+		mediaDir = filepath.Join(privateDir, "media")
+	}
+	err = checkNotServed(mediaDir)
+	if err != nil {
+		log.Fatalf("refusing to use MEDIA_DIR: %s", err)
+	}
+	blobs, err := media.NewLocalStore(mediaDir)
+	if err != nil {
+		log.Fatalf("error opening media store: %s", err)
+	}
+	previewOpts := preview.DefaultOptions
+	previewOpts.Timeout = envDuration("PREVIEW_FETCH_TIMEOUT", previewOpts.Timeout)
+	previewOpts.CacheTTL = envDuration("PREVIEW_CACHE_TTL", previewOpts.CacheTTL)
+	// only for development, lets previews load from servers on localhost
+	previewOpts.AllowPrivate = os.Getenv("PREVIEW_ALLOW_PRIVATE") == "true"
+	previews := preview.NewFetcher(previewOpts)
+	notifyOpts := notify.DefaultOptions
+	notifyOpts.Window = envDuration("NOTIFICATION_COALESCE_WINDOW", notifyOpts.Window)
+	// only for development, lets webhooks go to servers on localhost
+	notifyOpts.AllowPrivate = os.Getenv("NOTIFICATION_WEBHOOK_ALLOW_PRIVATE") == "true"
+	notifier := notify.NewNotifier(notificationStore{db: db}, newMailer(), notifyOpts)
+	digester := notify.NewDigester(notifier, envDuration("DIGEST_CHECK_INTERVAL", time.Hour), envDuration("DIGEST_PERIOD", 24*time.Hour))
+	webhookOpts := webhooks.DefaultOptions
+	webhookOpts.MaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", webhookOpts.MaxAttempts)
+	webhookOpts.BaseBackoff = envDuration("WEBHOOK_BASE_BACKOFF", webhookOpts.BaseBackoff)
+	// only for development, lets webhooks go to servers on localhost
+	webhookOpts.AllowPrivate = os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+	dispatcher := webhooks.NewDispatcher(webhookStore{db: db}, webhookOpts)
+	baseURL := strings.TrimSuffix(os.Getenv("BASE_URL"), "/")
+	federationOpts := activitypub.DefaultOptions
+	federationOpts.MaxAttempts = envInt("ACTIVITYPUB_MAX_ATTEMPTS", federationOpts.MaxAttempts)
+	federationOpts.BaseBackoff = envDuration("ACTIVITYPUB_BASE_BACKOFF", federationOpts.BaseBackoff)
+	// only for development, lets us federate with servers on localhost
+	federationOpts.AllowPrivate = os.Getenv("ACTIVITYPUB_ALLOW_PRIVATE") == "true"
+	federation := activitypub.NewClient(federationOpts.Timeout, federationOpts.AllowPrivate)
+	deliverer := activitypub.NewDeliverer(activityPubStore{db: db, baseURL: baseURL}, federation, federationOpts)
+	authenticator := auth.NewAuthenticator(keyring)
+	authenticator.APIKeys = apiKeyStore{db: db}
+	authenticator.Users = userStore{db: db}
 	cfg := &apiConfig{
 		db: db,
-		jwtSecret: jwtSecret,
+		keyring: keyring,
+		auth: authenticator,
+		accessTokenTTL: accessTokenTTL,
+		refreshTokenTTL: refreshTokenTTL,
+		passwordResetTTL: envDuration("PASSWORD_RESET_TTL", 24*time.Hour),
+		paymentsWebhookKey: os.Getenv("PAYMENTS_WEBHOOK_KEY"),
+		paymentsWebhookSecret: os.Getenv("PAYMENTS_WEBHOOK_SECRET"),
+		janitor: janitor,
+		moderation: moderation.NewChain(wordList, moderationRules),
+		moderationRules: moderationRules,
+		chirpLengthLimits: map[string]int{
+			tierFree: envInt("CHIRP_MAX_LENGTH", defaultChirpLengthLimits[tierFree]),
+			tierRed: envInt("CHIRP_MAX_LENGTH_RED", defaultChirpLengthLimits[tierRed]),
+		},
+		blobs: blobs,
+		mediaMaxBytes: int64(envInt("MEDIA_MAX_BYTES", 5<<20)),
+		previews: previews,
+		hub: stream.NewHub(envInt("STREAM_REPLAY_SIZE", 1000), envInt("STREAM_CLIENT_BUFFER", 64)),
+		streamHeartbeat: envDuration("STREAM_HEARTBEAT_INTERVAL", 15*time.Second),
+		wsPingInterval: envDuration("WS_PING_INTERVAL", 30*time.Second),
+		wsRateLimit: rate.Limit(envInt("WS_RATE_LIMIT", 10)),
+		wsRateBurst: envInt("WS_RATE_BURST", 20),
+		notifier: notifier,
+		webhooks: dispatcher,
+		baseURL: baseURL,
+		federation: federation,
+		deliverer: deliverer,
 	}
+	scheduler := database.NewScheduler(db, envDuration("CHIRP_SCHEDULER_INTERVAL", 15*time.Second), cfg.chirpPublished)
 	r := chi.NewRouter()
 	// mux := http.NewServeMux()
-	fsHandler := cfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir("."))))
+	fsHandler := cfg.middlewareMetricsInc(http.StripPrefix("/app", hideFile(http.FileServer(http.Dir(appRoot)), databasePath)))
 	r.Handle("/app/*", fsHandler)
 	r.Handle("/app", fsHandler)
+	r.Get(mediaURLPrefix+"{key}", cfg.mediaServeHandler)
 	r.Mount("/api", apiRoutes(cfg))
 	r.Mount("/admin", adminRoutes(cfg))
+	r.Get("/.well-known/jwks.json", cfg.jwksHandler)
+	r.Group(cfg.syndicationRoutes)
+	if cfg.federating() {
+		r.Group(cfg.activityPubRoutes)
+	} else {
+		log.Printf("BASE_URL isn't set, ActivityPub is off")
+	}
+	r.Mount("/oauth", oauthRoutes(cfg))
 	corsR := middlewareCors(r)
 	s := &http.Server{
 		Addr:           ":8080",
 		Handler:        corsR,
 	}
-	log.Fatal(s.ListenAndServe())
-}
\ No newline at end of file
+	// streams run until the client leaves, end them so Shutdown doesn't wait
+	// on them
+	s.RegisterOnShutdown(cfg.hub.Close)
+
+	janitor.Start()
+	rotator.Start()
+	previews.Start()
+	scheduler.Start()
+	notifier.Start()
+	digester.Start()
+	dispatcher.Start()
+	deliverer.Start()
+	wordList.Watch(envDuration("MODERATION_WORDLIST_RELOAD_INTERVAL", 30*time.Second))
+
+	// shut down cleanly on ctrl-c / SIGTERM so background workers can finish
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		err := s.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	<-ctx.Done()
+
+	log.Printf("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		log.Printf("error shutting down server: %s", err)
+	}
+	janitor.Stop()
+	rotator.Stop()
+	scheduler.Stop()
+	digester.Stop()
+	notifier.Stop()
+	dispatcher.Stop()
+	deliverer.Stop()
+	wordList.Stop()
+	previews.Stop()
+}
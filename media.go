@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/media"
+	"github.com/staf3333/chirpy/internal/validation"
+)
+
+const (
+	// maxChirpMedia is how many uploads can be attached to one chirp
+	maxChirpMedia = 4
+	// maxAltTextLength is the longest image description, in characters
+	maxAltTextLength = 1000
+	// mediaURLPrefix is where stored media is served from
+	mediaURLPrefix = "/media/"
+)
+
+// mediaUploadHandler takes a multipart form with the image in "file" and
+// an optional "alt_text"
+func (cfg *apiConfig) mediaUploadHandler(w http.ResponseWriter, r *http.Request) {
+	// leave some room for the rest of the multipart form
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.mediaMaxBytes+64*1024)
+	file, _, err := r.FormFile("file")
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respondWithError(w, 413, "file is too large")
+		return
+	}
+	if err != nil {
+		respondWithError(w, 400, "expected a multipart form with a file")
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, cfg.mediaMaxBytes+1))
+	if err != nil {
+		respondWithError(w, 400, "couldn't read file")
+		return
+	}
+	if int64(len(data)) > cfg.mediaMaxBytes {
+		respondWithError(w, 413, "file is too large")
+		return
+	}
+
+	errs := validation.Errors{}
+	altText := validation.NormalizeText(r.FormValue("alt_text"))
+	if length := validation.Length(altText); length > maxAltTextLength {
+		errs = append(errs, validation.FieldError{
+			Field:   "alt_text",
+			Code:    validation.CodeTooLong,
+			Message: "alt_text is too long",
+			Limit:   maxAltTextLength,
+			Length:  length,
+		})
+	}
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	processed, err := media.Process(data, media.DefaultOptions)
+	if errors.Is(err, media.ErrUnsupportedType) {
+		respondWithError(w, 415, "only jpeg, png, gif and webp images are supported")
+		return
+	}
+	if errors.Is(err, media.ErrInvalidImage) || errors.Is(err, media.ErrTooManyPixels) || errors.Is(err, media.ErrTooManyFrames) {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error processing upload: %s", err)
+		respondWithError(w, 500, "couldn't process image")
+		return
+	}
+
+	key := processed.Original.Key()
+	thumbnailKey := processed.Thumbnail.Key()
+	for k, img := range map[string]media.Image{key: processed.Original, thumbnailKey: processed.Thumbnail} {
+		err = cfg.blobs.Put(k, bytes.NewReader(img.Data))
+		if err != nil {
+			log.Printf("error storing media: %s", err)
+			respondWithError(w, 500, "couldn't store image")
+			return
+		}
+	}
+
+	principal, _ := auth.PrincipalFrom(r.Context())
+	record, err := cfg.db.CreateMedia(database.Media{
+		ID:           auth.RandomToken(12),
+		OwnerID:      principal.UserID,
+		ContentType:  processed.Original.ContentType,
+		Size:         len(processed.Original.Data),
+		Width:        processed.Original.Width,
+		Height:       processed.Original.Height,
+		AltText:      altText,
+		Key:          key,
+		ThumbnailKey: thumbnailKey,
+		URL:          mediaURLPrefix + key,
+		ThumbnailURL: mediaURLPrefix + thumbnailKey,
+		CreatedAt:    time.Now(),
+	})
+	if err != nil {
+		log.Printf("error saving media: %s", err)
+		respondWithError(w, 500, "couldn't save image")
+		return
+	}
+	respondWithJSON(w, 201, record)
+}
+
+// mediaServeHandler serves stored media. Keys are content hashes so a key
+// always has the same bytes and can be cached forever
+func (cfg *apiConfig) mediaServeHandler(w http.ResponseWriter, r *http.Request) {
+	key := chi.URLParam(r, "key")
+	blob, err := cfg.blobs.Open(key)
+	if errors.Is(err, media.ErrBlobNotFound) || errors.Is(err, media.ErrInvalidKey) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Printf("error opening media: %s", err)
+		http.Error(w, "couldn't open media", 500)
+		return
+	}
+	defer blob.Close()
+
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(key)))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+key+`"`)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, key, time.Time{}, blob)
+}
+
+// validateChirpMedia checks the media ids attached to a chirp
+func validateChirpMedia(errs *validation.Errors, mediaIDs []string) {
+	if len(mediaIDs) > maxChirpMedia {
+		errs.Add("media_ids", validation.CodeInvalid, "a chirp can have at most 4 media")
+		return
+	}
+	seen := map[string]struct{}{}
+	for _, id := range mediaIDs {
+		if _, ok := seen[id]; ok {
+			errs.Add("media_ids", validation.CodeInvalid, "media "+id+" is attached twice")
+			return
+		}
+		seen[id] = struct{}{}
+	}
+}
+
+func mediaRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.With(auth.RequireScope(auth.ScopeChirpsWrite)).Post("/", cfg.mediaUploadHandler)
+	return r
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/moderation"
+)
+
+// errChirpRejected is shown when moderation refuses a chirp, we don't say
+// which rule matched so people can't probe the rules
+const errChirpRejected = "Chirp breaks the content rules"
+
+// loadModerationRules compiles the rules stored in db into rules
+func loadModerationRules(db *database.DB, rules *moderation.RuleSet) error {
+	stored, err := db.ListModerationRules()
+	if err != nil {
+		return err
+	}
+	compiled := []moderation.Rule{}
+	for _, rule := range stored {
+		compiled = append(compiled, moderationRule(rule))
+	}
+	return rules.SetRules(compiled)
+}
+
+func moderationRule(rule database.ModerationRule) moderation.Rule {
+	return moderation.Rule{
+		ID:      rule.ID,
+		Kind:    moderation.RuleKind(rule.Kind),
+		Pattern: rule.Pattern,
+		Action:  moderation.Action(rule.Action),
+	}
+}
+
+// moderationState is the state a chirp is saved in after moderation
+func moderationState(result moderation.Result) string {
+	if result.Held() {
+		return database.ChirpHeld
+	}
+	return ""
+}
+
+// chirpVisible reports whether the requester can see chirp. Drafts and
+// scheduled chirps are only shown to their author, held and hidden chirps
+// to their author and moderators
+func chirpVisible(r *http.Request, chirp database.Chirp) bool {
+	if chirp.Published() && chirp.ModerationState == "" {
+		return true
+	}
+	principal, ok := auth.PrincipalFrom(r.Context())
+	if !ok {
+		return false
+	}
+	if !chirp.Published() {
+		return principal.UserID == chirp.AuthorID
+	}
+	return principal.UserID == chirp.AuthorID || principal.HasRole(auth.RoleModerator)
+}
+
+func (cfg *apiConfig) moderationRulesGetHandler(w http.ResponseWriter, r *http.Request) {
+	rules, err := cfg.db.ListModerationRules()
+	if err != nil {
+		log.Printf("error listing moderation rules: %s", err)
+		respondWithError(w, 500, "couldn't list moderation rules")
+		return
+	}
+	respondWithJSON(w, 200, rules)
+}
+
+type moderationRuleRequest struct {
+	Kind        string `json:"kind"`
+	Pattern     string `json:"pattern"`
+	Action      string `json:"action"`
+	Description string `json:"description"`
+}
+
+// decodeModerationRule reads and validates a rule from the request body
+func decodeModerationRule(w http.ResponseWriter, r *http.Request) (database.ModerationRule, bool) {
+	defer r.Body.Close()
+	params := moderationRuleRequest{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return database.ModerationRule{}, false
+	}
+	rule := database.ModerationRule{
+		Kind:        params.Kind,
+		Pattern:     params.Pattern,
+		Action:      params.Action,
+		Description: params.Description,
+	}
+	err = moderationRule(rule).Validate()
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return database.ModerationRule{}, false
+	}
+	return rule, true
+}
+
+func (cfg *apiConfig) moderationRuleCreateHandler(w http.ResponseWriter, r *http.Request) {
+	rule, ok := decodeModerationRule(w, r)
+	if !ok {
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	now := time.Now()
+	rule.CreatedBy = principal.UserID
+	rule.CreatedAt = now
+	rule.UpdatedAt = now
+
+	rule, err := cfg.db.CreateModerationRule(rule)
+	if err != nil {
+		log.Printf("error creating moderation rule: %s", err)
+		respondWithError(w, 500, "couldn't create moderation rule")
+		return
+	}
+	cfg.reloadModerationRules()
+	respondWithJSON(w, 201, rule)
+}
+
+func (cfg *apiConfig) moderationRuleUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid rule id")
+		return
+	}
+	rule, ok := decodeModerationRule(w, r)
+	if !ok {
+		return
+	}
+	rule.ID = ruleID
+	rule.UpdatedAt = time.Now()
+
+	rule, err = cfg.db.UpdateModerationRule(rule)
+	if errors.Is(err, database.ErrModerationRuleNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error updating moderation rule: %s", err)
+		respondWithError(w, 500, "couldn't update moderation rule")
+		return
+	}
+	cfg.reloadModerationRules()
+	respondWithJSON(w, 200, rule)
+}
+
+func (cfg *apiConfig) moderationRuleDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid rule id")
+		return
+	}
+	err = cfg.db.DeleteModerationRule(ruleID)
+	if errors.Is(err, database.ErrModerationRuleNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error deleting moderation rule: %s", err)
+		respondWithError(w, 500, "couldn't delete moderation rule")
+		return
+	}
+	cfg.reloadModerationRules()
+	w.WriteHeader(204)
+}
+
+// moderationTestHandler runs a body through the pipeline without posting
+// it, so admins can try out their rules
+func (cfg *apiConfig) moderationTestHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Body string `json:"body"`
+	}
+	params := requestBody{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	result := cfg.moderation.Run(params.Body)
+	action := string(result.Action)
+	if action == "" {
+		action = "allow"
+	}
+	matches := result.Matches
+	if matches == nil {
+		matches = []moderation.Match{}
+	}
+	respondWithJSON(w, 200, map[string]interface{}{
+		"body":    result.Body,
+		"action":  action,
+		"matches": matches,
+	})
+}
+
+// reloadModerationRules picks up rule changes, the database is the source
+// of truth so a failure only means the old rules stay in effect
+func (cfg *apiConfig) reloadModerationRules() {
+	err := loadModerationRules(cfg.db, cfg.moderationRules)
+	if err != nil {
+		log.Printf("error reloading moderation rules: %s", err)
+	}
+}
+
+func (cfg *apiConfig) heldChirpsGetHandler(w http.ResponseWriter, r *http.Request) {
+	chirps, err := cfg.db.ListHeldChirps()
+	if err != nil {
+		log.Printf("error listing held chirps: %s", err)
+		respondWithError(w, 500, "couldn't list held chirps")
+		return
+	}
+	cfg.respondWithChirps(w, r, 200, chirps)
+}
+
+// heldChirpReviewHandler returns a handler that moves a held chirp to state,
+// approving it (empty state) or hiding it, and records action in the audit
+// trail
+func (cfg *apiConfig) heldChirpReviewHandler(state string, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondWithError(w, 400, "invalid chirp id")
+			return
+		}
+		chirp, err := cfg.db.GetChirp(chirpID)
+		if errors.Is(err, database.ErrChirpNotFound) {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("error getting chirp: %s", err)
+			respondWithError(w, 500, "couldn't review chirp")
+			return
+		}
+		if chirp.ModerationState != database.ChirpHeld {
+			respondWithError(w, 409, "chirp isn't held for review")
+			return
+		}
+		chirp, err = cfg.db.SetChirpModerationState(chirpID, state)
+		if err != nil {
+			log.Printf("error reviewing chirp: %s", err)
+			respondWithError(w, 500, "couldn't review chirp")
+			return
+		}
+		principal, _ := auth.PrincipalFrom(r.Context())
+		_, err = cfg.db.RecordAudit(database.AuditEntry{
+			ActorID:    principal.UserID,
+			Action:     action,
+			TargetType: database.ReportTargetChirp,
+			TargetID:   chirp.ID,
+			CreatedAt:  time.Now(),
+		})
+		if err != nil {
+			log.Printf("error recording audit entry: %s", err)
+		}
+		if chirp.ModerationState == "" && chirp.Published() {
+			cfg.announceChirp(chirp)
+		}
+		cfg.respondWithChirp(w, r, 200, chirp)
+	}
+}
+
+// adminModerationRoutes manage the moderation rules, admins only
+func adminModerationRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/rules", cfg.moderationRulesGetHandler)
+	r.Post("/rules", cfg.moderationRuleCreateHandler)
+	r.Put("/rules/{id}", cfg.moderationRuleUpdateHandler)
+	r.Delete("/rules/{id}", cfg.moderationRuleDeleteHandler)
+	r.Post("/test", cfg.moderationTestHandler)
+	return r
+}
+
+// moderationRoutes are the held chirps and report queues and the audit
+// trail, open to moderators
+func moderationRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(auth.RequireRole(auth.RoleModerator))
+	r.Get("/held", cfg.heldChirpsGetHandler)
+	r.Post("/held/{id}/approve", cfg.heldChirpReviewHandler("", "held.approve"))
+	r.Post("/held/{id}/reject", cfg.heldChirpReviewHandler(database.ChirpHidden, "held.reject"))
+	r.Get("/reports", cfg.reportsGetHandler)
+	r.Get("/reports/{id}", cfg.reportGetHandler)
+	r.Post("/reports/{id}/claim", cfg.reportClaimHandler)
+	r.Post("/reports/{id}/release", cfg.reportReleaseHandler)
+	r.Post("/reports/{id}/resolve", cfg.reportResolveHandler)
+	r.Get("/audit", cfg.auditGetHandler)
+	return r
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/notify"
+	"github.com/staf3333/chirpy/internal/validation"
+)
+
+// notificationStore keeps the notify package's notifications in the
+// database
+type notificationStore struct {
+	db *database.DB
+}
+
+func (s notificationStore) Preferences(userID int) (notify.Preferences, error) {
+	stored, err := s.db.GetNotificationPrefs(userID)
+	if err != nil || stored == nil {
+		return notify.DefaultPreferences(), err
+	}
+	prefs := notify.DefaultPreferences()
+	// kinds added since the user saved their preferences keep the defaults
+	for kind, channels := range stored.Channels {
+		prefs.Channels[kind] = channels
+	}
+	prefs.Digest = stored.Digest
+	prefs.WebhookURL = stored.WebhookURL
+	prefs.WebhookSecret = stored.WebhookSecret
+	if stored.LastDigestAt != nil {
+		prefs.LastDigestAt = *stored.LastDigestAt
+	}
+	return prefs, nil
+}
+
+func (s notificationStore) Hidden(userID, actorID int) (bool, error) {
+	hidden, err := s.db.HiddenAuthors(userID)
+	if err != nil {
+		return false, err
+	}
+	_, ok := hidden[actorID]
+	return ok, nil
+}
+
+func (s notificationStore) AddNotification(event notify.Event, window time.Duration) (notify.Notification, bool, error) {
+	n, created, err := s.db.AddNotification(event.UserID, event.Kind, event.ChirpID, event.ActorID, event.At, window)
+	return toNotifyNotification(n), created, err
+}
+
+func (s notificationStore) Email(userID int) (string, error) {
+	user, err := s.db.GetUser(userID)
+	return user.Email, err
+}
+
+// Names shows users by their @handle, users without one are just someone
+func (s notificationStore) Names(userIDs []int) (map[int]string, error) {
+	names := map[int]string{}
+	for _, id := range userIDs {
+		user, err := s.db.GetUser(id)
+		if err != nil && !errors.Is(err, database.ErrUserNotFound) {
+			return nil, err
+		}
+		names[id] = "someone"
+		if user.Handle != "" {
+			names[id] = "@" + user.Handle
+		}
+	}
+	return names, nil
+}
+
+func (s notificationStore) DigestRecipients(before time.Time) ([]int, error) {
+	return s.db.DigestRecipients(before)
+}
+
+func (s notificationStore) UnreadNotifications(userID int, since time.Time) ([]notify.Notification, error) {
+	stored, err := s.db.UnreadNotifications(userID, since)
+	if err != nil {
+		return nil, err
+	}
+	notifications := []notify.Notification{}
+	for _, n := range stored {
+		notifications = append(notifications, toNotifyNotification(n))
+	}
+	return notifications, nil
+}
+
+func (s notificationStore) SetDigestSent(userID int, at time.Time) error {
+	return s.db.SetDigestSent(userID, at)
+}
+
+func toNotifyNotification(n database.Notification) notify.Notification {
+	return notify.Notification{
+		ID:        n.ID,
+		UserID:    n.UserID,
+		Kind:      n.Kind,
+		ChirpID:   n.ChirpID,
+		ActorIDs:  n.ActorIDs,
+		UpdatedAt: n.UpdatedAt,
+	}
+}
+
+// newMailer sends email through SMTP_ADDR when it's set, otherwise emails
+// only go to the log
+func newMailer() notify.Mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return notify.LogMailer{}
+	}
+	mailer := notify.SMTPMailer{Addr: addr, From: os.Getenv("SMTP_FROM")}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		host, _, _ := strings.Cut(addr, ":")
+		mailer.Auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return mailer
+}
+
+// notificationResponse is a notification with its text and how many
+// people are behind it
+type notificationResponse struct {
+	database.Notification
+	Count int    `json:"count"`
+	Text  string `json:"text"`
+}
+
+// notificationsGetHandler lists the requester's notifications, newest
+// first and paged like the feeds. ?unread=true leaves out read ones
+func (cfg *apiConfig) notificationsGetHandler(w http.ResponseWriter, r *http.Request) {
+	page, err := parseFeedPage(r)
+	if err != nil {
+		respondWithError(w, 400, err.Error())
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+	notifications, more, err := cfg.db.ListNotifications(principal.UserID, unreadOnly, page.before, page.limit)
+	if err != nil {
+		log.Printf("error listing notifications: %s", err)
+		respondWithError(w, 500, "couldn't list notifications")
+		return
+	}
+	if more {
+		setNextPageLink(w, r, page, notifications[len(notifications)-1].ID)
+	}
+	response := []notificationResponse{}
+	for _, n := range notifications {
+		text, err := cfg.notifier.Text(toNotifyNotification(n))
+		if err != nil {
+			log.Printf("error rendering notification: %s", err)
+			respondWithError(w, 500, "couldn't list notifications")
+			return
+		}
+		response = append(response, notificationResponse{
+			Notification: n,
+			Count:        len(n.ActorIDs),
+			Text:         text,
+		})
+	}
+	respondWithJSON(w, 200, response)
+}
+
+// notificationsReadHandler marks the requester's notifications read up to
+// {"up_to": id}, or all of them without a body
+func (cfg *apiConfig) notificationsReadHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		UpTo int `json:"up_to"`
+	}
+
+	params := requestBody{}
+	// up_to is optional, so an empty body is fine
+	json.NewDecoder(r.Body).Decode(&params)
+
+	principal, _ := auth.PrincipalFrom(r.Context())
+	marked, err := cfg.db.MarkNotificationsRead(principal.UserID, params.UpTo, time.Now())
+	if err != nil {
+		log.Printf("error marking notifications read: %s", err)
+		respondWithError(w, 500, "couldn't mark notifications read")
+		return
+	}
+	respondWithJSON(w, 200, struct {
+		Marked int `json:"marked"`
+	}{
+		Marked: marked,
+	})
+}
+
+// notificationPrefsResponse is the requester's notification settings, the
+// webhook secret is theirs to check signatures with
+type notificationPrefsResponse struct {
+	Channels      map[string][]string `json:"channels"`
+	Digest        bool                `json:"digest"`
+	WebhookURL    string              `json:"webhook_url"`
+	WebhookSecret string              `json:"webhook_secret,omitempty"`
+}
+
+func newNotificationPrefsResponse(prefs notify.Preferences) notificationPrefsResponse {
+	return notificationPrefsResponse{
+		Channels:      prefs.Channels,
+		Digest:        prefs.Digest,
+		WebhookURL:    prefs.WebhookURL,
+		WebhookSecret: prefs.WebhookSecret,
+	}
+}
+
+func (cfg *apiConfig) notificationPrefsGetHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFrom(r.Context())
+	prefs, err := notificationStore{db: cfg.db}.Preferences(principal.UserID)
+	if err != nil {
+		log.Printf("error loading notification preferences: %s", err)
+		respondWithError(w, 500, "couldn't load notification preferences")
+		return
+	}
+	respondWithJSON(w, 200, newNotificationPrefsResponse(prefs))
+}
+
+// notificationPrefsUpdateHandler takes
+//
+//	{"channels": {"like": ["in_app"], "mention": ["in_app", "email"]},
+//	 "digest": true, "webhook_url": "https://example.com/hook"}
+//
+// Every field is optional, kinds left out of channels keep their current
+// channels and an empty list turns a kind off. Setting a new webhook URL
+// gives it a new signing secret
+func (cfg *apiConfig) notificationPrefsUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Channels   map[string][]string `json:"channels"`
+		Digest     *bool               `json:"digest"`
+		WebhookURL *string             `json:"webhook_url"`
+	}
+
+	params := requestBody{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	prefs, err := notificationStore{db: cfg.db}.Preferences(principal.UserID)
+	if err != nil {
+		log.Printf("error loading notification preferences: %s", err)
+		respondWithError(w, 500, "couldn't update notification preferences")
+		return
+	}
+
+	errs := validation.Errors{}
+	for kind, channels := range params.Channels {
+		if !contains(notify.Kinds, kind) {
+			errs.Add("channels", validation.CodeInvalid, "unknown notification kind "+kind)
+			continue
+		}
+		for _, channel := range channels {
+			if !contains(notify.Channels, channel) {
+				errs.Add("channels", validation.CodeInvalid, "unknown channel "+channel)
+			}
+		}
+		prefs.Channels[kind] = channels
+	}
+	if params.Digest != nil {
+		prefs.Digest = *params.Digest
+	}
+	if params.WebhookURL != nil && *params.WebhookURL != prefs.WebhookURL {
+		prefs.WebhookURL = *params.WebhookURL
+		prefs.WebhookSecret = ""
+		if prefs.WebhookURL != "" {
+			u, err := url.Parse(prefs.WebhookURL)
+			if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				errs.Add("webhook_url", validation.CodeInvalid, "webhook_url must be an http or https URL")
+			}
+			prefs.WebhookSecret = newWebhookSecret()
+		}
+	}
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
+		return
+	}
+
+	_, err = cfg.db.SetNotificationPrefs(principal.UserID, database.NotificationPrefs{
+		Channels:      prefs.Channels,
+		Digest:        prefs.Digest,
+		WebhookURL:    prefs.WebhookURL,
+		WebhookSecret: prefs.WebhookSecret,
+	}, time.Now())
+	if err != nil {
+		log.Printf("error saving notification preferences: %s", err)
+		respondWithError(w, 500, "couldn't update notification preferences")
+		return
+	}
+	respondWithJSON(w, 200, newNotificationPrefsResponse(prefs))
+}
+
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func notificationsRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.Group(func(r chi.Router) {
+		r.Use(auth.RequireScope(auth.ScopeChirpsRead))
+		r.Get("/", cfg.notificationsGetHandler)
+		r.Post("/read", cfg.notificationsReadHandler)
+		r.Get("/preferences", cfg.notificationPrefsGetHandler)
+	})
+	r.With(auth.RequireScope(auth.ScopeProfileWrite)).Put("/preferences", cfg.notificationPrefsUpdateHandler)
+	return r
+}
@@ -0,0 +1,563 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+)
+
+// authorization codes are exchanged straight away, they don't need to live long
+const oauthCodeTTL = 10 * time.Minute
+
+// scopeDescriptions is how each scope is explained on the consent page
+var scopeDescriptions = map[string]string{
+	auth.ScopeChirpsRead:    "Read chirps",
+	auth.ScopeChirpsWrite:   "Post chirps as you",
+	auth.ScopeProfileWrite:  "Change your email and password",
+	auth.ScopeMessagesRead:  "Read your direct messages",
+	auth.ScopeMessagesWrite: "Send direct messages as you",
+}
+
+// oauthCodeKey is how an authorization code is stored, we only keep its hash
+func oauthCodeKey(code string) string {
+	return hex.EncodeToString(auth.HashSecret(code))
+}
+
+// respondWithOAuthError writes an error in the format RFC 6749 section 5.2
+// expects from the token endpoint
+func respondWithOAuthError(w http.ResponseWriter, code int, errCode string, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, code, map[string]string{
+		"error":             errCode,
+		"error_description": description,
+	})
+}
+
+func (cfg *apiConfig) oauthClientCreateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	principal, _ := auth.PrincipalFrom(r.Context())
+	if !principal.FirstParty() {
+		respondWithError(w, 403, "oauth clients can only be registered from a login session")
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestBody{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		log.Printf("Error decoding JSON: %s", err)
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	if params.Name == "" {
+		respondWithError(w, 400, "clients need a name")
+		return
+	}
+	if len(params.RedirectURIs) == 0 {
+		respondWithError(w, 400, "clients need at least one redirect uri")
+		return
+	}
+	for _, redirectURI := range params.RedirectURIs {
+		if err := validateRedirectURI(redirectURI); err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+	}
+	if len(params.Scopes) == 0 {
+		params.Scopes = auth.KnownScopes
+	}
+	for _, scope := range params.Scopes {
+		if !auth.IsKnownScope(scope) {
+			respondWithError(w, 400, "unknown scope "+scope)
+			return
+		}
+	}
+
+	client := database.OAuthClient{
+		ID:           auth.RandomToken(12),
+		Name:         params.Name,
+		OwnerID:      principal.UserID,
+		RedirectURIs: params.RedirectURIs,
+		Scopes:       params.Scopes,
+		CreatedAt:    time.Now(),
+	}
+	var secret string
+	if params.Confidential {
+		secret = auth.RandomToken(32)
+		client.SecretHash = auth.HashSecret(secret)
+	}
+	client, err = cfg.db.CreateOAuthClient(client)
+	if err != nil {
+		log.Printf("error creating oauth client: %s", err)
+		respondWithError(w, 500, "couldn't register client")
+		return
+	}
+
+	respondWithJSON(w, 201, struct {
+		ClientID     string    `json:"client_id"`
+		ClientSecret string    `json:"client_secret,omitempty"`
+		Name         string    `json:"name"`
+		RedirectURIs []string  `json:"redirect_uris"`
+		Scopes       []string  `json:"scopes"`
+		CreatedAt    time.Time `json:"created_at"`
+	}{
+		ClientID:     client.ID,
+		ClientSecret: secret,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Scopes:       client.Scopes,
+		CreatedAt:    client.CreatedAt,
+	})
+}
+
+// validateRedirectURI accepts https URLs, plain http only for loopback
+// addresses, and custom schemes for native apps
+func validateRedirectURI(redirectURI string) error {
+	u, err := url.Parse(redirectURI)
+	if err != nil || !u.IsAbs() {
+		return errors.New("redirect uris must be absolute urls")
+	}
+	if u.Fragment != "" {
+		return errors.New("redirect uris can't have a fragment")
+	}
+	if u.Scheme == "http" {
+		host := u.Hostname()
+		if host != "localhost" && host != "127.0.0.1" && host != "::1" {
+			return errors.New("http redirect uris are only allowed for localhost")
+		}
+	}
+	return nil
+}
+
+// authorizeRequest is the query (or consent form) of an authorization request
+type authorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+func parseAuthorizeRequest(values url.Values) authorizeRequest {
+	return authorizeRequest{
+		ResponseType:        values.Get("response_type"),
+		ClientID:            values.Get("client_id"),
+		RedirectURI:         values.Get("redirect_uri"),
+		Scope:               values.Get("scope"),
+		State:               values.Get("state"),
+		CodeChallenge:       values.Get("code_challenge"),
+		CodeChallengeMethod: values.Get("code_challenge_method"),
+	}
+}
+
+// authorizeError is an error we can report back to the client by
+// redirecting, as opposed to one we have to show the user
+type authorizeError struct {
+	code        string
+	description string
+}
+
+// checkAuthorizeRequest validates an authorization request. If the client
+// or redirect uri is bad it returns an error to show the user, since we
+// can't trust the redirect. Anything else comes back as an authorizeError
+// to send to the redirect uri
+func (cfg *apiConfig) checkAuthorizeRequest(req *authorizeRequest) (database.OAuthClient, []string, *authorizeError, error) {
+	client, err := cfg.db.GetOAuthClient(req.ClientID)
+	if err != nil {
+		return database.OAuthClient{}, nil, nil, errors.New("unknown client")
+	}
+	if req.RedirectURI == "" && len(client.RedirectURIs) == 1 {
+		req.RedirectURI = client.RedirectURIs[0]
+	}
+	registered := false
+	for _, redirectURI := range client.RedirectURIs {
+		if redirectURI == req.RedirectURI {
+			registered = true
+		}
+	}
+	if !registered {
+		return database.OAuthClient{}, nil, nil, errors.New("redirect uri isn't registered for this client")
+	}
+
+	if req.ResponseType != "code" {
+		return client, nil, &authorizeError{"unsupported_response_type", "only the code response type is supported"}, nil
+	}
+	if req.CodeChallengeMethod != auth.PKCEMethodS256 || !auth.ValidCodeChallenge(req.CodeChallenge) {
+		return client, nil, &authorizeError{"invalid_request", "a S256 code_challenge is required"}, nil
+	}
+
+	scopes := auth.SplitScopes(req.Scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, scope := range scopes {
+		allowed := false
+		for _, clientScope := range client.Scopes {
+			if scope == clientScope {
+				allowed = true
+			}
+		}
+		if !allowed {
+			return client, nil, &authorizeError{"invalid_scope", "scope " + scope + " isn't allowed for this client"}, nil
+		}
+	}
+	return client, scopes, nil, nil
+}
+
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirectURI string, params map[string]string) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		renderOAuthError(w, 400, "invalid redirect uri")
+		return
+	}
+	q := u.Query()
+	for k, v := range params {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+func renderOAuthError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	outputMetricsHtml(w, "static/oauth_error.html", map[string]interface{}{
+		"Error": msg,
+	})
+}
+
+func renderConsent(w http.ResponseWriter, code int, client database.OAuthClient, req authorizeRequest, scopes []string, email string, errMsg string) {
+	descriptions := []string{}
+	for _, scope := range scopes {
+		// never ask a user to grant something the page can't explain
+		description, ok := scopeDescriptions[scope]
+		if !ok {
+			log.Printf("no consent description for scope %q", scope)
+			renderOAuthError(w, 500, "this app asked for a permission we can't describe")
+			return
+		}
+		descriptions = append(descriptions, description)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// don't let other sites frame the consent page and click Allow for the user
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	outputMetricsHtml(w, "static/consent.html", map[string]interface{}{
+		"ClientName":          client.Name,
+		"ClientID":            client.ID,
+		"RedirectURI":         req.RedirectURI,
+		"Scope":               auth.JoinScopes(scopes),
+		"Scopes":              descriptions,
+		"State":               req.State,
+		"CodeChallenge":       req.CodeChallenge,
+		"CodeChallengeMethod": req.CodeChallengeMethod,
+		"Email":               email,
+		"Error":               errMsg,
+	})
+}
+
+// oauthAuthorizeHandler shows the consent page for an authorization request
+func (cfg *apiConfig) oauthAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	req := parseAuthorizeRequest(r.URL.Query())
+	client, scopes, authErr, err := cfg.checkAuthorizeRequest(&req)
+	if err != nil {
+		renderOAuthError(w, 400, err.Error())
+		return
+	}
+	if authErr != nil {
+		redirectWithParams(w, r, req.RedirectURI, map[string]string{
+			"error":             authErr.code,
+			"error_description": authErr.description,
+			"state":             req.State,
+		})
+		return
+	}
+	renderConsent(w, 200, client, req, scopes, "", "")
+}
+
+// oauthConsentHandler handles the consent form, logging the user in and
+// sending them back to the client with an authorization code
+func (cfg *apiConfig) oauthConsentHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		renderOAuthError(w, 400, "couldn't parse form")
+		return
+	}
+	req := parseAuthorizeRequest(r.PostForm)
+	client, scopes, authErr, err := cfg.checkAuthorizeRequest(&req)
+	if err != nil {
+		renderOAuthError(w, 400, err.Error())
+		return
+	}
+	if authErr != nil {
+		redirectWithParams(w, r, req.RedirectURI, map[string]string{
+			"error":             authErr.code,
+			"error_description": authErr.description,
+			"state":             req.State,
+		})
+		return
+	}
+
+	if r.PostForm.Get("action") != "approve" {
+		redirectWithParams(w, r, req.RedirectURI, map[string]string{
+			"error": "access_denied",
+			"state": req.State,
+		})
+		return
+	}
+
+	email := r.PostForm.Get("email")
+	user, err := cfg.db.LoginUser(email, r.PostForm.Get("password"))
+	if err != nil {
+		renderConsent(w, 401, client, req, scopes, email, "Incorrect email or password")
+		return
+	}
+	if reason := loginBlocked(user); reason != "" {
+		renderConsent(w, 403, client, req, scopes, email, "Can't sign in: "+reason)
+		return
+	}
+
+	code := auth.RandomToken(32)
+	err = cfg.db.CreateOAuthCode(oauthCodeKey(code), database.OAuthCode{
+		ClientID:            client.ID,
+		UserID:              user.ID,
+		RedirectURI:         req.RedirectURI,
+		Scopes:              scopes,
+		CodeChallenge:       req.CodeChallenge,
+		CodeChallengeMethod: req.CodeChallengeMethod,
+		ExpiresAt:           time.Now().Add(oauthCodeTTL),
+	})
+	if err != nil {
+		log.Printf("error saving oauth code: %s", err)
+		redirectWithParams(w, r, req.RedirectURI, map[string]string{
+			"error": "server_error",
+			"state": req.State,
+		})
+		return
+	}
+
+	redirectWithParams(w, r, req.RedirectURI, map[string]string{
+		"code":  code,
+		"state": req.State,
+	})
+}
+
+// authenticateOAuthClient checks the client credentials on a token,
+// introspection or revocation request. Confidential clients authenticate
+// with HTTP basic auth or client_secret in the form, public clients just
+// identify themselves with client_id
+func (cfg *apiConfig) authenticateOAuthClient(r *http.Request) (database.OAuthClient, error) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client, err := cfg.db.GetOAuthClient(clientID)
+	if err != nil {
+		return database.OAuthClient{}, errors.New("unknown client")
+	}
+	if client.Confidential() {
+		if subtle.ConstantTimeCompare(client.SecretHash, auth.HashSecret(secret)) != 1 {
+			return database.OAuthClient{}, errors.New("invalid client credentials")
+		}
+	}
+	return client, nil
+}
+
+// oauthTokenHandler exchanges an authorization code for tokens. Tokens are
+// refreshed through /api/refresh like any other session
+func (cfg *apiConfig) oauthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, 400, "invalid_request", "couldn't parse form")
+		return
+	}
+	if r.PostForm.Get("grant_type") != "authorization_code" {
+		respondWithOAuthError(w, 400, "unsupported_grant_type", "only authorization_code is supported, refresh tokens go to /api/refresh")
+		return
+	}
+	client, err := cfg.authenticateOAuthClient(r)
+	if err != nil {
+		respondWithOAuthError(w, 401, "invalid_client", err.Error())
+		return
+	}
+
+	code, err := cfg.db.ConsumeOAuthCode(oauthCodeKey(r.PostForm.Get("code")), time.Now())
+	if err != nil {
+		respondWithOAuthError(w, 400, "invalid_grant", "authorization code is invalid or expired")
+		return
+	}
+	if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		respondWithOAuthError(w, 400, "invalid_grant", "authorization code was issued to another client or redirect uri")
+		return
+	}
+	if !auth.VerifyPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge, code.CodeChallengeMethod) {
+		respondWithOAuthError(w, 400, "invalid_grant", "code_verifier doesn't match the code_challenge")
+		return
+	}
+
+	principal := auth.Principal{
+		UserID:    code.UserID,
+		Scopes:    code.Scopes,
+		SessionID: auth.NewSessionID(),
+		ClientID:  client.ID,
+	}
+	accessTokenString, accessTokenExpiresAt, err := cfg.auth.IssueAccessToken(principal, cfg.accessTokenTTL)
+	if err != nil {
+		log.Printf("error generating oauth access token: %s", err)
+		respondWithOAuthError(w, 500, "server_error", "couldn't create access token")
+		return
+	}
+	refreshTokenString, _, err := cfg.auth.IssueRefreshToken(principal, cfg.refreshTokenTTL)
+	if err != nil {
+		log.Printf("error generating oauth refresh token: %s", err)
+		respondWithOAuthError(w, 500, "server_error", "couldn't create refresh token")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	respondWithJSON(w, 200, struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}{
+		AccessToken:  accessTokenString,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(accessTokenExpiresAt).Seconds()),
+		RefreshToken: refreshTokenString,
+		Scope:        auth.JoinScopes(principal.Scopes),
+	})
+}
+
+// oauthIntrospectHandler implements RFC 7662 token introspection for
+// confidential clients
+func (cfg *apiConfig) oauthIntrospectHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, 400, "invalid_request", "couldn't parse form")
+		return
+	}
+	client, err := cfg.authenticateOAuthClient(r)
+	if err != nil || !client.Confidential() {
+		respondWithOAuthError(w, 401, "invalid_client", "introspection requires client credentials")
+		return
+	}
+
+	tokenString := r.PostForm.Get("token")
+	tokenType := "access_token"
+	claims, err := cfg.auth.ParseAccessToken(tokenString)
+	if err != nil {
+		tokenType = "refresh_token"
+		claims, err = cfg.auth.ParseRefreshToken(tokenString)
+		if err == nil {
+			var revoked bool
+			revoked, err = cfg.db.GetRevokeToken(tokenString)
+			if err == nil && revoked {
+				err = errors.New("token has been revoked")
+			}
+		}
+	}
+	if err != nil {
+		// RFC 7662 says not to explain why a token is inactive
+		respondWithJSON(w, 200, map[string]bool{"active": false})
+		return
+	}
+
+	response := map[string]interface{}{
+		"active":     true,
+		"token_type": tokenType,
+		"scope":      claims.Scope,
+		"sub":        claims.Subject,
+		"iss":        claims.Issuer,
+	}
+	if claims.ClientID != "" {
+		response["client_id"] = claims.ClientID
+	}
+	if len(claims.Audience) > 0 {
+		response["aud"] = claims.Audience
+	}
+	if claims.ExpiresAt != nil {
+		response["exp"] = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		response["iat"] = claims.IssuedAt.Unix()
+	}
+	respondWithJSON(w, 200, response)
+}
+
+// oauthRevokeHandler implements RFC 7009 token revocation. Access tokens
+// are short lived and stateless so only refresh tokens can actually be
+// revoked, but per the RFC the response is the same either way
+func (cfg *apiConfig) oauthRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		respondWithOAuthError(w, 400, "invalid_request", "couldn't parse form")
+		return
+	}
+	client, err := cfg.authenticateOAuthClient(r)
+	if err != nil {
+		respondWithOAuthError(w, 401, "invalid_client", err.Error())
+		return
+	}
+
+	tokenString := r.PostForm.Get("token")
+	if hint := r.PostForm.Get("token_type_hint"); hint != "" && hint != "refresh_token" && hint != "access_token" {
+		respondWithOAuthError(w, 400, "unsupported_token_type", "unknown token_type_hint")
+		return
+	}
+	claims, err := cfg.auth.ParseRefreshToken(tokenString)
+	// clients can only revoke their own tokens
+	if err == nil && claims.ClientID == client.ID {
+		var expiresAt time.Time
+		if claims.ExpiresAt != nil {
+			expiresAt = claims.ExpiresAt.Time
+		}
+		err = cfg.db.AddRevokeToken(tokenString, time.Now(), expiresAt)
+		if err != nil {
+			log.Printf("error revoking oauth refresh token: %s", err)
+			respondWithOAuthError(w, 503, "temporarily_unavailable", "couldn't revoke token")
+			return
+		}
+	}
+	w.WriteHeader(200)
+}
+
+func oauthClientsRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.Use(auth.RequireAuth)
+	r.Post("/", cfg.oauthClientCreateHandler)
+	return r
+}
+
+func oauthRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/authorize", cfg.oauthAuthorizeHandler)
+	r.Post("/authorize", cfg.oauthConsentHandler)
+	r.Post("/token", cfg.oauthTokenHandler)
+	r.Post("/introspect", cfg.oauthIntrospectHandler)
+	r.Post("/revoke", cfg.oauthRevokeHandler)
+	return r
+}
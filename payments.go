@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+)
+
+// payment webhooks signed longer ago than this are treated as replays
+const paymentsSignatureTolerance = 5 * time.Minute
+
+// payment event ids are remembered this long to skip retried deliveries,
+// events that happened longer ago than this are refused
+const paymentEventRetention = 30 * 24 * time.Hour
+
+// payment webhook bodies are tiny, anything bigger isn't from the provider
+const maxPaymentsWebhookBody = 64 << 10
+
+// paymentEventMemberships maps each payment event to whether the user
+// should be on Chirpy Red afterwards
+var paymentEventMemberships = map[string]bool{
+	"user.upgraded":    true,
+	"user.downgraded":  false,
+	"payment.refunded": false,
+}
+
+// authenticatePaymentsWebhook accepts either the shared API key in an
+// `Authorization: ApiKey ...` header or an HMAC signature of the body in
+// X-Payments-Signature
+func (cfg *apiConfig) authenticatePaymentsWebhook(r *http.Request, body []byte) error {
+	if signature := r.Header.Get("X-Payments-Signature"); signature != "" {
+		if cfg.paymentsWebhookSecret == "" {
+			return errors.New("signed webhooks aren't configured")
+		}
+		return auth.VerifyWebhookSignature(cfg.paymentsWebhookSecret, signature, body, time.Now(), paymentsSignatureTolerance)
+	}
+
+	scheme, key, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "ApiKey") {
+		return errors.New("missing webhook credentials")
+	}
+	if cfg.paymentsWebhookKey == "" {
+		return errors.New("webhook api keys aren't configured")
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimSpace(key)), []byte(cfg.paymentsWebhookKey)) != 1 {
+		return errors.New("invalid webhook api key")
+	}
+	return nil
+}
+
+// paymentsWebhookHandler upgrades and downgrades Chirpy Red memberships when
+// the payment provider tells us to. Providers retry on anything but a 2xx,
+// so events we don't care about are acknowledged too
+func (cfg *apiConfig) paymentsWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		ID    string `json:"id"`
+		Event string `json:"event"`
+		// CreatedAt is when the event happened, deliveries without it are
+		// taken to have happened when they arrive
+		CreatedAt time.Time `json:"created_at"`
+		Data      struct {
+			UserID int `json:"user_id"`
+		} `json:"data"`
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxPaymentsWebhookBody))
+	if err != nil {
+		respondWithError(w, 400, "couldn't read request body")
+		return
+	}
+	err = cfg.authenticatePaymentsWebhook(r, body)
+	if err != nil {
+		log.Printf("rejected payments webhook: %s", err)
+		respondWithError(w, 401, err.Error())
+		return
+	}
+
+	params := requestBody{}
+	err = json.Unmarshal(body, &params)
+	if err != nil {
+		log.Printf("Error decoding JSON: %s", err)
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	isChirpyRed, ok := paymentEventMemberships[params.Event]
+	if !ok {
+		w.WriteHeader(204)
+		return
+	}
+	if params.ID == "" {
+		respondWithError(w, 400, "events need an id")
+		return
+	}
+
+	now := time.Now()
+	occurredAt := params.CreatedAt
+	if occurredAt.IsZero() {
+		occurredAt = now
+	}
+	applied, err := cfg.db.ApplyPaymentEvent(params.ID, database.PaymentEvent{
+		Type:        params.Event,
+		UserID:      params.Data.UserID,
+		OccurredAt:  occurredAt,
+		ProcessedAt: now,
+	}, isChirpyRed, paymentEventRetention)
+	if errors.Is(err, database.ErrUserNotFound) {
+		respondWithError(w, 404, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("error applying payment event %s: %s", params.ID, err)
+		respondWithError(w, 500, "couldn't apply event")
+		return
+	}
+	if !applied {
+		log.Printf("payment event %s was already applied or is out of date", params.ID)
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/validation"
+)
+
+const (
+	minPollOptions = 2
+	maxPollOptions = 4
+	// maxPollOptionLength is the longest option, in characters
+	maxPollOptionLength = 25
+	// maxPollDuration is how long a poll can stay open after it's published
+	maxPollDuration = 7 * 24 * time.Hour
+)
+
+// pollRequest is the poll part of a new chirp
+type pollRequest struct {
+	Options  []string  `json:"options"`
+	ClosesAt time.Time `json:"closes_at"`
+}
+
+// validatePoll checks a poll on a chirp going out at publishAt and returns
+// it with its options normalized
+func validatePoll(errs *validation.Errors, req *pollRequest, publishAt time.Time) *database.Poll {
+	if req == nil {
+		return nil
+	}
+	if len(req.Options) < minPollOptions || len(req.Options) > maxPollOptions {
+		errs.Add("poll.options", validation.CodeInvalid, "polls need 2 to 4 options")
+	}
+	options := []string{}
+	seen := map[string]struct{}{}
+	for i, option := range req.Options {
+		field := "poll.options." + strconv.Itoa(i)
+		option = validation.Text(errs, field, option, maxPollOptionLength)
+		key := strings.ToLower(strings.TrimSpace(option))
+		if _, ok := seen[key]; ok && key != "" {
+			errs.Add(field, validation.CodeInvalid, "options must be different")
+		}
+		seen[key] = struct{}{}
+		options = append(options, strings.TrimSpace(option))
+	}
+	switch {
+	case req.ClosesAt.IsZero():
+		errs.Add("poll.closes_at", validation.CodeRequired, "polls need a closing time")
+	case !req.ClosesAt.After(publishAt):
+		errs.Add("poll.closes_at", validation.CodeInvalid, "polls have to close after the chirp is published")
+	case req.ClosesAt.After(publishAt.Add(maxPollDuration)):
+		errs.Add("poll.closes_at", validation.CodeInvalid, "polls can stay open for at most 7 days")
+	}
+	return &database.Poll{
+		Options:  options,
+		ClosesAt: req.ClosesAt,
+	}
+}
+
+type pollOptionResponse struct {
+	Text string `json:"text"`
+	// Votes is left out until the requester can see the results
+	Votes *int `json:"votes,omitempty"`
+}
+
+type pollResponse struct {
+	Options     []pollOptionResponse `json:"options"`
+	ClosesAt    time.Time            `json:"closes_at"`
+	Closed      bool                 `json:"closed"`
+	TotalVotes  *int                 `json:"total_votes,omitempty"`
+	VotedOption *int                 `json:"voted_option,omitempty"`
+}
+
+// newPollResponse shows poll to userID, who only gets to see the results
+// once they've voted or the poll has closed
+func newPollResponse(poll database.Poll, userID int, now time.Time) *pollResponse {
+	response := &pollResponse{
+		Options:  []pollOptionResponse{},
+		ClosesAt: poll.ClosesAt,
+		Closed:   poll.Closed(now),
+	}
+	if option, ok := poll.Votes[userID]; ok && userID != 0 {
+		response.VotedOption = &option
+	}
+	showResults := response.Closed || response.VotedOption != nil
+	tally := poll.Tally()
+	for i, text := range poll.Options {
+		option := pollOptionResponse{Text: text}
+		if showResults {
+			option.Votes = &tally[i]
+		}
+		response.Options = append(response.Options, option)
+	}
+	if showResults {
+		total := len(poll.Votes)
+		response.TotalVotes = &total
+	}
+	return response
+}
+
+// chirpResponse is a chirp as shown to whoever asked for it
+type chirpResponse struct {
+	database.Chirp
+	Poll        *pollResponse        `json:"poll,omitempty"`
+	QuotedChirp *quotedChirpResponse `json:"quoted_chirp,omitempty"`
+	Likes       int                  `json:"likes"`
+}
+
+// renderChirps adds the parts of each chirp that depend on who's asking
+func (cfg *apiConfig) renderChirps(r *http.Request, chirps []database.Chirp) ([]chirpResponse, error) {
+	ids := []int{}
+	for _, chirp := range chirps {
+		ids = append(ids, chirp.ID)
+	}
+	polls, err := cfg.db.PollsFor(ids)
+	if err != nil {
+		return nil, err
+	}
+	quotes, err := cfg.quotedChirps(r, chirps)
+	if err != nil {
+		return nil, err
+	}
+	likes, err := cfg.db.LikeCounts(ids)
+	if err != nil {
+		return nil, err
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	now := time.Now()
+	responses := []chirpResponse{}
+	for _, chirp := range chirps {
+		response := chirpResponse{Chirp: chirp, Likes: likes[chirp.ID]}
+		if poll, ok := polls[chirp.ID]; ok {
+			response.Poll = newPollResponse(poll, principal.UserID, now)
+		}
+		if chirp.QuotedChirpID != 0 {
+			response.QuotedChirp = quotes[chirp.QuotedChirpID]
+		}
+		responses = append(responses, response)
+	}
+	return responses, nil
+}
+
+// respondWithChirps renders chirps for the requester and writes them
+func (cfg *apiConfig) respondWithChirps(w http.ResponseWriter, r *http.Request, code int, chirps []database.Chirp) {
+	responses, err := cfg.renderChirps(r, chirps)
+	if err != nil {
+		log.Printf("error rendering chirps: %s", err)
+		respondWithError(w, 500, "couldn't load chirps")
+		return
+	}
+	respondWithJSON(w, code, responses)
+}
+
+// respondWithChirp renders a single chirp for the requester and writes it
+func (cfg *apiConfig) respondWithChirp(w http.ResponseWriter, r *http.Request, code int, chirp database.Chirp) {
+	responses, err := cfg.renderChirps(r, []database.Chirp{chirp})
+	if err != nil {
+		log.Printf("error rendering chirp: %s", err)
+		respondWithError(w, 500, "couldn't load chirp")
+		return
+	}
+	respondWithJSON(w, code, responses[0])
+}
+
+// pollVoteHandler takes {"option": 0}, the index of the option to vote for
+func (cfg *apiConfig) pollVoteHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Option *int `json:"option"`
+	}
+
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+	params := requestBody{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	if params.Option == nil {
+		errs := validation.Errors{}
+		errs.Add("option", validation.CodeRequired, "option is required")
+		respondWithValidationErrors(w, errs)
+		return
+	}
+	chirp, err := cfg.db.GetChirp(chirpID)
+	if err != nil || !chirp.Published() || !chirpVisible(r, chirp) {
+		respondWithError(w, 404, database.ErrChirpNotFound.Error())
+		return
+	}
+
+	principal, _ := auth.PrincipalFrom(r.Context())
+	now := time.Now()
+	poll, err := cfg.db.Vote(chirpID, principal.UserID, *params.Option, now)
+	switch {
+	case errors.Is(err, database.ErrPollNotFound):
+		respondWithError(w, 404, err.Error())
+	case errors.Is(err, database.ErrPollClosed), errors.Is(err, database.ErrAlreadyVoted):
+		respondWithError(w, 409, err.Error())
+	case errors.Is(err, database.ErrInvalidVote):
+		errs := validation.Errors{}
+		errs.Add("option", validation.CodeInvalid, err.Error())
+		respondWithValidationErrors(w, errs)
+	case err != nil:
+		log.Printf("error voting: %s", err)
+		respondWithError(w, 500, "couldn't record vote")
+	default:
+		respondWithJSON(w, 201, newPollResponse(poll, principal.UserID, now))
+	}
+}
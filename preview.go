@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"log"
+
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/preview"
+	"github.com/staf3333/chirpy/internal/validation"
+)
+
+// requestPreview fetches a preview card for the first link in chirp in the
+// background, it shows up on the chirp once it's ready
+func (cfg *apiConfig) requestPreview(chirp database.Chirp) {
+	links := validation.URLs(chirp.Body)
+	if len(links) == 0 {
+		return
+	}
+	link := links[0]
+	cfg.previews.Enqueue(link, func(card preview.Card, err error) {
+		if err != nil {
+			log.Printf("preview: no card for %s: %s", link, err)
+			return
+		}
+		err = cfg.db.SetChirpPreview(chirp.ID, database.LinkPreview{
+			Link:        link,
+			URL:         card.URL,
+			Title:       card.Title,
+			Description: card.Description,
+			ImageURL:    card.ImageURL,
+			SiteName:    card.SiteName,
+			Type:        card.Type,
+		})
+		if err != nil && !errors.Is(err, database.ErrChirpNotFound) {
+			log.Printf("preview: error saving card for chirp %d: %s", chirp.ID, err)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/validation"
+)
+
+// quotedChirpResponse is the compact copy of a quoted chirp embedded in the
+// chirp quoting it. When the quoted chirp is gone or the requester can't
+// see it only the id is filled in and Tombstone is set
+type quotedChirpResponse struct {
+	ID            int                   `json:"id"`
+	Tombstone     bool                  `json:"tombstone,omitempty"`
+	Body          string                `json:"body,omitempty"`
+	AuthorID      int                   `json:"author_id,omitempty"`
+	Media         []database.ChirpMedia `json:"media,omitempty"`
+	QuotedChirpID int                   `json:"quoted_chirp_id,omitempty"`
+	PublishedAt   *time.Time            `json:"published_at,omitempty"`
+}
+
+// quotedChirps loads the chirps quoted by chirps and renders them for the
+// requester, keyed by id. Quoted chirps that were deleted, aren't public or
+// whose author blocked the requester (or the other way round) come back as
+// tombstones
+func (cfg *apiConfig) quotedChirps(r *http.Request, chirps []database.Chirp) (map[int]*quotedChirpResponse, error) {
+	ids := []int{}
+	for _, chirp := range chirps {
+		if chirp.QuotedChirpID != 0 {
+			ids = append(ids, chirp.QuotedChirpID)
+		}
+	}
+	quotes := map[int]*quotedChirpResponse{}
+	if len(ids) == 0 {
+		return quotes, nil
+	}
+	quoted, err := cfg.db.ChirpsFor(ids)
+	if err != nil {
+		return nil, err
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	blocked, err := cfg.db.BlockedUsers(principal.UserID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		quote := &quotedChirpResponse{ID: id, Tombstone: true}
+		quotes[id] = quote
+		chirp, ok := quoted[id]
+		if !ok || !chirp.Published() || !chirpVisible(r, chirp) {
+			continue
+		}
+		if _, ok := blocked[chirp.AuthorID]; ok {
+			continue
+		}
+		*quote = quotedChirpResponse{
+			ID:            chirp.ID,
+			Body:          chirp.Body,
+			AuthorID:      chirp.AuthorID,
+			Media:         chirp.Media,
+			QuotedChirpID: chirp.QuotedChirpID,
+			PublishedAt:   chirp.PublishedAt,
+		}
+	}
+	return quotes, nil
+}
+
+// validateQuote checks that userID can quote the chirp with the given id:
+// it has to be published, not held by moderation and not written by
+// someone on either side of a block with them
+func (cfg *apiConfig) validateQuote(errs *validation.Errors, userID int, quotedID int) error {
+	if quotedID == 0 {
+		return nil
+	}
+	chirp, err := cfg.db.GetChirp(quotedID)
+	if err != nil || !chirp.Published() || chirp.ModerationState != "" {
+		errs.Add("quoted_chirp_id", validation.CodeInvalid, database.ErrChirpNotFound.Error())
+		return nil
+	}
+	blocked, err := cfg.db.IsBlocked(userID, chirp.AuthorID)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		errs.Add("quoted_chirp_id", validation.CodeInvalid, "you can't quote this chirp")
+	}
+	return nil
+}
+
+// chirpQuotesHandler lists the chirps quoting a chirp, paged like every
+// other feed
+func (cfg *apiConfig) chirpQuotesHandler(w http.ResponseWriter, r *http.Request) {
+	chirpID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid chirp id")
+		return
+	}
+	chirp, err := cfg.db.GetChirp(chirpID)
+	if err != nil || !chirp.Published() || !chirpVisible(r, chirp) {
+		respondWithError(w, 404, database.ErrChirpNotFound.Error())
+		return
+	}
+	quotes, err := cfg.db.QuotesOf(chirpID)
+	if err != nil {
+		log.Printf("error listing quotes: %s", err)
+		respondWithError(w, 500, "couldn't load chirps")
+		return
+	}
+	cfg.respondWithFeed(w, r, quotes)
+}
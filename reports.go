@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+)
+
+// reportReasons are the reason codes users can pick from when reporting
+var reportReasons = map[string]struct{}{
+	"spam":           {},
+	"harassment":     {},
+	"hate":           {},
+	"violence":       {},
+	"self_harm":      {},
+	"misinformation": {},
+	"impersonation":  {},
+	"other":          {},
+}
+
+// maxReportComment is the longest free text comment a report can carry
+const maxReportComment = 1000
+
+// reportHandler returns a handler that files a report against the chirp or
+// user in the {id} URL param
+func (cfg *apiConfig) reportHandler(targetType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		type requestBody struct {
+			Reason  string `json:"reason"`
+			Comment string `json:"comment"`
+		}
+
+		targetID, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			respondWithError(w, 400, "invalid "+targetType+" id")
+			return
+		}
+		params := requestBody{}
+		err = json.NewDecoder(r.Body).Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, "couldn't decode request body")
+			return
+		}
+		if _, ok := reportReasons[params.Reason]; !ok {
+			respondWithError(w, 400, "unknown report reason "+params.Reason)
+			return
+		}
+		if len(params.Comment) > maxReportComment {
+			respondWithError(w, 400, "comment is too long")
+			return
+		}
+
+		principal, _ := auth.PrincipalFrom(r.Context())
+		if targetType == database.ReportTargetChirp {
+			// people can only report chirps they can see
+			chirp, err := cfg.db.GetChirp(targetID)
+			if err != nil || !chirpVisible(r, chirp) {
+				respondWithError(w, 404, database.ErrChirpNotFound.Error())
+				return
+			}
+			if chirp.AuthorID == principal.UserID {
+				respondWithError(w, 400, "you can't report your own chirp")
+				return
+			}
+		}
+		if targetType == database.ReportTargetUser && targetID == principal.UserID {
+			respondWithError(w, 400, "you can't report yourself")
+			return
+		}
+
+		report, created, err := cfg.db.CreateReport(database.Report{
+			ReporterID: principal.UserID,
+			TargetType: targetType,
+			TargetID:   targetID,
+			Reason:     params.Reason,
+			Comment:    params.Comment,
+			CreatedAt:  time.Now(),
+		})
+		if errors.Is(err, database.ErrChirpNotFound) || errors.Is(err, database.ErrUserNotFound) {
+			respondWithError(w, 404, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("error creating report: %s", err)
+			respondWithError(w, 500, "couldn't create report")
+			return
+		}
+		// reporters only get to see their own report, not the queue state
+		response := map[string]interface{}{
+			"id":          report.ID,
+			"target_type": report.TargetType,
+			"target_id":   report.TargetID,
+			"reason":      report.Reason,
+			"created_at":  report.CreatedAt,
+		}
+		if !created {
+			respondWithJSON(w, 200, response)
+			return
+		}
+		respondWithJSON(w, 201, response)
+	}
+}
+
+// respondWithReport writes the result of a moderator action on a report
+func respondWithReport(w http.ResponseWriter, report database.Report, err error) {
+	switch {
+	case errors.Is(err, database.ErrReportNotFound),
+		errors.Is(err, database.ErrChirpNotFound),
+		errors.Is(err, database.ErrUserNotFound):
+		respondWithError(w, 404, err.Error())
+	case errors.Is(err, database.ErrReportClaimed), errors.Is(err, database.ErrReportResolved):
+		respondWithError(w, 409, err.Error())
+	case errors.Is(err, database.ErrInvalidResolution):
+		respondWithError(w, 400, err.Error())
+	case errors.Is(err, database.ErrSuspendStaff):
+		respondWithError(w, 403, err.Error())
+	case err != nil:
+		log.Printf("error updating report: %s", err)
+		respondWithError(w, 500, "couldn't update report")
+	default:
+		respondWithJSON(w, 200, report)
+	}
+}
+
+// reportsGetHandler lists the queue, filtered by ?status=, ?target_type=
+// and ?claimed_by=. It defaults to everything that isn't resolved yet
+func (cfg *apiConfig) reportsGetHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.ReportFilter{
+		Status:     query.Get("status"),
+		TargetType: query.Get("target_type"),
+	}
+	if claimedBy := query.Get("claimed_by"); claimedBy != "" {
+		id, err := strconv.Atoi(claimedBy)
+		if err != nil {
+			respondWithError(w, 400, "invalid claimed_by")
+			return
+		}
+		filter.ClaimedBy = id
+	}
+
+	reports, err := cfg.db.ListReports(filter)
+	if err != nil {
+		log.Printf("error listing reports: %s", err)
+		respondWithError(w, 500, "couldn't list reports")
+		return
+	}
+	if filter.Status == "" {
+		pending := []database.Report{}
+		for _, report := range reports {
+			if report.Status != database.ReportResolved {
+				pending = append(pending, report)
+			}
+		}
+		reports = pending
+	}
+	respondWithJSON(w, 200, reports)
+}
+
+func (cfg *apiConfig) reportGetHandler(w http.ResponseWriter, r *http.Request) {
+	reportID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid report id")
+		return
+	}
+	report, err := cfg.db.GetReport(reportID)
+	respondWithReport(w, report, err)
+}
+
+func (cfg *apiConfig) reportClaimHandler(w http.ResponseWriter, r *http.Request) {
+	reportID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid report id")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	report, err := cfg.db.ClaimReport(reportID, principal.UserID, time.Now())
+	respondWithReport(w, report, err)
+}
+
+func (cfg *apiConfig) reportReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	reportID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid report id")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	report, err := cfg.db.ReleaseReport(reportID, principal.UserID, principal.HasRole(auth.RoleAdmin), time.Now())
+	respondWithReport(w, report, err)
+}
+
+// reportResolveHandler takes {"action": "dismiss" | "hide_chirp" |
+// "suspend_author", "note": "..."}
+func (cfg *apiConfig) reportResolveHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Action string `json:"action"`
+		Note   string `json:"note"`
+	}
+
+	reportID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid report id")
+		return
+	}
+	params := requestBody{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, 400, "couldn't decode request body")
+		return
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	report, err := cfg.db.ResolveReport(reportID, principal.UserID, params.Action, params.Note, principal.HasRole(auth.RoleAdmin), time.Now())
+	respondWithReport(w, report, err)
+}
+
+// auditGetHandler shows the audit trail, filtered by ?actor_id=,
+// ?target_type= and ?target_id=
+func (cfg *apiConfig) auditGetHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.AuditFilter{
+		TargetType: query.Get("target_type"),
+	}
+	for param, field := range map[string]*int{
+		"actor_id":  &filter.ActorID,
+		"target_id": &filter.TargetID,
+	} {
+		val := query.Get(param)
+		if val == "" {
+			continue
+		}
+		id, err := strconv.Atoi(val)
+		if err != nil {
+			respondWithError(w, 400, "invalid "+param)
+			return
+		}
+		*field = id
+	}
+
+	entries, err := cfg.db.ListAuditEntries(filter)
+	if err != nil {
+		log.Printf("error listing audit entries: %s", err)
+		respondWithError(w, 500, "couldn't list audit entries")
+		return
+	}
+	respondWithJSON(w, 200, entries)
+}
@@ -5,51 +5,32 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/staf3333/chirpy/internal/auth"
 )
 
-func (cfg *apiConfig) refreshHandler(w http.ResponseWriter, r *http.Request) {
-
-	authHeader := r.Header.Get("Authorization")
-	if len(authHeader) == 0 {
-		log.Printf("unauthorized attempt to modify resources")
-		w.WriteHeader(401)
-		return
-	}
-	// get token string from authorization header
-	tokenString := stripAuthHeaderPrefix(authHeader)
-
-	type MyCustomClaims struct {
-		jwt.RegisteredClaims
-	}
-	claims := &MyCustomClaims{}
-
-	keyFunc := func (token *jwt.Token) (interface{}, error) {
-		return []byte(cfg.jwtSecret), nil
-	}
-	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc)
+// parseRefreshRequest pulls the refresh token out of the Authorization
+// header and verifies it, writing the error response itself on failure
+func (cfg *apiConfig) parseRefreshRequest(w http.ResponseWriter, r *http.Request) (string, *auth.Claims, bool) {
+	tokenString, err := auth.BearerToken(r)
 	if err != nil {
-		log.Printf("unauthorized attempt to modify resources, claims don't match")
-		respondWithError(w, 401, err.Error())
-		return
-	}
-
-	if !token.Valid {
-		log.Printf("token has expired")
+		log.Printf("unauthorized attempt to use refresh token: %s", err)
 		respondWithError(w, 401, err.Error())
-		return
+		return "", nil, false
 	}
 
-	issuerString, err := token.Claims.GetIssuer()
+	claims, err := cfg.auth.ParseRefreshToken(tokenString)
 	if err != nil {
-		log.Printf("issue getting issuer from token")
-		respondWithError(w, 401, err.Error())
-		return
+		log.Printf("rejected refresh token: %s", err)
+		respondWithError(w, 401, "invalid refresh token")
+		return "", nil, false
 	}
+	return tokenString, claims, true
+}
+
+func (cfg *apiConfig) refreshHandler(w http.ResponseWriter, r *http.Request) {
 
-	if issuerString != "chirpy-refresh" {
-		log.Printf("wrong type of token")
-		respondWithError(w, 401, "wrong type of token bruh")
+	tokenString, claims, ok := cfg.parseRefreshRequest(w, r)
+	if !ok {
 		return
 	}
 
@@ -64,83 +45,72 @@ func (cfg *apiConfig) refreshHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	userIDStr, err := token.Claims.GetSubject()
+	principal, err := claims.Principal()
 	if err != nil {
-		log.Printf("issue getting subject from token")
 		respondWithError(w, 401, err.Error())
 		return
 	}
+	// refresh tokens from before scopes existed get the first party defaults
+	if len(principal.Scopes) == 0 {
+		principal.Scopes = auth.DefaultScopes
+	}
 
-	// here is where I need to create a new access token to return
-	accessTokenExpirationDuration := time.Duration(1) * time.Hour
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer: "chirpy-access",
-		IssuedAt: jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenExpirationDuration)),
-		Subject: userIDStr,
-	})
+	// suspensions and forced logouts apply to refresh tokens too
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	err = cfg.auth.Users.CheckUser(principal.UserID, issuedAt)
+	if err != nil {
+		respondWithError(w, 401, err.Error())
+		return
+	}
+	// pick up role changes made since the user logged in
+	principal.Role = ""
+	if principal.FirstParty() {
+		user, err := cfg.db.GetUser(principal.UserID)
+		if err != nil {
+			respondWithError(w, 401, err.Error())
+			return
+		}
+		principal.Role = user.RoleOrDefault()
+	}
 
-	accessTokenString, err := accessToken.SignedString([]byte(cfg.jwtSecret))
+	// here is where I need to create a new access token to return
+	accessTokenString, accessTokenExpiresAt, err := cfg.auth.IssueAccessToken(principal, cfg.accessTokenTTL)
 	if err != nil {
-		log.Fatal("error generating users jwt token")
+		log.Printf("error generating users access token: %s", err)
+		respondWithError(w, 500, "couldn't create access token")
+		return
 	}
 
 	respondWithJSON(w, 200, struct {
 		Token string `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
 	}{
 		Token: accessTokenString,
+		ExpiresAt: accessTokenExpiresAt,
 	})
 }
 
 func (cfg *apiConfig) revokeHandler(w http.ResponseWriter, r *http.Request) {
 
-	authHeader := r.Header.Get("Authorization")
-	if len(authHeader) == 0 {
-		log.Printf("unauthorized attempt to modify resources")
-		w.WriteHeader(401)
+	tokenString, claims, ok := cfg.parseRefreshRequest(w, r)
+	if !ok {
 		return
 	}
-	// get token string from authorization header
-	tokenString := stripAuthHeaderPrefix(authHeader)
 
-	type MyCustomClaims struct {
-		jwt.RegisteredClaims
+	// keep the token's own expiry so the janitor knows when it can forget it
+	var expiresAt time.Time
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
 	}
-	claims := &MyCustomClaims{}
 
-	keyFunc := func (token *jwt.Token) (interface{}, error) {
-		return []byte(cfg.jwtSecret), nil
-	}
-	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc)
+	err := cfg.db.AddRevokeToken(tokenString, time.Now(), expiresAt)
 	if err != nil {
-		log.Printf("unauthorized attempt to modify resources, claims don't match")
 		respondWithError(w, 401, err.Error())
 		return
 	}
 
-	if !token.Valid {
-		log.Printf("token has expired")
-		respondWithError(w, 401, err.Error())
-		return
-	}
-
-	issuerString, err := token.Claims.GetIssuer()
-	if err != nil {
-		log.Printf("issue getting issuer from token")
-		respondWithError(w, 401, err.Error())
-		return
-	}
-
-	if issuerString != "chirpy-refresh" {
-		log.Printf("wrong type of token")
-		respondWithError(w, 401, "wrong type of token bruh")
-		return
-	}
-
-	err = cfg.db.AddRevokeToken(tokenString, time.Now())
-	if err != nil {
-		respondWithError(w, 401, err.Error())
-	}
-
 	w.WriteHeader(200)
-}
\ No newline at end of file
+}
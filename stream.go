@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/notify"
+	"github.com/staf3333/chirpy/internal/stream"
+	"github.com/staf3333/chirpy/internal/validation"
+	"github.com/staf3333/chirpy/internal/webhooks"
+)
+
+// hub event types
+const (
+	eventChirp   = "chirp"
+	eventLike    = "like"
+	eventMention = "mention"
+	// eventReset tells a client resuming with Last-Event-ID that it missed
+	// too much, it should reload the feed and carry on from this event
+	eventReset = "reset"
+
+	// streamRetry is how long clients wait before reconnecting
+	streamRetry = 3 * time.Second
+)
+
+// mentionEvent goes out on the hub for each user @mentioned in a chirp
+type mentionEvent struct {
+	UserID int
+	Chirp  database.Chirp
+}
+
+// chirpPublished is called whenever a chirp goes out, it fetches the link
+// preview and tells the live streams. Chirps held by moderation stay off
+// the streams until they're approved
+func (cfg *apiConfig) chirpPublished(chirp database.Chirp) {
+	cfg.requestPreview(chirp)
+	if chirp.ModerationState == "" {
+		cfg.announceChirp(chirp)
+	}
+}
+
+// announceChirp publishes chirp on the hub, to webhooks and to the
+// author's followers on other servers, along with a mention event for
+// everyone it @mentions, and notifies them and the author of the chirp it
+// quotes
+func (cfg *apiConfig) announceChirp(chirp database.Chirp) {
+	cfg.hub.Publish(eventChirp, chirp)
+	cfg.emitWebhook(webhooks.EventChirpCreated, chirp.AuthorID, chirp)
+	cfg.federateChirp(chirp)
+	if chirp.QuotedChirpID != 0 {
+		quoted, err := cfg.db.GetChirp(chirp.QuotedChirpID)
+		if err == nil {
+			cfg.notifier.Notify(notify.Event{
+				Kind:    notify.KindReply,
+				UserID:  quoted.AuthorID,
+				ActorID: chirp.AuthorID,
+				ChirpID: quoted.ID,
+			})
+		}
+	}
+	handles := validation.Mentions(chirp.Body)
+	if len(handles) == 0 {
+		return
+	}
+	users, err := cfg.db.UsersByHandle(handles)
+	if err != nil {
+		log.Printf("error looking up mentions: %s", err)
+		return
+	}
+	for _, handle := range handles {
+		user, ok := users[handle]
+		if !ok || user.ID == chirp.AuthorID {
+			continue
+		}
+		cfg.hub.Publish(eventMention, mentionEvent{UserID: user.ID, Chirp: chirp})
+		cfg.notifier.Notify(notify.Event{
+			Kind:    notify.KindMention,
+			UserID:  user.ID,
+			ActorID: chirp.AuthorID,
+			ChirpID: chirp.ID,
+		})
+	}
+}
+
+// showChirp reports whether a live chirp should go to userID: they can see
+// it and haven't blocked or muted its author, nor been blocked by them
+func (cfg *apiConfig) showChirp(r *http.Request, userID int, chirp database.Chirp) (bool, error) {
+	if !chirpVisible(r, chirp) {
+		return false, nil
+	}
+	hidden, err := cfg.db.HiddenAuthors(userID)
+	if err != nil {
+		return false, err
+	}
+	_, ok := hidden[chirp.AuthorID]
+	return !ok, nil
+}
+
+// onTimeline reports whether chirp belongs on userID's timeline, their own
+// chirps and those of people they follow
+func (cfg *apiConfig) onTimeline(userID int, chirp database.Chirp) (bool, error) {
+	if chirp.AuthorID == userID {
+		return true, nil
+	}
+	following, err := cfg.db.Following(userID)
+	if err != nil {
+		return false, err
+	}
+	_, ok := following[chirp.AuthorID]
+	return ok, nil
+}
+
+// chirpStreamFilter picks the chirps that go to one stream
+type chirpStreamFilter func(chirp database.Chirp) (bool, error)
+
+// serveChirpStream streams chirps from the hub as Server-Sent Events until
+// the client goes away or falls too far behind. Like the feeds, chirps the
+// requester can't see or whose author they blocked or muted are left out,
+// filter narrows it down further. Both are checked again for every chirp,
+// so follows, blocks and mutes made mid-stream apply.
+//
+// Clients resume with the Last-Event-ID header, events still in the hub's
+// ring are replayed
+func (cfg *apiConfig) serveChirpStream(w http.ResponseWriter, r *http.Request, filter chirpStreamFilter) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, 500, "streaming isn't supported")
+		return
+	}
+	var lastID uint64
+	if header := r.Header.Get("Last-Event-ID"); header != "" {
+		id, err := strconv.ParseUint(header, 10, 64)
+		if err != nil {
+			respondWithError(w, 400, "invalid Last-Event-ID")
+			return
+		}
+		lastID = id
+	}
+
+	principal, _ := auth.PrincipalFrom(r.Context())
+	sub, replay, complete := cfg.hub.Subscribe(lastID)
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// stops nginx and friends from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(200)
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetry.Milliseconds())
+	if !complete {
+		writeEvent(w, sub.StartID, eventReset, struct{}{})
+	}
+
+	send := func(event stream.Event) error {
+		chirp, ok := event.Data.(database.Chirp)
+		if !ok {
+			return nil
+		}
+		show, err := cfg.showChirp(r, principal.UserID, chirp)
+		if err != nil || !show {
+			return err
+		}
+		if filter != nil {
+			include, err := filter(chirp)
+			if err != nil || !include {
+				return err
+			}
+		}
+		responses, err := cfg.renderChirps(r, []database.Chirp{chirp})
+		if err != nil {
+			return err
+		}
+		return writeEvent(w, event.ID, event.Type, responses[0])
+	}
+	for _, event := range replay {
+		err := send(event)
+		if err != nil {
+			log.Printf("stream: %s", err)
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(cfg.streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			_, err := fmt.Fprint(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+		case event, ok := <-sub.C:
+			if !ok {
+				// dropped for falling behind or shutting down, the client
+				// reconnects and resumes from Last-Event-ID
+				if sub.Dropped() {
+					log.Printf("stream: dropped slow consumer")
+				}
+				return
+			}
+			err := send(event)
+			if err != nil {
+				log.Printf("stream: %s", err)
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes one SSE event with data as its JSON payload
+func writeEvent(w http.ResponseWriter, id uint64, typ string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, typ, payload)
+	return err
+}
+
+// streamChirpsHandler streams every public chirp, the live version of
+// GET /api/chirps
+func (cfg *apiConfig) streamChirpsHandler(w http.ResponseWriter, r *http.Request) {
+	cfg.serveChirpStream(w, r, nil)
+}
+
+// streamTimelineHandler streams the requester's timeline, the live version
+// of GET /api/timeline
+func (cfg *apiConfig) streamTimelineHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFrom(r.Context())
+	cfg.serveChirpStream(w, r, func(chirp database.Chirp) (bool, error) {
+		return cfg.onTimeline(principal.UserID, chirp)
+	})
+}
+
+func streamRoutes(cfg *apiConfig) *chi.Mux {
+	r := chi.NewRouter()
+	r.Get("/chirps", cfg.streamChirpsHandler)
+	r.With(auth.RequireScope(auth.ScopeChirpsRead)).Get("/timeline", cfg.streamTimelineHandler)
+	return r
+}
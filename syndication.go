@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/syndication"
+	"github.com/staf3333/chirpy/internal/validation"
+)
+
+const (
+	// syndicationEntries is how many chirps a feed has, readers that poll
+	// often enough never miss one
+	syndicationEntries = 50
+	// syndicationTitleLength is how much of a chirp its entry's title has
+	syndicationTitleLength = 60
+
+	formatAtom = "atom"
+	formatRSS  = "rss"
+)
+
+var errFeedNotFound = errors.New("feed not found")
+
+// absoluteURL turns a path on this server into a full URL. It uses
+// BASE_URL when that's set, so links and ids don't depend on which host
+// name a request came in on
+func (cfg *apiConfig) absoluteURL(r *http.Request, path string) string {
+	base := cfg.baseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + r.Host
+	}
+	return base + path
+}
+
+// tagURI is a stable id for something on this server (RFC 4151), date is
+// when it came to be so the id never changes
+func (cfg *apiConfig) tagURI(r *http.Request, date time.Time, specific string) string {
+	host := r.Host
+	if u, err := url.Parse(cfg.baseURL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	host, _, _ = strings.Cut(host, ":")
+	return fmt.Sprintf("tag:%s,%s:%s", host, date.UTC().Format("2006-01-02"), specific)
+}
+
+// feedChirps is the newest public chirps that match, published chirps
+// without a moderation hold only since feeds are read anonymously
+func (cfg *apiConfig) feedChirps(match func(chirp database.Chirp) bool) ([]database.Chirp, error) {
+	chirps, err := cfg.db.GetChirps()
+	if err != nil {
+		return nil, err
+	}
+	public := []database.Chirp{}
+	for _, chirp := range chirps {
+		if chirp.Published() && chirp.ModerationState == "" && match(chirp) {
+			public = append(public, chirp)
+		}
+	}
+	sort.Slice(public, func(i, j int) bool {
+		return public[i].ID > public[j].ID
+	})
+	if len(public) > syndicationEntries {
+		public = public[:syndicationEntries]
+	}
+	return public, nil
+}
+
+// authorName is how a user appears in feeds, their @handle when they have
+// one. Emails are never shown
+func authorName(user database.User) string {
+	if user.Handle != "" {
+		return "@" + user.Handle
+	}
+	return "user " + strconv.Itoa(user.ID)
+}
+
+// feedTitle shortens a chirp for its entry's title
+func feedTitle(body string) string {
+	body = strings.Join(strings.Fields(body), " ")
+	runes := []rune(body)
+	if len(runes) <= syndicationTitleLength {
+		return body
+	}
+	return strings.TrimSpace(string(runes[:syndicationTitleLength-1])) + "…"
+}
+
+// feedEntries turns chirps into feed entries. An entry's updated time is
+// when the chirp was last edited, so readers pick up edits
+func (cfg *apiConfig) feedEntries(r *http.Request, chirps []database.Chirp) ([]syndication.Entry, error) {
+	entries := []syndication.Entry{}
+	authors := map[int]string{}
+	for _, chirp := range chirps {
+		name, ok := authors[chirp.AuthorID]
+		if !ok {
+			user, err := cfg.db.GetUser(chirp.AuthorID)
+			if err != nil && !errors.Is(err, database.ErrUserNotFound) {
+				return nil, err
+			}
+			user.ID = chirp.AuthorID
+			name = authorName(user)
+			authors[chirp.AuthorID] = name
+		}
+		published := chirp.CreatedAt
+		if chirp.PublishedAt != nil {
+			published = *chirp.PublishedAt
+		}
+		updated := published
+		if chirp.EditedAt != nil && chirp.EditedAt.After(updated) {
+			updated = *chirp.EditedAt
+		}
+		entry := syndication.Entry{
+			ID:        cfg.tagURI(r, chirp.CreatedAt, "chirp:"+strconv.Itoa(chirp.ID)),
+			Title:     feedTitle(chirp.Body),
+			Link:      cfg.absoluteURL(r, "/api/chirps/"+strconv.Itoa(chirp.ID)),
+			Content:   chirp.Body,
+			Author:    name,
+			Published: published,
+			Updated:   updated,
+		}
+		for _, m := range chirp.Media {
+			entry.Enclosures = append(entry.Enclosures, syndication.Enclosure{
+				URL:  cfg.absoluteURL(r, m.URL),
+				Type: m.ContentType,
+			})
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// serveFeed renders feed in format and writes it. The ETag is a hash of
+// the document and Last-Modified is the newest entry's updated time, so
+// readers polling with If-None-Match or If-Modified-Since get a 304 until
+// something changes
+func serveFeed(w http.ResponseWriter, r *http.Request, feed syndication.Feed, format string) {
+	var body []byte
+	var err error
+	contentType := "application/atom+xml; charset=utf-8"
+	if format == formatRSS {
+		contentType = "application/rss+xml; charset=utf-8"
+		body, err = syndication.RSS(feed)
+	} else {
+		body, err = syndication.Atom(feed)
+	}
+	if err != nil {
+		log.Printf("error rendering feed: %s", err)
+		http.Error(w, "couldn't render feed", 500)
+		return
+	}
+	sum := sha256.Sum256(body)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	http.ServeContent(w, r, "", feed.Updated, bytes.NewReader(body))
+}
+
+// feedSource is what's in one feed
+type feedSource struct {
+	title string
+	// link is the API path with the same chirps, if there's one
+	link  string
+	match func(chirp database.Chirp) bool
+}
+
+// feedHandler serves the feed load describes in format
+func (cfg *apiConfig) feedHandler(format string, load func(r *http.Request) (feedSource, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		source, err := load(r)
+		if errors.Is(err, errFeedNotFound) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Printf("error loading feed: %s", err)
+			http.Error(w, "couldn't load feed", 500)
+			return
+		}
+		chirps, err := cfg.feedChirps(source.match)
+		if err != nil {
+			log.Printf("error loading feed: %s", err)
+			http.Error(w, "couldn't load feed", 500)
+			return
+		}
+		entries, err := cfg.feedEntries(r, chirps)
+		if err != nil {
+			log.Printf("error loading feed: %s", err)
+			http.Error(w, "couldn't load feed", 500)
+			return
+		}
+		feed := syndication.Feed{
+			// the Atom and RSS versions are the same feed, so they share an id
+			ID:      cfg.tagURI(r, feedEpoch, "feed:"+strings.TrimSuffix(r.URL.Path, "."+format)),
+			Title:   source.title,
+			Self:    cfg.absoluteURL(r, r.URL.Path),
+			Updated: syndication.LastUpdated(entries),
+			Entries: entries,
+		}
+		if source.link != "" {
+			feed.Link = cfg.absoluteURL(r, source.link)
+		}
+		serveFeed(w, r, feed, format)
+	}
+}
+
+// feedEpoch dates the ids of feeds, tag URIs need a date and feeds don't
+// have one of their own
+var feedEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func (cfg *apiConfig) globalFeed(r *http.Request) (feedSource, error) {
+	return feedSource{
+		title: "Chirpy",
+		link:  "/api/chirps",
+		match: func(database.Chirp) bool { return true },
+	}, nil
+}
+
+func (cfg *apiConfig) userFeed(r *http.Request) (feedSource, error) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		return feedSource{}, errFeedNotFound
+	}
+	user, err := cfg.db.GetUser(userID)
+	if errors.Is(err, database.ErrUserNotFound) {
+		return feedSource{}, errFeedNotFound
+	}
+	if err != nil {
+		return feedSource{}, err
+	}
+	return feedSource{
+		title: "Chirps by " + authorName(user),
+		match: func(chirp database.Chirp) bool { return chirp.AuthorID == user.ID },
+	}, nil
+}
+
+func (cfg *apiConfig) tagFeed(r *http.Request) (feedSource, error) {
+	tag := strings.ToLower(chi.URLParam(r, "tag"))
+	if !validation.IsTag(tag) {
+		return feedSource{}, errFeedNotFound
+	}
+	return feedSource{
+		title: "Chirps tagged #" + tag,
+		match: func(chirp database.Chirp) bool {
+			for _, t := range validation.Hashtags(chirp.Body) {
+				if t == tag {
+					return true
+				}
+			}
+			return false
+		},
+	}, nil
+}
+
+// syndicationRoutes adds the Atom and RSS feeds to the root router, they're
+// public and read without a token
+func (cfg *apiConfig) syndicationRoutes(r chi.Router) {
+	for _, format := range []string{formatAtom, formatRSS} {
+		r.Get("/feed."+format, cfg.feedHandler(format, cfg.globalFeed))
+		r.Get("/users/{id}/feed."+format, cfg.feedHandler(format, cfg.userFeed))
+		r.Get("/tags/{tag}/feed."+format, cfg.feedHandler(format, cfg.tagFeed))
+	}
+}
@@ -2,15 +2,49 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
-	"strconv"
-	"strings"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/validation"
+	"github.com/staf3333/chirpy/internal/webhooks"
 )
 
+// userStore lets the auth middleware check a user is still in good standing
+type userStore struct {
+	db *database.DB
+}
+
+func (s userStore) CheckUser(userID int, issuedAt time.Time) error {
+	user, err := s.db.GetUser(userID)
+	if err != nil {
+		return err
+	}
+	if user.SuspendedAt != nil {
+		return errors.New("account suspended")
+	}
+	// token dates only have second precision
+	if !issuedAt.IsZero() && issuedAt.Before(user.TokensValidAfter.Truncate(time.Second)) {
+		return errors.New("session has been revoked")
+	}
+	return nil
+}
+
+// loginBlocked is why user can't log in even with the right password, or
+// "" if they can. Every way of logging in has to check it
+func loginBlocked(user database.User) string {
+	if user.SuspendedAt != nil {
+		return "account suspended"
+	}
+	if user.PasswordResetRequired {
+		return "password reset required"
+	}
+	return ""
+}
+
 func (cfg *apiConfig) userCreateHandler(w http.ResponseWriter, r *http.Request) {
 
 	defer r.Body.Close()
@@ -34,13 +68,17 @@ func (cfg *apiConfig) userCreateHandler(w http.ResponseWriter, r *http.Request)
 		respondWithError(w, 500, err.Error())
 		return
 	}
-	respondWithJSON(w, 201, struct {
+	response := struct {
 		Email string `json:"email"`
 		ID int `json:"id"`
+		IsChirpyRed bool `json:"is_chirpy_red"`
 	}{
 		Email: user.Email,
 		ID: user.ID,
-	})
+		IsChirpyRed: user.IsChirpyRed,
+	}
+	cfg.emitWebhook(webhooks.EventUserCreated, user.ID, response)
+	respondWithJSON(w, 201, response)
 }
 
 func (cfg *apiConfig) loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -60,56 +98,69 @@ func (cfg *apiConfig) loginHandler(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(500)
 		return
 	}
+	if params.Expiration != nil && *params.Expiration <= 0 {
+		respondWithError(w, 400, "expires_in_seconds must be positive")
+		return
+	}
 
 	user, err := cfg.db.LoginUser(params.Email, params.Password)
 	if err != nil {
 		respondWithError(w, 401, err.Error())
 		return
 	}
+	if reason := loginBlocked(user); reason != "" {
+		respondWithError(w, 403, reason)
+		return
+	}
 
-	accessTokenExpirationDuration := time.Duration(1) * time.Hour
-	accessToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer: "chirpy-access",
-		IssuedAt: jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(accessTokenExpirationDuration)),
-		Subject: strconv.Itoa(user.ID),
-	})
+	// the refresh token and every access token minted from it share a session
+	principal := auth.Principal{
+		UserID: user.ID,
+		Scopes: auth.DefaultScopes,
+		SessionID: auth.NewSessionID(),
+		Role: user.RoleOrDefault(),
+	}
 
-	accessTokenString, err := accessToken.SignedString([]byte(cfg.jwtSecret))
+	// clients can ask for a shorter lived access token, never a longer one.
+	// The seconds are clamped before they become a Duration so a huge value
+	// can't overflow past the limit
+	accessTokenExpirationDuration := cfg.accessTokenTTL
+	if params.Expiration != nil && int64(*params.Expiration) < int64(cfg.accessTokenTTL/time.Second) {
+		accessTokenExpirationDuration = time.Duration(*params.Expiration) * time.Second
+	}
+	accessTokenString, accessTokenExpiresAt, err := cfg.auth.IssueAccessToken(principal, accessTokenExpirationDuration)
 	if err != nil {
-		log.Fatal("error generating users jwt token")
+		log.Printf("error generating users access token: %s", err)
+		respondWithError(w, 500, "couldn't create access token")
+		return
 	}
 
-	refreshTokenExpirationDuration := time.Duration(24 * 60) * time.Hour
-	refreshToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer: "chirpy-refresh",
-		IssuedAt: jwt.NewNumericDate(time.Now()),
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(refreshTokenExpirationDuration)),
-		Subject: strconv.Itoa(user.ID),
-	})
-
-	refreshTokenString, err := refreshToken.SignedString([]byte(cfg.jwtSecret))
+	refreshTokenString, refreshTokenExpiresAt, err := cfg.auth.IssueRefreshToken(principal, cfg.refreshTokenTTL)
 	if err != nil {
-		log.Fatal("error generating users jwt token")
+		log.Printf("error generating users refresh token: %s", err)
+		respondWithError(w, 500, "couldn't create refresh token")
+		return
 	}
 
 	respondWithJSON(w, 200, struct {
 		Email string `json:"email"`
 		ID int `json:"id"`
+		IsChirpyRed bool `json:"is_chirpy_red"`
 		Token string `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
 		RefreshToken string `json:"refresh_token"`
+		RefreshTokenExpiresAt time.Time `json:"refresh_token_expires_at"`
 	}{
 		Email: user.Email,
 		ID: user.ID,
+		IsChirpyRed: user.IsChirpyRed,
 		Token: accessTokenString,
+		ExpiresAt: accessTokenExpiresAt,
 		RefreshToken: refreshTokenString, 
+		RefreshTokenExpiresAt: refreshTokenExpiresAt,
 	})
 }
 
-func stripAuthHeaderPrefix(h string) string {
-	return strings.Split(h, " ")[1]
-}
-
 func (cfg *apiConfig) userUpdateHandler(w http.ResponseWriter, r *http.Request) {
 	
 	defer r.Body.Close()
@@ -127,81 +178,108 @@ func (cfg *apiConfig) userUpdateHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	authHeader := r.Header.Get("Authorization")
-	var tokenString string
-	if len(authHeader) == 0 {
-		log.Printf("unauthorized attempt to modify resources")
-		w.WriteHeader(401)
+	// the auth middleware has already checked the access token
+	principal, _ := auth.PrincipalFrom(r.Context())
+
+	updatedUser, err := cfg.db.UpdateUser(principal.UserID, params.Email, params.Password)
+	if err != nil {
+		log.Printf("error updating user in the database")
+		w.WriteHeader(500)
 		return
 	}
 
-	// get token string from authorization header
-	tokenString = stripAuthHeaderPrefix(authHeader)
+	respondWithJSON(w, 200, struct {
+		Email string `json:"email"`
+		ID int `json:"id"`
+		IsChirpyRed bool `json:"is_chirpy_red"`
+	}{
+		Email: updatedUser.Email,
+		ID: updatedUser.ID,
+		IsChirpyRed: updatedUser.IsChirpyRed,
+	})
+}
 
-	type MyCustomClaims struct {
-		jwt.RegisteredClaims
+// userHandleHandler sets or, with an empty handle, removes the handle
+// others @mention the requester by
+func (cfg *apiConfig) userHandleHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Handle string `json:"handle"`
 	}
-	claims := &MyCustomClaims{}
 
-	// Keyfunc will be used by the Parse methods as a 
-	// callback function to supply the key for verification. 
-	// The function receives the parsed, but unverified Token. 
-	// This allows you to use properties in the Header 
-	// of the token (such as `kid`) to identify which key to use.
-	keyFunc := func (token *jwt.Token) (interface{}, error) {
-		return []byte(cfg.jwtSecret), nil
-	}
-	token, err := jwt.ParseWithClaims(tokenString, claims, keyFunc)
+	params := requestBody{}
+	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
-		log.Printf("unauthorized attempt to modify resources, claims don't match")
-		respondWithError(w, 401, err.Error())
+		respondWithError(w, 400, "couldn't decode request body")
 		return
 	}
-
-	if !token.Valid {
-		log.Printf("token has expired")
-		respondWithError(w, 401, err.Error())
+	errs := validation.Errors{}
+	handle := validation.Handle(&errs, "handle", params.Handle)
+	if len(errs) > 0 {
+		respondWithValidationErrors(w, errs)
 		return
 	}
 
-	issuerString, err := token.Claims.GetIssuer()
+	principal, _ := auth.PrincipalFrom(r.Context())
+	user, err := cfg.db.SetHandle(principal.UserID, handle)
+	if errors.Is(err, database.ErrHandleTaken) {
+		respondWithError(w, 409, err.Error())
+		return
+	}
 	if err != nil {
-		log.Printf("issue getting issuer from token")
-		respondWithError(w, 401, err.Error())
+		log.Printf("error setting handle: %s", err)
+		respondWithError(w, 500, "couldn't set handle")
 		return
 	}
+	respondWithJSON(w, 200, struct {
+		ID     int    `json:"id"`
+		Handle string `json:"handle"`
+	}{
+		ID:     user.ID,
+		Handle: user.Handle,
+	})
+}
 
-	if issuerString == "chirpy-refresh" {
-		log.Printf("can't use a refresh token to modify user")
-		respondWithError(w, 401, "can't use refresh token bruh")
-		return
+// passwordResetHandler lets a user whose password reset was forced by an
+// admin pick a new one, with the reset token the admin gave them
+func (cfg *apiConfig) passwordResetHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	type requestBody struct {
+		Email string `json:"email"`
+		Token string `json:"token"`
+		NewPassword string `json:"new_password"`
 	}
-	
-	userIDStr, err := token.Claims.GetSubject()
+
+	decoder := json.NewDecoder(r.Body)
+	params := requestBody{}
+	err := decoder.Decode(&params)
 	if err != nil {
-		log.Printf("issue getting subject from token")
-		respondWithError(w, 401, err.Error())
+		log.Printf("Error decoding JSON: %s", err)
+		respondWithError(w, 400, "couldn't decode request body")
 		return
 	}
-	userID, err := strconv.Atoi(userIDStr)
-	if err != nil {
-		log.Printf("Error converting id from string to int")
-		respondWithError(w, 401, err.Error())
+	if params.Token == "" {
+		respondWithError(w, 401, database.ErrInvalidResetToken.Error())
+		return
+	}
+	if params.NewPassword == "" {
+		respondWithError(w, 400, "pick a new password")
 		return
 	}
 
-	updatedUser, err := cfg.db.UpdateUser(userID, params.Email, params.Password)
+	_, err = cfg.db.ResetPassword(params.Email, auth.HashSecret(params.Token), params.NewPassword, time.Now())
+	if errors.Is(err, database.ErrInvalidResetToken) {
+		respondWithError(w, 401, err.Error())
+		return
+	}
+	if errors.Is(err, database.ErrUserSuspended) {
+		respondWithError(w, 403, err.Error())
+		return
+	}
 	if err != nil {
-		log.Printf("error updating user in the database")
-		w.WriteHeader(500)
+		log.Printf("error resetting password: %s", err)
+		respondWithError(w, 500, "couldn't reset password")
 		return
 	}
-
-	respondWithJSON(w, 200, struct {
-		Email string `json:"email"`
-		ID int `json:"id"`
-	}{
-		Email: updatedUser.Email,
-		ID: updatedUser.ID,
-	})
-}
\ No newline at end of file
+	w.WriteHeader(204)
+}
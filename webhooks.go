@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/validation"
+	"github.com/staf3333/chirpy/internal/webhooks"
+)
+
+// webhookStore is the webhooks package's delivery queue, kept in the
+// database
+type webhookStore struct {
+	db *database.DB
+}
+
+func (s webhookStore) ClaimDeliveries(now, leaseUntil time.Time, limit int) ([]webhooks.Delivery, error) {
+	claimed, hooks, err := s.db.ClaimWebhookDeliveries(now, leaseUntil, limit)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []webhooks.Delivery{}
+	for _, delivery := range claimed {
+		hook := hooks[delivery.WebhookID]
+		deliveries = append(deliveries, webhooks.Delivery{
+			ID:        delivery.ID,
+			EventType: delivery.EventType,
+			URL:       hook.URL,
+			Secret:    hook.Secret,
+			Payload:   delivery.Payload,
+			Attempts:  len(delivery.Attempts),
+		})
+	}
+	return deliveries, nil
+}
+
+func (s webhookStore) RecordAttempt(deliveryID int, attempt webhooks.Attempt, retryAt time.Time) error {
+	var next *time.Time
+	if !retryAt.IsZero() {
+		next = &retryAt
+	}
+	return s.db.RecordWebhookAttempt(deliveryID, database.WebhookAttempt{
+		At:         attempt.At,
+		DurationMS: attempt.Duration.Milliseconds(),
+		StatusCode: attempt.StatusCode,
+		Response:   attempt.Response,
+		Error:      attempt.Error,
+	}, next)
+}
+
+// webhookEvent is the body of every delivery. Redeliveries have the same
+// id, so receivers can tell they've seen an event before
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// emitWebhook queues eventType for the webhooks of ownerID, the user it's
+// about, and the global webhooks
+func (cfg *apiConfig) emitWebhook(eventType string, ownerID int, data any) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := webhookEvent{
+		ID:        hex.EncodeToString(id),
+		Type:      eventType,
+		CreatedAt: time.Now(),
+		Data:      data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("error encoding webhook event: %s", err)
+		return
+	}
+	queued, err := cfg.db.EnqueueWebhookEvent(event.ID, eventType, ownerID, payload, event.CreatedAt)
+	if err != nil {
+		log.Printf("error queueing webhook event: %s", err)
+		return
+	}
+	if queued > 0 {
+		cfg.webhooks.Wake()
+	}
+}
+
+// webhookResponse is a webhook as shown to whoever manages it, the secret
+// is only included when it's created or rotated
+type webhookResponse struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id,omitempty"`
+	Global    bool      `json:"global"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func newWebhookResponse(hook database.Webhook) webhookResponse {
+	return webhookResponse{
+		ID:        hook.ID,
+		UserID:    hook.UserID,
+		Global:    hook.Global,
+		URL:       hook.URL,
+		Events:    hook.Events,
+		Active:    hook.Active,
+		CreatedAt: hook.CreatedAt,
+		UpdatedAt: hook.UpdatedAt,
+	}
+}
+
+// validateWebhook checks a webhook's URL and event types
+func validateWebhook(errs *validation.Errors, rawURL string, events []string) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs.Add("url", validation.CodeInvalid, "url must be an http or https URL")
+	}
+	if len(events) == 0 {
+		errs.Add("events", validation.CodeRequired, "webhooks need at least one event type")
+	}
+	for _, event := range events {
+		if !contains(webhooks.EventTypes, event) {
+			errs.Add("events", validation.CodeInvalid, "unknown event type "+event)
+		}
+	}
+}
+
+// respondWithWebhookError writes the errors the webhook endpoints have in
+// common
+func respondWithWebhookError(w http.ResponseWriter, err error, msg string) {
+	switch {
+	case errors.Is(err, database.ErrWebhookNotFound), errors.Is(err, database.ErrWebhookDeliveryNotFound):
+		respondWithError(w, 404, err.Error())
+	default:
+		log.Printf("%s: %s", msg, err)
+		respondWithError(w, 500, msg)
+	}
+}
+
+// webhookFromURL loads the webhook in the {id} URL param, it writes an
+// error and returns false when the requester doesn't manage it
+func (cfg *apiConfig) webhookFromURL(w http.ResponseWriter, r *http.Request, global bool) (database.Webhook, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		respondWithError(w, 400, "invalid webhook id")
+		return database.Webhook{}, false
+	}
+	principal, _ := auth.PrincipalFrom(r.Context())
+	hook, err := cfg.db.GetWebhook(id, principal.UserID, global)
+	if err != nil {
+		respondWithWebhookError(w, err, "couldn't load webhook")
+		return database.Webhook{}, false
+	}
+	return hook, true
+}
+
+// webhookCreateHandler takes {"url": "https://...", "events":
+// ["chirp.created"]}, the response has the secret deliveries are signed
+// with
+func (cfg *apiConfig) webhookCreateHandler(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		type requestBody struct {
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}
+
+		params := requestBody{}
+		err := json.NewDecoder(r.Body).Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, "couldn't decode request body")
+			return
+		}
+		errs := validation.Errors{}
+		validateWebhook(&errs, params.URL, params.Events)
+		if len(errs) > 0 {
+			respondWithValidationErrors(w, errs)
+			return
+		}
+
+		principal, _ := auth.PrincipalFrom(r.Context())
+		now := time.Now()
+		hook, err := cfg.db.CreateWebhook(database.Webhook{
+			UserID:    principal.UserID,
+			Global:    global,
+			URL:       params.URL,
+			Secret:    newWebhookSecret(),
+			Events:    params.Events,
+			Active:    true,
+			CreatedAt: now,
+			UpdatedAt: now,
+		})
+		if err != nil {
+			respondWithWebhookError(w, err, "couldn't create webhook")
+			return
+		}
+		response := newWebhookResponse(hook)
+		response.Secret = hook.Secret
+		respondWithJSON(w, 201, response)
+	}
+}
+
+func (cfg *apiConfig) webhooksGetHandler(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, _ := auth.PrincipalFrom(r.Context())
+		hooks, err := cfg.db.ListWebhooks(principal.UserID, global)
+		if err != nil {
+			respondWithWebhookError(w, err, "couldn't list webhooks")
+			return
+		}
+		response := []webhookResponse{}
+		for _, hook := range hooks {
+			response = append(response, newWebhookResponse(hook))
+		}
+		respondWithJSON(w, 200, response)
+	}
+}
+
+func (cfg *apiConfig) webhookGetHandler(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := cfg.webhookFromURL(w, r, global)
+		if !ok {
+			return
+		}
+		respondWithJSON(w, 200, newWebhookResponse(hook))
+	}
+}
+
+// webhookUpdateHandler takes any of {"url": ..., "events": [...],
+// "active": false}, deliveries to a webhook that's turned off wait until
+// it's back on
+func (cfg *apiConfig) webhookUpdateHandler(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		type requestBody struct {
+			URL    *string  `json:"url"`
+			Events []string `json:"events"`
+			Active *bool    `json:"active"`
+		}
+
+		existing, ok := cfg.webhookFromURL(w, r, global)
+		if !ok {
+			return
+		}
+		params := requestBody{}
+		err := json.NewDecoder(r.Body).Decode(&params)
+		if err != nil {
+			respondWithError(w, 400, "couldn't decode request body")
+			return
+		}
+		if params.URL == nil {
+			params.URL = &existing.URL
+		}
+		if params.Events == nil {
+			params.Events = existing.Events
+		}
+		errs := validation.Errors{}
+		validateWebhook(&errs, *params.URL, params.Events)
+		if len(errs) > 0 {
+			respondWithValidationErrors(w, errs)
+			return
+		}
+
+		principal, _ := auth.PrincipalFrom(r.Context())
+		hook, err := cfg.db.UpdateWebhook(existing.ID, principal.UserID, global, func(hook *database.Webhook) error {
+			hook.URL = *params.URL
+			hook.Events = params.Events
+			if params.Active != nil {
+				hook.Active = *params.Active
+			}
+			hook.UpdatedAt = time.Now()
+			return nil
+		})
+		if err != nil {
+			respondWithWebhookError(w, err, "couldn't update webhook")
+			return
+		}
+		if hook.Active {
+			// anything that queued up while it was off can go now
+			cfg.webhooks.Wake()
+		}
+		respondWithJSON(w, 200, newWebhookResponse(hook))
+	}
+}
+
+// webhookSecretHandler gives the webhook a new signing secret, deliveries
+// already queued are signed with it too
+func (cfg *apiConfig) webhookSecretHandler(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		existing, ok := cfg.webhookFromURL(w, r, global)
+		if !ok {
+			return
+		}
+		principal, _ := auth.PrincipalFrom(r.Context())
+		hook, err := cfg.db.UpdateWebhook(existing.ID, principal.UserID, global, func(hook *database.Webhook) error {
+			hook.Secret = newWebhookSecret()
+			hook.UpdatedAt = time.Now()
+			return nil
+		})
+		if err != nil {
+			respondWithWebhookError(w, err, "couldn't rotate webhook secret")
+			return
+		}
+		response := newWebhookResponse(hook)
+		response.Secret = hook.Secret
+		respondWithJSON(w, 200, response)
+	}
+}
+
+func (cfg *apiConfig) webhookDeleteHandler(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := cfg.webhookFromURL(w, r, global)
+		if !ok {
+			return
+		}
+		principal, _ := auth.PrincipalFrom(r.Context())
+		err := cfg.db.DeleteWebhook(hook.ID, principal.UserID, global)
+		if err != nil {
+			respondWithWebhookError(w, err, "couldn't delete webhook")
+			return
+		}
+		w.WriteHeader(204)
+	}
+}
+
+// webhookDeliveriesHandler is the webhook's delivery log, newest first
+// and paged like the feeds
+func (cfg *apiConfig) webhookDeliveriesHandler(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := cfg.webhookFromURL(w, r, global)
+		if !ok {
+			return
+		}
+		page, err := parseFeedPage(r)
+		if err != nil {
+			respondWithError(w, 400, err.Error())
+			return
+		}
+		deliveries, more, err := cfg.db.ListWebhookDeliveries(hook.ID, page.before, page.limit)
+		if err != nil {
+			respondWithWebhookError(w, err, "couldn't list deliveries")
+			return
+		}
+		if more {
+			setNextPageLink(w, r, page, deliveries[len(deliveries)-1].ID)
+		}
+		respondWithJSON(w, 200, deliveries)
+	}
+}
+
+// webhookDeliveryFromURL loads the {deliveryID} delivery of the {id} webhook
+func (cfg *apiConfig) webhookDeliveryFromURL(w http.ResponseWriter, r *http.Request, global bool) (database.WebhookDelivery, bool) {
+	hook, ok := cfg.webhookFromURL(w, r, global)
+	if !ok {
+		return database.WebhookDelivery{}, false
+	}
+	deliveryID, err := strconv.Atoi(chi.URLParam(r, "deliveryID"))
+	if err != nil {
+		respondWithError(w, 400, "invalid delivery id")
+		return database.WebhookDelivery{}, false
+	}
+	delivery, err := cfg.db.GetWebhookDelivery(hook.ID, deliveryID)
+	if err != nil {
+		respondWithWebhookError(w, err, "couldn't load delivery")
+		return database.WebhookDelivery{}, false
+	}
+	return delivery, true
+}
+
+func (cfg *apiConfig) webhookDeliveryHandler(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		delivery, ok := cfg.webhookDeliveryFromURL(w, r, global)
+		if !ok {
+			return
+		}
+		respondWithJSON(w, 200, delivery)
+	}
+}
+
+// webhookRedeliverHandler queues the delivery to go out again now, as a
+// new entry in the log with the same event
+func (cfg *apiConfig) webhookRedeliverHandler(global bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		delivery, ok := cfg.webhookDeliveryFromURL(w, r, global)
+		if !ok {
+			return
+		}
+		redelivery, err := cfg.db.RedeliverWebhook(delivery.WebhookID, delivery.ID, time.Now())
+		if err != nil {
+			respondWithWebhookError(w, err, "couldn't redeliver")
+			return
+		}
+		cfg.webhooks.Wake()
+		respondWithJSON(w, 202, redelivery)
+	}
+}
+
+// webhooksRoutes manages the requester's webhooks, or the global ones when
+// global is set
+func webhooksRoutes(cfg *apiConfig, global bool) *chi.Mux {
+	r := chi.NewRouter()
+	r.Post("/", cfg.webhookCreateHandler(global))
+	r.Get("/", cfg.webhooksGetHandler(global))
+	r.Get("/{id}", cfg.webhookGetHandler(global))
+	r.Put("/{id}", cfg.webhookUpdateHandler(global))
+	r.Delete("/{id}", cfg.webhookDeleteHandler(global))
+	r.Post("/{id}/secret", cfg.webhookSecretHandler(global))
+	r.Get("/{id}/deliveries", cfg.webhookDeliveriesHandler(global))
+	r.Get("/{id}/deliveries/{deliveryID}", cfg.webhookDeliveryHandler(global))
+	r.Post("/{id}/deliveries/{deliveryID}/redeliver", cfg.webhookRedeliverHandler(global))
+	return r
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/staf3333/chirpy/internal/auth"
+	"github.com/staf3333/chirpy/internal/database"
+	"github.com/staf3333/chirpy/internal/stream"
+	"golang.org/x/time/rate"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsMaxMessageSize = 4096
+	wsMaxTopics      = 50
+
+	topicTimeline      = "timeline"
+	topicNotifications = "notifications"
+	// topicChirpPrefix followed by a chirp id is that chirp's thread, its
+	// likes and the chirps quoting it
+	topicChirpPrefix = "chirp:"
+)
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// clients authenticate with the Authorization header rather than a
+	// cookie, so a page on another origin can't ride on someone's session
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// wsMessage is a frame from the client:
+//
+//	{"type": "subscribe", "topic": "timeline", "id": "1"}
+//	{"type": "unsubscribe", "topic": "chirp:12"}
+//	{"type": "ping"}
+//
+// The id is optional and echoed back in the reply
+type wsMessage struct {
+	Type  string `json:"type"`
+	Topic string `json:"topic"`
+	ID    string `json:"id"`
+}
+
+// wsFrame is a frame to the client, either a reply to a message or an
+// event on one of the subscribed topics
+type wsFrame struct {
+	Type    string `json:"type"`
+	Topic   string `json:"topic,omitempty"`
+	ID      string `json:"id,omitempty"`
+	EventID uint64 `json:"event_id,omitempty"`
+	Data    any    `json:"data,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// wsTopicFilter renders the hub events that go out on one topic, it
+// returns nil for events that don't
+type wsTopicFilter func(event stream.Event) (any, error)
+
+// wsConn is one client's WebSocket. Everything but reading happens on the
+// goroutine running serve, so writes never race
+type wsConn struct {
+	cfg       *apiConfig
+	r         *http.Request
+	conn      *websocket.Conn
+	principal auth.Principal
+	topics    map[string]wsTopicFilter
+}
+
+// wsHandler upgrades an authenticated request to a WebSocket. The
+// connection lives until the client leaves, its access token expires, it
+// sends messages faster than the rate limit or it falls too far behind
+func (cfg *apiConfig) wsHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := auth.PrincipalFrom(r.Context())
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already written an error response
+		return
+	}
+	c := &wsConn{
+		cfg:       cfg,
+		r:         r,
+		conn:      conn,
+		principal: principal,
+		topics:    map[string]wsTopicFilter{},
+	}
+	c.serve()
+}
+
+func (c *wsConn) serve() {
+	defer c.conn.Close()
+	sub, _, _ := c.cfg.hub.Subscribe(0)
+	defer sub.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	messages := make(chan []byte)
+	readErr := make(chan error, 1)
+	go c.read(messages, readErr, done)
+
+	ping := time.NewTicker(c.cfg.wsPingInterval)
+	defer ping.Stop()
+	var expired <-chan time.Time
+	if !c.principal.ExpiresAt.IsZero() {
+		timer := time.NewTimer(time.Until(c.principal.ExpiresAt))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		var err error
+		select {
+		case err = <-readErr:
+			if errors.Is(err, errRateLimited) {
+				c.close(websocket.ClosePolicyViolation, err.Error())
+			}
+			return
+		case message := <-messages:
+			err = c.handle(message)
+		case event, ok := <-sub.C:
+			if !ok {
+				if sub.Dropped() {
+					c.close(websocket.CloseTryAgainLater, "too slow")
+				} else {
+					c.close(websocket.CloseGoingAway, "server shutting down")
+				}
+				return
+			}
+			err = c.dispatch(event)
+		case <-ping.C:
+			// suspensions and forced logouts end the connection too
+			if c.cfg.auth.Users != nil {
+				err = c.cfg.auth.Users.CheckUser(c.principal.UserID, c.principal.IssuedAt)
+				if err != nil {
+					c.close(websocket.ClosePolicyViolation, err.Error())
+					return
+				}
+			}
+			err = c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+		case <-expired:
+			c.close(websocket.ClosePolicyViolation, "access token expired")
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// read passes the client's messages to serve until the connection breaks
+// or the client goes over the rate limit. The client has to answer pings
+// within two ping intervals
+func (c *wsConn) read(messages chan<- []byte, readErr chan<- error, done <-chan struct{}) {
+	pongWait := 2 * c.cfg.wsPingInterval
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	limiter := rate.NewLimiter(c.cfg.wsRateLimit, c.cfg.wsRateBurst)
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			readErr <- err
+			return
+		}
+		if !limiter.Allow() {
+			readErr <- errRateLimited
+			return
+		}
+		select {
+		case messages <- message:
+		case <-done:
+			return
+		}
+	}
+}
+
+// handle answers one message from the client
+func (c *wsConn) handle(message []byte) error {
+	msg := wsMessage{}
+	err := json.Unmarshal(message, &msg)
+	if err != nil {
+		return c.write(wsFrame{Type: "error", Error: "couldn't decode message"})
+	}
+	switch msg.Type {
+	case "ping":
+		return c.write(wsFrame{Type: "pong", ID: msg.ID})
+	case "subscribe":
+		if _, ok := c.topics[msg.Topic]; !ok && len(c.topics) >= wsMaxTopics {
+			return c.write(wsFrame{Type: "error", Topic: msg.Topic, ID: msg.ID, Error: "too many subscriptions"})
+		}
+		filter, err := c.topicFilter(msg.Topic)
+		if err != nil {
+			return c.write(wsFrame{Type: "error", Topic: msg.Topic, ID: msg.ID, Error: err.Error()})
+		}
+		c.topics[msg.Topic] = filter
+		return c.write(wsFrame{Type: "subscribed", Topic: msg.Topic, ID: msg.ID})
+	case "unsubscribe":
+		delete(c.topics, msg.Topic)
+		return c.write(wsFrame{Type: "unsubscribed", Topic: msg.Topic, ID: msg.ID})
+	}
+	return c.write(wsFrame{Type: "error", ID: msg.ID, Error: "unknown message type " + msg.Type})
+}
+
+// dispatch sends event on every subscribed topic it belongs to
+func (c *wsConn) dispatch(event stream.Event) error {
+	for topic, filter := range c.topics {
+		data, err := filter(event)
+		if err != nil {
+			log.Printf("ws: error filtering event: %s", err)
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		err = c.write(wsFrame{Type: event.Type, Topic: topic, EventID: event.ID, Data: data})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *wsConn) write(frame wsFrame) error {
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteJSON(frame)
+}
+
+func (c *wsConn) close(code int, text string) {
+	message := websocket.FormatCloseMessage(code, text)
+	c.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(wsWriteWait))
+}
+
+// render renders chirp the way the REST API would for this client
+func (c *wsConn) render(chirp database.Chirp) (any, error) {
+	responses, err := c.cfg.renderChirps(c.r, []database.Chirp{chirp})
+	if err != nil {
+		return nil, err
+	}
+	return responses[0], nil
+}
+
+// shownLiker reports whether a like by userID should be passed on, likes
+// by users this client blocked or muted, or who blocked them, aren't
+func (c *wsConn) shownLiker(userID int) (bool, error) {
+	hidden, err := c.cfg.db.HiddenAuthors(c.principal.UserID)
+	if err != nil {
+		return false, err
+	}
+	_, ok := hidden[userID]
+	return !ok, nil
+}
+
+// topicFilter returns the filter for a topic, or an error when the topic
+// doesn't exist or this client can't follow it
+func (c *wsConn) topicFilter(topic string) (wsTopicFilter, error) {
+	userID := c.principal.UserID
+	switch {
+	case topic == topicTimeline:
+		return func(event stream.Event) (any, error) {
+			chirp, ok := event.Data.(database.Chirp)
+			if !ok {
+				return nil, nil
+			}
+			show, err := c.cfg.showChirp(c.r, userID, chirp)
+			if err != nil || !show {
+				return nil, err
+			}
+			show, err = c.cfg.onTimeline(userID, chirp)
+			if err != nil || !show {
+				return nil, err
+			}
+			return c.render(chirp)
+		}, nil
+
+	case topic == topicNotifications:
+		return func(event stream.Event) (any, error) {
+			switch data := event.Data.(type) {
+			case likeEvent:
+				if data.Chirp.AuthorID != userID || data.Like.UserID == userID {
+					return nil, nil
+				}
+				show, err := c.shownLiker(data.Like.UserID)
+				if err != nil || !show {
+					return nil, err
+				}
+				return data.Like, nil
+			case mentionEvent:
+				if data.UserID != userID {
+					return nil, nil
+				}
+				show, err := c.cfg.showChirp(c.r, userID, data.Chirp)
+				if err != nil || !show {
+					return nil, err
+				}
+				return c.render(data.Chirp)
+			}
+			return nil, nil
+		}, nil
+
+	case strings.HasPrefix(topic, topicChirpPrefix):
+		chirpID, err := strconv.Atoi(strings.TrimPrefix(topic, topicChirpPrefix))
+		if err != nil {
+			return nil, errors.New("invalid chirp id")
+		}
+		chirp, err := c.cfg.db.GetChirp(chirpID)
+		if err != nil || !chirp.Published() || !chirpVisible(c.r, chirp) {
+			return nil, database.ErrChirpNotFound
+		}
+		blocked, err := c.cfg.db.IsBlocked(userID, chirp.AuthorID)
+		if err != nil {
+			return nil, err
+		}
+		if blocked {
+			return nil, database.ErrChirpNotFound
+		}
+		return func(event stream.Event) (any, error) {
+			switch data := event.Data.(type) {
+			case likeEvent:
+				if data.Like.ChirpID != chirpID {
+					return nil, nil
+				}
+				show, err := c.shownLiker(data.Like.UserID)
+				if err != nil || !show {
+					return nil, err
+				}
+				return data.Like, nil
+			case database.Chirp:
+				if data.QuotedChirpID != chirpID {
+					return nil, nil
+				}
+				show, err := c.cfg.showChirp(c.r, userID, data)
+				if err != nil || !show {
+					return nil, err
+				}
+				return c.render(data)
+			}
+			return nil, nil
+		}, nil
+	}
+	return nil, errors.New("unknown topic " + topic)
+}